@@ -0,0 +1,286 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// unistore-ctl inspects the data directory of a stopped unistore server.
+//
+// Usage:
+//
+//	unistore-ctl -data-dir <dir> regions
+//	unistore-ctl -data-dir <dir> mvcc -key <hex key>
+//	unistore-ctl -data-dir <dir> locks [-start <hex key>] [-end <hex key>] [-limit <n>]
+//	unistore-ctl -data-dir <dir> lsm
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ngaut/unistore/tikv"
+	"github.com/ngaut/unistore/tikv/dbreader"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tidb/util/rowcodec"
+)
+
+var dataDir = flag.String("data-dir", "", "data directory of the stopped server")
+
+// The badger DB of the KV data is in the kv sub directory of the data directory in both the stand-alone and the
+// raft mode, the locks are dumped to the data directory when the server stops.
+const subPathKV = "kv"
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s -data-dir <dir> <regions|mvcc|locks|lsm> [flags]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *dataDir == "" || flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	var err error
+	switch cmd {
+	case "regions":
+		err = withDB(dumpRegions)
+	case "mvcc":
+		err = printMvcc(args)
+	case "locks":
+		err = listLocks(args)
+	case "lsm":
+		err = withDB(printLSM)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+// withDB opens the badger DB of the KV data, it fails if the server is still running.
+func withDB(f func(db *badger.DB) error) error {
+	opts := badger.DefaultOptions
+	opts.Dir = filepath.Join(*dataDir, subPathKV)
+	opts.ValueDir = opts.Dir
+	opts.ManagedTxns = true
+	db, err := badger.Open(opts)
+	if err != nil {
+		return errors.Annotate(err, "open the DB, is the server stopped?")
+	}
+	defer db.Close()
+	return f(db)
+}
+
+// dumpRegions prints the region meta stored by the stand-alone region manager, the raft mode keeps the region
+// meta in the raft states instead.
+func dumpRegions(db *badger.DB) error {
+	var cnt int
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		prefix := tikv.InternalRegionMetaPrefix
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			val, err := it.Item().Value()
+			if err != nil {
+				return errors.Trace(err)
+			}
+			// The meta of a merged region is empty.
+			if len(val) < 8 {
+				continue
+			}
+			// The value is the approximate size followed by the region meta.
+			size := int64(binary.LittleEndian.Uint64(val))
+			region := &metapb.Region{}
+			if err = region.Unmarshal(val[8:]); err != nil {
+				return errors.Annotatef(err, "region meta key %q", it.Item().Key())
+			}
+			fmt.Printf("region %d start_key: %s end_key: %s epoch: %s approximate_size: %d peers: %v\n",
+				region.Id, decodeRegionKey(region.StartKey), decodeRegionKey(region.EndKey), region.RegionEpoch,
+				size, region.Peers)
+			cnt++
+		}
+		return nil
+	})
+	if err == nil && cnt == 0 {
+		fmt.Println("no region meta found, the regions of the raft mode are not stored in the region meta keys")
+	}
+	return err
+}
+
+func decodeRegionKey(key []byte) string {
+	if len(key) == 0 {
+		return `""`
+	}
+	_, rawKey, err := codec.DecodeBytes(key, nil)
+	if err != nil {
+		return "invalid " + hex.EncodeToString(key)
+	}
+	return hex.EncodeToString(rawKey)
+}
+
+// printMvcc prints the lock and the committed versions of a key, the newest first.
+func printMvcc(args []string) error {
+	fs := flag.NewFlagSet("mvcc", flag.ExitOnError)
+	keyHex := fs.String("key", "", "the raw key in hex")
+	fs.Parse(args)
+	key, err := hex.DecodeString(*keyHex)
+	if err != nil || len(key) == 0 {
+		return errors.Errorf("invalid key %q", *keyHex)
+	}
+	var lockFound bool
+	err = readLocks(key, dbreader.PrefixNext(key), func(lockKey []byte, lock mvcc.MvccLock) bool {
+		if bytes.Equal(lockKey, key) {
+			printLock(lockKey, lock)
+			lockFound = true
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if !lockFound {
+		fmt.Println("no lock")
+	}
+	return withDB(func(db *badger.DB) error {
+		return db.View(func(txn *badger.Txn) error {
+			info := &kvrpcpb.MvccInfo{}
+			reader := dbreader.NewDBReader(key, dbreader.PrefixNext(key), txn)
+			defer reader.Close()
+			if err := reader.GetMvccInfoByKey(key, rowcodec.IsRowKey(key), info); err != nil {
+				return errors.Trace(err)
+			}
+			sort.Slice(info.Writes, func(i, j int) bool {
+				return info.Writes[i].CommitTs > info.Writes[j].CommitTs
+			})
+			for _, write := range info.Writes {
+				fmt.Printf("write type: %s start_ts: %d commit_ts: %d value: %s\n",
+					write.Type, write.StartTs, write.CommitTs, hex.EncodeToString(write.ShortValue))
+			}
+			if len(info.Writes) == 0 {
+				fmt.Println("no committed version")
+			}
+			return nil
+		})
+	})
+}
+
+// listLocks prints the locks in [start, end) from the lock dump.
+func listLocks(args []string) error {
+	fs := flag.NewFlagSet("locks", flag.ExitOnError)
+	startHex := fs.String("start", "", "the start key in hex")
+	endHex := fs.String("end", "", "the end key in hex, empty means no limit")
+	limit := fs.Int("limit", 100, "max number of locks to print, 0 means no limit")
+	fs.Parse(args)
+	start, err := hex.DecodeString(*startHex)
+	if err != nil {
+		return errors.Errorf("invalid start key %q", *startHex)
+	}
+	end, err := hex.DecodeString(*endHex)
+	if err != nil {
+		return errors.Errorf("invalid end key %q", *endHex)
+	}
+	var cnt int
+	err = readLocks(start, end, func(key []byte, lock mvcc.MvccLock) bool {
+		printLock(key, lock)
+		cnt++
+		return *limit > 0 && cnt >= *limit
+	})
+	if err == nil {
+		fmt.Printf("%d locks\n", cnt)
+	}
+	return err
+}
+
+var errStopRead = errors.New("stop read")
+
+// readLocks calls f with the locks in [start, end) in key order until it returns true.
+func readLocks(start, end []byte, f func(key []byte, lock mvcc.MvccLock) bool) error {
+	path := filepath.Join(*dataDir, tikv.LockDumpFile)
+	err := tikv.ReadLockDump(path, func(key, val []byte) error {
+		if bytes.Compare(key, start) < 0 {
+			return nil
+		}
+		if len(end) > 0 && bytes.Compare(key, end) >= 0 {
+			return errStopRead
+		}
+		if f(key, mvcc.DecodeLock(val)) {
+			return errStopRead
+		}
+		return nil
+	})
+	if os.IsNotExist(errors.Cause(err)) {
+		return errors.Errorf("no lock dump at %s, the locks are dumped when the server stops", path)
+	}
+	if err == errStopRead {
+		return nil
+	}
+	return err
+}
+
+func printLock(key []byte, lock mvcc.MvccLock) {
+	fmt.Printf("lock key: %s type: %s start_ts: %d for_update_ts: %d min_commit_ts: %d ttl: %d primary: %s"+
+		" async_commit: %v secondaries: %d\n", hex.EncodeToString(key), kvrpcpb.Op(lock.Op), lock.StartTS,
+		lock.ForUpdateTS, lock.MinCommitTS, lock.TTL, hex.EncodeToString(lock.Primary), lock.UseAsyncCommit,
+		len(lock.Secondaries))
+}
+
+// printLSM prints the number of tables of each level and the size of the files of the DB.
+func printLSM(db *badger.DB) error {
+	levels := map[int]int{}
+	var maxLevel int
+	for _, table := range db.Tables() {
+		levels[table.Level]++
+		if table.Level > maxLevel {
+			maxLevel = table.Level
+		}
+	}
+	for level := 0; level <= maxLevel; level++ {
+		fmt.Printf("level %d: %d tables\n", level, levels[level])
+	}
+	sizes := map[string]int64{}
+	err := filepath.Walk(filepath.Join(*dataDir, subPathKV), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			ext := strings.TrimPrefix(filepath.Ext(path), ".")
+			sizes[ext] += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	exts := make([]string, 0, len(sizes))
+	for ext := range sizes {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	for _, ext := range exts {
+		fmt.Printf("*.%s files: %d bytes\n", ext, sizes[ext])
+	}
+	return nil
+}
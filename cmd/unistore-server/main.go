@@ -18,9 +18,9 @@ import (
 	"fmt"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"syscall"
@@ -30,14 +30,18 @@ import (
 	"github.com/ngaut/unistore/config"
 	"github.com/ngaut/unistore/pd"
 	"github.com/ngaut/unistore/server"
-	"github.com/pingcap/badger"
-	"github.com/pingcap/badger/y"
+	"github.com/ngaut/unistore/tikv"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/cdcpb"
 	"github.com/pingcap/kvproto/pkg/deadlock"
+	"github.com/pingcap/kvproto/pkg/debugpb"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/log"
 	"github.com/zhangjinpeng1987/raft"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
 )
 
@@ -49,6 +53,11 @@ var (
 	statusAddr    = flag.String("status-addr", "", "status address")
 	dataDir       = flag.String("data-dir", "", "data directory")
 	logFile       = flag.String("log-file", "", "log file")
+	logLevel      = flag.String("L", "", "log level: debug, info, warn, error, fatal")
+	regionSize    = flag.Int64("region-size", 0, "average region size in bytes")
+	blockCache    = flag.Int64("block-cache-size", 0, "block cache size of the engine in bytes")
+	compactors    = flag.Int("num-compactors", 0, "number of compaction workers of the engine")
+	gcGracePeriod = flag.String("gc-grace-period", "", "versions newer than the GC safe point minus it are not collected")
 	configCheck   = flagBoolean("config-check", false, "check config file validity and exit")
 )
 
@@ -89,6 +98,21 @@ func loadCmdConf(conf *config.Config) {
 	if *logFile != "" {
 		conf.Server.LogfilePath = *logFile
 	}
+	if *logLevel != "" {
+		conf.Server.LogLevel = *logLevel
+	}
+	if *regionSize > 0 {
+		conf.Server.RegionSize = *regionSize
+	}
+	if *blockCache > 0 {
+		conf.Engine.BlockCacheSize = *blockCache
+	}
+	if *compactors > 0 {
+		conf.Engine.NumCompactors = *compactors
+	}
+	if *gcGracePeriod != "" {
+		conf.GC.GracePeriod = *gcGracePeriod
+	}
 }
 
 type raftLogger struct {
@@ -137,26 +161,50 @@ func main() {
 		PermitWithoutStream: true,            // Allow pings even when there are no active streams
 	}
 
-	grpcServer := grpc.NewServer(
+	tlsConfig, err := conf.Security.ToTLSConfig()
+	if err != nil {
+		log.S().Fatal(err)
+	}
+	grpcOpts := []grpc.ServerOption{
 		grpc.KeepaliveEnforcementPolicy(alivePolicy),
 		grpc.InitialWindowSize(grpcInitialWindowSize),
 		grpc.InitialConnWindowSize(grpcInitialConnWindowSize),
-		grpc.MaxRecvMsgSize(10*1024*1024),
-	)
+		grpc.MaxRecvMsgSize(10 * 1024 * 1024),
+	}
+	if tlsConfig != nil {
+		grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	grpcServer := grpc.NewServer(grpcOpts...)
 	tikvpb.RegisterTikvServer(grpcServer, tikvServer)
+	importer, err := tikv.NewSSTImporter(tikvServer, filepath.Join(conf.Engine.DBPath, "import"))
+	if err != nil {
+		log.S().Fatal(err)
+	}
+	import_sstpb.RegisterImportSSTServer(grpcServer, importer)
+	backup.RegisterBackupServer(grpcServer, tikvServer)
+	debugpb.RegisterDebugServer(grpcServer, tikvServer)
+	cdcpb.RegisterChangeDataServer(grpcServer, tikvServer)
 	listenAddr := conf.Server.StoreAddr[strings.IndexByte(conf.Server.StoreAddr, ':'):]
 	l, err := net.Listen("tcp", listenAddr)
 	deadlock.RegisterDeadlockServer(grpcServer, tikvServer)
 	if err != nil {
 		log.S().Fatal(err)
 	}
-	handleSignal(grpcServer)
+	handleSignal(grpcServer, tikvServer)
 	go func() {
 		log.S().Infof("listening on %v", conf.Server.StatusAddr)
-		http.HandleFunc("/status", func(writer http.ResponseWriter, request *http.Request) {
-			writer.WriteHeader(http.StatusOK)
-		})
-		err := http.ListenAndServe(conf.Server.StatusAddr, nil)
+		statusServer := &http.Server{
+			Addr:      conf.Server.StatusAddr,
+			Handler:   tikvServer.StatusHandler(func() error { return reloadConfig(tikvServer) }),
+			TLSConfig: tlsConfig,
+		}
+		var err error
+		if tlsConfig != nil {
+			// The certificate is loaded in the TLS config.
+			err = statusServer.ListenAndServeTLS("", "")
+		} else {
+			err = statusServer.ListenAndServe()
+		}
 		if err != nil {
 			log.S().Fatal(err)
 		}
@@ -165,14 +213,13 @@ func main() {
 	if err != nil {
 		log.S().Fatal(err)
 	}
-	tikvServer.Stop()
 	log.Info("Server stopped.")
 }
 
 func loadConfig() *config.Config {
 	conf := config.DefaultConf
 	if *configPath != "" {
-		_, err := toml.DecodeFile(*configPath, &conf)
+		meta, err := toml.DecodeFile(*configPath, &conf)
 		if err != nil {
 			if *configCheck {
 				fmt.Fprintf(os.Stderr, "config check failed, err=%s\n", err.Error())
@@ -180,8 +227,13 @@ func loadConfig() *config.Config {
 			}
 			panic(err)
 		}
-		if *configCheck {
-			os.Exit(0)
+		// The misspelled or removed items would silently keep their defaults.
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			if *configCheck {
+				fmt.Fprintf(os.Stderr, "config check failed, unknown items %v\n", undecoded)
+				os.Exit(1)
+			}
+			fmt.Fprintf(os.Stderr, "ignore unknown config items %v\n", undecoded)
 		}
 	} else {
 		// configCheck should have the config file specified.
@@ -190,11 +242,34 @@ func loadConfig() *config.Config {
 			os.Exit(1)
 		}
 	}
-	y.Assert(len(conf.Engine.Compression) >= badger.DefaultOptions.TableBuilderOptions.MaxLevels)
+	if err := conf.Engine.Validate(); err != nil {
+		if *configCheck {
+			fmt.Fprintf(os.Stderr, "config check failed, err=%s\n", err.Error())
+			os.Exit(1)
+		}
+		panic(err)
+	}
+	if *configCheck {
+		os.Exit(0)
+	}
 	return &conf
 }
 
-func handleSignal(grpcServer *grpc.Server) {
+// reloadConfig reads the config file and the command line flags again, and applies the online items.
+func reloadConfig(tikvServer *tikv.Server) error {
+	if *configPath == "" {
+		return fmt.Errorf("no config file specified")
+	}
+	conf := config.DefaultConf
+	if _, err := toml.DecodeFile(*configPath, &conf); err != nil {
+		return err
+	}
+	loadCmdConf(&conf)
+	return tikvServer.ReloadConfig(&conf)
+}
+
+// handleSignal stops the server gracefully on SIGINT, SIGTERM and SIGQUIT, and reloads the config on SIGHUP.
+func handleSignal(grpcServer *grpc.Server, tikvServer *tikv.Server) {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh,
 		syscall.SIGHUP,
@@ -202,8 +277,20 @@ func handleSignal(grpcServer *grpc.Server) {
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
 	go func() {
-		sig := <-sigCh
-		log.S().Infof("Got signal [%s] to exit.", sig)
-		grpcServer.Stop()
+		for sig := range sigCh {
+			if sig == syscall.SIGHUP {
+				if err := reloadConfig(tikvServer); err != nil {
+					log.S().Errorf("reload config failed: %v", err)
+				}
+				continue
+			}
+			log.S().Infof("Got signal [%s] to exit.", sig)
+			// The connections are kept until the server stops, so the in-flight requests can send their responses.
+			if err := tikvServer.Stop(); err != nil {
+				log.S().Errorf("stop server failed: %v", err)
+			}
+			grpcServer.Stop()
+			return
+		}
 	}()
 }
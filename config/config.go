@@ -14,9 +14,13 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
 	"time"
 
 	"github.com/pingcap/badger/options"
+	"github.com/pingcap/errors"
 	"github.com/pingcap/log"
 )
 
@@ -26,6 +30,8 @@ type Config struct {
 	RaftStore      RaftStore      `toml:"raftstore"`       // RaftStore configs
 	Coprocessor    Coprocessor    `toml:"coprocessor"`     // Coprocessor options
 	PessimisticTxn PessimisticTxn `toml:"pessimistic-txn"` // Pessimistic txn related
+	GC             GC             `toml:"gc"`              // GC related
+	Security       Security       `toml:"security"`        // TLS of the gRPC and status servers
 }
 
 type Server struct {
@@ -37,6 +43,40 @@ type Server struct {
 	MaxProcs    int    `toml:"max-procs"`   // Max CPU cores to use, set 0 to use all CPU cores in the machine.
 	Raft        bool   `toml:"raft"`        // Enable raft.
 	LogfilePath string `toml:"log-file"`    // Log file path for unistore server
+
+	MaxRequestSize       int64   `toml:"max-request-size"`       // Max size of a prewrite or raw put request, larger ones are rejected with RaftEntryTooLarge. Set 0 to disable the limit.
+	MaxOpenReaders       int     `toml:"max-open-readers"`       // Max number of concurrently open DB readers, set 0 to disable the limit.
+	ReaderWaitTimeout    string  `toml:"reader-wait-timeout"`    // Max time a read request waits for a DB reader before returning ServerIsBusy.
+	MaxRunningWrites     int     `toml:"max-running-writes"`     // Max number of concurrently running transactional writes, set 0 to disable the limit.
+	WriterWaitTimeout    string  `toml:"writer-wait-timeout"`    // Max time a write request waits for a write slot before returning ServerIsBusy.
+	WriteStallThreshold  string  `toml:"write-stall-threshold"`  // Reject new writes with ServerIsBusy if the average write duration exceeds it, set 0 to disable the check.
+	MaxPendingWrites     int     `toml:"max-pending-writes"`     // Reject new writes with ServerIsBusy if so many writes are pending, set 0 to disable the limit.
+	ReadPoolPointWorkers int     `toml:"point-read-workers"`     // Number of workers for the point gets, set 0 to run them on the request goroutines.
+	ReadPoolScanWorkers  int     `toml:"scan-read-workers"`      // Number of workers for the scans, set 0 to run them on the request goroutines.
+	ReadPoolCopWorkers   int     `toml:"cop-read-workers"`       // Number of workers for the coprocessor requests, set 0 to run them on the request goroutines.
+	ReadPoolQueueSize    int     `toml:"read-queue-size"`        // Max number of tasks waiting for a worker in each read pool.
+	MaxTraceEvents       int     `toml:"max-trace-events"`       // Max number of trace events kept for a request, set 0 to disable the limit.
+	MaxLocksPerRegion    int     `toml:"max-locks-per-region"`   // Max number of outstanding locks in a region, set 0 to disable the limit.
+	ScanEpochCheckKeys   int     `toml:"scan-epoch-check-keys"`  // Number of keys a scan iterates between region epoch checks, set 0 to disable the check.
+	ChangeBufferSize     int     `toml:"change-buffer-size"`     // Number of committed change events buffered for the change sink.
+	ChangeOverflowPolicy string  `toml:"change-overflow-policy"` // What to do when the change event buffer is full, "block" or "drop".
+	RegionSplitKeys      int64   `toml:"region-split-keys"`      // Split a region if it has more keys than it, set 0 to disable the split by keys.
+	RegionSplitCooldown  string  `toml:"region-split-cooldown"`  // Min age of a region before it is split by keys again.
+	SplitCheckInterval   string  `toml:"split-check-interval"`   // Interval of checking the regions to split by size and keys.
+	RawEnableTTL         bool    `toml:"raw-enable-ttl"`         // Store the expire time with the raw values, the raw keys must not be written by transactions.
+	RawTTLCheckInterval  string  `toml:"raw-ttl-check-interval"` // Interval of purging the expired raw keys, set 0 to disable the purge.
+	ImportBatchSize      int     `toml:"import-batch-size"`      // Max number of keys written in one batch by KvImport.
+	ImportRateLimit      int     `toml:"import-rate-limit"`      // Max bytes per second written by KvImport, set 0 to disable the limit.
+	TraceAgentAddr       string  `toml:"trace-agent-addr"`       // Address of the Jaeger agent the request spans are reported to, empty to disable the tracing.
+	TraceSampleRate      float64 `toml:"trace-sample-rate"`      // Ratio of the requests traced if the client doesn't start the trace.
+	ShutdownTimeout      string  `toml:"shutdown-timeout"`       // Max time the in-flight requests are waited for on shutdown before they are cancelled, set 0 to wait forever.
+	AdvanceTSInterval    string  `toml:"advance-ts-interval"`    // Interval of advancing the resolved ts of the regions for the stale reads and CDC, set 0 to disable it.
+	WriteBatchWait       string  `toml:"write-batch-wait"`       // Max time a write waits for the concurrent writes to be committed with it, set 0 to only group the queued writes.
+	WriteBatchMaxKeys    int     `toml:"write-batch-max-keys"`   // Stop waiting for more writes once the group has so many keys, set 0 to disable the limit.
+
+	SlowLogThreshold        string            `toml:"slow-log-threshold"`         // Requests slower than it are logged to the slow log, set 0 to disable the slow log.
+	SlowLogMethodThresholds map[string]string `toml:"slow-log-method-thresholds"` // Slow log thresholds of the methods overriding slow-log-threshold.
+	SlowLogFile             string            `toml:"slow-log-file"`              // File of the slow log in JSON, empty to log to the server log.
 }
 
 type RaftStore struct {
@@ -63,9 +103,24 @@ type Engine struct {
 	NumL0Tables      int    `toml:"num-L0-tables"`       // Maximum number of Level 0 tables before we start compacting.
 	NumL0TablesStall int    `toml:"num-L0-tables-stall"` // Maximum number of Level 0 tables before stalling.
 	VlogFileSize     int64  `toml:"vlog-file-size"`      // Value log file size.
+	VlogMaxNumFiles  int    `toml:"vlog-max-num-files"`  // Maximum number of value log files to keep.
+	VlogWriteBuffer  int    `toml:"vlog-write-buffer"`   // Buffer size of the value log writes.
+	MaxLevels        int    `toml:"max-levels"`          // Number of levels of the LSM tree.
 
 	// 	Sync all writes to disk. Setting this to true would slow down data loading significantly.")
-	SyncWrite         bool     `toml:"sync-write"`
+	SyncWrite bool `toml:"sync-write"`
+	// Durability of the writes, it overrides SyncWrite unless it's empty. The value log is the write ahead log of
+	// badger, on a restart it's replayed up to the first broken entry, so the DB always recovers to a prefix of the
+	// acknowledged writes. What's lost on a crash depends on the mode:
+	//   "sync" syncs the value log before a write is acknowledged, nothing is lost.
+	//   "periodic" syncs it every SyncInterval, a crash of the process loses nothing as the writes are in the OS
+	//   page cache, a crash of the machine loses up to SyncInterval of the acknowledged writes.
+	//   "none" leaves the syncs to the OS, a crash of the machine loses the writes not written back yet. It's
+	//   meant for the CI runs.
+	// The raft logs in the raft mode follow the same mode, a peer that loses them recovers from the other peers.
+	Durability   string `toml:"durability"`
+	SyncInterval string `toml:"sync-interval"`
+
 	NumCompactors     int      `toml:"num-compactors"`
 	SurfStartLevel    int      `toml:"surf-start-level"`
 	BlockCacheSize    int64    `toml:"block-cache-size"`
@@ -88,6 +143,124 @@ type PessimisticTxn struct {
 	WakeUpDelayDuration int64 `toml:"wake-up-delay-duration"`
 }
 
+type GC struct {
+	// Versions newer than the safe point minus the grace period are not collected by GC,
+	// it protects recent reads against clock skew and aggressive safe points.
+	GracePeriod string `toml:"grace-period"`
+	// What to do with the KvGC requests received while GC is paused, "defer" applies the safe point on
+	// resume, "reject" returns an error.
+	PausedPolicy string `toml:"paused-policy"`
+	// The background GC worker purges the stale versions and txn status records before the safe point
+	// without waiting for badger to compact them. It's disabled by default, badger drops them on compaction.
+	EnableBackground    bool `toml:"enable-background"`
+	BatchKeys           int  `toml:"batch-keys"`              // Max number of keys scanned by the GC worker in a batch
+	MaxWriteBytesPerSec int  `toml:"max-write-bytes-per-sec"` // Max bytes written by the GC worker per second, 0 disables the limit
+}
+
+type Security struct {
+	// The gRPC and status servers serve TLS with the certificate and key if they are set.
+	CertPath string `toml:"cert-path"`
+	KeyPath  string `toml:"key-path"`
+	// Path of the CA certificate to verify the client certificates with.
+	CAPath string `toml:"ca-path"`
+	// Require the clients to present a certificate signed by the CA.
+	VerifyClientCert bool `toml:"verify-client-cert"`
+}
+
+// ToTLSConfig returns the server side TLS config, or nil if the certificate is not set.
+func (s *Security) ToTLSConfig() (*tls.Config, error) {
+	if s.CertPath == "" && s.KeyPath == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.CertPath, s.KeyPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	tlsConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if s.CAPath != "" {
+		ca, err := ioutil.ReadFile(s.CAPath)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.Errorf("no certificate found in %s", s.CAPath)
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if s.VerifyClientCert {
+		if s.CAPath == "" {
+			return nil, errors.New("ca-path is required to verify the client certificates")
+		}
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConf, nil
+}
+
+// The durability modes of the engine.
+const (
+	DurabilitySync     = "sync"
+	DurabilityPeriodic = "periodic"
+	DurabilityNone     = "none"
+)
+
+// SyncWrites returns if the engine syncs the value log on every write.
+func (e *Engine) SyncWrites() bool {
+	if e.Durability == "" {
+		return e.SyncWrite
+	}
+	return e.Durability == DurabilitySync
+}
+
+// Validate checks the engine options before the engine is opened with them.
+func (e *Engine) Validate() error {
+	switch {
+	case e.MaxMemTableSize <= 0 || e.MaxTableSize <= 0 || e.L1Size <= 0 || e.VlogFileSize <= 0:
+		return errors.New("max-mem-table-size, max-table-size, l1-size and vlog-file-size should be positive")
+	case e.NumMemTables <= 0 || e.NumCompactors <= 0 || e.VlogMaxNumFiles <= 0 || e.VlogWriteBuffer <= 0:
+		return errors.New("num-mem-tables, num-compactors, vlog-max-num-files and vlog-write-buffer should be positive")
+	case e.NumL0Tables <= 0 || e.NumL0TablesStall < e.NumL0Tables:
+		return errors.Errorf("num-L0-tables %d should be positive and not greater than num-L0-tables-stall %d",
+			e.NumL0Tables, e.NumL0TablesStall)
+	case e.MaxLevels < 2:
+		return errors.Errorf("max-levels %d should be at least 2", e.MaxLevels)
+	case len(e.Compression) < e.MaxLevels:
+		return errors.Errorf("compression has %d levels, max-levels is %d", len(e.Compression), e.MaxLevels)
+	case e.BlockCacheSize < 0 || e.IndexCacheSize < 0:
+		return errors.New("block-cache-size and index-cache-size should not be negative")
+	}
+	switch e.Durability {
+	case "", DurabilitySync, DurabilityNone:
+	case DurabilityPeriodic:
+		if interval, err := TryParseDuration(e.SyncInterval); err != nil || interval == 0 {
+			return errors.Errorf("invalid sync-interval %q for the periodic durability", e.SyncInterval)
+		}
+	default:
+		return errors.Errorf("unknown durability %q", e.Durability)
+	}
+	for _, c := range e.Compression {
+		if !validCompression(c) {
+			return errors.Errorf("unknown compression %q", c)
+		}
+	}
+	if !validCompression(e.IngestCompression) {
+		return errors.Errorf("unknown ingest-compression %q", e.IngestCompression)
+	}
+	return nil
+}
+
+func validCompression(s string) bool {
+	switch s {
+	case "", "none", "snappy", "zstd":
+		return true
+	}
+	return false
+}
+
 func ParseCompression(s string) options.CompressionType {
 	switch s {
 	case "snappy":
@@ -111,6 +284,39 @@ var DefaultConf = Config{
 		MaxProcs:    0,
 		Raft:        true,
 		LogfilePath: "",
+
+		MaxRequestSize:       6 * MB,
+		MaxOpenReaders:       0,
+		ReaderWaitTimeout:    "100ms",
+		MaxRunningWrites:     0,
+		WriterWaitTimeout:    "100ms",
+		WriteStallThreshold:  "0s",
+		MaxPendingWrites:     0,
+		ReadPoolPointWorkers: 0,
+		ReadPoolScanWorkers:  0,
+		ReadPoolCopWorkers:   0,
+		ReadPoolQueueSize:    1024,
+		MaxTraceEvents:       64,
+		MaxLocksPerRegion:    0,
+		ScanEpochCheckKeys:   0,
+		ChangeBufferSize:     4096,
+		ChangeOverflowPolicy: "block",
+		RegionSplitKeys:      0,
+		RegionSplitCooldown:  "1m",
+		SplitCheckInterval:   "5s",
+		RawEnableTTL:         false,
+		RawTTLCheckInterval:  "1h",
+		ImportBatchSize:      1024,
+		ImportRateLimit:      0,
+		TraceAgentAddr:       "",
+		TraceSampleRate:      0.01,
+		ShutdownTimeout:      "10s",
+		AdvanceTSInterval:    "1s",
+		WriteBatchWait:       "0s",
+		WriteBatchMaxKeys:    4096,
+
+		SlowLogThreshold: "300ms",
+		SlowLogFile:      "",
 	},
 	RaftStore: RaftStore{
 		PdHeartbeatTickInterval:  "20s",
@@ -129,6 +335,9 @@ var DefaultConf = Config{
 		NumL0Tables:        4,
 		NumL0TablesStall:   8,
 		VlogFileSize:       256 * MB,
+		VlogMaxNumFiles:    3,
+		VlogWriteBuffer:    4 * MB,
+		MaxLevels:          7,
 		NumCompactors:      3,
 		SurfStartLevel:     8,
 		L1Size:             512 * MB,
@@ -136,6 +345,7 @@ var DefaultConf = Config{
 		BlockCacheSize:     0, // 0 means disable block cache, use mmap to access sst.
 		IndexCacheSize:     0,
 		CompactL0WhenClose: true,
+		SyncInterval:       "1s",
 	},
 	Coprocessor: Coprocessor{
 		RegionMaxKeys:   1440000,
@@ -145,16 +355,33 @@ var DefaultConf = Config{
 		WaitForLockTimeout:  1000, // 1000ms same with tikv default value
 		WakeUpDelayDuration: 100,  // 100ms same with tikv default value
 	},
+	GC: GC{
+		GracePeriod:         "0s",
+		PausedPolicy:        "defer",
+		EnableBackground:    false,
+		BatchKeys:           512,
+		MaxWriteBytesPerSec: 0,
+	},
 }
 
 // parseDuration parses duration argument string.
 func ParseDuration(durationStr string) time.Duration {
+	dur, err := TryParseDuration(durationStr)
+	if err != nil {
+		log.S().Fatal(err)
+	}
+	return dur
+}
+
+// TryParseDuration parses the duration like ParseDuration, but returns the error instead of exiting, it's used
+// to check the reloaded config.
+func TryParseDuration(durationStr string) (time.Duration, error) {
 	dur, err := time.ParseDuration(durationStr)
 	if err != nil {
 		dur, err = time.ParseDuration(durationStr + "s")
 	}
 	if err != nil || dur < 0 {
-		log.S().Fatalf("invalid duration=%v", durationStr)
+		return 0, errors.Errorf("invalid duration=%v", durationStr)
 	}
-	return dur
+	return dur, nil
 }
@@ -23,6 +23,11 @@ import (
 const (
 	namespace = "unistore"
 	raft      = "raft"
+	kv        = "kv"
+	grpc      = "grpc"
+	gc        = "gc"
+	engine    = "engine"
+	readPool  = "read_pool"
 )
 
 var (
@@ -90,6 +95,21 @@ var (
 			Name:      "latch_wait",
 			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 15),
 		})
+	// LatchQueueLength is the number of the commands ahead of a command waiting for the latch of a key, the long
+	// queues are on the hot keys. LatchWaiters is the number of the commands waiting for a latch.
+	LatchQueueLength = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: kv,
+			Name:      "latch_queue_length",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		})
+	LatchWaiters = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: kv,
+			Name:      "latch_waiters",
+		})
 	RaftBatchSize = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
 			Namespace: namespace,
@@ -97,6 +117,120 @@ var (
 			Name:      "batch_size",
 			Buckets:   prometheus.ExponentialBuckets(1, 1.5, 20),
 		})
+
+	// WriteBatchKeys and WriteBatchBytes are the number of keys and bytes written by a prewrite or commit.
+	WriteBatchKeys = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: kv,
+			Name:      "write_batch_keys",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 20),
+		}, []string{"type"})
+	WriteBatchBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: kv,
+			Name:      "write_batch_bytes",
+			Buckets:   prometheus.ExponentialBuckets(16, 2, 24),
+		}, []string{"type"})
+
+	// GroupCommitSize is the number of the writes committed to the DB together.
+	GroupCommitSize = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: kv,
+			Name:      "group_commit_size",
+			Buckets:   prometheus.ExponentialBuckets(1, 2, 12),
+		})
+
+	// GrpcMsgDuration is the duration of the requests by the method.
+	GrpcMsgDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: grpc,
+			Name:      "msg_duration_seconds",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 20),
+		}, []string{"type"})
+	// GrpcRegionErrors is the number of the requests failed by region errors by the method.
+	GrpcRegionErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: grpc,
+			Name:      "region_error_total",
+		}, []string{"type"})
+	// KeyErrors is the number of the key errors returned by the error type, the lock conflicts are counted by
+	// the locked, conflict and deadlock types.
+	KeyErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: kv,
+			Name:      "key_error_total",
+		}, []string{"type"})
+	// FlowControlRejects is the number of the writes rejected by the flow control by the reason.
+	FlowControlRejects = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: kv,
+			Name:      "flow_control_reject_total",
+		}, []string{"reason"})
+	// RegionCount is the number of the regions on the store.
+	RegionCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: kv,
+			Name:      "region_count",
+		})
+
+	// GCSafePoint is the safe point of the last finished round of the background GC.
+	GCSafePoint = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: gc,
+			Name:      "safe_point",
+		})
+	GCScannedKeys = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: gc,
+			Name:      "scanned_keys_total",
+		})
+	GCTombstones = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: gc,
+			Name:      "tombstones_total",
+		})
+
+	// EngineSize and EngineFiles are the size and number of the files of the kv engine by the file type, sst
+	// for the LSM tree and vlog for the value log.
+	EngineSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: engine,
+			Name:      "size_bytes",
+		}, []string{"type"})
+	EngineFiles = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: engine,
+			Name:      "file_count",
+		}, []string{"type"})
+
+	// ReadPoolQueueLength and ReadPoolWaitDuration are the number of the queued tasks and the time a task waits
+	// for a worker by the read pool.
+	ReadPoolQueueLength = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: readPool,
+			Name:      "queue_length",
+		}, []string{"pool"})
+	ReadPoolWaitDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: readPool,
+			Name:      "wait_duration_seconds",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 20),
+		}, []string{"pool"})
 )
 
 func init() {
@@ -110,5 +244,22 @@ func init() {
 	prometheus.MustRegister(LockUpdate)
 	prometheus.MustRegister(RaftBatchSize)
 	prometheus.MustRegister(LatchWait)
+	prometheus.MustRegister(LatchQueueLength)
+	prometheus.MustRegister(LatchWaiters)
+	prometheus.MustRegister(WriteBatchKeys)
+	prometheus.MustRegister(WriteBatchBytes)
+	prometheus.MustRegister(GroupCommitSize)
+	prometheus.MustRegister(GrpcMsgDuration)
+	prometheus.MustRegister(GrpcRegionErrors)
+	prometheus.MustRegister(KeyErrors)
+	prometheus.MustRegister(FlowControlRejects)
+	prometheus.MustRegister(RegionCount)
+	prometheus.MustRegister(GCSafePoint)
+	prometheus.MustRegister(GCScannedKeys)
+	prometheus.MustRegister(GCTombstones)
+	prometheus.MustRegister(EngineSize)
+	prometheus.MustRegister(EngineFiles)
+	prometheus.MustRegister(ReadPoolQueueLength)
+	prometheus.MustRegister(ReadPoolWaitDuration)
 	http.Handle("/metrics", promhttp.Handler())
 }
@@ -82,6 +82,10 @@ func getRegionOptions(conf *config.Config) tikv.RegionOptions {
 		StoreAddr:  conf.Server.StoreAddr,
 		PDAddr:     conf.Server.PDAddr,
 		RegionSize: conf.Server.RegionSize,
+
+		RegionSplitKeys:     conf.Server.RegionSplitKeys,
+		RegionSplitCooldown: config.ParseDuration(conf.Server.RegionSplitCooldown),
+		SplitCheckInterval:  config.ParseDuration(conf.Server.SplitCheckInterval),
 	}
 }
 
@@ -136,9 +140,14 @@ func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient
 }
 
 func setupStandAlongInnerServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, rm tikv.RegionManager, pdClient pd.Client, conf *config.Config) (*tikv.Server, error) {
+	lockWAL, err := tikv.RecoverLockStore(conf.Engine.DBPath, bundle.LockStore, conf.Engine.SyncWrites())
+	if err != nil {
+		return nil, err
+	}
 	innerServer := tikv.NewStandAlongInnerServer(bundle)
 	innerServer.Setup(pdClient)
-	store := tikv.NewMVCCStore(conf, bundle, conf.Engine.DBPath, safePoint, tikv.NewDBWriter(bundle), pdClient)
+	writer := tikv.NewDBWriter(conf, bundle, lockWAL)
+	store := tikv.NewMVCCStore(conf, bundle, conf.Engine.DBPath, safePoint, writer, pdClient)
 	store.DeadlockDetectSvr.ChangeRole(tikv.Leader)
 
 	if err := innerServer.Start(pdClient); err != nil {
@@ -166,6 +175,9 @@ func setupRaftStoreConf(raftConf *raftstore.Config, conf *config.Config) {
 }
 
 func createDB(subPath string, safePoint *tikv.SafePoint, conf *config.Engine) (*badger.DB, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
 	opts := badger.DefaultOptions
 	opts.NumCompactors = conf.NumCompactors
 	opts.ValueThreshold = conf.ValueThreshold
@@ -176,18 +188,19 @@ func createDB(subPath string, safePoint *tikv.SafePoint, conf *config.Engine) (*
 	} else {
 		opts.ManagedTxns = true
 	}
-	opts.ValueLogWriteOptions.WriteBufferSize = 4 * 1024 * 1024
+	opts.ValueLogWriteOptions.WriteBufferSize = conf.VlogWriteBuffer
 	opts.Dir = filepath.Join(conf.DBPath, subPath)
 	opts.ValueDir = opts.Dir
 	opts.ValueLogFileSize = conf.VlogFileSize
-	opts.ValueLogMaxNumFiles = 3
+	opts.ValueLogMaxNumFiles = conf.VlogMaxNumFiles
 	opts.MaxMemTableSize = conf.MaxMemTableSize
 	opts.TableBuilderOptions.MaxTableSize = conf.MaxTableSize
+	opts.TableBuilderOptions.MaxLevels = conf.MaxLevels
 	opts.NumMemtables = conf.NumMemTables
 	opts.NumLevelZeroTables = conf.NumL0Tables
 	opts.NumLevelZeroTablesStall = conf.NumL0TablesStall
 	opts.LevelOneSize = conf.L1Size
-	opts.SyncWrites = conf.SyncWrite
+	opts.SyncWrites = conf.SyncWrites()
 	compressionPerLevel := make([]options.CompressionType, len(conf.Compression))
 	for i := range opts.TableBuilderOptions.CompressionPerLevel {
 		compressionPerLevel[i] = config.ParseCompression(conf.Compression[i])
@@ -0,0 +1,304 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash/crc64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/ngaut/unistore/tikv/dbreader"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// The backup files are SST files of the format read by SSTImporter, a region is backed up into a write CF file
+// and a default CF file for the values longer than sstShortValueMaxLen.
+
+// sstShortValueMaxLen is the max length of the values stored in the write CF.
+const sstShortValueMaxLen = 255
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// Backup backs up the data of the regions of this store in the range of the request to the local storage, a
+// response is sent for each region. If the start version is 0, the latest versions at the end version are
+// backed up, otherwise the versions committed in (start version, end version] are backed up incrementally.
+func (svr *Server) Backup(req *backup.BackupRequest, stream backup.Backup_BackupServer) error {
+	local := req.GetStorageBackend().GetLocal()
+	if local == nil {
+		return stream.Send(&backup.BackupResponse{Error: &backup.Error{Msg: "only the local storage is supported"}})
+	}
+	if req.GetIsRawKv() {
+		return stream.Send(&backup.BackupResponse{Error: &backup.Error{Msg: "raw kv backup is not supported"}})
+	}
+	if err := os.MkdirAll(local.GetPath(), 0755); err != nil {
+		return errors.Trace(err)
+	}
+	var limiter *rate.Limiter
+	if rateLimit := int(req.GetRateLimit()); rateLimit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(rateLimit), rateLimit)
+	}
+	var regions []*regionCtx
+	svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+		if !regCtx.greaterEqualEndKey(req.GetStartKey()) && !exceedEndKey(regCtx.startKey, req.GetEndKey()) {
+			regions = append(regions, regCtx)
+		}
+	})
+	sort.Slice(regions, func(i, j int) bool {
+		return bytes.Compare(regions[i].startKey, regions[j].startKey) < 0
+	})
+	for _, regCtx := range regions {
+		resp := svr.backupRegion(stream.Context(), req, regCtx, local.GetPath(), limiter)
+		if err := stream.Send(resp); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+func (svr *Server) backupRegion(ctx context.Context, req *backup.BackupRequest, regCtx *regionCtx, dir string,
+	limiter *rate.Limiter) *backup.BackupResponse {
+	startKey, endKey := req.GetStartKey(), req.GetEndKey()
+	if bytes.Compare(startKey, regCtx.startKey) < 0 {
+		startKey = regCtx.startKey
+	}
+	if len(endKey) == 0 || (len(regCtx.endKey) > 0 && bytes.Compare(regCtx.endKey, endKey) < 0) {
+		endKey = regCtx.endKey
+	}
+	resp := &backup.BackupResponse{StartKey: startKey, EndKey: endKey}
+	reqCtx, err := newRequestCtx(ctx, svr, svr.localRPCContext(regCtx), "Backup")
+	if err != nil {
+		resp.Error = &backup.Error{Msg: err.Error()}
+		return resp
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		resp.Error = &backup.Error{Detail: &backup.Error_RegionError{RegionError: reqCtx.regErr}}
+		return resp
+	}
+	if regErr := reqCtx.acquireReaderSlot(); regErr != nil {
+		resp.Error = &backup.Error{Detail: &backup.Error_RegionError{RegionError: regErr}}
+		return resp
+	}
+	bw := &backupWriter{
+		store:    svr.mvccStore,
+		dir:      dir,
+		prefix:   fmt.Sprintf("%d_%d_%x", reqCtx.storeId, regCtx.meta.Id, sha256.Sum256(startKey)),
+		startTS:  req.GetStartVersion(),
+		endTS:    req.GetEndVersion(),
+		limiter:  limiter,
+		ctx:      ctx,
+		startKey: startKey,
+		endKey:   endKey,
+	}
+	resp.Files, err = bw.backup()
+	if err != nil {
+		if regErr := extractRegionError(err); regErr != nil {
+			resp.Error = &backup.Error{Detail: &backup.Error_RegionError{RegionError: regErr}}
+		} else if _, ok := errors.Cause(err).(*ErrLocked); ok {
+			resp.Error = &backup.Error{Detail: &backup.Error_KvError{KvError: convertToKeyError(err)}}
+		} else {
+			log.Warn("backup region failed", zap.Uint64("region", regCtx.meta.Id), zap.Error(err))
+			resp.Error = &backup.Error{Msg: err.Error()}
+		}
+	}
+	return resp
+}
+
+// backupWriter writes the versions of a range to the backup files.
+type backupWriter struct {
+	store    *MVCCStore
+	dir      string
+	prefix   string
+	startTS  uint64
+	endTS    uint64
+	limiter  *rate.Limiter
+	ctx      context.Context
+	startKey []byte
+	endKey   []byte
+
+	files [2]*backupFile
+}
+
+// backupFile is a backup SST file being written.
+type backupFile struct {
+	file   *backup.File
+	path   string
+	writer *rocksdb.SstFileWriter
+}
+
+func (bw *backupWriter) backup() ([]*backup.File, error) {
+	defer bw.cleanup()
+	if err := bw.checkLocks(); err != nil {
+		return nil, err
+	}
+	txn := bw.store.db.NewTransaction(false)
+	defer txn.Discard()
+	iter := dbreader.NewIterator(txn, false, bw.startKey, bw.endKey)
+	defer iter.Close()
+	iter.SetAllVersions(true)
+	var lastKey []byte
+	for iter.Seek(bw.startKey); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if isExtraTxnStatusItem(item) {
+			continue
+		}
+		key := item.Key()
+		userMeta := mvcc.DBUserMeta(item.UserMeta())
+		commitTS := userMeta.CommitTS()
+		if commitTS > bw.endTS || commitTS <= bw.startTS {
+			continue
+		}
+		if !bytes.Equal(key, lastKey) {
+			lastKey = safeCopy(key)
+		} else if bw.startTS == 0 {
+			// Only the latest version is backed up by a full backup.
+			continue
+		}
+		val, err := item.Value()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if val, err = bw.store.decodeValue(val); err != nil {
+			return nil, errors.Trace(err)
+		}
+		writeType := byte(sstWriteTypePut)
+		if len(val) == 0 {
+			if bw.startTS == 0 {
+				continue
+			}
+			writeType = sstWriteTypeDelete
+		}
+		if err = bw.write(key, userMeta.StartTS(), commitTS, writeType, val); err != nil {
+			return nil, err
+		}
+	}
+	return bw.finish()
+}
+
+// checkLocks returns ErrLocked if a key in the range is locked by a transaction started before the end ts.
+func (bw *backupWriter) checkLocks() error {
+	it := bw.store.lockStore.NewIterator()
+	for it.Seek(bw.startKey); it.Valid(); it.Next() {
+		if exceedEndKey(it.Key(), bw.endKey) {
+			break
+		}
+		lock := mvcc.DecodeLock(it.Value())
+		if lock.Op == uint8(kvrpcpb.Op_PessimisticLock) || lock.StartTS > bw.endTS {
+			continue
+		}
+		return BuildLockErr(safeCopy(it.Key()), &lock)
+	}
+	return nil
+}
+
+func (bw *backupWriter) write(key []byte, startTS, commitTS uint64, writeType byte, val []byte) error {
+	shortValue := val
+	if writeType == sstWriteTypePut && len(val) > sstShortValueMaxLen {
+		shortValue = nil
+		if err := bw.add(0, cfDefault, encodeSSTKey(key, startTS), val); err != nil {
+			return err
+		}
+	} else if writeType == sstWriteTypeDelete {
+		shortValue = nil
+	}
+	return bw.add(1, cfWrite, encodeSSTKey(key, commitTS), encodeSSTWriteValue(writeType, startTS, shortValue))
+}
+
+func (bw *backupWriter) add(idx int, cf string, key, value []byte) error {
+	if err := waitLimiter(bw.ctx, bw.limiter, len(key)+len(value)); err != nil {
+		return errors.Trace(err)
+	}
+	bf := bw.files[idx]
+	if bf == nil {
+		name := fmt.Sprintf("%s_%s.sst", bw.prefix, cf)
+		path := filepath.Join(bw.dir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		bf = &backupFile{
+			file: &backup.File{
+				Name:         name,
+				StartKey:     bw.startKey,
+				EndKey:       bw.endKey,
+				StartVersion: bw.startTS,
+				EndVersion:   bw.endTS,
+				Cf:           cf,
+			},
+			path:   path,
+			writer: rocksdb.NewSstFileWriter(f, rocksdb.NewDefaultBlockBasedTableOptions(bytes.Compare)),
+		}
+		bw.files[idx] = bf
+	}
+	if err := bf.writer.Put(key, value); err != nil {
+		return errors.Trace(err)
+	}
+	digest := crc64.New(crc64Table)
+	digest.Write(key)
+	digest.Write(value)
+	bf.file.Crc64Xor ^= digest.Sum64()
+	bf.file.TotalKvs++
+	bf.file.TotalBytes += uint64(len(key) + len(value))
+	return nil
+}
+
+func (bw *backupWriter) finish() ([]*backup.File, error) {
+	var files []*backup.File
+	for i, bf := range bw.files {
+		if bf == nil {
+			continue
+		}
+		err := bf.writer.Finish()
+		if err1 := bf.writer.Close(); err == nil {
+			err = err1
+		}
+		bw.files[i] = nil
+		if err != nil {
+			os.Remove(bf.path)
+			return nil, errors.Trace(err)
+		}
+		data, err := ioutil.ReadFile(bf.path)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		sum := sha256.Sum256(data)
+		bf.file.Sha256 = sum[:]
+		bf.file.Size_ = uint64(len(data))
+		files = append(files, bf.file)
+	}
+	return files, nil
+}
+
+// cleanup removes the files not finished because of an error.
+func (bw *backupWriter) cleanup() {
+	for _, bf := range bw.files {
+		if bf != nil {
+			bf.writer.Close()
+			os.Remove(bf.path)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"context"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/cdcpb"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// The change data service of TiKV used by TiCDC. A capture subscribes the regions on an EventFeed stream, the
+// subscription starts with an incremental scan of the changes committed after the checkpoint ts and the locks,
+// followed by the INITIALIZED event. Then the prewrites, commits and rollbacks of the region are sent as they are
+// written, and the resolved ts of the region is sent whenever it's advanced.
+
+const (
+	// cdcEventBufferSize is the number of events buffered for a stream, the stream fails with ErrCDCCongested
+	// if the writes of the subscribed regions fill the buffer.
+	cdcEventBufferSize = 1024
+	// cdcMaxEventsPerResponse is the max number of events sent in a response of the stream.
+	cdcMaxEventsPerResponse = 128
+)
+
+// ErrCDCCongested is returned by an EventFeed stream which doesn't keep up with the writes, the writes are never
+// blocked by a stream, so the stream fails and the capture subscribes the regions again.
+var ErrCDCCongested = errors.New("cdc event buffer is full")
+
+// cdcObserver wraps the DBWriter of the store to capture the rows of the write batches, the rows are published
+// to the subscribers of the regions and the committed ones to the change sink, so every write path is captured.
+// The writes hold the read lock of mu while they are written and published to the subscribers, so a subscription
+// or a resolved ts taken with the write lock sees every write either done or not started.
+type cdcObserver struct {
+	mvcc.DBWriter
+	decodeValue func([]byte) ([]byte, error)
+
+	mu sync.RWMutex
+	// regions maps the region id to the subscriptions of the region.
+	regions map[uint64][]*cdcDownstream
+	// changeFeed receives the committed changes if a change sink is set.
+	changeFeed *changeFeed
+}
+
+func newCDCObserver(writer mvcc.DBWriter, decodeValue func([]byte) ([]byte, error)) *cdcObserver {
+	return &cdcObserver{
+		DBWriter:    writer,
+		decodeValue: decodeValue,
+		regions:     make(map[uint64][]*cdcDownstream),
+	}
+}
+
+// cdcWriteBatch records the rows written by the batch, the rows of the raw keys are kept apart since they are
+// not the changes of the transactional data.
+type cdcWriteBatch struct {
+	mvcc.WriteBatch
+	regionID uint64
+	startTS  uint64
+	commitTS uint64
+	onePC    bool
+	rows     []*cdcpb.Event_Row
+	rawRows  []*cdcpb.Event_Row
+}
+
+func (o *cdcObserver) NewWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Context) mvcc.WriteBatch {
+	return &cdcWriteBatch{
+		WriteBatch: o.DBWriter.NewWriteBatch(startTS, commitTS, ctx),
+		regionID:   ctx.GetRegionId(),
+		startTS:    startTS,
+		commitTS:   commitTS,
+	}
+}
+
+func (o *cdcObserver) Write(batch mvcc.WriteBatch) error {
+	cdcBatch, ok := batch.(*cdcWriteBatch)
+	if !ok {
+		return o.DBWriter.Write(batch)
+	}
+	return o.observe(cdcBatch.regionID, cdcBatch.rows, cdcBatch.rawRows, func() error {
+		return o.DBWriter.Write(cdcBatch.WriteBatch)
+	})
+}
+
+func (o *cdcObserver) currentChangeFeed() *changeFeed {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.changeFeed
+}
+
+// observe runs the write and publishes its rows, the rows of the writes which bypass the DBWriter, like an SST
+// ingest, are published by it too. The rows are sent to the subscriptions of the region with the read lock
+// held, and the committed rows and raw rows are sent to the change sink after the lock is released, so a full
+// change buffer with the block policy doesn't block the subscriptions.
+func (o *cdcObserver) observe(regionID uint64, rows, rawRows []*cdcpb.Event_Row, write func() error) error {
+	o.mu.RLock()
+	if err := write(); err != nil {
+		o.mu.RUnlock()
+		return err
+	}
+	downs := o.regions[regionID]
+	feed := o.changeFeed
+	if len(downs) > 0 || feed != nil {
+		for _, list := range [][]*cdcpb.Event_Row{rows, rawRows} {
+			for _, row := range list {
+				if row.OpType == cdcpb.Event_Row_PUT {
+					row.Value = o.decodeRowValue(row)
+				}
+			}
+		}
+	}
+	if len(rows) > 0 {
+		for _, down := range downs {
+			down.sendEntries(rows)
+		}
+	}
+	o.mu.RUnlock()
+	if feed != nil {
+		events := appendChangeEvents(nil, regionID, rows, false)
+		feed.publish(appendChangeEvents(events, regionID, rawRows, true))
+	}
+	return nil
+}
+
+func (o *cdcObserver) decodeRowValue(row *cdcpb.Event_Row) []byte {
+	val, err := o.decodeValue(row.Value)
+	if err != nil {
+		log.Error("decode value of cdc event failed", zap.Binary("key", row.Key), zap.Error(err))
+	}
+	return val
+}
+
+// markOnePC marks the commits of the batch as committed by 1PC, they are sent without the prewrites.
+func markOnePC(batch mvcc.WriteBatch) {
+	if cdcBatch, ok := batch.(*cdcWriteBatch); ok {
+		cdcBatch.onePC = true
+	}
+}
+
+func (b *cdcWriteBatch) Prewrite(key []byte, lock *mvcc.MvccLock) {
+	b.WriteBatch.Prewrite(key, lock)
+	if row := newCDCRow(cdcpb.Event_PREWRITE, key, lock, 0); row != nil {
+		b.rows = append(b.rows, row)
+	}
+}
+
+func (b *cdcWriteBatch) Commit(key []byte, lock *mvcc.MvccLock) {
+	b.WriteBatch.Commit(key, lock)
+	if isRawDataKey(key) {
+		// The start ts of a raw version is its expire time.
+		if row := newCDCRow(cdcpb.Event_COMMITTED, key[len(InternalRawKeyPrefix):], lock, b.commitTS); row != nil {
+			row.StartTs = 0
+			b.rawRows = append(b.rawRows, row)
+		}
+		return
+	}
+	tp := cdcpb.Event_COMMIT
+	if b.onePC {
+		tp = cdcpb.Event_COMMITTED
+	}
+	if row := newCDCRow(tp, key, lock, b.commitTS); row != nil {
+		b.rows = append(b.rows, row)
+	}
+}
+
+func (b *cdcWriteBatch) Rollback(key []byte, deleteLock bool) {
+	b.WriteBatch.Rollback(key, deleteLock)
+	b.rows = append(b.rows, &cdcpb.Event_Row{
+		StartTs: b.startTS,
+		Type:    cdcpb.Event_ROLLBACK,
+		Key:     safeCopy(key),
+	})
+}
+
+// newCDCRow returns the row of a put or delete lock, nil is returned for the other locks which don't change
+// the data.
+func newCDCRow(tp cdcpb.Event_LogType, key []byte, lock *mvcc.MvccLock, commitTS uint64) *cdcpb.Event_Row {
+	var opType cdcpb.Event_Row_OpType
+	switch kvrpcpb.Op(lock.Op) {
+	case kvrpcpb.Op_Put:
+		opType = cdcpb.Event_Row_PUT
+	case kvrpcpb.Op_Del:
+		opType = cdcpb.Event_Row_DELETE
+	default:
+		return nil
+	}
+	return &cdcpb.Event_Row{
+		StartTs:  lock.StartTS,
+		CommitTs: commitTS,
+		Type:     tp,
+		OpType:   opType,
+		Key:      safeCopy(key),
+		// The value is decoded when it's sent, it's copied because the lock may be reused by the caller.
+		Value: safeCopy(lock.Value),
+	}
+}
+
+// cdcConn is an EventFeed stream, the events of its subscriptions are buffered and sent by the stream.
+type cdcConn struct {
+	events    chan *cdcpb.Event
+	closeCh   chan struct{}
+	closeOnce sync.Once
+	// err is the error the stream is failed with, it's set before closeCh is closed.
+	err error
+}
+
+func newCDCConn() *cdcConn {
+	return &cdcConn{
+		events:  make(chan *cdcpb.Event, cdcEventBufferSize),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// send buffers the event, it's called by the writes so it never blocks, the stream fails with ErrCDCCongested
+// if the buffer is full.
+func (conn *cdcConn) send(event *cdcpb.Event) {
+	select {
+	case <-conn.closeCh:
+	case conn.events <- event:
+	default:
+		conn.fail(ErrCDCCongested)
+	}
+}
+
+// sendWait buffers the event, it blocks if the buffer is full until the stream is closed. It must not be called
+// with the lock of the observer held.
+func (conn *cdcConn) sendWait(event *cdcpb.Event) {
+	select {
+	case conn.events <- event:
+	case <-conn.closeCh:
+	}
+}
+
+func (conn *cdcConn) close() {
+	conn.fail(nil)
+}
+
+func (conn *cdcConn) fail(err error) {
+	conn.closeOnce.Do(func() {
+		conn.err = err
+		close(conn.closeCh)
+	})
+}
+
+// cdcDownstream is the subscription of a region.
+type cdcDownstream struct {
+	conn      *cdcConn
+	regionID  uint64
+	requestID uint64
+	// epoch and the range are the region's at the subscription, the subscription fails if the epoch changes.
+	epoch    *metapb.RegionEpoch
+	startKey []byte
+	endKey   []byte
+	// initialized and resolvedTS are protected by the write lock of the observer.
+	initialized bool
+	resolvedTS  uint64
+}
+
+func (down *cdcDownstream) newEvent() *cdcpb.Event {
+	return &cdcpb.Event{RegionId: down.regionID, RequestId: down.requestID}
+}
+
+func (down *cdcDownstream) newEntriesEvent(rows []*cdcpb.Event_Row) *cdcpb.Event {
+	ev := down.newEvent()
+	ev.Event = &cdcpb.Event_Entries_{Entries: &cdcpb.Event_Entries{Entries: rows}}
+	return ev
+}
+
+func (down *cdcDownstream) sendEntries(rows []*cdcpb.Event_Row) {
+	down.conn.send(down.newEntriesEvent(rows))
+}
+
+func (down *cdcDownstream) sendError(evErr *cdcpb.Event_Error) {
+	ev := down.newEvent()
+	ev.Event = &cdcpb.Event_Error_{Error: evErr}
+	down.conn.send(ev)
+}
+
+func (down *cdcDownstream) sendResolvedTS(ts uint64) {
+	ev := down.newEvent()
+	ev.Event = &cdcpb.Event_ResolvedTs{ResolvedTs: ts}
+	down.conn.send(ev)
+}
+
+// addDownstream adds the subscription, a previous subscription of the region on the same stream is replaced.
+func (o *cdcObserver) addDownstream(down *cdcDownstream) {
+	downs := o.regions[down.regionID]
+	for i, old := range downs {
+		if old.conn == down.conn {
+			downs = append(downs[:i], downs[i+1:]...)
+			break
+		}
+	}
+	o.regions[down.regionID] = append(downs, down)
+}
+
+func (o *cdcObserver) removeDownstream(down *cdcDownstream) {
+	downs := o.regions[down.regionID]
+	for i, d := range downs {
+		if d == down {
+			downs = append(downs[:i], downs[i+1:]...)
+			break
+		}
+	}
+	if len(downs) == 0 {
+		delete(o.regions, down.regionID)
+	} else {
+		o.regions[down.regionID] = downs
+	}
+}
+
+// removeConn removes all the subscriptions of the stream.
+func (o *cdcObserver) removeConn(conn *cdcConn) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var removed []*cdcDownstream
+	for _, downs := range o.regions {
+		for _, down := range downs {
+			if down.conn == conn {
+				removed = append(removed, down)
+			}
+		}
+	}
+	for _, down := range removed {
+		o.removeDownstream(down)
+	}
+}
+
+// EventFeed serves the region subscriptions of a TiCDC capture.
+func (svr *Server) EventFeed(stream cdcpb.ChangeData_EventFeedServer) error {
+	observer := svr.mvccStore.cdcObserver
+	conn := newCDCConn()
+	defer observer.removeConn(conn)
+	defer conn.close()
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				conn.close()
+				return
+			}
+			svr.subscribeRegion(conn, req)
+		}
+	}()
+	resp := new(cdcpb.ChangeDataEvent)
+	for {
+		select {
+		case ev := <-conn.events:
+			resp.Events = append(resp.Events[:0], ev)
+			for len(resp.Events) < cdcMaxEventsPerResponse && len(conn.events) > 0 {
+				resp.Events = append(resp.Events, <-conn.events)
+			}
+			if err := stream.Send(resp); err != nil {
+				return err
+			}
+		case <-conn.closeCh:
+			if conn.err != nil {
+				log.Warn("cdc stream is congested", zap.Error(conn.err))
+				return conn.err
+			}
+			// The stream is closed by the receiver.
+			err := <-recvErr
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Trace(err)
+		case err := <-recvErr:
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Trace(err)
+		case <-svr.closeCh:
+			return nil
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+// subscribeRegion registers the subscription and sends the incremental scan.
+func (svr *Server) subscribeRegion(conn *cdcConn, req *cdcpb.ChangeDataRequest) {
+	observer := svr.mvccStore.cdcObserver
+	down := &cdcDownstream{
+		conn:       conn,
+		regionID:   req.RegionId,
+		requestID:  req.RequestId,
+		resolvedTS: req.CheckpointTs,
+	}
+	rpcCtx := &kvrpcpb.Context{RegionId: req.RegionId, RegionEpoch: req.RegionEpoch}
+	if regCtx, err := svr.debugRegion(req.RegionId); err == nil {
+		rpcCtx = svr.localRPCContext(regCtx)
+		rpcCtx.RegionEpoch = req.RegionEpoch
+	}
+	reqCtx, err := newRequestCtx(context.Background(), svr, rpcCtx, "EventFeed")
+	if err != nil {
+		down.sendError(cdcRegionError(req.RegionId, &errorpb.Error{Message: err.Error()}))
+		return
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		down.sendError(cdcRegionError(req.RegionId, reqCtx.regErr))
+		return
+	}
+	regCtx := reqCtx.regCtx
+	down.epoch = regCtx.getRegionEpoch()
+	down.startKey, down.endKey = regCtx.rawStartKey(), regCtx.rawEndKey()
+
+	// The subscription is added, the locks are scanned and the snapshot is taken without a write in progress, so
+	// every write is either in the scan or sent to the subscription.
+	observer.mu.Lock()
+	observer.addDownstream(down)
+	locks := observer.scanLocks(svr.mvccStore, down.startKey, down.endKey)
+	reader := reqCtx.getDBReader()
+	observer.mu.Unlock()
+
+	rows := locks
+	err = reader.IncrementalScan(down.startKey, down.endKey, req.CheckpointTs, math.MaxUint64,
+		func(key, value []byte, commitTS uint64) error {
+			row := &cdcpb.Event_Row{
+				CommitTs: commitTS,
+				Type:     cdcpb.Event_COMMITTED,
+				OpType:   cdcpb.Event_Row_PUT,
+				Key:      safeCopy(key),
+				Value:    safeCopy(value),
+			}
+			if value == nil {
+				row.OpType = cdcpb.Event_Row_DELETE
+			}
+			rows = append(rows, row)
+			// The scan holds no lock, so it waits for the stream instead of failing it.
+			if len(rows) == cdcMaxEventsPerResponse {
+				conn.sendWait(down.newEntriesEvent(rows))
+				rows = nil
+			}
+			return nil
+		})
+	if err != nil {
+		log.Error("cdc incremental scan failed", zap.Uint64("region", req.RegionId), zap.Error(err))
+		observer.mu.Lock()
+		observer.removeDownstream(down)
+		observer.mu.Unlock()
+		down.sendError(cdcRegionError(req.RegionId, &errorpb.Error{Message: err.Error()}))
+		return
+	}
+	conn.sendWait(down.newEntriesEvent(append(rows, &cdcpb.Event_Row{Type: cdcpb.Event_INITIALIZED})))
+	observer.mu.Lock()
+	down.initialized = true
+	observer.mu.Unlock()
+}
+
+// scanLocks returns the prewrite rows of the put and delete locks in [start, end).
+func (o *cdcObserver) scanLocks(store *MVCCStore, start, end []byte) []*cdcpb.Event_Row {
+	var rows []*cdcpb.Event_Row
+	it := store.lockStore.NewIterator()
+	for it.Seek(start); it.Valid(); it.Next() {
+		if exceedEndKey(it.Key(), end) {
+			break
+		}
+		lock := mvcc.DecodeLock(it.Value())
+		if row := newCDCRow(cdcpb.Event_PREWRITE, it.Key(), &lock, 0); row != nil {
+			if row.OpType == cdcpb.Event_Row_PUT {
+				row.Value = o.decodeRowValue(row)
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
+
+// cdcRegionError converts the region error to the error event, the errors other than NotLeader and
+// EpochNotMatch are sent as RegionNotFound so the region is reloaded and subscribed again.
+func cdcRegionError(regionID uint64, regErr *errorpb.Error) *cdcpb.Event_Error {
+	evErr := &cdcpb.Event_Error{
+		NotLeader:      regErr.GetNotLeader(),
+		RegionNotFound: regErr.GetRegionNotFound(),
+		EpochNotMatch:  regErr.GetEpochNotMatch(),
+	}
+	if evErr.NotLeader == nil && evErr.RegionNotFound == nil && evErr.EpochNotMatch == nil {
+		evErr.RegionNotFound = &errorpb.RegionNotFound{RegionId: regionID}
+	}
+	return evErr
+}
+
+// sendResolvedTS sends the resolved ts of the regions to their initialized subscriptions, it's called with the
+// write lock held. The subscriptions of the regions changed since they are subscribed fail with the region error.
+func (o *cdcObserver) sendResolvedTS(regions map[uint64]*regionCtx) {
+	var failed []*cdcDownstream
+	for _, downs := range o.regions {
+		for _, down := range downs {
+			if !down.initialized {
+				continue
+			}
+			regCtx := regions[down.regionID]
+			if regCtx == nil {
+				down.sendError(&cdcpb.Event_Error{RegionNotFound: &errorpb.RegionNotFound{RegionId: down.regionID}})
+				failed = append(failed, down)
+				continue
+			}
+			if epoch := regCtx.getRegionEpoch(); epoch.Version != down.epoch.Version || epoch.ConfVer != down.epoch.ConfVer {
+				down.sendError(&cdcpb.Event_Error{EpochNotMatch: &errorpb.EpochNotMatch{
+					CurrentRegions: []*metapb.Region{regCtx.meta},
+				}})
+				failed = append(failed, down)
+				continue
+			}
+			if resolvedTS := regCtx.getResolvedTS(); resolvedTS > down.resolvedTS {
+				down.resolvedTS = resolvedTS
+				down.sendResolvedTS(resolvedTS)
+			}
+		}
+	}
+	for _, down := range failed {
+		o.removeDownstream(down)
+	}
+}
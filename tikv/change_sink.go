@@ -0,0 +1,174 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pingcap/kvproto/pkg/cdcpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// ChangeEvent is a committed change of a key.
+type ChangeEvent struct {
+	RegionID uint64
+	Key      []byte
+	// Value is nil if the key is deleted.
+	Value    []byte
+	Op       kvrpcpb.Op
+	StartTS  uint64
+	CommitTS uint64
+	// Raw is true if the change is written by the raw API, its StartTS is 0 and CommitTS is the raw version.
+	Raw bool
+}
+
+// ChangeSink receives the committed change events, it can be implemented to forward the events to an
+// external system. The events are sent one by one in the order they are committed.
+type ChangeSink interface {
+	Send(event *ChangeEvent) error
+}
+
+// changeOverflowDrop is the overflow policy that drops the events when the buffer is full, the commits
+// are blocked until the buffer has room with the default policy.
+const changeOverflowDrop = "drop"
+
+// changeFeed buffers the change events published by the writes and sends them to the sink
+// on a background goroutine, so a slow sink doesn't block the commits unless the buffer is full.
+type changeFeed struct {
+	sink    ChangeSink
+	events  chan *ChangeEvent
+	drop    bool
+	dropped int64
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newChangeFeed(sink ChangeSink, bufferSize int, overflowPolicy string) *changeFeed {
+	feed := &changeFeed{
+		sink:    sink,
+		events:  make(chan *ChangeEvent, bufferSize),
+		drop:    overflowPolicy == changeOverflowDrop,
+		closeCh: make(chan struct{}),
+	}
+	feed.wg.Add(1)
+	go feed.run()
+	return feed
+}
+
+func (feed *changeFeed) run() {
+	defer feed.wg.Done()
+	for {
+		select {
+		case ev := <-feed.events:
+			feed.send(ev)
+		case <-feed.closeCh:
+			// Send the buffered events before exit.
+			for {
+				select {
+				case ev := <-feed.events:
+					feed.send(ev)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (feed *changeFeed) send(ev *ChangeEvent) {
+	if err := feed.sink.Send(ev); err != nil {
+		log.Error("send change event failed", zap.Uint64("region", ev.RegionID), zap.Binary("key", ev.Key),
+			zap.Uint64("commit ts", ev.CommitTS), zap.Error(err))
+	}
+}
+
+// publish buffers the events, if the buffer is full it blocks or drops the events depending on the policy.
+func (feed *changeFeed) publish(events []*ChangeEvent) {
+	for _, ev := range events {
+		if feed.drop {
+			select {
+			case feed.events <- ev:
+			default:
+				atomic.AddInt64(&feed.dropped, 1)
+				log.Error("change event buffer is full, event dropped", zap.Uint64("region", ev.RegionID),
+					zap.Binary("key", ev.Key), zap.Uint64("commit ts", ev.CommitTS))
+			}
+			continue
+		}
+		select {
+		case feed.events <- ev:
+		case <-feed.closeCh:
+			return
+		}
+	}
+}
+
+func (feed *changeFeed) close() {
+	close(feed.closeCh)
+	feed.wg.Wait()
+}
+
+// SetChangeSink sets the sink of the committed change events, nil stops sending the events.
+// It should be called before the server starts to serve requests.
+func (svr *Server) SetChangeSink(sink ChangeSink) {
+	store := svr.mvccStore
+	var feed *changeFeed
+	if sink != nil {
+		serverConf := store.conf.Server
+		feed = newChangeFeed(sink, serverConf.ChangeBufferSize, serverConf.ChangeOverflowPolicy)
+	}
+	// The old feed sends its buffered events before it's closed, the writes in progress may still publish to it.
+	observer := store.cdcObserver
+	observer.mu.Lock()
+	old := observer.changeFeed
+	observer.changeFeed = feed
+	observer.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+}
+
+// DroppedChangeEvents returns the number of change events dropped because the buffer is full.
+func (svr *Server) DroppedChangeEvents() int64 {
+	if feed := svr.mvccStore.cdcObserver.currentChangeFeed(); feed != nil {
+		return atomic.LoadInt64(&feed.dropped)
+	}
+	return 0
+}
+
+// appendChangeEvents appends the changes of the committed rows of the region.
+func appendChangeEvents(events []*ChangeEvent, regionID uint64, rows []*cdcpb.Event_Row, raw bool) []*ChangeEvent {
+	for _, row := range rows {
+		if row.Type != cdcpb.Event_COMMIT && row.Type != cdcpb.Event_COMMITTED {
+			continue
+		}
+		ev := &ChangeEvent{
+			RegionID: regionID,
+			Key:      row.Key,
+			Op:       kvrpcpb.Op_Put,
+			Value:    row.Value,
+			StartTS:  row.StartTs,
+			CommitTS: row.CommitTs,
+			Raw:      raw,
+		}
+		if row.OpType == cdcpb.Event_Row_DELETE {
+			ev.Op, ev.Value = kvrpcpb.Op_Del, nil
+		}
+		events = append(events, ev)
+	}
+	return events
+}
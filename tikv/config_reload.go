@@ -0,0 +1,105 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"reflect"
+	"sync/atomic"
+
+	"github.com/ngaut/unistore/config"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// The online config items can be changed by ReloadConfig without restarting the server:
+//
+//   server.slow-log-threshold, server.slow-log-method-thresholds
+//   server.write-stall-threshold, server.max-pending-writes
+//   server.import-rate-limit, gc.max-write-bytes-per-sec
+//   gc.grace-period
+//   server.advance-ts-interval
+//   server.region-size, server.region-split-keys (standalone mode only)
+//
+// The other items take effect after a restart.
+
+// Config returns the effective config of the server, including the online items changed by ReloadConfig.
+func (svr *Server) Config() config.Config {
+	svr.confMu.Lock()
+	defer svr.confMu.Unlock()
+	return svr.conf
+}
+
+// ReloadConfig applies the online items of conf. Nothing is applied if any of them is invalid.
+func (svr *Server) ReloadConfig(conf *config.Config) error {
+	if err := checkOnlineConfig(conf); err != nil {
+		return err
+	}
+	svr.confMu.Lock()
+	defer svr.confMu.Unlock()
+	effective := svr.conf
+	effective.Server.SlowLogThreshold = conf.Server.SlowLogThreshold
+	effective.Server.SlowLogMethodThresholds = conf.Server.SlowLogMethodThresholds
+	effective.Server.WriteStallThreshold = conf.Server.WriteStallThreshold
+	effective.Server.MaxPendingWrites = conf.Server.MaxPendingWrites
+	effective.Server.ImportRateLimit = conf.Server.ImportRateLimit
+	effective.GC.MaxWriteBytesPerSec = conf.GC.MaxWriteBytesPerSec
+	effective.GC.GracePeriod = conf.GC.GracePeriod
+	effective.Server.AdvanceTSInterval = conf.Server.AdvanceTSInterval
+	if _, ok := svr.regionManager.(*StandAloneRegionManager); ok {
+		effective.Server.RegionSize = conf.Server.RegionSize
+		effective.Server.RegionSplitKeys = conf.Server.RegionSplitKeys
+	}
+
+	svr.slowLog.setThresholds(effective.Server)
+	if store := svr.mvccStore; store != nil {
+		store.flowController.setLimits(effective.Server)
+		store.importLimiter.setLimit(effective.Server.ImportRateLimit)
+		if store.gcWorker != nil {
+			store.gcWorker.limiter.setLimit(effective.GC.MaxWriteBytesPerSec)
+		}
+		atomic.StoreInt64(&store.gcGracePeriod, int64(config.ParseDuration(effective.GC.GracePeriod)))
+	}
+	if rm, ok := svr.regionManager.(*StandAloneRegionManager); ok {
+		rm.SetSplitSize(effective.Server.RegionSize, effective.Server.RegionSplitKeys)
+	}
+	svr.conf = effective
+	if !reflect.DeepEqual(effective, *conf) {
+		log.Warn("some changed config items are not reloaded, they take effect after a restart")
+	}
+	log.Info("config is reloaded", zap.Reflect("server", effective.Server), zap.Reflect("gc", effective.GC))
+	return nil
+}
+
+// checkOnlineConfig checks the online items, an invalid duration would make the server exit when it's parsed.
+func checkOnlineConfig(conf *config.Config) error {
+	durations := map[string]string{
+		"server.slow-log-threshold":    conf.Server.SlowLogThreshold,
+		"server.write-stall-threshold": conf.Server.WriteStallThreshold,
+		"gc.grace-period":              conf.GC.GracePeriod,
+		"server.advance-ts-interval":   conf.Server.AdvanceTSInterval,
+	}
+	for method, threshold := range conf.Server.SlowLogMethodThresholds {
+		durations["server.slow-log-method-thresholds."+method] = threshold
+	}
+	for item, value := range durations {
+		if _, err := config.TryParseDuration(value); err != nil {
+			return errors.Annotate(err, item)
+		}
+	}
+	if conf.Server.RegionSize <= 0 {
+		return errors.Errorf("server.region-size must be positive, got %d", conf.Server.RegionSize)
+	}
+	return nil
+}
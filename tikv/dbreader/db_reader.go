@@ -30,6 +30,7 @@ import (
 	"bytes"
 	"math"
 
+	"github.com/ngaut/unistore/lockstore"
 	"github.com/ngaut/unistore/tikv/mvcc"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
@@ -57,6 +58,15 @@ func NewIterator(txn *badger.Txn, reverse bool, startKey, endKey []byte) *badger
 	return txn.NewIterator(opts)
 }
 
+// ValueCodec transforms the values stored in DB, it can be used to attach metadata like schema version to
+// the values transparently. Empty values are deletes and are never passed to the codec.
+type ValueCodec interface {
+	// Encode returns the value to store in DB.
+	Encode(value []byte) []byte
+	// Decode returns the original value of the stored value.
+	Decode(stored []byte) ([]byte, error)
+}
+
 // DBReader reads data from DB, for read-only requests, the locks must already be checked before DBReader is created.
 type DBReader struct {
 	StartKey  []byte
@@ -65,6 +75,80 @@ type DBReader struct {
 	iter      *badger.Iterator
 	extraIter *badger.Iterator
 	revIter   *badger.Iterator
+	codec     ValueCodec
+	// lockStore is set to annotate the scanned pairs with their lock status.
+	lockStore *lockstore.MemStore
+	lockBuf   []byte
+	// readOwnIntent makes Get return the pending value of the lock written by the reading transaction.
+	readOwnIntent bool
+	// rangeChecker is called by scans every checkInterval keys, the scan stops with its error.
+	rangeChecker  func() error
+	checkInterval int
+	// scannedKeys is the number of the keys read, processedKeys is the number of them with a value, the deleted
+	// keys are only scanned. They're reported in the exec details of the request.
+	scannedKeys   int
+	processedKeys int
+}
+
+// ScanStats returns the number of the keys read by the reader and the number of them with a value.
+func (r *DBReader) ScanStats() (scanned, processed int) {
+	return r.scannedKeys, r.processedKeys
+}
+
+// countKey counts a key read by the reader, the empty item is a delete.
+func (r *DBReader) countKey(item *badger.Item) {
+	r.scannedKeys++
+	if !item.IsEmpty() {
+		r.processedKeys++
+	}
+}
+
+// SetRangeChecker sets the function called by Scan and ReverseScan every interval keys to check if the
+// range of the reader is still valid, e.g. the region is not split. If it returns an error, the scan stops
+// and returns the error as is, the pairs processed before are kept by the ScanProcessor.
+func (r *DBReader) SetRangeChecker(interval int, checker func() error) {
+	r.checkInterval = interval
+	r.rangeChecker = checker
+}
+
+func (r *DBReader) checkRange(iterated int) error {
+	if r.rangeChecker == nil || r.checkInterval <= 0 || iterated == 0 || iterated%r.checkInterval != 0 {
+		return nil
+	}
+	return r.rangeChecker()
+}
+
+// SetLockStore enables the lock annotation of Scan, the ScanProcessor that implements LockAnnotator
+// receives the lock status of every processed pair. nil disables the annotation.
+func (r *DBReader) SetLockStore(lockStore *lockstore.MemStore) {
+	r.lockStore = lockStore
+}
+
+// SetReadOwnIntent makes Get return the value of the write intent if the key is locked by a Put or Delete
+// of the transaction that reads it, i.e. the lock start ts equals the read ts, so a statement can read the
+// values written by the previous statements of the same transaction. It requires the lock store to be set.
+func (r *DBReader) SetReadOwnIntent(enable bool) {
+	r.readOwnIntent = enable
+}
+
+// SetValueCodec sets the codec used to decode the values read from DB, nil means the values are stored as is.
+func (r *DBReader) SetValueCodec(codec ValueCodec) {
+	r.codec = codec
+}
+
+func (r *DBReader) decodeValue(val []byte) ([]byte, error) {
+	if r.codec == nil || len(val) == 0 {
+		return val, nil
+	}
+	return r.codec.Decode(val)
+}
+
+func (r *DBReader) itemValue(item *badger.Item) ([]byte, error) {
+	val, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+	return r.decodeValue(val)
 }
 
 // GetMvccInfoByKey fills MvccInfo reading committed keys from db
@@ -81,6 +165,10 @@ func (r *DBReader) GetMvccInfoByKey(key []byte, isRowKey bool, mvccInfo *kvrpcpb
 		if err != nil {
 			return err
 		}
+		val, err = r.decodeValue(val)
+		if err != nil {
+			return err
+		}
 		userMeta := mvcc.DBUserMeta(item.UserMeta())
 		var tp kvrpcpb.Op
 		if len(val) == 0 {
@@ -98,7 +186,36 @@ func (r *DBReader) GetMvccInfoByKey(key []byte, isRowKey bool, mvccInfo *kvrpcpb
 	return nil
 }
 
+// GetOldestVersion returns the commit ts of the oldest committed version of the key retained in db,
+// ok is false if the key has no committed version.
+func (r *DBReader) GetOldestVersion(key []byte) (commitTS uint64, ok bool) {
+	it := r.GetIter()
+	it.SetAllVersions(true)
+	for it.Seek(key); it.Valid(); it.Next() {
+		item := it.Item()
+		if !bytes.Equal(item.Key(), key) {
+			break
+		}
+		// A delete written by GC or DeleteRange has no user meta, it hides all the older versions.
+		if len(item.UserMeta()) == 0 {
+			break
+		}
+		// Versions are iterated from the newest to the oldest.
+		commitTS = mvcc.DBUserMeta(item.UserMeta()).CommitTS()
+		ok = true
+	}
+	return
+}
+
+// Get returns the value of the latest version committed at or before startTS, the commit ts is used as the
+// badger version so older read ts are served from the version chain. Rollbacks are not stored as versions
+// of the key, and a delete is a version with empty value, so an empty value is returned for a deleted key.
 func (r *DBReader) Get(key []byte, startTS uint64) ([]byte, error) {
+	if r.readOwnIntent && r.lockStore != nil {
+		if val, ok, err := r.getOwnIntent(key, startTS); ok {
+			return val, err
+		}
+	}
 	r.txn.SetReadTS(startTS)
 	item, err := r.txn.Get(key)
 	if err != nil && err != badger.ErrKeyNotFound {
@@ -107,7 +224,30 @@ func (r *DBReader) Get(key []byte, startTS uint64) ([]byte, error) {
 	if item == nil {
 		return nil, nil
 	}
-	return item.Value()
+	r.countKey(item)
+	return r.itemValue(item)
+}
+
+// getOwnIntent returns the value of the Put or Delete lock written by the transaction of startTS, ok is false
+// if there is no such lock, e.g. the key is not locked or is only locked by a Lock or PessimisticLock.
+func (r *DBReader) getOwnIntent(key []byte, startTS uint64) (val []byte, ok bool, err error) {
+	r.lockBuf = r.lockStore.Get(key, r.lockBuf)
+	if len(r.lockBuf) == 0 {
+		return nil, false, nil
+	}
+	lock := mvcc.DecodeLock(r.lockBuf)
+	if lock.StartTS != startTS {
+		return nil, false, nil
+	}
+	switch kvrpcpb.Op(lock.Op) {
+	case kvrpcpb.Op_Put:
+		// The lock buffer is reused, so the value is copied.
+		val, err = r.decodeValue(lock.Value)
+		return append([]byte{}, val...), true, err
+	case kvrpcpb.Op_Del:
+		return nil, true, nil
+	}
+	return nil, false, nil
 }
 
 func (r *DBReader) GetIter() *badger.Iterator {
@@ -154,7 +294,8 @@ func (r *DBReader) BatchGet(keys [][]byte, startTS uint64, f BatchGetFunc) {
 		key := keys[i]
 		var val []byte
 		if item != nil {
-			val, err = item.Value()
+			r.countKey(item)
+			val, err = r.itemValue(item)
 		}
 		f(key, val, err)
 	}
@@ -168,6 +309,13 @@ var ScanBreak = errors.New("scan break")
 // Returns ScanBreak will break the scan loop.
 type ScanFunc = func(key, value []byte) error
 
+// LockAnnotator is implemented by the ScanProcessor that wants to know if the scanned keys are locked.
+type LockAnnotator interface {
+	// AnnotateLock is called after Process with the start ts of the outstanding lock of the key,
+	// lockStartTS is 0 if the key is not locked.
+	AnnotateLock(key []byte, lockStartTS uint64)
+}
+
 // ScanProcessor process the key/value pair.
 type ScanProcessor interface {
 	// Process accepts key and value, should not keep reference to them.
@@ -187,21 +335,30 @@ func exceedEndKey(current, endKey []byte) bool {
 func (r *DBReader) Scan(startKey, endKey []byte, limit int, startTS uint64, proc ScanProcessor) error {
 	r.txn.SetReadTS(startTS)
 	skipValue := proc.SkipValue()
+	annotator, _ := proc.(LockAnnotator)
+	if r.lockStore == nil {
+		annotator = nil
+	}
 	iter := r.GetIter()
-	var cnt int
+	var cnt, iterated int
 	for iter.Seek(startKey); iter.Valid(); iter.Next() {
 		item := iter.Item()
 		key := item.Key()
 		if exceedEndKey(key, endKey) {
 			break
 		}
+		if err := r.checkRange(iterated); err != nil {
+			return err
+		}
+		iterated++
+		r.countKey(item)
 		var err error
 		if item.IsEmpty() {
 			continue
 		}
 		var val []byte
 		if !skipValue {
-			val, err = item.Value()
+			val, err = r.itemValue(item)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -213,6 +370,9 @@ func (r *DBReader) Scan(startKey, endKey []byte, limit int, startTS uint64, proc
 			}
 			return errors.Trace(err)
 		}
+		if annotator != nil {
+			annotator.AnnotateLock(key, r.getLockStartTS(key))
+		}
 		cnt++
 		if cnt >= limit {
 			break
@@ -221,6 +381,65 @@ func (r *DBReader) Scan(startKey, endKey []byte, limit int, startTS uint64, proc
 	return nil
 }
 
+func (r *DBReader) getLockStartTS(key []byte) uint64 {
+	r.lockBuf = r.lockStore.Get(key, r.lockBuf)
+	if len(r.lockBuf) == 0 {
+		return 0
+	}
+	return mvcc.DecodeLock(r.lockBuf).StartTS
+}
+
+// IncrementalScanFunc is called for every key changed by the incremental scan, value is nil if the key is deleted.
+type IncrementalScanFunc = func(key, value []byte, commitTS uint64) error
+
+// IncrementalScan scans the keys in [startKey, endKey) whose latest version visible at snapshotTS is committed
+// after fromTS. Deleted keys are included, so the changes since fromTS can be replayed.
+func (r *DBReader) IncrementalScan(startKey, endKey []byte, fromTS, snapshotTS uint64, f IncrementalScanFunc) error {
+	r.txn.SetReadTS(snapshotTS)
+	iter := r.GetIter()
+	iter.SetAllVersions(false)
+	for iter.Seek(startKey); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		key := item.Key()
+		if exceedEndKey(key, endKey) {
+			break
+		}
+		commitTS := mvcc.DBUserMeta(item.UserMeta()).CommitTS()
+		if commitTS <= fromTS {
+			continue
+		}
+		var val []byte
+		if !item.IsEmpty() {
+			var err error
+			val, err = r.itemValue(item)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if err := f(key, val, commitTS); err != nil {
+			if err == ScanBreak {
+				break
+			}
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// PrefixNext returns the exclusive upper bound of the keys that start with prefix, the trailing 0xFF bytes
+// are stripped before the last byte is increased. nil is returned if there is no such bound, that is the
+// prefix is empty or only contains 0xFF bytes.
+func PrefixNext(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			next := append([]byte{}, prefix[:i+1]...)
+			next[i]++
+			return next
+		}
+	}
+	return nil
+}
+
 func (r *DBReader) GetKeyByStartTs(startKey, endKey []byte, startTs uint64) ([]byte, error) {
 	iter := r.GetIter()
 	iter.SetAllVersions(true)
@@ -238,12 +457,18 @@ func (r *DBReader) GetKeyByStartTs(startKey, endKey []byte, startTs uint64) ([]b
 	return nil, nil
 }
 
-// ReverseScan implements the MVCCStore interface. The search range is [startKey, endKey).
+// ReverseScan implements the MVCCStore interface. The search range is [startKey, endKey), the keys are processed
+// in descending order with their latest versions not after startTS.
 func (r *DBReader) ReverseScan(startKey, endKey []byte, limit int, startTS uint64, proc ScanProcessor) error {
+	// The read ts is set before the iterator is created like Scan, the iterator reads the versions at it.
+	r.txn.SetReadTS(startTS)
 	skipValue := proc.SkipValue()
+	annotator, _ := proc.(LockAnnotator)
+	if r.lockStore == nil {
+		annotator = nil
+	}
 	iter := r.getReverseIter()
-	r.txn.SetReadTS(startTS)
-	var cnt int
+	var cnt, iterated int
 	for iter.Seek(endKey); iter.Valid(); iter.Next() {
 		item := iter.Item()
 		key := item.Key()
@@ -253,13 +478,18 @@ func (r *DBReader) ReverseScan(startKey, endKey []byte, limit int, startTS uint6
 		if cnt == 0 && bytes.Equal(key, endKey) {
 			continue
 		}
+		if err := r.checkRange(iterated); err != nil {
+			return err
+		}
+		iterated++
+		r.countKey(item)
 		var err error
 		if item.IsEmpty() {
 			continue
 		}
 		var val []byte
 		if !skipValue {
-			val, err = item.Value()
+			val, err = r.itemValue(item)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -271,6 +501,9 @@ func (r *DBReader) ReverseScan(startKey, endKey []byte, limit int, startTS uint6
 			}
 			return errors.Trace(err)
 		}
+		if annotator != nil {
+			annotator.AnnotateLock(key, r.getLockStartTS(key))
+		}
 		cnt++
 		if cnt >= limit {
 			break
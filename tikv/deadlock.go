@@ -44,6 +44,7 @@ func (ds *DetectorServer) Detect(req *deadlockPb.DeadlockRequest) *deadlockPb.De
 	case deadlockPb.DeadlockRequestType_Detect:
 		err := ds.Detector.Detect(req.Entry.Txn, req.Entry.WaitForTxn, req.Entry.KeyHash)
 		if err != nil {
+			log.Info("deadlock detected", zap.Uint64("txn", req.Entry.Txn), zap.Any("wait chain", err.WaitChain))
 			resp := convertErrToResp(err, req.Entry.Txn, req.Entry.WaitForTxn, req.Entry.KeyHash)
 			return resp
 		}
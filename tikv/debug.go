@@ -0,0 +1,304 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/ngaut/unistore/tikv/dbreader"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/debugpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The debug service of TiKV used by tikv-ctl and the diagnostics of TiDB. The data of unistore is in a single
+// badger DB plus the lock store instead of the column families of RocksDB, the "lock" CF maps to the lock store
+// and the "default" and "write" CFs map to the committed versions in badger. There is no raft engine to inspect.
+
+func debugNotSupported(method string) error {
+	return status.Errorf(codes.Unimplemented, "%s is not supported by unistore", method)
+}
+
+// Get returns the value of the raw key in the CF, the latest committed value for the "default" and "write" CFs.
+func (svr *Server) Get(ctx context.Context, req *debugpb.GetRequest) (*debugpb.GetResponse, error) {
+	if req.GetDb() != debugpb.DB_KV {
+		return nil, debugNotSupported("raft DB")
+	}
+	store := svr.mvccStore
+	switch req.GetCf() {
+	case "lock":
+		val := store.lockStore.Get(req.GetKey(), nil)
+		if len(val) == 0 {
+			return nil, status.Errorf(codes.NotFound, "lock of key %q not found", req.GetKey())
+		}
+		return &debugpb.GetResponse{Value: val}, nil
+	case "", "default", "write":
+		txn := store.db.NewTransaction(false)
+		defer txn.Discard()
+		txn.SetReadTS(maxSystemTS)
+		item, err := txn.Get(req.GetKey())
+		if err == badger.ErrKeyNotFound {
+			return nil, status.Errorf(codes.NotFound, "key %q not found", req.GetKey())
+		}
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		val, err := item.Value()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if val, err = store.decodeValue(val); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &debugpb.GetResponse{Value: val}, nil
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "invalid CF %s", req.GetCf())
+}
+
+func (svr *Server) RaftLog(context.Context, *debugpb.RaftLogRequest) (*debugpb.RaftLogResponse, error) {
+	return nil, debugNotSupported("RaftLog")
+}
+
+// RegionInfo returns the local state of the region, the raft states are not reported.
+func (svr *Server) RegionInfo(ctx context.Context, req *debugpb.RegionInfoRequest) (*debugpb.RegionInfoResponse, error) {
+	regCtx, err := svr.debugRegion(req.GetRegionId())
+	if err != nil {
+		return nil, err
+	}
+	region := proto.Clone(regCtx.meta).(*metapb.Region)
+	region.RegionEpoch = regCtx.getRegionEpoch()
+	return &debugpb.RegionInfoResponse{
+		RegionLocalState: &raft_serverpb.RegionLocalState{
+			State:  raft_serverpb.PeerState_Normal,
+			Region: region,
+		},
+	}, nil
+}
+
+// RegionSize returns the size of the region in the CFs. The approximate size of the data is reported in the
+// "write" CF, where TiKV stores the short values, and the size of the locks in the "lock" CF.
+func (svr *Server) RegionSize(ctx context.Context, req *debugpb.RegionSizeRequest) (*debugpb.RegionSizeResponse, error) {
+	regCtx, err := svr.debugRegion(req.GetRegionId())
+	if err != nil {
+		return nil, err
+	}
+	cfs := req.GetCfs()
+	if len(cfs) == 0 {
+		cfs = []string{"default", "write", "lock"}
+	}
+	resp := &debugpb.RegionSizeResponse{}
+	for _, cf := range cfs {
+		var size int64
+		switch cf {
+		case "default":
+			// The values are stored with the versions.
+		case "write":
+			size = regCtx.approximateSize + atomic.LoadInt64(&regCtx.diff)
+		case "lock":
+			it := svr.mvccStore.lockStore.NewIterator()
+			for it.Seek(regCtx.startKey); it.Valid() && !exceedEndKey(it.Key(), regCtx.endKey); it.Next() {
+				size += int64(len(it.Key()) + len(it.Value()))
+			}
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "invalid CF %s", cf)
+		}
+		if size < 0 {
+			size = 0
+		}
+		resp.Entries = append(resp.Entries, &debugpb.RegionSizeResponse_Entry{Cf: cf, Size_: uint64(size)})
+	}
+	return resp, nil
+}
+
+// ScanMvcc sends the MVCC info of the keys in [from_key, to_key) in order, at most limit keys if it's not 0.
+func (svr *Server) ScanMvcc(req *debugpb.ScanMvccRequest, stream debugpb.Debug_ScanMvccServer) error {
+	from, to := req.GetFromKey(), req.GetToKey()
+	var regions []*regionCtx
+	svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+		if !regCtx.greaterEqualEndKey(from) && !exceedEndKey(regCtx.startKey, to) {
+			regions = append(regions, regCtx)
+		}
+	})
+	sort.Slice(regions, func(i, j int) bool {
+		return bytes.Compare(regions[i].startKey, regions[j].startKey) < 0
+	})
+	remain := int(req.GetLimit())
+	for _, regCtx := range regions {
+		sent, err := svr.scanRegionMvcc(stream, regCtx, from, to, remain)
+		if err != nil {
+			return err
+		}
+		if remain > 0 {
+			if remain -= sent; remain == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// scanRegionMvcc sends the MVCC info of the keys of the region in [from, to), at most limit keys if it's not 0.
+func (svr *Server) scanRegionMvcc(stream debugpb.Debug_ScanMvccServer, regCtx *regionCtx, from, to []byte,
+	limit int) (int, error) {
+	if bytes.Compare(from, regCtx.startKey) < 0 {
+		from = regCtx.startKey
+	}
+	if len(to) == 0 || bytes.Compare(regCtx.endKey, to) < 0 {
+		to = regCtx.endKey
+	}
+	reqCtx, err := newRequestCtx(stream.Context(), svr, svr.localRPCContext(regCtx), "ScanMvcc")
+	if err != nil {
+		return 0, err
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return 0, errors.New(reqCtx.regErr.String())
+	}
+	if regErr := reqCtx.acquireReaderSlot(); regErr != nil {
+		return 0, errors.New(regErr.String())
+	}
+	// The keys with only locks have no version in badger, the keys of both are merged.
+	var dataKeys, lockKeys [][]byte
+	iter := dbreader.NewIterator(reqCtx.getDBReader().GetTxn(), false, from, to)
+	defer iter.Close()
+	for iter.Seek(from); iter.Valid() && (limit == 0 || len(dataKeys) < limit); iter.Next() {
+		if item := iter.Item(); !isExtraTxnStatusItem(item) {
+			dataKeys = append(dataKeys, safeCopy(item.Key()))
+		}
+	}
+	it := svr.mvccStore.lockStore.NewIterator()
+	for it.Seek(from); it.Valid() && !exceedEndKey(it.Key(), to) && (limit == 0 || len(lockKeys) < limit); it.Next() {
+		lockKeys = append(lockKeys, safeCopy(it.Key()))
+	}
+	keys := mergeSortedKeys(dataKeys, lockKeys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	for _, key := range keys {
+		info, err := svr.mvccStore.MvccGetByKey(reqCtx, key)
+		if err != nil {
+			return 0, err
+		}
+		if err = stream.Send(&debugpb.ScanMvccResponse{Key: key, Info: info}); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+	return len(keys), nil
+}
+
+// mergeSortedKeys merges two sorted key lists, the duplicated keys are kept once.
+func mergeSortedKeys(a, b [][]byte) [][]byte {
+	merged := make([][]byte, 0, len(a)+len(b))
+	for len(a) > 0 || len(b) > 0 {
+		var cmp int
+		switch {
+		case len(a) == 0:
+			cmp = 1
+		case len(b) == 0:
+			cmp = -1
+		default:
+			cmp = bytes.Compare(a[0], b[0])
+		}
+		if cmp <= 0 {
+			merged = append(merged, a[0])
+			a = a[1:]
+			if cmp == 0 {
+				b = b[1:]
+			}
+		} else {
+			merged = append(merged, b[0])
+			b = b[1:]
+		}
+	}
+	return merged
+}
+
+// Compact is not supported, badger compacts the LSM tree in the background and has no manual compaction.
+func (svr *Server) Compact(ctx context.Context, req *debugpb.CompactRequest) (*debugpb.CompactResponse, error) {
+	return nil, debugNotSupported("manual compaction")
+}
+
+func (svr *Server) InjectFailPoint(context.Context, *debugpb.InjectFailPointRequest) (*debugpb.InjectFailPointResponse, error) {
+	return nil, debugNotSupported("InjectFailPoint")
+}
+
+func (svr *Server) RecoverFailPoint(context.Context, *debugpb.RecoverFailPointRequest) (*debugpb.RecoverFailPointResponse, error) {
+	return nil, debugNotSupported("RecoverFailPoint")
+}
+
+func (svr *Server) ListFailPoints(context.Context, *debugpb.ListFailPointsRequest) (*debugpb.ListFailPointsResponse, error) {
+	return nil, debugNotSupported("ListFailPoints")
+}
+
+// GetMetrics returns the prometheus metrics of the server in the text format.
+func (svr *Server) GetMetrics(ctx context.Context, req *debugpb.GetMetricsRequest) (*debugpb.GetMetricsResponse, error) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	var buf strings.Builder
+	for _, family := range families {
+		if _, err = expfmt.MetricFamilyToText(&buf, family); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	_, storeID, _ := svr.regionManager.GetStoreInfoFromCtx(&kvrpcpb.Context{})
+	return &debugpb.GetMetricsResponse{Prometheus: buf.String(), StoreId: storeID}, nil
+}
+
+func (svr *Server) CheckRegionConsistency(context.Context, *debugpb.RegionConsistencyCheckRequest) (*debugpb.RegionConsistencyCheckResponse, error) {
+	return nil, debugNotSupported("CheckRegionConsistency")
+}
+
+func (svr *Server) ModifyTikvConfig(context.Context, *debugpb.ModifyTikvConfigRequest) (*debugpb.ModifyTikvConfigResponse, error) {
+	return nil, debugNotSupported("ModifyTikvConfig")
+}
+
+func (svr *Server) GetRegionProperties(context.Context, *debugpb.GetRegionPropertiesRequest) (*debugpb.GetRegionPropertiesResponse, error) {
+	return nil, debugNotSupported("GetRegionProperties")
+}
+
+func (svr *Server) GetStoreInfo(context.Context, *debugpb.GetStoreInfoRequest) (*debugpb.GetStoreInfoResponse, error) {
+	_, storeID, _ := svr.regionManager.GetStoreInfoFromCtx(&kvrpcpb.Context{})
+	return &debugpb.GetStoreInfoResponse{StoreId: storeID}, nil
+}
+
+func (svr *Server) GetClusterInfo(context.Context, *debugpb.GetClusterInfoRequest) (*debugpb.GetClusterInfoResponse, error) {
+	return nil, debugNotSupported("GetClusterInfo")
+}
+
+func (svr *Server) debugRegion(regionID uint64) (*regionCtx, error) {
+	var found *regionCtx
+	svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+		if regCtx.meta.Id == regionID {
+			found = regCtx
+		}
+	})
+	if found == nil {
+		return nil, status.Errorf(codes.NotFound, "region %d not found", regionID)
+	}
+	return found, nil
+}
@@ -30,6 +30,7 @@ import (
 	"sync"
 	"time"
 
+	deadlockPb "github.com/pingcap/kvproto/pkg/deadlock"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
 )
@@ -74,20 +75,31 @@ func NewDetector(ttl time.Duration, urgentSize uint64, expireInterval time.Durat
 	}
 }
 
-// Detect detects deadlock for the sourceTxn on a locked key.
+// Detect detects deadlock for the sourceTxn on a locked key, the returned error has the wait chain of the cycle.
 func (d *Detector) Detect(sourceTxn, waitForTxn, keyHash uint64) *ErrDeadlock {
 	d.lock.Lock()
 	nowTime := time.Now()
 	d.activeExpire(nowTime)
-	err := d.doDetect(nowTime, sourceTxn, waitForTxn)
-	if err == nil {
+	var err *ErrDeadlock
+	if chain := d.doDetect(nowTime, sourceTxn, waitForTxn, map[uint64]struct{}{}); chain != nil {
+		err = &ErrDeadlock{
+			DeadlockKeyHash: chain[len(chain)-1].KeyHash,
+			WaitChain:       append(chain, &deadlockPb.WaitForEntry{Txn: sourceTxn, WaitForTxn: waitForTxn, KeyHash: keyHash}),
+		}
+	} else {
 		d.register(sourceTxn, waitForTxn, keyHash)
 	}
 	d.lock.Unlock()
 	return err
 }
 
-func (d *Detector) doDetect(nowTime time.Time, sourceTxn, waitForTxn uint64) *ErrDeadlock {
+// doDetect returns the wait-for edges from waitForTxn to sourceTxn, or nil if sourceTxn is not reachable.
+// The visited transactions are skipped, so every edge is checked at most once.
+func (d *Detector) doDetect(nowTime time.Time, sourceTxn, waitForTxn uint64, visited map[uint64]struct{}) []*deadlockPb.WaitForEntry {
+	if _, ok := visited[waitForTxn]; ok {
+		return nil
+	}
+	visited[waitForTxn] = struct{}{}
 	val := d.waitForMap[waitForTxn]
 	if val == nil {
 		return nil
@@ -102,11 +114,12 @@ func (d *Detector) doDetect(nowTime time.Time, sourceTxn, waitForTxn uint64) *Er
 			d.totalSize--
 			continue
 		}
+		entry := &deadlockPb.WaitForEntry{Txn: waitForTxn, WaitForTxn: keyHashPair.txn, KeyHash: keyHashPair.keyHash}
 		if keyHashPair.txn == sourceTxn {
-			return &ErrDeadlock{DeadlockKeyHash: keyHashPair.keyHash}
+			return []*deadlockPb.WaitForEntry{entry}
 		}
-		if err := d.doDetect(nowTime, sourceTxn, keyHashPair.txn); err != nil {
-			return err
+		if chain := d.doDetect(nowTime, sourceTxn, keyHashPair.txn, visited); chain != nil {
+			return append([]*deadlockPb.WaitForEntry{entry}, chain...)
 		}
 	}
 	if val.txns.Len() == 0 {
@@ -55,6 +55,13 @@ func (s *testDeadlockSuite) TestDeadlock(c *C) {
 	err = detector.Detect(3, 1, 300)
 	c.Assert(err, NotNil)
 	c.Assert(err.Error(), Equals, fmt.Sprintf("deadlock"))
+	c.Assert(err.DeadlockKeyHash, Equals, uint64(200))
+	c.Assert(err.WaitChain, HasLen, 3)
+	for i, entry := range []struct{ txn, waitForTxn, keyHash uint64 }{{1, 2, 100}, {2, 3, 200}, {3, 1, 300}} {
+		c.Assert(err.WaitChain[i].Txn, Equals, entry.txn)
+		c.Assert(err.WaitChain[i].WaitForTxn, Equals, entry.waitForTxn)
+		c.Assert(err.WaitChain[i].KeyHash, Equals, entry.keyHash)
+	}
 	c.Assert(detector.totalSize, Equals, uint64(2))
 	detector.CleanUp(2)
 	list2 := detector.waitForMap[2]
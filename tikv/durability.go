@@ -0,0 +1,74 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// runPeriodicSync syncs the value logs of the kv and raft engines and the lock WAL every interval in the periodic
+// durability, the writes are not synced in this mode.
+func (store *MVCCStore) runPeriodicSync(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-store.closeCh:
+			return
+		case <-ticker.C:
+		}
+		for _, subPath := range []string{"kv", "raft"} {
+			if err := syncValueLogs(filepath.Join(store.dir, subPath)); err != nil {
+				log.Warn("sync value logs failed", zap.String("path", subPath), zap.Error(err))
+			}
+		}
+		if err := syncFile(filepath.Join(store.dir, LockWALFile)); err != nil {
+			log.Warn("sync lock WAL failed", zap.Error(err))
+		}
+	}
+}
+
+// syncValueLogs flushes the value log files in dir to the disk, the engine of the files may not exist.
+func syncValueLogs(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.vlog"))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for _, file := range files {
+		if err = syncFile(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncFile flushes the file to the disk, it's skipped if the file doesn't exist, e.g. removed by the value log GC.
+func syncFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = f.Sync()
+	f.Close()
+	return errors.Trace(err)
+}
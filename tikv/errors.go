@@ -14,9 +14,11 @@
 package tikv
 
 import (
+	"errors"
 	"fmt"
 
 	"github.com/ngaut/unistore/tikv/mvcc"
+	deadlockPb "github.com/pingcap/kvproto/pkg/deadlock"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 )
 
@@ -56,8 +58,19 @@ var (
 	ErrLockNotFound    = ErrRetryable("lock not found")
 	ErrAlreadyRollback = ErrRetryable("already rollback")
 	ErrReplaced        = ErrRetryable("replaced by another transaction")
+	ErrLockChanged     = ErrRetryable("lock changed")
+	ErrRegionReadOnly  = ErrRetryable("region is read-only")
+	ErrGCPaused        = ErrRetryable("GC is paused")
+	ErrTooManyLocks    = ErrRetryable("too many locks in region")
 )
 
+// ErrRequestCanceled is returned when the request is cancelled by Server.CancelRequest.
+var ErrRequestCanceled = errors.New("request is cancelled")
+
+// ErrMaxExecutionTimeExceeded is returned when the request runs longer than the max execution duration in its
+// context.
+var ErrMaxExecutionTimeExceeded = errors.New("max execution time exceeded")
+
 type ErrInvalidOp struct {
 	op kvrpcpb.Op
 }
@@ -87,6 +100,8 @@ type ErrDeadlock struct {
 	LockKey         []byte
 	LockTS          uint64
 	DeadlockKeyHash uint64
+	// WaitChain is the wait-for edges forming the cycle, the last one is the edge being detected.
+	WaitChain []*deadlockPb.WaitForEntry
 }
 
 func (e ErrDeadlock) Error() string {
@@ -125,3 +140,14 @@ type ErrTxnNotFound struct {
 func (e *ErrTxnNotFound) Error() string {
 	return "txn not found"
 }
+
+// ErrGCTooEarly is returned when the read ts is older than the GC safe point, the versions visible
+// to the read may have been collected.
+type ErrGCTooEarly struct {
+	ReadTS    uint64
+	SafePoint uint64
+}
+
+func (e *ErrGCTooEarly) Error() string {
+	return fmt.Sprintf("GC too early, read ts %d is older than safe point %d", e.ReadTS, e.SafePoint)
+}
@@ -0,0 +1,120 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/unistore/config"
+	"github.com/ngaut/unistore/metrics"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+)
+
+// flowController wraps the DBWriter of the store to measure how far the engine falls behind, like the flow
+// control of TiKV. Badger blocks the writes when the memtables can't be flushed or there are too many level 0
+// tables, so a stall shows up as slow writes. New writes are rejected with ServerIsBusy while the engine is
+// stalled or too many writes are pending, the clients back off and retry.
+type flowController struct {
+	mvcc.DBWriter
+	// stallThreshold is the write duration in nanoseconds considered as a stall, 0 disables the stall check.
+	// It's changed by the config reload, so is maxPending.
+	stallThreshold int64
+	// maxPending is the max number of pending writes, 0 disables the limit.
+	maxPending int32
+
+	pending int32
+	// latency is the moving average of the write durations in nanoseconds.
+	latency int64
+	// lastWrite is the unix nano time the last write finished.
+	lastWrite int64
+}
+
+func newFlowController(writer mvcc.DBWriter, conf config.Server) *flowController {
+	fc := &flowController{DBWriter: writer}
+	fc.setLimits(conf)
+	return fc
+}
+
+func (fc *flowController) setLimits(conf config.Server) {
+	atomic.StoreInt64(&fc.stallThreshold, int64(config.ParseDuration(conf.WriteStallThreshold)))
+	atomic.StoreInt32(&fc.maxPending, int32(conf.MaxPendingWrites))
+}
+
+func (fc *flowController) Write(batch mvcc.WriteBatch) error {
+	atomic.AddInt32(&fc.pending, 1)
+	defer atomic.AddInt32(&fc.pending, -1)
+	start := time.Now()
+	err := fc.DBWriter.Write(batch)
+	fc.observe(start)
+	return err
+}
+
+func (fc *flowController) DeleteRange(start, end []byte, latchHandle mvcc.LatchHandle) error {
+	atomic.AddInt32(&fc.pending, 1)
+	defer atomic.AddInt32(&fc.pending, -1)
+	startTime := time.Now()
+	err := fc.DBWriter.DeleteRange(start, end, latchHandle)
+	fc.observe(startTime)
+	return err
+}
+
+// observe updates the moving average with the duration of a write started at start, a sample weighs 1/8.
+func (fc *flowController) observe(start time.Time) {
+	now := time.Now()
+	dur := int64(now.Sub(start))
+	for {
+		old := atomic.LoadInt64(&fc.latency)
+		if atomic.CompareAndSwapInt64(&fc.latency, old, old-old/8+dur/8) {
+			break
+		}
+	}
+	atomic.StoreInt64(&fc.lastWrite, now.UnixNano())
+}
+
+// check returns a ServerIsBusy error if a new write should be rejected. The backoff grows with the number
+// of pending writes and how slow the writes are.
+func (fc *flowController) check() *errorpb.Error {
+	pending := int(atomic.LoadInt32(&fc.pending))
+	if maxPending := int(atomic.LoadInt32(&fc.maxPending)); maxPending > 0 && pending >= maxPending {
+		metrics.FlowControlRejects.WithLabelValues("pending_writes").Inc()
+		return newServerIsBusyErr("too many pending writes", pending)
+	}
+	stallThreshold := time.Duration(atomic.LoadInt64(&fc.stallThreshold))
+	if stallThreshold <= 0 {
+		return nil
+	}
+	latency := time.Duration(atomic.LoadInt64(&fc.latency))
+	if latency <= stallThreshold {
+		return nil
+	}
+	// The average is only updated by the finished writes, if none finished recently it's stale and the write
+	// is let through to measure the engine again.
+	if time.Since(time.Unix(0, atomic.LoadInt64(&fc.lastWrite))) > stallThreshold {
+		return nil
+	}
+	metrics.FlowControlRejects.WithLabelValues("write_stall").Inc()
+	return newServerIsBusyErr("engine write stall", pending+int(latency/stallThreshold))
+}
+
+// checkFlowControl returns a ServerIsBusy error if the engine of the store falls behind the writes.
+func (req *requestCtx) checkFlowControl() *errorpb.Error {
+	if fc := req.svr.mvccStore.flowController; fc != nil {
+		if regErr := fc.check(); regErr != nil {
+			return regErr
+		}
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ngaut/unistore/metrics"
+	"github.com/ngaut/unistore/tikv/dbreader"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// The GCCompactionFilter drops the stale data only when badger compacts the tables holding it, which may take a
+// long time for the cold data. The background GC worker scans the data when the safe point is advanced, and
+// writes the tombstones that hide the same data the compaction filter would drop, so the reads skip it and the
+// next compaction discards it.
+
+// gcDataRanges are the ranges of the data keys and their txn status keys, the internal keys are not collected.
+var gcDataRanges = [][2][]byte{
+	{[]byte{metaPrefix}, []byte{metaExtraPrefix + 1}},
+	{[]byte{tablePrefix}, []byte{tableExtraPrefix + 1}},
+}
+
+type gcWorker struct {
+	store    *MVCCStore
+	notifyCh chan struct{}
+	limiter  *byteLimiter
+	wg       sync.WaitGroup
+	// safePoint is the safe point of the last finished round.
+	safePoint uint64
+}
+
+func newGCWorker(store *MVCCStore) *gcWorker {
+	return &gcWorker{
+		store:    store,
+		notifyCh: make(chan struct{}, 1),
+		limiter:  newByteLimiter(store.conf.GC.MaxWriteBytesPerSec),
+	}
+}
+
+func (w *gcWorker) start() {
+	w.wg.Add(1)
+	go w.run()
+}
+
+// notify wakes up the worker after the safe point is advanced, it never blocks.
+func (w *gcWorker) notify() {
+	select {
+	case w.notifyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (w *gcWorker) run() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.store.closeCh:
+			return
+		case <-w.notifyCh:
+		}
+		// The smallest of the keyspace safe points is used, so no keyspace loses the data it still needs.
+		safePoint := w.store.safePoint.minTS()
+		if safePoint <= w.finishedSafePoint() {
+			continue
+		}
+		if err := w.gc(safePoint); err != nil {
+			log.Warn("background GC stopped", zap.Uint64("safePoint", safePoint), zap.Error(err))
+			continue
+		}
+		atomic.StoreUint64(&w.safePoint, safePoint)
+		metrics.GCSafePoint.Set(float64(safePoint))
+	}
+}
+
+func (w *gcWorker) finishedSafePoint() uint64 {
+	return atomic.LoadUint64(&w.safePoint)
+}
+
+// errGCWorkerClosed stops the GC round when the store is closed.
+var errGCWorkerClosed = errors.New("GC worker is closed")
+
+func (w *gcWorker) gc(safePoint uint64) error {
+	var keys, tombstones int
+	for _, r := range gcDataRanges {
+		startKey := r[0]
+		for startKey != nil {
+			select {
+			case <-w.store.closeCh:
+				return errGCWorkerClosed
+			default:
+			}
+			// The round is abandoned while GC is paused, it's restarted by the next safe point.
+			if w.store.IsGCPaused() {
+				return ErrGCPaused
+			}
+			entries, scanned, nextKey := w.collectBatch(startKey, r[1], safePoint)
+			if err := w.write(entries); err != nil {
+				return err
+			}
+			keys += scanned
+			tombstones += len(entries)
+			metrics.GCScannedKeys.Add(float64(scanned))
+			metrics.GCTombstones.Add(float64(len(entries)))
+			startKey = nextKey
+		}
+	}
+	log.Info("background GC finished", zap.Uint64("safePoint", safePoint),
+		zap.Int("keys", keys), zap.Int("tombstones", tombstones))
+	return nil
+}
+
+// collectBatch scans at most batch-keys keys from startKey and returns the tombstones of their stale data, and
+// the key to resume the scan, which is nil if the range is exhausted. The versions of a key are iterated from
+// the newest, a tombstone at a version hides it and all the older versions.
+func (w *gcWorker) collectBatch(startKey, endKey []byte, safePoint uint64) (entries []*badger.Entry, scanned int, nextKey []byte) {
+	batchKeys := w.store.conf.GC.BatchKeys
+	if batchKeys <= 0 {
+		batchKeys = 512
+	}
+	txn := w.store.db.NewTransaction(false)
+	defer txn.Discard()
+	iter := dbreader.NewIterator(txn, false, startKey, endKey)
+	defer iter.Close()
+	iter.SetAllVersions(true)
+	var curKey []byte
+	// done is true if the older versions of curKey need no tombstone.
+	var done, hasBase bool
+	for iter.Seek(startKey); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		key := item.Key()
+		if !bytes.Equal(key, curKey) {
+			if scanned == batchKeys {
+				return entries, scanned, safeCopy(key)
+			}
+			scanned++
+			curKey = safeCopy(key)
+			done, hasBase = false, false
+		}
+		if done || item.Version() > safePoint {
+			continue
+		}
+		// A delete written by GC or DeleteRange has no user meta, the older versions are already hidden.
+		if len(item.UserMeta()) == 0 {
+			done = true
+			continue
+		}
+		userMeta := mvcc.DBUserMeta(item.UserMeta())
+		if isExtraTxnStatusItem(item) {
+			// The rollback and Op_Lock records are dropped like the compaction filter does.
+			if userMeta.StartTS() < safePoint {
+				entries = append(entries, newTombstone(curKey, item.Version()))
+			}
+			continue
+		}
+		if hasBase {
+			// The versions older than the latest version before the safe point are never read.
+			entries = append(entries, newTombstone(curKey, item.Version()))
+			done = true
+			continue
+		}
+		if userMeta.CommitTS() < safePoint && item.ValueSize() == 0 {
+			// The latest version before the safe point is a delete, the key doesn't exist at the safe point.
+			entries = append(entries, newTombstone(curKey, item.Version()))
+			done = true
+			continue
+		}
+		hasBase = true
+	}
+	return entries, scanned, nil
+}
+
+func (w *gcWorker) write(entries []*badger.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	var size int
+	for _, e := range entries {
+		size += len(e.Key.UserKey) + 8
+	}
+	if err := w.limiter.wait(context.Background(), size); err != nil {
+		return errors.Trace(err)
+	}
+	// The tombstones are at versions before the safe point, which the transactions never write, so they don't
+	// need latches.
+	return w.store.writeTombstones(entries)
+}
@@ -0,0 +1,205 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"golang.org/x/time/rate"
+)
+
+// The imported mutations are written as committed versions directly, bypassing the two-phase commit. They are
+// written in batches of import-batch-size keys, and the writes are throttled by import-rate-limit.
+
+// ErrInvalidImportTS is returned when the commit version of an import is 0.
+var ErrInvalidImportTS = errors.New("commit version of import must be greater than 0")
+
+// Import writes the mutations of the region as committed at commitTS. The keys must not be locked, Put and Insert
+// write the values, Del deletes the keys. The batches written before an error are not rolled back.
+func (store *MVCCStore) Import(reqCtx *requestCtx, mutations []*kvrpcpb.Mutation, commitTS uint64) error {
+	if commitTS == 0 {
+		return ErrInvalidImportTS
+	}
+	for _, m := range mutations {
+		switch m.Op {
+		case kvrpcpb.Op_Put, kvrpcpb.Op_Insert, kvrpcpb.Op_Del:
+		default:
+			return errors.Errorf("unsupported import op %v of key %q", m.Op, m.Key)
+		}
+		if err := checkKeysInRegion(reqCtx.regCtx, m.Key); err != nil {
+			return err
+		}
+	}
+	store.updateLatestTS(commitTS)
+	batchSize := store.conf.Server.ImportBatchSize
+	if batchSize <= 0 {
+		batchSize = len(mutations)
+	}
+	for len(mutations) > 0 {
+		n := batchSize
+		if n > len(mutations) {
+			n = len(mutations)
+		}
+		if err := store.importBatch(reqCtx, mutations[:n], commitTS); err != nil {
+			return err
+		}
+		mutations = mutations[n:]
+	}
+	return nil
+}
+
+func (store *MVCCStore) importBatch(reqCtx *requestCtx, mutations []*kvrpcpb.Mutation, commitTS uint64) error {
+	var size int
+	keys := make([][]byte, 0, len(mutations))
+	for _, m := range mutations {
+		keys = append(keys, m.Key)
+		size += len(m.Key) + len(m.Value)
+	}
+	if err := store.waitImportQuota(reqCtx.ctx, size); err != nil {
+		return errors.Trace(err)
+	}
+	regCtx := reqCtx.regCtx
+	hashVals := keysToHashVals(keys...)
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+	reqCtx.trace("acquire latches")
+	if err := reqCtx.checkDeadline(); err != nil {
+		return err
+	}
+	var buf []byte
+	for _, key := range keys {
+		buf = store.lockStore.Get(key, buf)
+		if len(buf) > 0 {
+			lock := mvcc.DecodeLock(buf)
+			return BuildLockErr(safeCopy(key), &lock)
+		}
+	}
+	// The start ts only needs to be less than the commit ts, the imported versions have no locks.
+	batch := store.dbWriter.NewWriteBatch(commitTS-1, commitTS, reqCtx.rpcCtx)
+	var diff int
+	for _, m := range mutations {
+		lock := &mvcc.MvccLock{MvccLockHdr: mvcc.MvccLockHdr{StartTS: commitTS - 1, Op: uint8(kvrpcpb.Op_Del)}}
+		if m.Op != kvrpcpb.Op_Del {
+			lock.Op = uint8(kvrpcpb.Op_Put)
+			lock.Value = store.encodeValue(m.Value)
+		}
+		batch.Commit(m.Key, lock)
+		diff += len(m.Key) + len(lock.Value)
+	}
+	atomic.AddInt64(&regCtx.diff, int64(diff))
+	atomic.AddInt64(&regCtx.keysDiff, int64(len(mutations)))
+	return store.writeData(reqCtx, batch)
+}
+
+// waitImportQuota waits until size bytes can be imported without exceeding import-rate-limit.
+func (store *MVCCStore) waitImportQuota(ctx context.Context, size int) error {
+	return store.importLimiter.wait(ctx, size)
+}
+
+// byteLimiter limits the bytes written per second, the limit can be changed at runtime.
+type byteLimiter struct {
+	mu      sync.RWMutex
+	limiter *rate.Limiter
+}
+
+// newByteLimiter returns a limiter of limit bytes per second, 0 disables the limit.
+func newByteLimiter(limit int) *byteLimiter {
+	l := new(byteLimiter)
+	l.setLimit(limit)
+	return l
+}
+
+func (l *byteLimiter) setLimit(limit int) {
+	var limiter *rate.Limiter
+	if limit > 0 {
+		limiter = rate.NewLimiter(rate.Limit(limit), limit)
+	}
+	l.mu.Lock()
+	l.limiter = limiter
+	l.mu.Unlock()
+}
+
+func (l *byteLimiter) wait(ctx context.Context, size int) error {
+	l.mu.RLock()
+	limiter := l.limiter
+	l.mu.RUnlock()
+	return waitLimiter(ctx, limiter, size)
+}
+
+// waitLimiter waits until size bytes are allowed by the limiter, a nil limiter doesn't wait.
+func waitLimiter(ctx context.Context, limiter *rate.Limiter, size int) error {
+	if limiter == nil {
+		return nil
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	// WaitN fails if n exceeds the burst, so a large size waits in pieces.
+	for size > 0 {
+		n := size
+		if n > limiter.Burst() {
+			n = limiter.Burst()
+		}
+		if err := limiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+		size -= n
+	}
+	return nil
+}
+
+// importGroup is the mutations of an import in a region.
+type importGroup struct {
+	regCtx    *regionCtx
+	mutations []*kvrpcpb.Mutation
+}
+
+// groupImportMutations groups the mutations by the regions of this store, the order of the mutations of a key
+// is kept. An error is returned if a key is not in any region.
+func (svr *Server) groupImportMutations(mutations []*kvrpcpb.Mutation) ([]*importGroup, error) {
+	var regions []*regionCtx
+	svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+		regions = append(regions, regCtx)
+	})
+	sort.Slice(regions, func(i, j int) bool {
+		return bytes.Compare(regions[i].startKey, regions[j].startKey) < 0
+	})
+	sorted := append([]*kvrpcpb.Mutation{}, mutations...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Key, sorted[j].Key) < 0
+	})
+	var groups []*importGroup
+	var cur *importGroup
+	for _, m := range sorted {
+		if cur == nil || cur.regCtx.greaterEqualEndKey(m.Key) {
+			idx := sort.Search(len(regions), func(i int) bool {
+				return bytes.Compare(regions[i].startKey, m.Key) > 0
+			}) - 1
+			if idx < 0 || regions[idx].greaterEqualEndKey(m.Key) {
+				return nil, errors.Errorf("key %q is not in any region", m.Key)
+			}
+			cur = &importGroup{regCtx: regions[idx]}
+			groups = append(groups, cur)
+		}
+		cur.mutations = append(cur.mutations, m)
+	}
+	return groups, nil
+}
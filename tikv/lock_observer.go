@@ -0,0 +1,105 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sync"
+
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+)
+
+// The green GC of TiDB resolves the locks before the safe point by PhysicalScanLock, which doesn't block the
+// writes. A lock observer is registered with the safe point before the scan, and collects the locks written
+// during the scan so they are not missed.
+
+// maxObservedLocks is the max number of locks collected by the lock observer, the observer becomes dirty if more
+// locks are written, and the GC falls back to the scan lock of the regions.
+const maxObservedLocks = 1024
+
+// lockObserver collects the prewritten locks whose start ts is not greater than the max ts.
+type lockObserver struct {
+	mu sync.Mutex
+	// maxTS is 0 if the observer is not registered.
+	maxTS   uint64
+	locks   []*kvrpcpb.LockInfo
+	isDirty bool
+}
+
+// register starts collecting the locks for maxTS, the collected locks are kept if it's registered with the same
+// max ts again.
+func (o *lockObserver) register(maxTS uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.maxTS == maxTS {
+		return
+	}
+	o.maxTS = maxTS
+	o.locks = nil
+	o.isDirty = false
+}
+
+// check returns the collected locks, isClean is false if some locks are not collected.
+func (o *lockObserver) check(maxTS uint64) (locks []*kvrpcpb.LockInfo, isClean bool, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err = o.checkMaxTS(maxTS); err != nil {
+		return nil, false, err
+	}
+	return o.locks, !o.isDirty, nil
+}
+
+// remove stops collecting the locks.
+func (o *lockObserver) remove(maxTS uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.checkMaxTS(maxTS); err != nil {
+		return err
+	}
+	o.maxTS = 0
+	o.locks = nil
+	o.isDirty = false
+	return nil
+}
+
+func (o *lockObserver) checkMaxTS(maxTS uint64) error {
+	if o.maxTS == 0 {
+		return errors.New("lock observer is not registered")
+	}
+	if o.maxTS != maxTS {
+		return errors.Errorf("lock observer is registered with max ts %d, not %d", o.maxTS, maxTS)
+	}
+	return nil
+}
+
+// observe collects the written locks, the pessimistic locks are skipped because they don't block the reads.
+func (o *lockObserver) observe(keys [][]byte, locks []*mvcc.MvccLock) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.maxTS == 0 || o.isDirty {
+		return
+	}
+	for i, lock := range locks {
+		if lock == nil || lock.StartTS > o.maxTS || lock.Op == uint8(kvrpcpb.Op_PessimisticLock) {
+			continue
+		}
+		if len(o.locks) == maxObservedLocks {
+			o.locks = nil
+			o.isDirty = true
+			return
+		}
+		o.locks = append(o.locks, lock.ToLockInfo(safeCopy(keys[i])))
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ngaut/unistore/lockstore"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// LockWALFile is the file in the data directory the lock mutations are logged to without raft.
+const LockWALFile = "lock_wal"
+
+// lockWALCheckpointSize is the size of the lock WAL the locks are dumped at, the log is truncated after the dump.
+const lockWALCheckpointSize = 64 << 20
+
+// The record of a lock mutation is crc32 (4 bytes) | delete (1 byte) | key len (4 bytes) | value len (4 bytes) |
+// key | value, the crc covers everything after it.
+const lockWALHeaderSize = 13
+
+// LockWAL logs the mutations of the lock store without raft. The lock store is memory resident, it's rebuilt on
+// restart from the lock dump and the mutations logged after the dump.
+//
+// The data of a commit is written to the DB before the lock is deleted, a crash between them leaves the lock of a
+// committed transaction, it's resolved with the commit record like the lock of a crashed client.
+type LockWAL struct {
+	dir  string
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+	sync bool
+}
+
+// RecoverLockStore loads the lock dump in dir to ls and replays the lock WAL on it, then checkpoints the locks
+// and returns the lock WAL for the writer. The raft mode restores the lock store from the raft logs instead.
+func RecoverLockStore(dir string, ls *lockstore.MemStore, sync bool) (*LockWAL, error) {
+	err := ReadLockDump(filepath.Join(dir, LockDumpFile), func(key, val []byte) error {
+		ls.Put(key, val)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, LockWALFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cnt, err := replayLockWAL(f, ls)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	wal := &LockWAL{dir: dir, f: f, w: bufio.NewWriter(f), sync: sync}
+	if err = wal.checkpoint(ls); err != nil {
+		f.Close()
+		return nil, err
+	}
+	log.Info("lock store recovered", zap.Int("locks", ls.Len()), zap.Int("replayed mutations", cnt))
+	return wal, nil
+}
+
+// replayLockWAL applies the mutations in the lock WAL to ls. The records after a broken one are the tail of a
+// write interrupted by a crash, they were never acknowledged and are ignored.
+func replayLockWAL(f *os.File, ls *lockstore.MemStore) (int, error) {
+	reader := bufio.NewReader(f)
+	hdr := make([]byte, lockWALHeaderSize)
+	var cnt int
+	for {
+		if _, err := io.ReadFull(reader, hdr); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return cnt, nil
+			}
+			return cnt, errors.Trace(err)
+		}
+		keyLen := binary.LittleEndian.Uint32(hdr[5:])
+		valLen := binary.LittleEndian.Uint32(hdr[9:])
+		entry := make([]byte, keyLen+valLen)
+		if _, err := io.ReadFull(reader, entry); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return cnt, nil
+			}
+			return cnt, errors.Trace(err)
+		}
+		crc := crc32.Update(crc32.ChecksumIEEE(hdr[4:]), crc32.IEEETable, entry)
+		if crc != binary.LittleEndian.Uint32(hdr) {
+			log.Warn("broken lock WAL record, the rest of the log is ignored", zap.Int("replayed mutations", cnt))
+			return cnt, nil
+		}
+		if hdr[4] == 1 {
+			ls.Delete(entry[:keyLen])
+		} else {
+			ls.Put(entry[:keyLen], entry[keyLen:])
+		}
+		cnt++
+	}
+}
+
+// log appends the mutations of the batches to the WAL, they're synced if the engine syncs every write.
+func (wal *LockWAL) log(batches []*writeLockBatch) error {
+	offset := wal.size
+	err := wal.append(batches)
+	if err == nil {
+		return nil
+	}
+	// The batches fail, a partial flush may have written complete records of them which would be replayed, so the
+	// WAL is truncated back and the error kept by the buffered writer is dropped.
+	if terr := wal.f.Truncate(offset); terr != nil {
+		log.Fatal("truncate lock WAL failed", zap.Error(terr), zap.NamedError("write error", err))
+	}
+	wal.size = offset
+	wal.w.Reset(wal.f)
+	return err
+}
+
+func (wal *LockWAL) append(batches []*writeLockBatch) error {
+	hdr := make([]byte, lockWALHeaderSize)
+	for _, batch := range batches {
+		for _, entry := range batch.entries {
+			hdr[4] = 0
+			if entry.UserMeta[0] == mvcc.LockUserMetaDeleteByte {
+				hdr[4] = 1
+			}
+			key := entry.Key.UserKey
+			binary.LittleEndian.PutUint32(hdr[5:], uint32(len(key)))
+			binary.LittleEndian.PutUint32(hdr[9:], uint32(len(entry.Value)))
+			crc := crc32.Update(crc32.ChecksumIEEE(hdr[4:]), crc32.IEEETable, key)
+			binary.LittleEndian.PutUint32(hdr, crc32.Update(crc, crc32.IEEETable, entry.Value))
+			wal.w.Write(hdr)
+			wal.w.Write(key)
+			wal.w.Write(entry.Value)
+			wal.size += int64(lockWALHeaderSize + len(key) + len(entry.Value))
+		}
+	}
+	if err := wal.w.Flush(); err != nil {
+		return errors.Trace(err)
+	}
+	if wal.sync {
+		return errors.Trace(wal.f.Sync())
+	}
+	return nil
+}
+
+// checkpoint dumps the locks and truncates the WAL. It must not run with the writes of the lock store, a crash
+// after the dump replays the mutations in the WAL again, the last mutation of a key wins so the result is the same.
+func (wal *LockWAL) checkpoint(ls *lockstore.MemStore) error {
+	if err := dumpLocks(ls, wal.dir); err != nil {
+		return err
+	}
+	if err := wal.f.Truncate(0); err != nil {
+		return errors.Trace(err)
+	}
+	wal.size = 0
+	return nil
+}
+
+// close checkpoints the locks so the restart doesn't replay the WAL, and closes the WAL.
+func (wal *LockWAL) close(ls *lockstore.MemStore) {
+	if err := wal.checkpoint(ls); err != nil {
+		log.Error("checkpoint locks failed", zap.Error(err))
+	}
+	wal.f.Close()
+}
@@ -2,6 +2,7 @@ package tikv
 
 import (
 	"bytes"
+	"fmt"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -18,11 +19,13 @@ import (
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/store/mockstore/unistore/cophandler"
 	"github.com/pingcap/tidb/tablecodec"
 	"github.com/pingcap/tidb/util/codec"
 	pdclient "github.com/tikv/pd/client"
+	"go.uber.org/zap"
 	"golang.org/x/net/context"
 )
 
@@ -144,6 +147,9 @@ func (rm *MockRegionManager) GetRegionFromCtx(ctx *kvrpcpb.Context) (*regionCtx,
 	ri := rm.regions[ctx.RegionId]
 	rm.mu.RUnlock()
 	if ri == nil {
+		if regErr := rm.mergedRegionError(ctx.RegionId); regErr != nil {
+			return nil, regErr
+		}
 		return nil, &errorpb.Error{
 			Message: "region not found",
 			RegionNotFound: &errorpb.RegionNotFound{
@@ -166,9 +172,33 @@ func (rm *MockRegionManager) GetRegionFromCtx(ctx *kvrpcpb.Context) (*regionCtx,
 			},
 		}
 	}
+	if regErr := rm.checkLeader(ctx, ri); regErr != nil {
+		return nil, regErr
+	}
 	return ri, nil
 }
 
+// checkLeader returns NotLeader if the request is sent to a follower and it's neither a replica read nor a stale
+// read. The first peer is the leader reported to the clients, the other peers are the simulated followers. The
+// data is shared by all the peers, so a replica read is always consistent with the leader.
+func (rm *MockRegionManager) checkLeader(ctx *kvrpcpb.Context, ri *regionCtx) *errorpb.Error {
+	if ctx.GetPeer() == nil || ctx.GetReplicaRead() || ctx.GetStaleRead() {
+		return nil
+	}
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	if len(ri.meta.Peers) == 0 || ri.meta.Peers[0].GetId() == ctx.GetPeer().GetId() {
+		return nil
+	}
+	return &errorpb.Error{
+		Message: fmt.Sprintf("peer %d is not the leader of region %d", ctx.GetPeer().GetId(), ri.meta.Id),
+		NotLeader: &errorpb.NotLeader{
+			RegionId: ri.meta.Id,
+			Leader:   proto.Clone(ri.meta.Peers[0]).(*metapb.Peer),
+		},
+	}
+}
+
 // btreeItem is BTree's Item that uses []byte to compare.
 type btreeItem struct {
 	key    []byte
@@ -354,8 +384,16 @@ func (rm *MockRegionManager) SplitKeys(start, end kv.Key, count int) {
 }
 
 func (rm *MockRegionManager) SplitRegion(req *kvrpcpb.SplitRegionRequest) *kvrpcpb.SplitRegionResponse {
-	if _, err := rm.GetRegionFromCtx(req.Context); err != nil {
-		return &kvrpcpb.SplitRegionResponse{RegionError: err}
+	resp, _ := rm.SplitRegionWithStats(req)
+	return resp
+}
+
+// SplitRegionWithStats splits the region like SplitRegion and also returns the estimated stats of every
+// resulting region, in the same order as the regions in the response.
+func (rm *MockRegionManager) SplitRegionWithStats(req *kvrpcpb.SplitRegionRequest) (*kvrpcpb.SplitRegionResponse, []*RegionStats) {
+	parent, regErr := rm.GetRegionFromCtx(req.Context)
+	if regErr != nil {
+		return &kvrpcpb.SplitRegionResponse{RegionError: regErr}, nil
 	}
 	splitKeys := make([][]byte, 0, len(req.SplitKeys))
 	for _, rawKey := range req.SplitKeys {
@@ -367,14 +405,23 @@ func (rm *MockRegionManager) SplitRegion(req *kvrpcpb.SplitRegionRequest) *kvrpc
 
 	newRegions, err := rm.splitKeys(splitKeys)
 	if err != nil {
-		return &kvrpcpb.SplitRegionResponse{RegionError: &errorpb.Error{Message: err.Error()}}
+		return &kvrpcpb.SplitRegionResponse{RegionError: &errorpb.Error{Message: err.Error()}}, nil
 	}
 
 	ret := make([]*metapb.Region, 0, len(newRegions))
 	for _, regCtx := range newRegions {
 		ret = append(ret, proto.Clone(regCtx.meta).(*metapb.Region))
 	}
-	return &kvrpcpb.SplitRegionResponse{Regions: ret}
+	stats, err := estimateSplitStats(rm.bundle.DB, newRegions, parent.approximateSize,
+		atomic.LoadInt64(&parent.approximateKeys), regionStatsSampleKeys)
+	if err != nil {
+		log.Warn("estimate region stats failed", zap.Error(err))
+		return &kvrpcpb.SplitRegionResponse{Regions: ret}, nil
+	}
+	for i, regCtx := range newRegions {
+		regCtx.approximateSize = stats[i].ApproximateSize
+	}
+	return &kvrpcpb.SplitRegionResponse{Regions: ret}, stats
 }
 
 func (rm *MockRegionManager) calculateSplitKeys(start, end []byte, count int) [][]byte {
@@ -476,6 +523,9 @@ func (rm *MockRegionManager) splitKeys(keys [][]byte) ([]*regionCtx, error) {
 		rm.sortedRegions.ReplaceOrInsert(newBtreeItem(region))
 	}
 	rm.mu.Unlock()
+	for _, region := range newRegions {
+		region.countLocks(rm.bundle.LockStore)
+	}
 	return newRegions, rm.saveRegions(newRegions)
 }
 
@@ -525,10 +575,24 @@ func (rm *MockRegionManager) split(regionID, newRegionID uint64, key []byte, pee
 	rm.regions[right.meta.Id] = right
 	rm.sortedRegions.ReplaceOrInsert(newBtreeItem(right))
 	rm.mu.Unlock()
+	left.countLocks(rm.bundle.LockStore)
+	right.countLocks(rm.bundle.LockStore)
 
 	return right.meta, nil
 }
 
+// Merge merges the source region into the adjacent target region, like a merge scheduled by PD. The merged
+// region keeps the id of the target region, the requests of the source region get EpochNotMatch.
+func (rm *MockRegionManager) Merge(sourceID, targetID uint64) error {
+	_, err := rm.mergeRegions(rm.bundle, sourceID, targetID, func(source, oldTarget, merged *regionCtx) {
+		// The btree is keyed by the end key, the items of both regions are replaced by the merged one.
+		rm.sortedRegions.Delete(newBtreeItem(source))
+		rm.sortedRegions.Delete(newBtreeItem(oldTarget))
+		rm.sortedRegions.ReplaceOrInsert(newBtreeItem(merged))
+	})
+	return err
+}
+
 func (rm *MockRegionManager) saveRegions(regions []*regionCtx) error {
 	if atomic.LoadUint32(&rm.closed) == 1 {
 		return nil
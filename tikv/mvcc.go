@@ -19,9 +19,11 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -29,11 +31,14 @@ import (
 	"github.com/dgryski/go-farm"
 	"github.com/ngaut/unistore/config"
 	"github.com/ngaut/unistore/lockstore"
+	"github.com/ngaut/unistore/metrics"
 	"github.com/ngaut/unistore/pd"
 	"github.com/ngaut/unistore/tikv/dbreader"
 	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/ngaut/unistore/tikv/raftstore"
 	"github.com/ngaut/unistore/util/lockwaiter"
 	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/log"
@@ -57,12 +62,58 @@ type MVCCStore struct {
 
 	conf *config.Config
 
-	latestTS          uint64
+	latestTS uint64
+	// maxReadTS is the max ts of the reads that checked the locks, the min commit ts of async commit must be
+	// greater than it so the reads are not affected by a later commit.
+	maxReadTS uint64
+	// rawVersion is the last version allocated to the raw writes.
+	rawVersion        uint64
+	lockObserver      lockObserver
+	flowController    *flowController
+	cdcObserver       *cdcObserver
 	lockWaiterManager *lockwaiter.Manager
 	DeadlockDetectCli *DetectorClient
 	DeadlockDetectSvr *DetectorServer
+
+	// resolveWorkers bounds the number of concurrently running async lock resolutions.
+	resolveWorkers      chan struct{}
+	asyncWg             sync.WaitGroup
+	asyncResolvePending int32
+
+	gcPaused         int32
+	pendingSafePoint uint64
+	gcWorker         *gcWorker
+
+	// valueCodec encodes the committed values, nil means the values are stored as is.
+	valueCodec dbreader.ValueCodec
+
+	// importLimiter throttles the imports by import-rate-limit.
+	importLimiter *byteLimiter
+	// gcGracePeriod is the GC grace period in nanoseconds, it's changed by the config reload.
+	gcGracePeriod int64
+}
+
+// SetValueCodec sets the codec of the values, it must be set before any value is written.
+func (store *MVCCStore) SetValueCodec(codec dbreader.ValueCodec) {
+	store.valueCodec = codec
+}
+
+func (store *MVCCStore) encodeValue(val []byte) []byte {
+	if store.valueCodec == nil || len(val) == 0 {
+		return val
+	}
+	return store.valueCodec.Encode(val)
 }
 
+func (store *MVCCStore) decodeValue(val []byte) ([]byte, error) {
+	if store.valueCodec == nil || len(val) == 0 {
+		return val, nil
+	}
+	return store.valueCodec.Decode(val)
+}
+
+const asyncResolveWorkers = 4
+
 // NewMVCCStore creates a new MVCCStore
 func NewMVCCStore(conf *config.Config, bundle *mvcc.DBBundle, dataDir string, safePoint *SafePoint,
 	writer mvcc.DBWriter, pdClient pd.Client) *MVCCStore {
@@ -73,17 +124,31 @@ func NewMVCCStore(conf *config.Config, bundle *mvcc.DBBundle, dataDir string, sa
 		safePoint:         safePoint,
 		pdClient:          pdClient,
 		closeCh:           make(chan bool),
-		dbWriter:          writer,
 		conf:              conf,
 		lockWaiterManager: lockwaiter.NewManager(conf),
-	}
+		resolveWorkers:    make(chan struct{}, asyncResolveWorkers),
+		importLimiter:     newByteLimiter(conf.Server.ImportRateLimit),
+		gcGracePeriod:     int64(config.ParseDuration(conf.GC.GracePeriod)),
+	}
+	// All the writes go through the flow controller to measure the engine.
+	store.flowController = newFlowController(writer, conf.Server)
+	// The rows written are published to the CDC subscriptions of the regions.
+	store.cdcObserver = newCDCObserver(store.flowController, store.decodeValue)
+	store.dbWriter = store.cdcObserver
 	store.DeadlockDetectSvr = NewDetectorServer()
 	store.DeadlockDetectCli = NewDetectorClient(store.lockWaiterManager, pdClient)
 	writer.Open()
+	if conf.GC.EnableBackground {
+		store.gcWorker = newGCWorker(store)
+		store.gcWorker.start()
+	}
 	if pdClient != nil {
 		// pdClient is nil in unit test.
 		go store.runUpdateSafePointLoop()
 	}
+	if conf.Engine.Durability == config.DurabilityPeriodic {
+		go store.runPeriodicSync(config.ParseDuration(conf.Engine.SyncInterval))
+	}
 	return store
 }
 
@@ -99,13 +164,33 @@ func (store *MVCCStore) updateLatestTS(ts uint64) {
 	}
 }
 
+// updateMaxReadTS records the ts of a read, the reads of the primary lock with maxSystemTS are not recorded.
+func (store *MVCCStore) updateMaxReadTS(ts uint64) {
+	if ts == maxSystemTS {
+		return
+	}
+	for {
+		old := atomic.LoadUint64(&store.maxReadTS)
+		if old >= ts || atomic.CompareAndSwapUint64(&store.maxReadTS, old, ts) {
+			return
+		}
+	}
+}
+
 func (store *MVCCStore) getLatestTS() uint64 {
 	return atomic.LoadUint64(&store.latestTS)
 }
 
 func (store *MVCCStore) Close() error {
+	store.asyncWg.Wait()
 	store.dbWriter.Close()
 	close(store.closeCh)
+	if store.gcWorker != nil {
+		store.gcWorker.wg.Wait()
+	}
+	if feed := store.cdcObserver.currentChangeFeed(); feed != nil {
+		feed.close()
+	}
 
 	err := store.dumpMemLocks()
 	if err != nil {
@@ -114,20 +199,28 @@ func (store *MVCCStore) Close() error {
 	return nil
 }
 
+// LockDumpFile is the file in the data directory the locks are dumped to when the store is closed.
+const LockDumpFile = "lock_store"
+
 type lockEntryHdr struct {
 	keyLen uint32
 	valLen uint32
 }
 
 func (store *MVCCStore) dumpMemLocks() error {
-	tmpFileName := store.dir + "/lock_store.tmp"
+	return dumpLocks(store.lockStore, store.dir)
+}
+
+// dumpLocks dumps the locks in ls to the lock dump file in dir, the file is replaced atomically.
+func dumpLocks(ls *lockstore.MemStore, dir string) error {
+	tmpFileName := dir + "/" + LockDumpFile + ".tmp"
 	f, err := os.OpenFile(tmpFileName, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0666)
 	if err != nil {
 		return errors.Trace(err)
 	}
 	writer := bufio.NewWriter(f)
 	cnt := 0
-	it := store.lockStore.NewIterator()
+	it := ls.NewIterator()
 	hdrBuf := make([]byte, 8)
 	hdr := (*lockEntryHdr)(unsafe.Pointer(&hdrBuf[0]))
 	for it.SeekToFirst(); it.Valid(); it.Next() {
@@ -147,7 +240,35 @@ func (store *MVCCStore) dumpMemLocks() error {
 		return errors.Trace(err)
 	}
 	f.Close()
-	return os.Rename(tmpFileName, store.dir+"/lock_store")
+	return os.Rename(tmpFileName, dir+"/"+LockDumpFile)
+}
+
+// ReadLockDump calls f with the key and the value of each lock in the lock dump file at path in key order, the
+// lock can be decoded by mvcc.DecodeLock.
+func ReadLockDump(path string, f func(key, val []byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	hdrBuf := make([]byte, 8)
+	hdr := (*lockEntryHdr)(unsafe.Pointer(&hdrBuf[0]))
+	for {
+		if _, err = io.ReadFull(reader, hdrBuf); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Trace(err)
+		}
+		entry := make([]byte, hdr.keyLen+hdr.valLen)
+		if _, err = io.ReadFull(reader, entry); err != nil {
+			return errors.Annotate(err, "truncated lock dump")
+		}
+		if err = f(entry[:hdr.keyLen], entry[hdr.keyLen:]); err != nil {
+			return err
+		}
+	}
 }
 
 func (store *MVCCStore) getDBItems(reqCtx *requestCtx, mutations []*kvrpcpb.Mutation) (items []*badger.Item, err error) {
@@ -220,6 +341,9 @@ func (store *MVCCStore) PessimisticLock(reqCtx *requestCtx, req *kvrpcpb.Pessimi
 	hashVals := mutationsToHashVals(mutations)
 	regCtx.AcquireLatches(hashVals)
 	defer regCtx.ReleaseLatches(hashVals)
+	if err := reqCtx.checkDeadline(); err != nil {
+		return nil, err
+	}
 
 	batch := store.dbWriter.NewWriteBatch(startTS, 0, reqCtx.rpcCtx)
 	var dup bool
@@ -269,6 +393,9 @@ func (store *MVCCStore) PessimisticLock(reqCtx *requestCtx, req *kvrpcpb.Pessimi
 	if req.Force {
 		dbMeta := mvcc.DBUserMeta(items[0].UserMeta())
 		val, err1 := items[0].ValueCopy(nil)
+		if err1 == nil {
+			val, err1 = store.decodeValue(val)
+		}
 		if err1 != nil {
 			return nil, err1
 		}
@@ -282,6 +409,9 @@ func (store *MVCCStore) PessimisticLock(reqCtx *requestCtx, req *kvrpcpb.Pessimi
 				continue
 			}
 			val, err1 := item.ValueCopy(nil)
+			if err1 == nil {
+				val, err1 = store.decodeValue(val)
+			}
 			if err1 != nil {
 				return nil, err1
 			}
@@ -354,8 +484,13 @@ func (store *MVCCStore) TxnHeartBeat(reqCtx *requestCtx, req *kvrpcpb.TxnHeartBe
 		if !bytes.Equal(lock.Primary, req.PrimaryLock) {
 			return 0, errors.New("heartbeat on non-primary key")
 		}
-		if lock.TTL < uint32(req.AdviseLockTtl) {
-			lock.TTL = uint32(req.AdviseLockTtl)
+		// The TTL is stored in 32 bits, a larger advise TTL must not wrap around to a smaller one.
+		adviseTTL := req.AdviseLockTtl
+		if adviseTTL > math.MaxUint32 {
+			adviseTTL = math.MaxUint32
+		}
+		if lock.TTL < uint32(adviseTTL) {
+			lock.TTL = uint32(adviseTTL)
 			batch := store.dbWriter.NewWriteBatch(req.StartVersion, 0, reqCtx.rpcCtx)
 			batch.PessimisticLock(req.PrimaryLock, lock)
 			err = store.dbWriter.Write(batch)
@@ -365,7 +500,11 @@ func (store *MVCCStore) TxnHeartBeat(reqCtx *requestCtx, req *kvrpcpb.TxnHeartBe
 		}
 		return uint64(lock.TTL), nil
 	}
-	return 0, errors.New("lock doesn't exists")
+	// The transaction is committed, rolled back or never prewritten, it can't be kept alive.
+	return 0, &ErrTxnNotFound{
+		PrimaryKey: req.PrimaryLock,
+		StartTS:    req.StartVersion,
+	}
 }
 
 // TxnStatus is the result of `CheckTxnStatus` API.
@@ -393,7 +532,9 @@ func (store *MVCCStore) CheckTxnStatus(reqCtx *requestCtx,
 		// If the lock has already outdated, clean up it.
 		if uint64(oracle.ExtractPhysical(lock.StartTS))+uint64(lock.TTL) < uint64(oracle.ExtractPhysical(req.CurrentTs)) {
 			batch.Rollback(req.PrimaryKey, true)
-			return TxnStatus{0, kvrpcpb.Action_TTLExpireRollback, nil}, store.dbWriter.Write(batch)
+			err = store.writeData(reqCtx, batch)
+			store.lockWaiterManager.WakeUp(req.LockTs, 0, hashVals)
+			return TxnStatus{0, kvrpcpb.Action_TTLExpireRollback, nil}, err
 		}
 		// If this is a large transaction and the lock is active, push forward the minCommitTS.
 		// lock.minCommitTS == 0 may be a secondary lock, or not a large transaction.
@@ -444,8 +585,8 @@ func (store *MVCCStore) CheckTxnStatus(reqCtx *requestCtx,
 	// Currently client will always set this flag to true when resolving locks
 	if req.RollbackIfNotExist {
 		batch.Rollback(req.PrimaryKey, false)
-		err = store.dbWriter.Write(batch)
-		return TxnStatus{0, kvrpcpb.Action_LockNotExistRollback, nil}, nil
+		err = store.writeData(reqCtx, batch)
+		return TxnStatus{0, kvrpcpb.Action_LockNotExistRollback, nil}, err
 	}
 	return TxnStatus{0, kvrpcpb.Action_NoAction, nil}, &ErrTxnNotFound{
 		PrimaryKey: req.PrimaryKey,
@@ -474,7 +615,7 @@ func (store *MVCCStore) CheckSecondaryLocks(reqCtx *requestCtx, keys [][]byte, s
 		if lock != nil && lock.StartTS == startTS {
 			if lock.Op == uint8(kvrpcpb.Op_PessimisticLock) {
 				batch.Rollback(key, true)
-				err := store.dbWriter.Write(batch)
+				err := store.writeData(reqCtx, batch)
 				if err != nil {
 					return SecondaryLocksStatus{}, err
 				}
@@ -498,7 +639,7 @@ func (store *MVCCStore) CheckSecondaryLocks(reqCtx *requestCtx, keys [][]byte, s
 			}
 			if !status.isRollback {
 				batch.Rollback(key, false)
-				err = store.dbWriter.Write(batch)
+				err = store.writeData(reqCtx, batch)
 			}
 			return SecondaryLocksStatus{commitTS: 0}, err
 		}
@@ -507,7 +648,8 @@ func (store *MVCCStore) CheckSecondaryLocks(reqCtx *requestCtx, keys [][]byte, s
 }
 
 func (store *MVCCStore) normalizeWaitTime(lockWaitTime int64) time.Duration {
-	if lockWaitTime > store.conf.PessimisticTxn.WaitForLockTimeout {
+	// LockAlwaysWait waits until the max wait timeout like TiKV, a zero timer would time out at once.
+	if lockWaitTime == lockwaiter.LockAlwaysWait || lockWaitTime > store.conf.PessimisticTxn.WaitForLockTimeout {
 		lockWaitTime = store.conf.PessimisticTxn.WaitForLockTimeout
 	}
 	return time.Duration(lockWaitTime) * time.Millisecond
@@ -568,6 +710,16 @@ func (store *MVCCStore) Prewrite(reqCtx *requestCtx, req *kvrpcpb.PrewriteReques
 
 	regCtx.AcquireLatches(hashVals)
 	defer regCtx.ReleaseLatches(hashVals)
+	reqCtx.trace("acquire latches")
+	if err := reqCtx.checkDeadline(); err != nil {
+		return err
+	}
+
+	if limit := store.conf.Server.MaxLocksPerRegion; limit > 0 {
+		if store.countRegionLocks(regCtx, req.StartVersion, limit)+len(mutations) > limit {
+			return ErrTooManyLocks
+		}
+	}
 
 	isPessimistic := req.ForUpdateTs > 0
 	var err error
@@ -576,6 +728,7 @@ func (store *MVCCStore) Prewrite(reqCtx *requestCtx, req *kvrpcpb.PrewriteReques
 	} else {
 		err = store.prewriteOptimistic(reqCtx, mutations, req)
 	}
+	reqCtx.trace("prewrite")
 	if err != nil {
 		return err
 	}
@@ -591,6 +744,57 @@ func (store *MVCCStore) Prewrite(reqCtx *requestCtx, req *kvrpcpb.PrewriteReques
 	return nil
 }
 
+// hasLocks returns if there is any lock in the region.
+func (store *MVCCStore) hasLocks(regCtx *regionCtx) bool {
+	it := store.lockStore.NewIterator()
+	it.Seek(regCtx.startKey)
+	return it.Valid() && !exceedEndKey(it.Key(), regCtx.endKey)
+}
+
+// countRegionLocks counts the locks in the region that don't belong to the transaction of startTS,
+// the counting stops once it exceeds limit.
+func (store *MVCCStore) countRegionLocks(regCtx *regionCtx, startTS uint64, limit int) int {
+	var cnt int
+	it := store.lockStore.NewIterator()
+	for it.Seek(regCtx.startKey); it.Valid() && cnt <= limit; it.Next() {
+		if exceedEndKey(it.Key(), regCtx.endKey) {
+			break
+		}
+		if mvcc.DecodeLock(it.Value()).StartTS != startTS {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// PrewriteDryRun runs the conflict and lock checks of Prewrite on every mutation without writing any lock.
+// The mutations of req are sorted like Prewrite does, the returned errors are in the same order and nil for
+// the keys that can be prewritten.
+func (store *MVCCStore) PrewriteDryRun(reqCtx *requestCtx, req *kvrpcpb.PrewriteRequest) []error {
+	mutations := sortPrewrite(req)
+	regCtx := reqCtx.regCtx
+	hashVals := mutationsToHashVals(mutations)
+
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+
+	reqCtx.dryRun = true
+	defer func() { reqCtx.dryRun = false }()
+	errs := make([]error, len(mutations))
+	for i, m := range mutations {
+		// Check the keys one by one, so a failed key doesn't hide the result of the others.
+		keyReq := *req
+		keyReq.Mutations = []*kvrpcpb.Mutation{m}
+		if req.ForUpdateTs > 0 {
+			keyReq.IsPessimisticLock = []bool{len(req.IsPessimisticLock) > 0 && req.IsPessimisticLock[i]}
+			errs[i] = store.prewritePessimistic(reqCtx, keyReq.Mutations, &keyReq)
+		} else {
+			errs[i] = store.prewriteOptimistic(reqCtx, keyReq.Mutations, &keyReq)
+		}
+	}
+	return errs
+}
+
 func (store *MVCCStore) prewriteOptimistic(reqCtx *requestCtx, mutations []*kvrpcpb.Mutation, req *kvrpcpb.PrewriteRequest) error {
 	startTS := req.StartVersion
 	// Must check the LockStore first.
@@ -697,6 +901,10 @@ func (store *MVCCStore) prewritePessimistic(reqCtx *requestCtx, mutations []*kvr
 
 func (store *MVCCStore) prewriteMutations(reqCtx *requestCtx, mutations []*kvrpcpb.Mutation,
 	req *kvrpcpb.PrewriteRequest, items []*badger.Item) error {
+	if reqCtx.dryRun {
+		// All the checks are passed.
+		return nil
+	}
 	var minCommitTS uint64
 	if req.UseAsyncCommit || req.TryOnePc {
 		// Get minCommitTS for async commit protocol. After all keys are locked in memory lock.
@@ -705,6 +913,9 @@ func (store *MVCCStore) prewriteMutations(reqCtx *requestCtx, mutations []*kvrpc
 			return tsErr
 		}
 		minCommitTS = uint64(physical)<<18 + uint64(logical)
+		if maxReadTS := atomic.LoadUint64(&store.maxReadTS); minCommitTS <= maxReadTS {
+			minCommitTS = maxReadTS + 1
+		}
 		if req.MaxCommitTs > 0 && minCommitTS > req.MaxCommitTs {
 			req.UseAsyncCommit = false
 			req.TryOnePc = false
@@ -731,8 +942,11 @@ func (store *MVCCStore) prewriteMutations(reqCtx *requestCtx, mutations []*kvrpc
 
 	batch := store.dbWriter.NewWriteBatch(req.StartVersion, 0, reqCtx.rpcCtx)
 
+	var batchKeys, batchBytes int
+	var locks []*mvcc.MvccLock
 	for i, m := range mutations {
 		if m.Op == kvrpcpb.Op_CheckNotExists {
+			locks = append(locks, nil)
 			continue
 		}
 		lock, err1 := store.buildPrewriteLock(reqCtx, m, items[i], req)
@@ -740,9 +954,74 @@ func (store *MVCCStore) prewriteMutations(reqCtx *requestCtx, mutations []*kvrpc
 			return err1
 		}
 		batch.Prewrite(m.Key, lock)
+		locks = append(locks, lock)
+		batchKeys++
+		batchBytes += len(m.Key) + len(m.Value)
+	}
+	observeWriteBatch(writeBatchPrewrite, batchKeys, batchBytes)
+
+	if err := store.dbWriter.Write(batch); err != nil {
+		return err
+	}
+	keys := make([][]byte, len(mutations))
+	for i, m := range mutations {
+		keys[i] = m.Key
+	}
+	store.lockObserver.observe(keys, locks)
+	if req.UseAsyncCommit {
+		return store.pushAsyncMinCommitTS(reqCtx, mutations, locks, req)
+	}
+	return nil
+}
+
+// pushAsyncMinCommitTS pushes the min commit ts of the written async commit locks if a read with a greater ts
+// checked the keys before the locks were written, such a read missed the locks and must not see the commit.
+// The read ts is recorded before the locks are checked, so every read either sees the locks or is seen here.
+func (store *MVCCStore) pushAsyncMinCommitTS(reqCtx *requestCtx, mutations []*kvrpcpb.Mutation,
+	locks []*mvcc.MvccLock, req *kvrpcpb.PrewriteRequest) error {
+	maxReadTS := atomic.LoadUint64(&store.maxReadTS)
+	if maxReadTS < req.MinCommitTs {
+		return nil
+	}
+	req.MinCommitTs = maxReadTS + 1
+	batch := store.dbWriter.NewWriteBatch(req.StartVersion, 0, reqCtx.rpcCtx)
+	for i, m := range mutations {
+		if locks[i] != nil {
+			locks[i].MinCommitTS = req.MinCommitTs
+			batch.Prewrite(m.Key, locks[i])
+		}
+	}
+	if err := store.dbWriter.Write(batch); err != nil {
+		return err
+	}
+	reqCtx.asyncMinCommitTS = req.MinCommitTs
+	if req.MaxCommitTs > 0 && req.MinCommitTs > req.MaxCommitTs {
+		// The client falls back to the normal commit, which uses a commit ts greater than the pushed one.
+		reqCtx.asyncMinCommitTS = 0
 	}
+	return nil
+}
+
+// writeData writes a batch that commits or rolls back the data of the region, the data version of the
+// region is bumped after the write so the results cached at older versions are invalidated.
+func (store *MVCCStore) writeData(reqCtx *requestCtx, batch mvcc.WriteBatch) error {
+	err := store.dbWriter.Write(batch)
+	reqCtx.regCtx.bumpDataVersion()
+	return err
+}
+
+const (
+	writeBatchPrewrite = "prewrite"
+	writeBatchCommit   = "commit"
+)
 
-	return store.dbWriter.Write(batch)
+// observeWriteBatch records the size of a write batch built by prewrite or commit.
+func observeWriteBatch(tp string, keys, size int) {
+	if keys == 0 {
+		return
+	}
+	metrics.WriteBatchKeys.WithLabelValues(tp).Observe(float64(keys))
+	metrics.WriteBatchBytes.WithLabelValues(tp).Observe(float64(size))
 }
 
 func (store *MVCCStore) tryOnePC(reqCtx *requestCtx, mutations []*kvrpcpb.Mutation,
@@ -761,6 +1040,7 @@ func (store *MVCCStore) tryOnePC(reqCtx *requestCtx, mutations []*kvrpcpb.Mutati
 	reqCtx.onePCCommitTS = minCommitTS
 	store.updateLatestTS(minCommitTS)
 	batch := store.dbWriter.NewWriteBatch(req.StartVersion, minCommitTS, reqCtx.rpcCtx)
+	markOnePC(batch)
 
 	for i, m := range mutations {
 		if m.Op == kvrpcpb.Op_CheckNotExists {
@@ -775,7 +1055,7 @@ func (store *MVCCStore) tryOnePC(reqCtx *requestCtx, mutations []*kvrpcpb.Mutati
 		batch.Commit(m.Key, lock)
 	}
 
-	if err := store.dbWriter.Write(batch); err != nil {
+	if err := store.writeData(reqCtx, batch); err != nil {
 		return false, err
 	}
 
@@ -815,11 +1095,14 @@ func (store *MVCCStore) buildPrewriteLock(reqCtx *requestCtx, m *kvrpcpb.Mutatio
 			PrimaryLen:     uint16(len(req.PrimaryLock)),
 			MinCommitTS:    req.MinCommitTs,
 			UseAsyncCommit: req.UseAsyncCommit,
-			SecondaryNum:   uint32(len(req.Secondaries)),
 		},
-		Primary:     req.PrimaryLock,
-		Value:       m.Value,
-		Secondaries: req.Secondaries,
+		Primary: req.PrimaryLock,
+		Value:   m.Value,
+	}
+	// Only the primary lock records the secondaries, they are used to resolve the async commit transaction.
+	if req.UseAsyncCommit && bytes.Equal(m.Key, req.PrimaryLock) {
+		lock.SecondaryNum = uint32(len(req.Secondaries))
+		lock.Secondaries = req.Secondaries
 	}
 	var err error
 	lock.Op = uint8(m.Op)
@@ -841,6 +1124,9 @@ func (store *MVCCStore) buildPrewriteLock(reqCtx *requestCtx, m *kvrpcpb.Mutatio
 		}
 		lock.Value = reqCtx.buf
 	}
+	if lock.Op == uint8(kvrpcpb.Op_Put) {
+		lock.Value = store.encodeValue(lock.Value)
+	}
 
 	lock.ForUpdateTS = req.ForUpdateTs
 	return lock, nil
@@ -880,9 +1166,13 @@ func (store *MVCCStore) Commit(req *requestCtx, keys [][]byte, startTS, commitTS
 	batch := store.dbWriter.NewWriteBatch(startTS, commitTS, req.rpcCtx)
 	regCtx.AcquireLatches(hashVals)
 	defer regCtx.ReleaseLatches(hashVals)
+	req.trace("acquire latches")
+	if err := req.checkDeadline(); err != nil {
+		return err
+	}
 
 	var buf []byte
-	var tmpDiff int
+	var tmpDiff, batchKeys int
 	var isPessimisticTxn bool
 	for _, key := range keys {
 		var lockErr error
@@ -896,6 +1186,9 @@ func (store *MVCCStore) Commit(req *requestCtx, keys [][]byte, startTS, commitTS
 		} else {
 			lock = mvcc.DecodeLock(buf)
 			if lock.StartTS != startTS {
+				// The key is locked by another transaction, so the lock of this transaction must have been
+				// resolved. The other lock is never committed or overwritten, the commit only succeeds if
+				// this transaction is already committed, otherwise the retryable ErrReplaced is returned.
 				lockErr = ErrReplaced
 			}
 		}
@@ -927,9 +1220,12 @@ func (store *MVCCStore) Commit(req *requestCtx, keys [][]byte, startTS, commitTS
 		isPessimisticTxn = lock.ForUpdateTS > 0
 		tmpDiff += len(key) + len(lock.Value)
 		batch.Commit(key, &lock)
+		batchKeys++
 	}
 	atomic.AddInt64(&regCtx.diff, int64(tmpDiff))
-	err := store.dbWriter.Write(batch)
+	atomic.AddInt64(&regCtx.keysDiff, int64(batchKeys))
+	observeWriteBatch(writeBatchCommit, batchKeys, tmpDiff)
+	err := store.writeData(req, batch)
 	store.lockWaiterManager.WakeUp(startTS, commitTS, hashVals)
 	if isPessimisticTxn {
 		store.DeadlockDetectCli.CleanUp(startTS)
@@ -993,10 +1289,21 @@ func (store *MVCCStore) Rollback(reqCtx *requestCtx, keys [][]byte, startTS uint
 		}
 	}
 	store.DeadlockDetectCli.CleanUp(startTS)
-	err := store.dbWriter.Write(batch)
+	err := store.writeData(reqCtx, batch)
 	return errors.Trace(err)
 }
 
+// CleanupTxn rolls back the primary lock of the transaction and writes the rollback record, it's called
+// after all the secondaries are rolled back so the abandoned transaction leaves nothing behind. The TTL of
+// the lock is not checked. Calling it again or on a primary without lock only writes the rollback record,
+// ErrAlreadyCommitted is returned if the transaction is committed.
+func (store *MVCCStore) CleanupTxn(reqCtx *requestCtx, primary []byte, startTS uint64) error {
+	if lock := store.getLock(reqCtx, primary); lock != nil && lock.StartTS == startTS && !bytes.Equal(lock.Primary, primary) {
+		return errors.Errorf("key %q is not the primary of txn %d", primary, startTS)
+	}
+	return store.Rollback(reqCtx, [][]byte{primary}, startTS)
+}
+
 func (store *MVCCStore) rollbackKeyReadLock(reqCtx *requestCtx, batch mvcc.WriteBatch, key []byte,
 	startTS, currentTs uint64) (int, error) {
 	reqCtx.buf = store.lockStore.Get(key, reqCtx.buf)
@@ -1084,6 +1391,7 @@ func checkLock(lock mvcc.MvccLock, key []byte, startTS uint64, resolved []uint64
 }
 
 func (store *MVCCStore) CheckKeysLock(startTS uint64, resolved []uint64, keys ...[]byte) error {
+	store.updateMaxReadTS(startTS)
 	var buf []byte
 	for _, key := range keys {
 		buf = store.lockStore.Get(key, buf)
@@ -1100,6 +1408,7 @@ func (store *MVCCStore) CheckKeysLock(startTS uint64, resolved []uint64, keys ..
 }
 
 func (store *MVCCStore) CheckRangeLock(startTS uint64, startKey, endKey []byte, resolved []uint64) error {
+	store.updateMaxReadTS(startTS)
 	it := store.lockStore.NewIterator()
 	for it.Seek(startKey); it.Valid(); it.Next() {
 		if exceedEndKey(it.Key(), endKey) {
@@ -1136,7 +1445,7 @@ func (store *MVCCStore) Cleanup(reqCtx *requestCtx, key []byte, startTS, current
 			return ErrAlreadyCommitted(rbStatus.commitTS)
 		}
 	}
-	err = store.dbWriter.Write(batch)
+	err = store.writeData(reqCtx, batch)
 	store.lockWaiterManager.WakeUp(startTS, 0, hashVals)
 	return err
 }
@@ -1154,14 +1463,19 @@ func (store *MVCCStore) appendScannedLock(locks []*kvrpcpb.LockInfo, it *locksto
 	return locks
 }
 
-func (store *MVCCStore) ScanLock(reqCtx *requestCtx, maxTS uint64, limit int) ([]*kvrpcpb.LockInfo, error) {
+// ScanLock returns the locks of the region before maxTS from startKey in key order, at most limit locks are
+// returned unless limit is 0. The caller pages through the locks with the key after the last lock returned.
+func (store *MVCCStore) ScanLock(reqCtx *requestCtx, startKey []byte, maxTS uint64, limit int) ([]*kvrpcpb.LockInfo, error) {
+	if bytes.Compare(startKey, reqCtx.regCtx.startKey) < 0 {
+		startKey = reqCtx.regCtx.startKey
+	}
 	var locks []*kvrpcpb.LockInfo
 	it := store.lockStore.NewIterator()
-	for it.Seek(reqCtx.regCtx.startKey); it.Valid(); it.Next() {
+	for it.Seek(startKey); it.Valid(); it.Next() {
 		if exceedEndKey(it.Key(), reqCtx.regCtx.endKey) {
 			return locks, nil
 		}
-		if len(locks) == limit {
+		if limit > 0 && len(locks) == limit {
 			return locks, nil
 		}
 		locks = store.appendScannedLock(locks, it, maxTS)
@@ -1181,24 +1495,55 @@ func (store *MVCCStore) PhysicalScanLock(startKey []byte, maxTS uint64, limit in
 	return locks
 }
 
+// resolveLockBatchSize is the max number of locks resolved in a write batch when the locks of a transaction are
+// scanned from the region, the same as TiKV.
+const resolveLockBatchSize = 256
+
+// ResolveLock commits or rolls back the locks of the transaction. If lockKeys is empty, the locks are scanned
+// from the region and resolved in batches, each batch holds the latches of its own keys only, otherwise only the
+// locks of lockKeys are resolved, which is the lite resolution.
 func (store *MVCCStore) ResolveLock(reqCtx *requestCtx, lockKeys [][]byte, startTS, commitTS uint64) error {
-	regCtx := reqCtx.regCtx
-	if len(lockKeys) == 0 {
-		it := store.lockStore.NewIterator()
-		for it.Seek(regCtx.startKey); it.Valid(); it.Next() {
-			if exceedEndKey(it.Key(), regCtx.endKey) {
-				break
-			}
-			lock := mvcc.DecodeLock(it.Value())
-			if lock.StartTS != startTS {
-				continue
-			}
-			lockKeys = append(lockKeys, safeCopy(it.Key()))
+	if len(lockKeys) > 0 {
+		return store.resolveLockKeys(reqCtx, lockKeys, startTS, commitTS)
+	}
+	scanKey := reqCtx.regCtx.startKey
+	for scanKey != nil {
+		if err := reqCtx.checkDeadline(); err != nil {
+			return err
 		}
+		lockKeys, scanKey = store.scanTxnLocks(reqCtx.regCtx, scanKey, startTS, resolveLockBatchSize)
 		if len(lockKeys) == 0 {
 			return nil
 		}
+		if err := store.resolveLockKeys(reqCtx, lockKeys, startTS, commitTS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanTxnLocks returns at most limit keys locked by the transaction from startKey in the region, and the key to
+// resume the scan, which is nil if the region is exhausted.
+func (store *MVCCStore) scanTxnLocks(regCtx *regionCtx, startKey []byte, startTS uint64, limit int) (keys [][]byte, nextKey []byte) {
+	it := store.lockStore.NewIterator()
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		if exceedEndKey(it.Key(), regCtx.endKey) {
+			break
+		}
+		if len(keys) == limit {
+			return keys, safeCopy(it.Key())
+		}
+		lock := mvcc.DecodeLock(it.Value())
+		if lock.StartTS != startTS {
+			continue
+		}
+		keys = append(keys, safeCopy(it.Key()))
 	}
+	return keys, nil
+}
+
+func (store *MVCCStore) resolveLockKeys(reqCtx *requestCtx, lockKeys [][]byte, startTS, commitTS uint64) error {
+	regCtx := reqCtx.regCtx
 	hashVals := keysToHashVals(lockKeys...)
 	batch := store.dbWriter.NewWriteBatch(startTS, commitTS, reqCtx.rpcCtx)
 
@@ -1206,7 +1551,7 @@ func (store *MVCCStore) ResolveLock(reqCtx *requestCtx, lockKeys [][]byte, start
 	defer regCtx.ReleaseLatches(hashVals)
 
 	var buf []byte
-	var tmpDiff int
+	var tmpDiff, committedKeys int
 	for _, lockKey := range lockKeys {
 		buf = store.lockStore.Get(lockKey, buf)
 		if len(buf) == 0 {
@@ -1218,23 +1563,267 @@ func (store *MVCCStore) ResolveLock(reqCtx *requestCtx, lockKeys [][]byte, start
 		}
 		if commitTS > 0 {
 			tmpDiff += len(lockKey) + len(lock.Value)
+			committedKeys++
 			batch.Commit(lockKey, &lock)
 		} else {
 			batch.Rollback(lockKey, true)
 		}
 	}
 	atomic.AddInt64(&regCtx.diff, int64(tmpDiff))
-	err := store.dbWriter.Write(batch)
+	atomic.AddInt64(&regCtx.keysDiff, int64(committedKeys))
+	err := store.writeData(reqCtx, batch)
+	// The lock waiters of the keys are waked up, otherwise they wait until timeout.
+	store.lockWaiterManager.WakeUp(startTS, commitTS, hashVals)
 	return err
 }
 
+// ResolveLockAsync resolves all the locks of the transaction in the region on a background worker and
+// returns immediately, done is called with the result once the locks are resolved.
+func (store *MVCCStore) ResolveLockAsync(reqCtx *requestCtx, startTS, commitTS uint64, done func(error)) {
+	// The request context is finished when the RPC returns, so the resolution uses its own one.
+	asyncCtx := &requestCtx{
+		svr:       reqCtx.svr,
+		regCtx:    reqCtx.regCtx,
+		rpcCtx:    reqCtx.rpcCtx,
+		method:    "ResolveLockAsync",
+		startTime: time.Now(),
+	}
+	store.asyncWg.Add(1)
+	atomic.AddInt32(&store.asyncResolvePending, 1)
+	go func() {
+		defer store.asyncWg.Done()
+		store.resolveWorkers <- struct{}{}
+		err := store.ResolveLock(asyncCtx, nil, startTS, commitTS)
+		<-store.resolveWorkers
+		atomic.AddInt32(&store.asyncResolvePending, -1)
+		if done != nil {
+			done(err)
+		}
+	}()
+}
+
+// BatchOpType is the type of an operation applied by ApplyBatch.
+type BatchOpType int
+
+const (
+	// BatchOpPut writes a committed value.
+	BatchOpPut BatchOpType = iota
+	// BatchOpDelete writes a committed delete.
+	BatchOpDelete
+	// BatchOpLock writes a lock to the lock store.
+	BatchOpLock
+)
+
+// BatchOp is an operation applied by ApplyBatch.
+type BatchOp struct {
+	Type  BatchOpType
+	Key   []byte
+	Value []byte
+	// Lock is the lock written by BatchOpLock.
+	Lock *mvcc.MvccLock
+}
+
+// ApplyBatch applies a mix of committed puts, deletes and locks in a single write batch, bypassing the
+// transaction protocol, the puts and deletes are committed with startTS and commitTS. It is only used to
+// build states for tests. All the keys must be in the region of reqCtx and appear at most once, otherwise
+// nothing is applied.
+func (store *MVCCStore) ApplyBatch(reqCtx *requestCtx, startTS, commitTS uint64, ops []BatchOp) error {
+	regCtx := reqCtx.regCtx
+	keys := make([][]byte, 0, len(ops))
+	keySet := make(map[string]struct{}, len(ops))
+	for _, op := range ops {
+		if regCtx.lessThanStartKey(op.Key) || regCtx.greaterEqualEndKey(op.Key) {
+			return errors.Errorf("key %q is not in region %d", op.Key, regCtx.meta.GetId())
+		}
+		if _, ok := keySet[string(op.Key)]; ok {
+			return errors.Errorf("duplicated key %q", op.Key)
+		}
+		if op.Type == BatchOpLock && op.Lock == nil {
+			return errors.Errorf("no lock for key %q", op.Key)
+		}
+		keySet[string(op.Key)] = struct{}{}
+		keys = append(keys, op.Key)
+	}
+	hashVals := keysToHashVals(keys...)
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+
+	batch := store.dbWriter.NewWriteBatch(startTS, commitTS, reqCtx.rpcCtx)
+	for _, op := range ops {
+		switch op.Type {
+		case BatchOpPut:
+			batch.Commit(op.Key, &mvcc.MvccLock{MvccLockHdr: mvcc.MvccLockHdr{StartTS: startTS, Op: uint8(kvrpcpb.Op_Put)}, Value: store.encodeValue(op.Value)})
+		case BatchOpDelete:
+			batch.Commit(op.Key, &mvcc.MvccLock{MvccLockHdr: mvcc.MvccLockHdr{StartTS: startTS, Op: uint8(kvrpcpb.Op_Del)}})
+		case BatchOpLock:
+			batch.Prewrite(op.Key, op.Lock)
+		}
+	}
+	return store.writeData(reqCtx, batch)
+}
+
+// RawIncrement atomically adds delta to the big-endian encoded int64 value of the key and returns the new
+// value, the key is created with the value delta if it doesn't exist. Increments of a key are serialized
+// by the latches, and every increment is written as a new version after the latest one.
+func (store *MVCCStore) RawIncrement(reqCtx *requestCtx, key []byte, delta int64) (int64, error) {
+	regCtx := reqCtx.regCtx
+	if err := checkKeysInRegion(regCtx, key); err != nil {
+		return 0, err
+	}
+	hashVals := keysToHashVals(key)
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+
+	txn := store.db.NewTransaction(false)
+	// The expire time of the key is kept by the increment.
+	val, expireTS, err := store.rawGetByTxn(txn, key)
+	txn.Discard()
+	if err != nil {
+		return 0, err
+	}
+	var current int64
+	if len(val) > 0 {
+		if len(val) != 8 {
+			return 0, errors.Errorf("value of key %q is not an 8 bytes integer", key)
+		}
+		current = int64(binary.BigEndian.Uint64(val))
+	}
+
+	current += delta
+	val = make([]byte, 8)
+	binary.BigEndian.PutUint64(val, uint64(current))
+	if err = store.rawWriteLatched(reqCtx, [][]byte{key}, [][]byte{val}, expireTS); err != nil {
+		return 0, err
+	}
+	return current, nil
+}
+
+// ResolveLockWithInfo resolves a lock whose info is already known, e.g. returned by ScanLock, so the resolver
+// doesn't need to find the lock again. The lock is committed if commitTS > 0, otherwise it is rolled back.
+// ErrLockChanged is returned if the lock in the lock store no longer matches the given info.
+func (store *MVCCStore) ResolveLockWithInfo(reqCtx *requestCtx, lockInfo *kvrpcpb.LockInfo, commitTS uint64) error {
+	key := lockInfo.Key
+	regCtx := reqCtx.regCtx
+	if checkKeysInRegion(regCtx, key) != nil {
+		return &raftstore.ErrKeyNotInRegion{Key: key, Region: regCtx.meta}
+	}
+	hashVals := keysToHashVals(key)
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+
+	lock := store.getLock(reqCtx, key)
+	if lock == nil || !lockMatchesInfo(lock, lockInfo) {
+		return ErrLockChanged
+	}
+	batch := store.dbWriter.NewWriteBatch(lock.StartTS, commitTS, reqCtx.rpcCtx)
+	if commitTS > 0 {
+		atomic.AddInt64(&regCtx.diff, int64(len(key)+len(lock.Value)))
+		batch.Commit(key, lock)
+	} else {
+		batch.Rollback(key, true)
+	}
+	err := store.writeData(reqCtx, batch)
+	store.lockWaiterManager.WakeUp(lock.StartTS, commitTS, hashVals)
+	return errors.Trace(err)
+}
+
+// lockMatchesInfo checks if the lock is the one described by the lock info, the ttl isn't compared because a
+// heartbeat may have extended the lock after the info was taken.
+func lockMatchesInfo(lock *mvcc.MvccLock, info *kvrpcpb.LockInfo) bool {
+	if lock.StartTS != info.LockVersion || !bytes.Equal(lock.Primary, info.PrimaryLock) {
+		return false
+	}
+	return info.LockForUpdateTs == 0 || lock.ForUpdateTS == info.LockForUpdateTs
+}
+
 func (store *MVCCStore) UpdateSafePoint(safePoint uint64) {
-	// We use the gcLock to make sure safePoint can only increase.
-	store.db.UpdateSafeTs(safePoint)
+	if store.IsGCPaused() {
+		store.deferSafePoint(safePoint)
+		return
+	}
+	safePoint = store.applyGCGracePeriod(safePoint)
+	if safePoint == 0 {
+		return
+	}
 	store.safePoint.UpdateTS(safePoint)
+	store.db.UpdateSafeTs(store.safePoint.minTS())
+	store.notifyGCWorker()
 	log.Info("safePoint is updated to", zap.Uint64("ts", safePoint), zap.Time("time", tsToTime(safePoint)))
 }
 
+// UpdateKeyspaceSafePoint updates the safe point of a keyspace, the keyspace of a key is found by the
+// classifier set on the SafePoint. Badger discards the old versions up to the smallest safe point, so the
+// safe point of a keyspace should be set before the global safe point passes it.
+func (store *MVCCStore) UpdateKeyspaceSafePoint(keyspace string, safePoint uint64) error {
+	if store.IsGCPaused() {
+		return ErrGCPaused
+	}
+	safePoint = store.applyGCGracePeriod(safePoint)
+	if safePoint == 0 {
+		return nil
+	}
+	store.safePoint.UpdateKeyspaceTS(keyspace, safePoint)
+	store.db.UpdateSafeTs(store.safePoint.minTS())
+	store.notifyGCWorker()
+	log.Info("keyspace safePoint is updated to", zap.String("keyspace", keyspace),
+		zap.Uint64("ts", safePoint), zap.Time("time", tsToTime(safePoint)))
+	return nil
+}
+
+func (store *MVCCStore) notifyGCWorker() {
+	if store.gcWorker != nil {
+		store.gcWorker.notify()
+	}
+}
+
+// PauseGC stops the safe point from advancing until ResumeGC is called, the safe points received
+// while GC is paused are applied on resume.
+func (store *MVCCStore) PauseGC() {
+	atomic.StoreInt32(&store.gcPaused, 1)
+	log.Info("GC is paused")
+}
+
+// ResumeGC resumes GC and applies the latest safe point deferred while GC was paused.
+func (store *MVCCStore) ResumeGC() {
+	atomic.StoreInt32(&store.gcPaused, 0)
+	log.Info("GC is resumed")
+	if safePoint := atomic.SwapUint64(&store.pendingSafePoint, 0); safePoint > 0 {
+		store.UpdateSafePoint(safePoint)
+	}
+}
+
+func (store *MVCCStore) IsGCPaused() bool {
+	return atomic.LoadInt32(&store.gcPaused) == 1
+}
+
+func (store *MVCCStore) deferSafePoint(safePoint uint64) {
+	for {
+		old := atomic.LoadUint64(&store.pendingSafePoint)
+		if old >= safePoint || atomic.CompareAndSwapUint64(&store.pendingSafePoint, old, safePoint) {
+			return
+		}
+	}
+}
+
+// applyGCGracePeriod moves the safe point back by the configured grace period, 0 is returned if the
+// grace period is longer than the safe point.
+func (store *MVCCStore) applyGCGracePeriod(safePoint uint64) uint64 {
+	grace := time.Duration(atomic.LoadInt64(&store.gcGracePeriod))
+	graceTS := uint64(grace.Milliseconds()) << 18
+	if safePoint <= graceTS {
+		return 0
+	}
+	return safePoint - graceTS
+}
+
+// CheckReadTS returns ErrGCTooEarly if the versions visible at readTS may have been collected by GC.
+func (store *MVCCStore) CheckReadTS(readTS uint64) error {
+	if safePoint := store.safePoint.getTS(); readTS < safePoint {
+		return &ErrGCTooEarly{ReadTS: readTS, SafePoint: safePoint}
+	}
+	return nil
+}
+
 func tsToTime(ts uint64) time.Time {
 	return time.Unix(0, int64(ts>>18)*1000000)
 }
@@ -1298,6 +1887,70 @@ func (store *MVCCStore) MvccGetByKey(reqCtx *requestCtx, key []byte) (*kvrpcpb.M
 	return mvccInfo, nil
 }
 
+// OldestVersion returns the commit ts of the oldest committed version of the key that is not yet
+// collected by GC, it returns 0 if the key has no committed version.
+func (store *MVCCStore) OldestVersion(reqCtx *requestCtx, key []byte) uint64 {
+	commitTS, _ := reqCtx.getDBReader().GetOldestVersion(key)
+	return commitTS
+}
+
+// VisibilityCondition tells if the latest committed version of a key is visible at a read ts.
+type VisibilityCondition int
+
+const (
+	// VersionVisible means the latest committed version is visible at the read ts.
+	VersionVisible VisibilityCondition = iota
+	// VersionNotExist means the key has no committed version.
+	VersionNotExist
+	// VersionLocked means the read is blocked by a lock whose start ts is not after the read ts.
+	VersionLocked
+	// VersionCommittedAfter means the latest version is committed after the read ts.
+	VersionCommittedAfter
+)
+
+// KeyVisibility is the visibility of the latest committed version of a key at a read ts.
+type KeyVisibility struct {
+	Condition VisibilityCondition
+	// LatestCommitTS is the commit ts of the latest committed version, 0 if the key has no committed version.
+	LatestCommitTS uint64
+	// LockStartTS is the start ts of the lock that blocks the read if the condition is VersionLocked.
+	LockStartTS uint64
+	// MinReadTS is the smallest read ts that the latest committed version is visible at.
+	MinReadTS uint64
+}
+
+// MinCommitTsForVisibility reports if the latest committed version of the key is visible at readTS, and the
+// condition blocks it if it's not visible. The lock is checked first, the same as the read requests.
+func (store *MVCCStore) MinCommitTsForVisibility(reqCtx *requestCtx, key []byte, readTS uint64) (*KeyVisibility, error) {
+	vis := &KeyVisibility{}
+	txn := reqCtx.getDBReader().GetTxn()
+	txn.SetReadTS(maxSystemTS)
+	item, err := txn.Get(key)
+	if err != nil && err != badger.ErrKeyNotFound {
+		return nil, errors.Trace(err)
+	}
+	if item != nil {
+		vis.LatestCommitTS = mvcc.DBUserMeta(item.UserMeta()).CommitTS()
+		vis.MinReadTS = vis.LatestCommitTS
+	}
+	if lock := store.getLock(reqCtx, key); lock != nil {
+		if err := checkLock(*lock, key, readTS, nil); err != nil {
+			vis.Condition = VersionLocked
+			vis.LockStartTS = lock.StartTS
+			return vis, nil
+		}
+	}
+	switch {
+	case item == nil:
+		vis.Condition = VersionNotExist
+	case vis.LatestCommitTS > readTS:
+		vis.Condition = VersionCommittedAfter
+	default:
+		vis.Condition = VersionVisible
+	}
+	return vis, nil
+}
+
 func (store *MVCCStore) getExtraMvccInfo(rawkey []byte,
 	reqCtx *requestCtx, mvccInfo *kvrpcpb.MvccInfo) error {
 	it := reqCtx.getDBReader().GetExtraIter()
@@ -1323,13 +1976,17 @@ func (store *MVCCStore) getExtraMvccInfo(rawkey []byte,
 	return nil
 }
 
+// MvccGetByStartTs finds a key of the transaction in the region and returns the key and its MVCC info. Like
+// TiKV, the locks are searched first, then the committed versions and the rollback and Op_Lock records. nil is
+// returned if the transaction has no key in the region.
 func (store *MVCCStore) MvccGetByStartTs(reqCtx *requestCtx, startTs uint64) (*kvrpcpb.MvccInfo, []byte, error) {
-	reader := reqCtx.getDBReader()
-	startKey := reqCtx.regCtx.startKey
-	endKey := reqCtx.regCtx.endKey
-	rawKey, err := reader.GetKeyByStartTs(startKey, endKey, startTs)
-	if err != nil {
-		return nil, nil, err
+	rawKey := store.findLockKeyByStartTs(reqCtx.regCtx, startTs)
+	if rawKey == nil {
+		var err error
+		rawKey, err = store.findWriteKeyByStartTs(reqCtx, startTs)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 	if rawKey == nil {
 		return nil, nil, nil
@@ -1341,11 +1998,184 @@ func (store *MVCCStore) MvccGetByStartTs(reqCtx *requestCtx, startTs uint64) (*k
 	return res, rawKey, nil
 }
 
-func (store *MVCCStore) DeleteFileInRange(start, end []byte) {
-	store.db.DeleteFilesInRange(start, end)
-	start[0]++
-	end[0]++
-	store.db.DeleteFilesInRange(start, end)
+// findLockKeyByStartTs returns the first key in the region that is locked by the transaction.
+func (store *MVCCStore) findLockKeyByStartTs(regCtx *regionCtx, startTs uint64) []byte {
+	it := store.lockStore.NewIterator()
+	for it.Seek(regCtx.startKey); it.Valid(); it.Next() {
+		if exceedEndKey(it.Key(), regCtx.endKey) {
+			break
+		}
+		if mvcc.DecodeLock(it.Value()).StartTS == startTs {
+			return safeCopy(it.Key())
+		}
+	}
+	return nil
+}
+
+// findWriteKeyByStartTs returns the first key in the region that has a committed version, a rollback or an
+// Op_Lock record of the transaction.
+func (store *MVCCStore) findWriteKeyByStartTs(reqCtx *requestCtx, startTs uint64) ([]byte, error) {
+	reader := reqCtx.getDBReader()
+	key, err := reader.GetKeyByStartTs(reqCtx.regCtx.startKey, reqCtx.regCtx.endKey, startTs)
+	if err != nil || key != nil {
+		// The region may cover the extra txn status keys, which have the start ts in the user meta too.
+		if isExtraTxnStatusKey(key) {
+			key = mvcc.DecodeExtraTxnStatusKey(key)
+		}
+		return key, err
+	}
+	// The extra txn status keys have the first byte of the key increased, the iterator is bounded by the range
+	// of the region increased the same way, which may cover the keys of other regions too.
+	regCtx := reqCtx.regCtx
+	seekKey := safeCopy(regCtx.startKey)
+	if len(seekKey) > 0 {
+		seekKey[0]++
+	}
+	it := reader.GetExtraIter()
+	for it.Seek(seekKey); it.Valid(); it.Next() {
+		key := it.Item().Key()
+		if !isExtraTxnStatusKey(key) || mvcc.DecodeKeyTS(key) != startTs {
+			continue
+		}
+		rawKey := mvcc.DecodeExtraTxnStatusKey(key)
+		if regCtx.lessThanStartKey(rawKey) || regCtx.greaterEqualEndKey(rawKey) {
+			continue
+		}
+		return safeCopy(rawKey), nil
+	}
+	return nil, nil
+}
+
+func isExtraTxnStatusKey(key []byte) bool {
+	return len(key) > 8 && (key[0] == tableExtraPrefix || key[0] == metaExtraPrefix)
+}
+
+// UnsafeDestroyRange deletes all the versions and the txn status records of the keys in the range and the raw keys
+// in the range, the locks are deleted by DestroyLocks. The files fully covered by the range are dropped, and every version left in the other
+// files is overwritten by a tombstone, which is discarded by the following compactions.
+func (store *MVCCStore) UnsafeDestroyRange(startKey, endKey []byte) error {
+	ranges := append([][2][]byte{{startKey, endKey}}, extraTxnStatusRanges(startKey, endKey)...)
+	rawStart, rawEnd := rawDataRange(startKey, endKey)
+	ranges = append(ranges, [2][]byte{rawStart, rawEnd})
+	for _, r := range ranges {
+		store.db.DeleteFilesInRange(r[0], r[1])
+	}
+	for _, r := range ranges {
+		if err := store.destroyVersions(r[0], r[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extraTxnStatusRanges returns the ranges of the txn status keys of the data keys in [startKey, endKey), the end key
+// must not be empty.
+func extraTxnStatusRanges(startKey, endKey []byte) [][2][]byte {
+	var ranges [][2][]byte
+	for _, prefix := range []byte{metaPrefix, tablePrefix} {
+		start, end := startKey, endKey
+		if bytes.Compare(start, []byte{prefix}) < 0 {
+			start = []byte{prefix}
+		}
+		if bytes.Compare(end, []byte{prefix + 1}) > 0 {
+			end = []byte{prefix + 1}
+		}
+		if bytes.Compare(start, end) >= 0 {
+			continue
+		}
+		// The txn status key replaces the prefix of the data key by the extra prefix, and appends the start ts.
+		extraStart, extraEnd := safeCopy(start), safeCopy(end)
+		extraStart[0]++
+		extraEnd[0]++
+		ranges = append(ranges, [2][]byte{extraStart, extraEnd})
+	}
+	return ranges
+}
+
+func (store *MVCCStore) destroyVersions(startKey, endKey []byte) error {
+	txn := store.db.NewTransaction(false)
+	defer txn.Discard()
+	iter := dbreader.NewIterator(txn, false, startKey, endKey)
+	defer iter.Close()
+	iter.SetAllVersions(true)
+	entries := make([]*badger.Entry, 0, delRangeBatchSize)
+	for iter.Seek(startKey); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		// The version is already deleted.
+		if len(item.UserMeta()) == 0 {
+			continue
+		}
+		entries = append(entries, newTombstone(item.KeyCopy(nil), item.Version()))
+		if len(entries) == delRangeBatchSize {
+			if err := store.writeTombstones(entries); err != nil {
+				return err
+			}
+			entries = entries[:0]
+		}
+	}
+	return store.writeTombstones(entries)
+}
+
+func newTombstone(key []byte, version uint64) *badger.Entry {
+	e := &badger.Entry{Key: y.KeyWithTs(key, version)}
+	e.SetDelete()
+	return e
+}
+
+// writeTombstones writes the tombstones to the DB directly, the callers make sure the versions are not written
+// by the transactions.
+func (store *MVCCStore) writeTombstones(entries []*badger.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	err := store.db.Update(func(txn *badger.Txn) error {
+		for _, e := range entries {
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Trace(err)
+}
+
+// DestroyLocks deletes the locks in the range of the region in batches, the waiters of the locks are woken up.
+func (store *MVCCStore) DestroyLocks(reqCtx *requestCtx, startKey, endKey []byte) error {
+	regCtx := reqCtx.regCtx
+	for startKey != nil {
+		var keys [][]byte
+		var startTSs []uint64
+		it := store.lockStore.NewIterator()
+		for it.Seek(startKey); it.Valid() && len(keys) < delRangeBatchSize; it.Next() {
+			if exceedEndKey(it.Key(), endKey) {
+				break
+			}
+			keys = append(keys, safeCopy(it.Key()))
+			startTSs = append(startTSs, mvcc.DecodeLock(it.Value()).StartTS)
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		startKey = nil
+		if len(keys) == delRangeBatchSize {
+			startKey = append(safeCopy(keys[len(keys)-1]), 0)
+		}
+		hashVals := keysToHashVals(keys...)
+		batch := store.dbWriter.NewWriteBatch(0, 0, reqCtx.rpcCtx)
+		for _, key := range keys {
+			batch.PessimisticRollback(key)
+		}
+		regCtx.AcquireLatches(hashVals)
+		err := store.writeData(reqCtx, batch)
+		regCtx.ReleaseLatches(hashVals)
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			store.lockWaiterManager.WakeUp(startTSs[i], 0, []uint64{farm.Fingerprint64(key)})
+		}
+	}
+	return nil
 }
 
 func (store *MVCCStore) BatchGet(reqCtx *requestCtx, keys [][]byte, version uint64) []*kvrpcpb.KvPair {
@@ -1372,23 +2202,100 @@ func (store *MVCCStore) BatchGet(reqCtx *requestCtx, keys [][]byte, version uint
 	return pairs
 }
 
-func (store *MVCCStore) collectRangeLock(startTS uint64, startKey, endKey []byte, resolved []uint64) []*kvrpcpb.KvPair {
-	var pairs []*kvrpcpb.KvPair
+// GetSkipLocks reads the key at readTS, the locks whose start ts are in skipLocks are treated as resolved.
+// skipLocks maps the start ts of a lock to the commit ts of its transaction, 0 means the transaction is
+// rolled back. If a skipped lock is committed before readTS, its value is returned. Locks not in skipLocks
+// are checked as usual.
+func (store *MVCCStore) GetSkipLocks(reqCtx *requestCtx, key []byte, readTS uint64, skipLocks map[uint64]uint64) ([]byte, error) {
+	store.updateMaxReadTS(readTS)
+	lock := store.getLock(reqCtx, key)
+	if lock != nil {
+		if commitTS, ok := skipLocks[lock.StartTS]; ok {
+			if isVisibleCommittedLock(lock, commitTS, readTS) {
+				val, err := store.decodeValue(lock.Value)
+				if err != nil {
+					return nil, err
+				}
+				return safeCopy(val), nil
+			}
+		} else if err := checkLock(*lock, key, readTS, reqCtx.rpcCtx.GetResolvedLocks()); err != nil {
+			return nil, err
+		}
+	}
+	val, err := reqCtx.getDBReader().Get(key, readTS)
+	if err != nil {
+		return nil, err
+	}
+	return safeCopy(val), nil
+}
+
+// ScanSkipLocks is like Scan but treats the locks in skipLocks as resolved, see GetSkipLocks.
+func (store *MVCCStore) ScanSkipLocks(reqCtx *requestCtx, req *kvrpcpb.ScanRequest, skipLocks map[uint64]uint64) []*kvrpcpb.KvPair {
+	return store.scan(reqCtx, req, skipLocks)
+}
+
+// isVisibleCommittedLock checks if the value of the lock is visible to readTS once its transaction
+// is committed at commitTS.
+func isVisibleCommittedLock(lock *mvcc.MvccLock, commitTS, readTS uint64) bool {
+	isWriteLock := lock.Op == uint8(kvrpcpb.Op_Put) || lock.Op == uint8(kvrpcpb.Op_Del)
+	return isWriteLock && commitTS > 0 && commitTS <= readTS
+}
+
+// collectRangeLock returns the locks in the range that block the read, and the values of the skipped locks
+// that are committed before startTS, a nil value means the key is deleted.
+func (store *MVCCStore) collectRangeLock(startTS uint64, startKey, endKey []byte, resolved []uint64,
+	skipLocks map[uint64]uint64) (lockPairs, committedPairs []*kvrpcpb.KvPair) {
+	store.updateMaxReadTS(startTS)
 	it := store.lockStore.NewIterator()
 	for it.Seek(startKey); it.Valid(); it.Next() {
 		if exceedEndKey(it.Key(), endKey) {
 			break
 		}
 		lock := mvcc.DecodeLock(it.Value())
+		if commitTS, ok := skipLocks[lock.StartTS]; ok {
+			if isVisibleCommittedLock(&lock, commitTS, startTS) {
+				pair := &kvrpcpb.KvPair{Key: safeCopy(it.Key())}
+				if val, err := store.decodeValue(lock.Value); err != nil {
+					pair.Error = convertToKeyError(err)
+				} else {
+					pair.Value = safeCopy(val)
+				}
+				committedPairs = append(committedPairs, pair)
+			}
+			continue
+		}
 		err := checkLock(lock, it.Key(), startTS, resolved)
 		if err != nil {
-			pairs = append(pairs, &kvrpcpb.KvPair{
+			lockPairs = append(lockPairs, &kvrpcpb.KvPair{
 				Error: convertToKeyError(err),
 				Key:   safeCopy(it.Key()),
 			})
 		}
 	}
-	return pairs
+	return
+}
+
+// overlayCommittedPairs replaces the scanned pairs with the values of committed skipped locks.
+func overlayCommittedPairs(pairs, committedPairs []*kvrpcpb.KvPair) []*kvrpcpb.KvPair {
+	if len(committedPairs) == 0 {
+		return pairs
+	}
+	overlaid := make(map[string]struct{}, len(committedPairs))
+	for _, pair := range committedPairs {
+		overlaid[string(pair.Key)] = struct{}{}
+	}
+	result := pairs[:0]
+	for _, pair := range pairs {
+		if _, ok := overlaid[string(pair.Key)]; !ok {
+			result = append(result, pair)
+		}
+	}
+	for _, pair := range committedPairs {
+		if len(pair.Value) > 0 {
+			result = append(result, pair)
+		}
+	}
+	return result
 }
 
 func isResolved(startTS uint64, resolved []uint64) bool {
@@ -1405,6 +2312,7 @@ type kvScanProcessor struct {
 	pairs      []*kvrpcpb.KvPair
 	sampleStep uint32
 	scanCnt    uint32
+	keyOnly    bool
 }
 
 func (p *kvScanProcessor) Process(key, value []byte) (err error) {
@@ -1422,52 +2330,74 @@ func (p *kvScanProcessor) Process(key, value []byte) (err error) {
 }
 
 func (p *kvScanProcessor) SkipValue() bool {
-	return false
+	return p.keyOnly
 }
 
 func (store *MVCCStore) Scan(reqCtx *requestCtx, req *kvrpcpb.ScanRequest) []*kvrpcpb.KvPair {
-	var startKey, endKey []byte
+	return store.scan(reqCtx, req, nil)
+}
+
+// clampToRegion returns the intersection of [startKey, endKey) and the region, an empty endKey is the end of the
+// region.
+func clampToRegion(regCtx *regionCtx, startKey, endKey []byte) ([]byte, []byte) {
+	regionStart, regionEnd := regCtx.rawStartKey(), regCtx.rawEndKey()
+	if len(regionEnd) == 0 {
+		// Don't scan internal keys.
+		regionEnd = InternalKeyPrefix
+	}
+	if bytes.Compare(startKey, regionStart) < 0 {
+		startKey = regionStart
+	}
+	if len(endKey) == 0 || bytes.Compare(endKey, regionEnd) > 0 {
+		endKey = regionEnd
+	}
+	return startKey, endKey
+}
+
+func (store *MVCCStore) scan(reqCtx *requestCtx, req *kvrpcpb.ScanRequest, skipLocks map[uint64]uint64) []*kvrpcpb.KvPair {
+	// The reverse scan reads [EndKey, StartKey) backwards.
+	startKey, endKey := req.StartKey, req.EndKey
 	if req.Reverse {
-		startKey = req.EndKey
-		if len(startKey) == 0 {
-			startKey = reqCtx.regCtx.rawStartKey()
-		}
-		endKey = req.StartKey
-	} else {
-		startKey = req.StartKey
-		endKey = req.EndKey
-		if len(endKey) == 0 {
-			endKey = reqCtx.regCtx.rawEndKey()
-		}
-		if len(endKey) == 0 {
-			// Don't scan internal keys.
-			endKey = InternalKeyPrefix
-		}
+		startKey, endKey = req.EndKey, req.StartKey
 	}
-	var lockPairs []*kvrpcpb.KvPair
+	startKey, endKey = clampToRegion(reqCtx.regCtx, startKey, endKey)
+	var lockPairs, committedPairs []*kvrpcpb.KvPair
 	limit := req.GetLimit()
 	if req.SampleStep == 0 {
-		lockPairs = store.collectRangeLock(req.GetVersion(), startKey, endKey, req.Context.ResolvedLocks)
+		lockPairs, committedPairs = store.collectRangeLock(req.GetVersion(), startKey, endKey, req.Context.GetResolvedLocks(), skipLocks)
 	} else {
 		limit = req.SampleStep * limit
 	}
+	// Every committed skipped lock may hide a scanned key, scan more keys to fill the limit.
+	scanLimit := limit + uint32(len(committedPairs))
 	var scanProc = &kvScanProcessor{
 		sampleStep: req.SampleStep,
+		keyOnly:    req.KeyOnly,
 	}
 	reader := reqCtx.getDBReader()
 	var err error
 	if req.Reverse {
-		err = reader.ReverseScan(startKey, endKey, int(limit), req.GetVersion(), scanProc)
+		err = reader.ReverseScan(startKey, endKey, int(scanLimit), req.GetVersion(), scanProc)
 	} else {
-		err = reader.Scan(startKey, endKey, int(limit), req.GetVersion(), scanProc)
+		err = reader.Scan(startKey, endKey, int(scanLimit), req.GetVersion(), scanProc)
 	}
-	if err != nil {
+	if regErr := extractRegionError(err); regErr != nil {
+		// The region is changed during the scan, return the pairs read so far with the region error,
+		// so the client only retries the remaining range.
+		reqCtx.regErr = regErr
+		if len(scanProc.pairs) == 0 {
+			return nil
+		}
+		lastKey := scanProc.pairs[len(scanProc.pairs)-1].Key
+		lockPairs = pairsNotAfter(lockPairs, lastKey, req.Reverse)
+		committedPairs = pairsNotAfter(committedPairs, lastKey, req.Reverse)
+	} else if err != nil {
 		scanProc.pairs = append(scanProc.pairs[:0], &kvrpcpb.KvPair{
 			Error: convertToKeyError(err),
 		})
 		return scanProc.pairs
 	}
-	pairs := append(scanProc.pairs, lockPairs...)
+	pairs := append(overlayCommittedPairs(scanProc.pairs, committedPairs), lockPairs...)
 	sort.Slice(pairs, func(i, j int) bool {
 		cmp := bytes.Compare(pairs[i].Key, pairs[j].Key)
 		if req.Reverse {
@@ -1489,6 +2419,10 @@ func (store *MVCCStore) Scan(reqCtx *requestCtx, req *kvrpcpb.ScanRequest) []*kv
 		if pair.Error != nil {
 			prevErr = pair
 		}
+		if req.KeyOnly {
+			// The values of the committed locks are only used to tell the deletes.
+			pair.Value = nil
+		}
 		validPairs = append(validPairs, pair)
 		if len(validPairs) >= int(limit) {
 			break
@@ -1497,6 +2431,30 @@ func (store *MVCCStore) Scan(reqCtx *requestCtx, req *kvrpcpb.ScanRequest) []*kv
 	return validPairs
 }
 
+// pairsNotAfter returns the pairs that are not after lastKey in the scan order.
+func pairsNotAfter(pairs []*kvrpcpb.KvPair, lastKey []byte, reverse bool) []*kvrpcpb.KvPair {
+	result := pairs[:0]
+	for _, pair := range pairs {
+		cmp := bytes.Compare(pair.Key, lastKey)
+		if (!reverse && cmp <= 0) || (reverse && cmp >= 0) {
+			result = append(result, pair)
+		}
+	}
+	return result
+}
+
+// ScanPrefix scans the keys under the prefix, the end key is computed as the prefix's successor so the
+// scan never iterates beyond the prefix.
+func (store *MVCCStore) ScanPrefix(reqCtx *requestCtx, prefix []byte, limit uint32, version uint64) []*kvrpcpb.KvPair {
+	return store.Scan(reqCtx, &kvrpcpb.ScanRequest{
+		Context:  reqCtx.rpcCtx,
+		StartKey: prefix,
+		EndKey:   dbreader.PrefixNext(prefix),
+		Limit:    limit,
+		Version:  version,
+	})
+}
+
 func (store *MVCCStore) runUpdateSafePointLoop() {
 	var lastSafePoint uint64
 	ticker := time.NewTicker(time.Minute)
@@ -1516,8 +2474,50 @@ func (store *MVCCStore) runUpdateSafePointLoop() {
 	}
 }
 
+// KeyspaceClassifier returns the keyspace of a key, ok is false if the key doesn't belong to any keyspace.
+type KeyspaceClassifier func(key []byte) (keyspace string, ok bool)
+
 type SafePoint struct {
 	timestamp uint64
+
+	// keyspaces holds the safe points of the keyspaces classified by classifier, the keys that don't
+	// belong to a keyspace with safe point use timestamp.
+	mu         sync.RWMutex
+	classifier KeyspaceClassifier
+	keyspaces  map[string]uint64
+}
+
+// SetKeyspaceClassifier sets the classifier used by GC to find the safe point of a key.
+func (sp *SafePoint) SetKeyspaceClassifier(classifier KeyspaceClassifier) {
+	sp.mu.Lock()
+	sp.classifier = classifier
+	sp.mu.Unlock()
+}
+
+// UpdateKeyspaceTS advances the safe point of the keyspace, the safe point can only increase.
+func (sp *SafePoint) UpdateKeyspaceTS(keyspace string, ts uint64) {
+	sp.mu.Lock()
+	if sp.keyspaces == nil {
+		sp.keyspaces = make(map[string]uint64)
+	}
+	if old, ok := sp.keyspaces[keyspace]; !ok || old < ts {
+		sp.keyspaces[keyspace] = ts
+	}
+	sp.mu.Unlock()
+}
+
+// minTS returns the smallest of the global and the keyspace safe points. Badger discards the versions
+// older than it regardless of the keyspace, so it's used as the safe ts of the DB.
+func (sp *SafePoint) minTS() uint64 {
+	minTS := sp.getTS()
+	sp.mu.RLock()
+	for _, ts := range sp.keyspaces {
+		if ts < minTS {
+			minTS = ts
+		}
+	}
+	sp.mu.RUnlock()
+	return minTS
 }
 
 func (sp *SafePoint) UpdateTS(ts uint64) {
@@ -1532,18 +2532,47 @@ func (sp *SafePoint) UpdateTS(ts uint64) {
 	}
 }
 
+func (sp *SafePoint) getTS() uint64 {
+	return atomic.LoadUint64(&sp.timestamp)
+}
+
 // CreateCompactionFilter implements badger.CompactionFilterFactory function.
 func (sp *SafePoint) CreateCompactionFilter(targetLevel int, startKey, endKey []byte) badger.CompactionFilter {
-	return &GCCompactionFilter{
+	f := &GCCompactionFilter{
 		targetLevel: targetLevel,
-		safePoint:   atomic.LoadUint64(&sp.timestamp),
+		safePoint:   sp.getTS(),
 	}
+	sp.mu.RLock()
+	if sp.classifier != nil && len(sp.keyspaces) > 0 {
+		f.classifier = sp.classifier
+		f.keyspaces = make(map[string]uint64, len(sp.keyspaces))
+		for keyspace, ts := range sp.keyspaces {
+			f.keyspaces[keyspace] = ts
+		}
+	}
+	sp.mu.RUnlock()
+	return f
 }
 
 // GCCompactionFilter implements the badger.CompactionFilter interface.
 type GCCompactionFilter struct {
 	targetLevel int
 	safePoint   uint64
+	classifier  KeyspaceClassifier
+	keyspaces   map[string]uint64
+}
+
+// safePointOf returns the safe point of the keyspace of the key, or the global safe point.
+func (f *GCCompactionFilter) safePointOf(key []byte) uint64 {
+	if f.classifier == nil {
+		return f.safePoint
+	}
+	if keyspace, ok := f.classifier(key); ok {
+		if ts, ok := f.keyspaces[keyspace]; ok {
+			return ts
+		}
+	}
+	return f.safePoint
 }
 
 const (
@@ -1562,14 +2591,23 @@ func (f *GCCompactionFilter) Filter(key, value, userMeta []byte) badger.Decision
 	switch key[0] {
 	case metaPrefix, tablePrefix:
 		// For latest version, we need to remove `delete` key, which has value len 0.
-		if mvcc.DBUserMeta(userMeta).CommitTS() < f.safePoint && len(value) == 0 {
+		if mvcc.DBUserMeta(userMeta).CommitTS() < f.safePointOf(key) && len(value) == 0 {
 			return badger.DecisionMarkTombstone
 		}
 	case metaExtraPrefix, tableExtraPrefix:
 		// For latest version, we can only remove `delete` key, which has value len 0.
-		if mvcc.DBUserMeta(userMeta).StartTS() < f.safePoint {
+		safePoint := f.safePoint
+		if f.classifier != nil {
+			safePoint = f.safePointOf(mvcc.DecodeExtraTxnStatusKey(key))
+		}
+		if mvcc.DBUserMeta(userMeta).StartTS() < safePoint {
 			return badger.DecisionDrop
 		}
+	default:
+		// The raw reads only read the latest version, a raw delete is removed like the deletes above.
+		if isRawDataKey(key) && len(userMeta) > 0 && mvcc.DBUserMeta(userMeta).CommitTS() < f.safePoint && len(value) == 0 {
+			return badger.DecisionMarkTombstone
+		}
 	}
 	// Older version are discarded automatically, we need to keep the first valid version.
 	return badger.DecisionKeep
@@ -14,24 +14,37 @@
 package tikv
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/ngaut/unistore/config"
 	"github.com/ngaut/unistore/lockstore"
+	"github.com/ngaut/unistore/metrics"
+	"github.com/ngaut/unistore/tikv/dbreader"
 	"github.com/ngaut/unistore/tikv/mvcc"
 	"github.com/ngaut/unistore/tikv/raftstore"
 	"github.com/ngaut/unistore/util/lockwaiter"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
 	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var _ = Suite(&testMvccSuite{})
@@ -42,11 +55,12 @@ var pessimisitcLockTTL = uint64(5000)
 type testMvccSuite struct{}
 
 type TestStore struct {
-	MvccStore *MVCCStore
-	Svr       *Server
-	DBPath    string
-	LogPath   string
-	c         *C
+	MvccStore     *MVCCStore
+	Svr           *Server
+	RegionManager *MockRegionManager
+	DBPath        string
+	LogPath       string
+	c             *C
 }
 
 func (ts *TestStore) newReqCtx() *requestCtx {
@@ -69,7 +83,8 @@ func (ts *TestStore) newReqCtxWithKeys(startKey, endKey []byte) *requestCtx {
 				Role:    metapb.PeerRole_Voter,
 			},
 		},
-		svr: ts.Svr,
+		svr:       ts.Svr,
+		startTime: time.Now(),
 	}
 }
 
@@ -129,13 +144,14 @@ func NewTestStore(dbPrefix string, logPrefix string, c *C) (*TestStore, error) {
 	}
 	pdClient := NewMockPD(rm)
 	store := NewMVCCStore(&config.DefaultConf, dbBundle, dbPath, safePoint, writer, pdClient)
-	svr := NewServer(nil, store, nil)
+	svr := NewServer(rm, store, nil)
 	return &TestStore{
-		MvccStore: store,
-		Svr:       svr,
-		DBPath:    dbPath,
-		LogPath:   LogPath,
-		c:         c,
+		MvccStore:     store,
+		Svr:           svr,
+		RegionManager: rm,
+		DBPath:        dbPath,
+		LogPath:       LogPath,
+		c:             c,
 	}, nil
 }
 
@@ -897,6 +913,54 @@ func (s *testMvccSuite) TestMvccGet(c *C) {
 	c.Assert(bytes.Compare(res4.Writes[1].ShortValue, emptyVal), Equals, 0)
 }
 
+func (s *testMvccSuite) TestMvccGetByStartTs(c *C) {
+	store, err := NewTestStore("TestMvccGetByStartTs", "TestMvccGetByStartTs", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	lockTTL := uint64(100)
+	k1 := []byte("t1_r1")
+	k2 := []byte("t1_r2")
+	val := []byte("val")
+	MustPrewriteOptimistic(k1, k1, val, 1, lockTTL, 0, store)
+	MustCommitKeyPut(k1, val, 1, 2, store)
+
+	// The lock is found.
+	MustPrewriteOptimistic(k2, k2, val, 3, lockTTL, 0, store)
+	res, resKey, err := store.MvccStore.MvccGetByStartTs(store.newReqCtx(), 3)
+	c.Assert(err, IsNil)
+	c.Assert(resKey, DeepEquals, k2)
+	c.Assert(res.Lock, NotNil)
+	c.Assert(res.Lock.StartTs, Equals, uint64(3))
+
+	// The rollback record is found.
+	MustRollbackKey(k2, 3, store)
+	res, resKey, err = store.MvccStore.MvccGetByStartTs(store.newReqCtx(), 3)
+	c.Assert(err, IsNil)
+	c.Assert(resKey, DeepEquals, k2)
+	c.Assert(res.Lock, IsNil)
+	c.Assert(res.Writes, HasLen, 1)
+	c.Assert(res.Writes[0].Type, Equals, kvrpcpb.Op_Rollback)
+
+	// The region doesn't contain the key.
+	res, resKey, err = store.MvccStore.MvccGetByStartTs(store.newReqCtxWithKeys([]byte("t1_r1"), []byte("t1_r2")), 3)
+	c.Assert(err, IsNil)
+	c.Assert(resKey, IsNil)
+	c.Assert(res, IsNil)
+	// The txn status key of a key before the region can sort after the start of the region.
+	res, resKey, err = store.MvccStore.MvccGetByStartTs(store.newReqCtxWithKeys([]byte("t1_r2\x00"), []byte("t1_r3")), 3)
+	c.Assert(err, IsNil)
+	c.Assert(resKey, IsNil)
+	c.Assert(res, IsNil)
+
+	// The committed version is found.
+	res, resKey, err = store.MvccStore.MvccGetByStartTs(store.newReqCtx(), 1)
+	c.Assert(err, IsNil)
+	c.Assert(resKey, DeepEquals, k1)
+	c.Assert(res.Writes, HasLen, 1)
+	c.Assert(res.Writes[0].CommitTs, Equals, uint64(2))
+}
+
 func (s *testMvccSuite) TestPrimaryKeyOpLock(c *C) {
 	store, err := NewTestStore("PrimaryKeyOpLock", "PrimaryKeyOpLock", c)
 	c.Assert(err, IsNil)
@@ -1121,6 +1185,29 @@ func (s *testMvccSuite) TestRollbackKey(c *C) {
 	MustGetVal(k, v, 18, store)
 }
 
+func (s *testMvccSuite) TestTxnHeartBeat(c *C) {
+	store, err := NewTestStore("TestTxnHeartBeat", "TestTxnHeartBeat", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	k := []byte("tk")
+	v := []byte("v")
+	MustPrewritePut(k, k, v, 10, store)
+	MustTxnHeartBeat(k, 10, 100, 100, store)
+	// The TTL never decreases, a TTL larger than 32 bits is capped instead of wrapping around.
+	MustTxnHeartBeat(k, 10, 1<<32+1, math.MaxUint32, store)
+	MustTxnHeartBeat(k, 10, 200, math.MaxUint32, store)
+
+	// The heartbeat of a finished transaction fails.
+	MustCommit(k, 10, 20, store)
+	_, err = store.MvccStore.TxnHeartBeat(store.newReqCtx(), &kvrpcpb.TxnHeartBeatRequest{
+		PrimaryLock:   k,
+		StartVersion:  10,
+		AdviseLockTtl: 300,
+	})
+	c.Assert(err, FitsTypeOf, &ErrTxnNotFound{})
+}
+
 func (s *testMvccSuite) TestCleanup(c *C) {
 	store, err := NewTestStore("TestCleanup", "TestCleanup", c)
 	c.Assert(err, IsNil)
@@ -1511,6 +1598,40 @@ func MustLoad(startTS, commitTS uint64, store *TestStore, pairs ...string) {
 	}
 }
 
+func (s *testMvccSuite) TestResolveLockBatches(c *C) {
+	store, err := NewTestStore("TestResolveLockBatches", "TestResolveLockBatches", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	// The locks of txn 10 take more than one batch, and are interleaved with the locks of txn 20.
+	n := resolveLockBatchSize*2 + 10
+	var keys10, keys20 [][]byte
+	for i := 0; i < n; i++ {
+		k := []byte(fmt.Sprintf("tk%05d", i))
+		if i%3 == 0 {
+			MustPrewritePut(k, k, k, 20, store)
+			keys20 = append(keys20, k)
+		} else {
+			MustPrewritePut([]byte("tk00001"), k, k, 10, store)
+			keys10 = append(keys10, k)
+		}
+	}
+	c.Assert(store.MvccStore.ResolveLock(store.newReqCtx(), nil, 10, 11), IsNil)
+	for _, k := range keys10 {
+		MustUnLocked(k, store)
+		MustGetVal(k, k, 12, store)
+	}
+	for _, k := range keys20 {
+		MustLocked(k, false, store)
+	}
+
+	// Lite resolution only resolves the given keys.
+	c.Assert(store.MvccStore.ResolveLock(store.newReqCtx(), keys20[:1], 20, 0), IsNil)
+	MustUnLocked(keys20[0], store)
+	MustGetRollback(keys20[0], 20, store)
+	MustLocked(keys20[1], false, store)
+}
+
 func (s *testMvccSuite) TestBatchGet(c *C) {
 	store, err := NewTestStore("TestBatchGet", "TestBatchGet", c)
 	c.Assert(err, IsNil)
@@ -1525,6 +1646,38 @@ func (s *testMvccSuite) TestBatchGet(c *C) {
 	c.Assert(string(pairs[2].Value), Equals, "3")
 }
 
+func (s *testMvccSuite) TestCommitLockedByOtherTxn(c *C) {
+	store, err := NewTestStore("TestCommitLockedByOtherTxn", "TestCommitLockedByOtherTxn", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	// The lock of txn A is rolled back and the key is locked by txn B.
+	k1 := []byte("tk1")
+	MustPrewritePut(k1, k1, []byte("a"), 10, store)
+	MustRollbackKey(k1, 10, store)
+	MustPrewritePut(k1, k1, []byte("b"), 20, store)
+	err = store.MvccStore.Commit(store.newReqCtx(), [][]byte{k1}, 10, 15)
+	c.Assert(err, Equals, ErrReplaced)
+	c.Assert(convertToKeyError(err).Retryable, Not(Equals), "")
+	lock := store.MvccStore.getLock(store.newReqCtx(), k1)
+	c.Assert(lock, NotNil)
+	c.Assert(lock.StartTS, Equals, uint64(20))
+	c.Assert(lock.Value, BytesEquals, []byte("b"))
+	MustGetNone(k1, 16, store)
+
+	// Txn A is already committed by the lock resolver, committing it again succeeds and keeps the lock of txn B.
+	k2 := []byte("tk2")
+	MustPrewritePut(k2, k2, []byte("a"), 30, store)
+	MustCommit(k2, 30, 31, store)
+	MustPrewritePut(k2, k2, []byte("b"), 40, store)
+	MustCommit(k2, 30, 31, store)
+	lock = store.MvccStore.getLock(store.newReqCtx(), k2)
+	c.Assert(lock, NotNil)
+	c.Assert(lock.StartTS, Equals, uint64(40))
+	MustCommit(k2, 40, 41, store)
+	MustGetVal(k2, []byte("b"), 42, store)
+}
+
 func (s *testMvccSuite) TestCommitPessimisticLock(c *C) {
 	store, err := NewTestStore("TestCommitPessimistic", "TestCommitPessimistic", c)
 	c.Assert(err, IsNil)
@@ -1572,6 +1725,58 @@ func (s *testMvccSuite) TestPessimisticLockForce(c *C) {
 	MustGetVal(k, v2, 13, store)
 }
 
+func (s *testMvccSuite) TestPessimisticLockWait(c *C) {
+	store, err := NewTestStore("TestPessimisticLockWait", "TestPessimisticLockWait", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	conf := *store.MvccStore.conf
+	conf.PessimisticTxn.WaitForLockTimeout = 3000
+	store.MvccStore.conf = &conf
+
+	startWait := func(waiter *lockwaiter.Waiter) chan lockwaiter.WaitResult {
+		resultCh := make(chan lockwaiter.WaitResult, 1)
+		go func() {
+			resultCh <- waiter.Wait()
+		}()
+		return resultCh
+	}
+	waitResult := func(resultCh chan lockwaiter.WaitResult) lockwaiter.WaitResult {
+		select {
+		case result := <-resultCh:
+			return result
+		case <-time.After(time.Second):
+			c.Fatal("the waiter is not waked up")
+		}
+		return lockwaiter.WaitResult{}
+	}
+
+	k := []byte("tk")
+	// The waiter is waked up when the lock is rolled back by ResolveLock.
+	MustAcquirePessimisticLock(k, k, 1, 1, store)
+	waiter, err := PessimisticLock(k, k, 2, 100, 2, false, false, store)
+	c.Assert(err, NotNil)
+	c.Assert(waiter, NotNil)
+	resultCh := startWait(waiter)
+	// LockAlwaysWait waits for wait-for-lock-timeout instead of timing out at once.
+	select {
+	case <-resultCh:
+		c.Fatal("the waiter returns before the lock is released")
+	case <-time.After(100 * time.Millisecond):
+	}
+	c.Assert(store.MvccStore.ResolveLock(store.newReqCtx(), [][]byte{k}, 1, 0), IsNil)
+	c.Assert(waitResult(resultCh).WakeupSleepTime, Equals, lockwaiter.WakeUpThisWaiter)
+	MustUnLocked(k, store)
+
+	// The waiter is waked up when the expired lock is rolled back by CheckTxnStatus.
+	MustAcquirePessimisticLock(k, k, 3, 3, store)
+	waiter, err = PessimisticLock(k, k, 4, 100, 4, false, false, store)
+	c.Assert(err, NotNil)
+	c.Assert(waiter, NotNil)
+	MustCheckTxnStatus(k, 3, 0, oracle.ComposeTS(1000, 0), false, 0, 0, kvrpcpb.Action_TTLExpireRollback, store)
+	c.Assert(waitResult(startWait(waiter)).WakeupSleepTime, Equals, lockwaiter.WakeUpThisWaiter)
+	MustUnLocked(k, store)
+}
+
 func (s *testMvccSuite) TestScanSampleStep(c *C) {
 	store, err := NewTestStore("TestScanSampleStep", "TestScanSampleStep", c)
 	c.Assert(err, IsNil)
@@ -1635,3 +1840,1236 @@ func (s *testMvccSuite) TestAsyncCommitPrewrite(c *C) {
 	store.c.Assert(secLock.MinCommitTS, Greater, uint64(0))
 	store.c.Assert(bytes.Compare(secLock.Value, secVal2), Equals, 0)
 }
+
+func (s *testMvccSuite) TestAsyncCommitMaxReadTS(c *C) {
+	store, err := NewTestStore("TestAsyncCommitMaxReadTS", "TestAsyncCommitMaxReadTS", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	pk, secKey := []byte("tpk"), []byte("tsec")
+	// The reads of the primary lock with the max ts don't push the min commit ts.
+	c.Assert(store.MvccStore.CheckKeysLock(maxSystemTS, nil, []byte("tk")), IsNil)
+	// A read ts later than the ts from PD.
+	readTS := oracle.ComposeTS(oracle.GetPhysical(time.Now().Add(time.Hour)), 0)
+	c.Assert(store.MvccStore.CheckKeysLock(readTS, nil, []byte("tk")), IsNil)
+
+	// The secondaries passed to the secondary keys are not recorded.
+	MustPrewriteOptimisticAsyncCommit(pk, pk, []byte("v"), 10, 100, 0, [][]byte{secKey}, store)
+	MustPrewriteOptimisticAsyncCommit(pk, secKey, []byte("v"), 10, 100, 0, [][]byte{secKey}, store)
+	pkLock := store.MvccStore.getLock(store.newReqCtx(), pk)
+	c.Assert(pkLock.Secondaries, HasLen, 1)
+	c.Assert(pkLock.MinCommitTS, Equals, readTS+1)
+	secLock := store.MvccStore.getLock(store.newReqCtx(), secKey)
+	c.Assert(secLock.Secondaries, HasLen, 0)
+	c.Assert(secLock.MinCommitTS, Equals, readTS+1)
+
+	// The transaction can't be committed before the read ts.
+	MustCommitErr(pk, 10, readTS, store)
+	MustCommit(pk, 10, readTS+1, store)
+	MustGetVal(pk, []byte("v"), readTS+2, store)
+}
+
+func (s *testMvccSuite) TestResolveLockWithInfo(c *C) {
+	store, err := NewTestStore("TestResolveLockWithInfo", "TestResolveLockWithInfo", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	k1 := []byte("tk1")
+	k2 := []byte("tk2")
+	v := []byte("v")
+	MustPrewritePut(k1, k1, v, 10, store)
+	MustPrewritePut(k1, k2, v, 10, store)
+	locks, err := store.MvccStore.ScanLock(store.newReqCtx(), nil, 20, 10)
+	c.Assert(err, IsNil)
+	c.Assert(locks, HasLen, 2)
+
+	// The key out of the region is rejected.
+	outside := *locks[0]
+	outside.Key = []byte("va")
+	err = store.MvccStore.ResolveLockWithInfo(store.newReqCtx(), &outside, 15)
+	c.Assert(raftstore.RaftstoreErrToPbError(err).GetKeyNotInRegion(), NotNil)
+
+	// Commit the first key with the scanned lock info, a heartbeat after the scan doesn't change the lock.
+	locks[0].LockTtl += 100
+	err = store.MvccStore.ResolveLockWithInfo(store.newReqCtx(), locks[0], 15)
+	c.Assert(err, IsNil)
+	MustUnLocked(k1, store)
+	MustGetVal(k1, v, 20, store)
+
+	// The second lock is rolled back and replaced by a new transaction underneath.
+	MustRollbackKey(k2, 10, store)
+	MustPrewritePut(k2, k2, v, 30, store)
+	err = store.MvccStore.ResolveLockWithInfo(store.newReqCtx(), locks[1], 0)
+	c.Assert(err, Equals, ErrLockChanged)
+	MustLocked(k2, false, store)
+}
+
+func (s *testMvccSuite) TestScanLockPagination(c *C) {
+	store, err := NewTestStore("TestScanLockPagination", "TestScanLockPagination", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	for i := 0; i < 5; i++ {
+		key := []byte(fmt.Sprintf("tk%d", i))
+		MustPrewritePut(key, key, []byte("v"), uint64(10+i), store)
+	}
+	// The lock not before the max ts isn't returned.
+	MustPrewritePut([]byte("tk5"), []byte("tk5"), []byte("v"), 30, store)
+
+	var pages [][]string
+	var startKey []byte
+	for {
+		locks, err := store.MvccStore.ScanLock(store.newReqCtx(), startKey, 20, 2)
+		c.Assert(err, IsNil)
+		if len(locks) == 0 {
+			break
+		}
+		var page []string
+		for _, lock := range locks {
+			page = append(page, string(lock.Key))
+		}
+		pages = append(pages, page)
+		startKey = append(locks[len(locks)-1].Key, 0)
+	}
+	c.Assert(pages, DeepEquals, [][]string{{"tk0", "tk1"}, {"tk2", "tk3"}, {"tk4"}})
+
+	// Limit 0 doesn't limit the locks.
+	locks, err := store.MvccStore.ScanLock(store.newReqCtx(), nil, 20, 0)
+	c.Assert(err, IsNil)
+	c.Assert(locks, HasLen, 5)
+}
+
+func (s *testMvccSuite) TestScanPrefix(c *C) {
+	store, err := NewTestStore("TestScanPrefix", "TestScanPrefix", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	c.Assert(dbreader.PrefixNext([]byte("ta")), BytesEquals, []byte("tb"))
+	c.Assert(dbreader.PrefixNext([]byte{'t', 0x01, 0xff, 0xff}), BytesEquals, []byte{'t', 0x02})
+	c.Assert(dbreader.PrefixNext([]byte{0xff, 0xff}), IsNil)
+	c.Assert(dbreader.PrefixNext(nil), IsNil)
+
+	keys := [][]byte{
+		[]byte("t"), {'t', 0x01}, {'t', 0x01, 0x00}, {'t', 0x01, 0xff}, {'t', 0x01, 0xff, 0xff}, {'t', 0x02},
+	}
+	for _, k := range keys {
+		MustPrewritePut(k, k, k, 1, store)
+		MustCommit(k, 1, 2, store)
+	}
+	pairs := store.MvccStore.ScanPrefix(store.newReqCtx(), []byte{'t', 0x01}, 10, 3)
+	c.Assert(pairs, HasLen, 4)
+	for i, pair := range pairs {
+		c.Assert(pair.Error, IsNil)
+		c.Assert(pair.Key, BytesEquals, keys[i+1])
+	}
+	pairs = store.MvccStore.ScanPrefix(store.newReqCtx(), []byte{'t', 0x01, 0xff}, 10, 3)
+	c.Assert(pairs, HasLen, 2)
+	c.Assert(pairs[0].Key, BytesEquals, keys[3])
+	c.Assert(pairs[1].Key, BytesEquals, keys[4])
+}
+
+func (s *testMvccSuite) TestReadSkipLocks(c *C) {
+	store, err := NewTestStore("TestReadSkipLocks", "TestReadSkipLocks", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	k1, k2, k3 := []byte("tk1"), []byte("tk2"), []byte("tk3")
+	MustLoad(1, 2, store, "tk1:v1", "tk3:v3")
+	MustPrewritePut(k1, k1, []byte("v2"), 10, store)
+	MustPrewritePut(k2, k2, []byte("v2"), 20, store)
+	MustPrewriteDelete(k3, k3, 30, store)
+
+	getSkip := func(key []byte, skipLocks map[uint64]uint64) ([]byte, error) {
+		return store.MvccStore.GetSkipLocks(store.newReqCtx(), key, 40, skipLocks)
+	}
+	// Committed before the read ts, the value of the lock is visible.
+	val, err := getSkip(k1, map[uint64]uint64{10: 15})
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("v2"))
+	// Rolled back or committed after the read ts, the old value is visible.
+	val, err = getSkip(k1, map[uint64]uint64{10: 0})
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("v1"))
+	val, err = getSkip(k1, map[uint64]uint64{10: 50})
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("v1"))
+	// Locks not in the skip set are still checked.
+	_, err = getSkip(k2, map[uint64]uint64{10: 15})
+	c.Assert(err, NotNil)
+	val, err = getSkip(k3, map[uint64]uint64{30: 35})
+	c.Assert(err, IsNil)
+	c.Assert(val, IsNil)
+
+	scanReq := &kvrpcpb.ScanRequest{
+		Context:  store.newReqCtx().rpcCtx,
+		StartKey: []byte("t"),
+		Limit:    10,
+		Version:  40,
+	}
+	pairs := store.MvccStore.ScanSkipLocks(store.newReqCtx(), scanReq, map[uint64]uint64{10: 15, 20: 0, 30: 35})
+	c.Assert(pairs, HasLen, 1)
+	c.Assert(pairs[0].Key, BytesEquals, k1)
+	c.Assert(pairs[0].Value, BytesEquals, []byte("v2"))
+	pairs = store.MvccStore.ScanSkipLocks(store.newReqCtx(), scanReq, map[uint64]uint64{10: 0, 30: 0})
+	c.Assert(pairs, HasLen, 3)
+	c.Assert(pairs[0].Value, BytesEquals, []byte("v1"))
+	c.Assert(pairs[1].Key, BytesEquals, k2)
+	c.Assert(pairs[1].Error, NotNil)
+	c.Assert(pairs[2].Value, BytesEquals, []byte("v3"))
+}
+
+// startGCWorker starts the background GC worker which is disabled by default.
+func startGCWorker(store *TestStore) {
+	store.MvccStore.gcWorker = newGCWorker(store.MvccStore)
+	store.MvccStore.gcWorker.start()
+}
+
+func (s *testMvccSuite) TestOldestVersion(c *C) {
+	store, err := NewTestStore("TestOldestVersion", "TestOldestVersion", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	startGCWorker(store)
+
+	k := []byte("tk")
+	c.Assert(store.MvccStore.OldestVersion(store.newReqCtx(), k), Equals, uint64(0))
+
+	MustPrewritePut(k, k, []byte("v1"), 5, store)
+	MustCommit(k, 5, 10, store)
+	c.Assert(store.MvccStore.OldestVersion(store.newReqCtx(), k), Equals, uint64(10))
+
+	MustPrewritePut(k, k, []byte("v2"), 15, store)
+	MustCommit(k, 15, 20, store)
+	MustPrewriteDelete(k, k, 25, store)
+	MustCommit(k, 25, 30, store)
+	// Rollbacks and uncommitted locks are not committed versions.
+	MustPrewritePut(k, k, []byte("v3"), 35, store)
+	MustRollbackKey(k, 35, store)
+	MustPrewritePut(k, k, []byte("v4"), 45, store)
+	c.Assert(store.MvccStore.OldestVersion(store.newReqCtx(), k), Equals, uint64(10))
+
+	MustCommit(k, 45, 50, store)
+
+	// The delete is the latest version before the safe point, it's collected with the versions it deletes.
+	safePoint := uint64(35)
+	MustGC(k, safePoint, store)
+	deadline := time.Now().Add(5 * time.Second)
+	for store.MvccStore.gcWorker.finishedSafePoint() < safePoint {
+		c.Assert(time.Now().Before(deadline), IsTrue)
+		time.Sleep(10 * time.Millisecond)
+	}
+	oldest := store.MvccStore.OldestVersion(store.newReqCtx(), k)
+	c.Assert(oldest >= safePoint, IsTrue)
+	c.Assert(oldest, Equals, uint64(50))
+	c.Assert(store.MvccStore.OldestVersion(store.newReqCtx(), []byte("tk2")), Equals, uint64(0))
+}
+
+func histogramSample(c *C, vec *prometheus.HistogramVec, tp string) (uint64, float64) {
+	m := &dto.Metric{}
+	c.Assert(vec.WithLabelValues(tp).(prometheus.Histogram).Write(m), IsNil)
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func (s *testMvccSuite) TestWriteBatchMetrics(c *C) {
+	store, err := NewTestStore("TestWriteBatchMetrics", "TestWriteBatchMetrics", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	prewriteCount, prewriteKeys := histogramSample(c, metrics.WriteBatchKeys, writeBatchPrewrite)
+	commitCount, commitKeys := histogramSample(c, metrics.WriteBatchKeys, writeBatchCommit)
+	_, commitBytes := histogramSample(c, metrics.WriteBatchBytes, writeBatchCommit)
+
+	startTS := uint64(10)
+	totalKeys, totalBytes := 0, 0
+	for _, n := range []int{1, 3, 10} {
+		var mutations []*kvrpcpb.Mutation
+		var keys [][]byte
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("tk%d_%d", n, i))
+			mutations = append(mutations, newMutation(kvrpcpb.Op_Put, key, []byte("value")))
+			keys = append(keys, key)
+			totalBytes += len(key) + len("value")
+		}
+		totalKeys += n
+		err = store.MvccStore.Prewrite(store.newReqCtx(), &kvrpcpb.PrewriteRequest{
+			Mutations:    mutations,
+			PrimaryLock:  keys[0],
+			StartVersion: startTS,
+			LockTtl:      lockTTL,
+		})
+		c.Assert(err, IsNil)
+		c.Assert(store.MvccStore.Commit(store.newReqCtx(), keys, startTS, startTS+1), IsNil)
+		startTS += 10
+	}
+
+	count, sum := histogramSample(c, metrics.WriteBatchKeys, writeBatchPrewrite)
+	c.Assert(count-prewriteCount, Equals, uint64(3))
+	c.Assert(sum-prewriteKeys, Equals, float64(totalKeys))
+	count, sum = histogramSample(c, metrics.WriteBatchKeys, writeBatchCommit)
+	c.Assert(count-commitCount, Equals, uint64(3))
+	c.Assert(sum-commitKeys, Equals, float64(totalKeys))
+	_, sum = histogramSample(c, metrics.WriteBatchBytes, writeBatchCommit)
+	c.Assert(sum-commitBytes, Equals, float64(totalBytes))
+}
+
+func (s *testMvccSuite) TestGroupCommit(c *C) {
+	store, err := NewTestStore("TestGroupCommit", "TestGroupCommit", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	conf := config.DefaultConf
+	conf.Server.WriteBatchWait = "1s"
+	conf.Server.WriteBatchMaxKeys = 4
+	bundle := &mvcc.DBBundle{DB: store.MvccStore.db, LockStore: store.MvccStore.lockStore}
+	writer := NewDBWriter(&conf, bundle, nil)
+	writer.Open()
+	defer writer.Close()
+
+	m := &dto.Metric{}
+	c.Assert(metrics.GroupCommitSize.Write(m), IsNil)
+	groups, writes := m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+
+	// The writes wait for each other until a group has 4 keys.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			batch := writer.NewWriteBatch(uint64(10+i), 0, nil)
+			batch.Rollback([]byte(fmt.Sprintf("tk%d", i)), false)
+			c.Check(writer.Write(batch), IsNil)
+		}(i)
+	}
+	wg.Wait()
+	c.Assert(metrics.GroupCommitSize.Write(m), IsNil)
+	c.Assert(m.GetHistogram().GetSampleCount()-groups, Equals, uint64(2))
+	c.Assert(m.GetHistogram().GetSampleSum()-writes, Equals, float64(8))
+
+	txn := store.MvccStore.db.NewTransaction(false)
+	defer txn.Discard()
+	txn.SetReadTS(maxSystemTS)
+	for i := 0; i < 8; i++ {
+		_, err = txn.Get(mvcc.EncodeExtraTxnStatusKey([]byte(fmt.Sprintf("tk%d", i)), uint64(10+i)))
+		c.Assert(err, IsNil)
+	}
+}
+
+func (s *testMvccSuite) TestSyncValueLogs(c *C) {
+	dir, err := ioutil.TempDir("", "TestSyncValueLogs")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "000001.vlog"), []byte("entries"), 0644), IsNil)
+	c.Assert(syncValueLogs(dir), IsNil)
+	// The raft engine doesn't exist without raft.
+	c.Assert(syncValueLogs(filepath.Join(dir, "raft")), IsNil)
+}
+
+func (s *testMvccSuite) TestLockWAL(c *C) {
+	dir, err := ioutil.TempDir("", "TestLockWAL")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	ls := lockstore.NewMemStore(4096)
+	ls.Put([]byte("ta"), []byte("va"))
+	c.Assert(dumpLocks(ls, dir), IsNil)
+
+	wal, err := RecoverLockStore(dir, lockstore.NewMemStore(4096), true)
+	c.Assert(err, IsNil)
+	prewrite, commit := new(writeLockBatch), new(writeLockBatch)
+	prewrite.set([]byte("tb"), []byte("vb"))
+	prewrite.set([]byte("tc"), []byte("vc"))
+	commit.delete([]byte("ta"))
+	commit.delete([]byte("tb"))
+	c.Assert(wal.log([]*writeLockBatch{prewrite, commit}), IsNil)
+	// A crash in the middle of a write leaves a broken record.
+	wal.w.Write([]byte{1, 2, 3})
+	c.Assert(wal.w.Flush(), IsNil)
+	wal.f.Close()
+
+	ls = lockstore.NewMemStore(4096)
+	wal, err = RecoverLockStore(dir, ls, true)
+	c.Assert(err, IsNil)
+	defer wal.f.Close()
+	c.Assert(ls.Len(), Equals, 1)
+	c.Assert(ls.Get([]byte("tc"), nil), BytesEquals, []byte("vc"))
+	// The recovered locks are dumped and the WAL is truncated.
+	info, err := wal.f.Stat()
+	c.Assert(err, IsNil)
+	c.Assert(info.Size(), Equals, int64(0))
+	var keys []string
+	c.Assert(ReadLockDump(filepath.Join(dir, LockDumpFile), func(key, val []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	}), IsNil)
+	c.Assert(keys, DeepEquals, []string{"tc"})
+}
+
+// failingWriter writes at most n bytes to w, then fails.
+type failingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > fw.n {
+		n, _ := fw.w.Write(p[:fw.n])
+		fw.n = 0
+		return n, errors.New("injected write error")
+	}
+	fw.n -= len(p)
+	return fw.w.Write(p)
+}
+
+func (s *testMvccSuite) TestLockWALWriteError(c *C) {
+	dir, err := ioutil.TempDir("", "TestLockWALWriteError")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	wal, err := RecoverLockStore(dir, lockstore.NewMemStore(4096), true)
+	c.Assert(err, IsNil)
+	first := new(writeLockBatch)
+	first.set([]byte("ta"), []byte("va"))
+	c.Assert(wal.log([]*writeLockBatch{first}), IsNil)
+
+	// The write fails after a complete record of the batch is flushed.
+	failed := new(writeLockBatch)
+	failed.set([]byte("tb"), []byte("vb"))
+	failed.set([]byte("tc"), []byte("vc"))
+	recordSize := lockWALHeaderSize + 4
+	wal.w = bufio.NewWriterSize(&failingWriter{w: wal.f, n: recordSize + 1}, recordSize)
+	c.Assert(wal.log([]*writeLockBatch{failed}), NotNil)
+	info, err := wal.f.Stat()
+	c.Assert(err, IsNil)
+	c.Assert(info.Size(), Equals, int64(recordSize))
+
+	// The later writes succeed.
+	last := new(writeLockBatch)
+	last.set([]byte("td"), []byte("vd"))
+	c.Assert(wal.log([]*writeLockBatch{last}), IsNil)
+	wal.f.Close()
+
+	ls := lockstore.NewMemStore(4096)
+	wal, err = RecoverLockStore(dir, ls, true)
+	c.Assert(err, IsNil)
+	defer wal.f.Close()
+	c.Assert(ls.Len(), Equals, 2)
+	c.Assert(ls.Get([]byte("ta"), nil), BytesEquals, []byte("va"))
+	c.Assert(ls.Get([]byte("tb"), nil), IsNil)
+	c.Assert(ls.Get([]byte("td"), nil), BytesEquals, []byte("vd"))
+}
+
+func (s *testMvccSuite) TestLatches(c *C) {
+	l := newLatches()
+	c.Assert(len(l.slots) >= minLatchSlots, IsTrue)
+	c.Assert(len(l.slots)&(len(l.slots)-1), Equals, 0)
+
+	// The increments of the same keys are serialized by the latches.
+	hashes := keysToHashVals([]byte("ta"), []byte("tb"))
+	var wg sync.WaitGroup
+	var counter int
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.acquire(hashes)
+				counter++
+				l.release(hashes)
+			}
+		}()
+	}
+	wg.Wait()
+	c.Assert(counter, Equals, 6400)
+
+	// The latch of a key is granted in FIFO order.
+	hash := hashes[0]
+	queueLen := func() int {
+		slot := l.slot(hash)
+		slot.mu.Lock()
+		defer slot.mu.Unlock()
+		return len(slot.queues[hash])
+	}
+	c.Assert(l.acquire([]uint64{hash}), Equals, 0)
+	order := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		go func(i int) {
+			c.Check(l.acquire([]uint64{hash}), Equals, 1)
+			order <- i
+			l.release([]uint64{hash})
+		}(i)
+		for queueLen() != i+2 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	l.release([]uint64{hash})
+	for i := 0; i < 5; i++ {
+		c.Assert(<-order, Equals, i)
+	}
+}
+
+func (s *testMvccSuite) TestResolveLockAsync(c *C) {
+	store, err := NewTestStore("TestResolveLockAsync", "TestResolveLockAsync", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	pk := []byte("tpk")
+	keys := [][]byte{pk, []byte("tk1"), []byte("tk2")}
+	v := []byte("v")
+	for _, key := range keys {
+		MustPrewritePut(pk, key, v, 10, store)
+	}
+	rollbackKey := []byte("tk3")
+	MustPrewritePut(rollbackKey, rollbackKey, v, 11, store)
+
+	results := make(chan error, 2)
+	store.MvccStore.ResolveLockAsync(store.newReqCtx(), 10, 20, func(err error) { results <- err })
+	store.MvccStore.ResolveLockAsync(store.newReqCtx(), 11, 0, func(err error) { results <- err })
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			c.Assert(err, IsNil)
+		case <-time.After(5 * time.Second):
+			c.Fatal("async resolve lock timeout")
+		}
+	}
+	for _, key := range keys {
+		MustUnLocked(key, store)
+		MustGetVal(key, v, 20, store)
+	}
+	MustUnLocked(rollbackKey, store)
+	MustGetRollback(rollbackKey, 11, store)
+}
+
+func (s *testMvccSuite) TestGCGracePeriod(c *C) {
+	store, err := NewTestStore("TestGCGracePeriod", "TestGCGracePeriod", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	atomic.StoreInt64(&store.MvccStore.gcGracePeriod, int64(10*time.Second))
+
+	physical := time.Now().UnixNano() / int64(time.Millisecond)
+	tsAt := func(ms int64) uint64 { return oracle.ComposeTS(ms, 0) }
+	k := []byte("tk")
+	// One version inside the grace window and one outside of it.
+	outsideTS := tsAt(physical - 20000)
+	insideTS := tsAt(physical - 5000)
+	MustPrewritePut(k, k, []byte("v1"), outsideTS-1, store)
+	MustCommit(k, outsideTS-1, outsideTS, store)
+	MustPrewritePut(k, k, []byte("v2"), insideTS-1, store)
+	MustCommit(k, insideTS-1, insideTS, store)
+
+	store.MvccStore.UpdateSafePoint(tsAt(physical))
+	gcTS := store.MvccStore.safePoint.getTS()
+	c.Assert(gcTS, Equals, tsAt(physical-10000))
+	// The version inside the grace window is still readable, the older one is collectable.
+	c.Assert(store.MvccStore.CheckReadTS(insideTS), IsNil)
+	MustGetVal(k, []byte("v2"), insideTS, store)
+	c.Assert(store.MvccStore.CheckReadTS(outsideTS), NotNil)
+
+	// A safe point within the grace period doesn't move the GC safe point.
+	atomic.StoreInt64(&store.MvccStore.gcGracePeriod, int64(100000*time.Hour))
+	store.MvccStore.UpdateSafePoint(tsAt(physical + 1000))
+	c.Assert(store.MvccStore.safePoint.getTS(), Equals, gcTS)
+}
+
+func (s *testMvccSuite) TestBackgroundGC(c *C) {
+	store, err := NewTestStore("TestBackgroundGC", "TestBackgroundGC", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	startGCWorker(store)
+	conf := *store.MvccStore.conf
+	conf.GC.BatchKeys = 1
+	store.MvccStore.conf = &conf
+
+	k1, k2, k3 := []byte("tk1"), []byte("tk2"), []byte("tk3")
+	MustLoad(1, 2, store, "tk1:v2", "tk2:v2")
+	MustLoad(3, 4, store, "tk1:v4")
+	MustPrewriteDelete(k2, k2, 3, store)
+	MustCommit(k2, 3, 4, store)
+	MustLoad(5, 6, store, "tk1:v6")
+	MustRollbackKey(k3, 3, store)
+
+	store.MvccStore.UpdateSafePoint(5)
+	deadline := time.Now().Add(5 * time.Second)
+	for store.MvccStore.gcWorker.finishedSafePoint() < 5 {
+		c.Assert(time.Now().Before(deadline), IsTrue)
+		time.Sleep(10 * time.Millisecond)
+	}
+	get := func(key []byte, readTS uint64) []byte {
+		txn := store.MvccStore.db.NewTransaction(false)
+		defer txn.Discard()
+		txn.SetReadTS(readTS)
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		c.Assert(err, IsNil)
+		val, err := item.Value()
+		c.Assert(err, IsNil)
+		return val
+	}
+	// The version older than the latest version before the safe point is purged.
+	c.Assert(get(k1, 3), IsNil)
+	c.Assert(get(k1, 5), BytesEquals, []byte("v4"))
+	c.Assert(get(k1, 6), BytesEquals, []byte("v6"))
+	// The delete before the safe point is purged with the versions it deletes.
+	c.Assert(get(k2, 5), IsNil)
+	c.Assert(store.MvccStore.checkExtraTxnStatus(store.newReqCtx(), k3, 3).isRollback, IsFalse)
+}
+
+func (s *testMvccSuite) TestIncrementalScan(c *C) {
+	store, err := NewTestStore("TestIncrementalScan", "TestIncrementalScan", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	// Before fromTS.
+	MustPrewritePut([]byte("ta"), []byte("ta"), []byte("a1"), 1, store)
+	MustCommit([]byte("ta"), 1, 2, store)
+	MustPrewritePut([]byte("tb"), []byte("tb"), []byte("b1"), 3, store)
+	MustCommit([]byte("tb"), 3, 4, store)
+	MustPrewritePut([]byte("tc"), []byte("tc"), []byte("c1"), 5, store)
+	MustCommit([]byte("tc"), 5, 6, store)
+	fromTS := uint64(10)
+	// After fromTS.
+	MustPrewritePut([]byte("tb"), []byte("tb"), []byte("b2"), 11, store)
+	MustCommit([]byte("tb"), 11, 12, store)
+	MustPrewriteDelete([]byte("tc"), []byte("tc"), 13, store)
+	MustCommit([]byte("tc"), 13, 14, store)
+	MustPrewritePut([]byte("td"), []byte("td"), []byte("d1"), 15, store)
+	MustCommit([]byte("td"), 15, 16, store)
+	// After the snapshot.
+	MustPrewritePut([]byte("te"), []byte("te"), []byte("e1"), 21, store)
+	MustCommit([]byte("te"), 21, 22, store)
+
+	type change struct {
+		key      string
+		value    string
+		deleted  bool
+		commitTS uint64
+	}
+	var changes []change
+	err = store.newReqCtx().getDBReader().IncrementalScan([]byte("ta"), []byte("tz"), fromTS, 20,
+		func(key, value []byte, commitTS uint64) error {
+			changes = append(changes, change{string(key), string(value), value == nil, commitTS})
+			return nil
+		})
+	c.Assert(err, IsNil)
+	c.Assert(changes, DeepEquals, []change{
+		{"tb", "b2", false, 12},
+		{"tc", "", true, 14},
+		{"td", "d1", false, 16},
+	})
+}
+
+func (s *testMvccSuite) TestPrewriteDryRun(c *C) {
+	store, err := NewTestStore("TestPrewriteDryRun", "TestPrewriteDryRun", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	locked, conflict, free := []byte("ta"), []byte("tb"), []byte("tc")
+	v := []byte("v")
+	MustPrewritePut(locked, locked, v, 5, store)
+	MustPrewritePut(conflict, conflict, v, 11, store)
+	MustCommit(conflict, 11, 15, store)
+
+	req := &kvrpcpb.PrewriteRequest{
+		Mutations: []*kvrpcpb.Mutation{
+			newMutation(kvrpcpb.Op_Put, free, v),
+			newMutation(kvrpcpb.Op_Put, conflict, v),
+			newMutation(kvrpcpb.Op_Put, locked, v),
+		},
+		PrimaryLock:  free,
+		StartVersion: 10,
+		LockTtl:      lockTTL,
+	}
+	errs := store.MvccStore.PrewriteDryRun(store.newReqCtx(), req)
+	c.Assert(errs, HasLen, 3)
+	// The mutations are sorted.
+	c.Assert(req.Mutations[0].Key, BytesEquals, locked)
+	lockErr, ok := errs[0].(*ErrLocked)
+	c.Assert(ok, IsTrue)
+	c.Assert(lockErr.Lock.StartTS, Equals, uint64(5))
+	_, ok = errs[1].(*ErrConflict)
+	c.Assert(ok, IsTrue)
+	c.Assert(errs[2], IsNil)
+
+	// Nothing is written.
+	MustUnLocked(free, store)
+	MustUnLocked(conflict, store)
+	lock := store.MvccStore.getLock(store.newReqCtx(), locked)
+	c.Assert(lock, NotNil)
+	c.Assert(lock.StartTS, Equals, uint64(5))
+	MustGetVal(conflict, v, 20, store)
+}
+
+func (s *testMvccSuite) TestMaxLocksPerRegion(c *C) {
+	store, err := NewTestStore("TestMaxLocksPerRegion", "TestMaxLocksPerRegion", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	conf := *store.MvccStore.conf
+	conf.Server.MaxLocksPerRegion = 3
+	store.MvccStore.conf = &conf
+
+	v := []byte("v")
+	k1, k2, k3, k4 := []byte("ta"), []byte("tb"), []byte("tc"), []byte("td")
+	MustPrewritePut(k1, k1, v, 10, store)
+	err = store.MvccStore.Prewrite(store.newReqCtx(), &kvrpcpb.PrewriteRequest{
+		Mutations:    []*kvrpcpb.Mutation{newMutation(kvrpcpb.Op_Put, k2, v), newMutation(kvrpcpb.Op_Put, k3, v)},
+		PrimaryLock:  k2,
+		StartVersion: 20,
+		LockTtl:      lockTTL,
+	})
+	c.Assert(err, IsNil)
+	MustLocked(k3, false, store)
+
+	// The region is full.
+	err = store.MvccStore.Prewrite(store.newReqCtx(), kvPrewriteReq(nil, k4, v, 30))
+	c.Assert(err, Equals, ErrTooManyLocks)
+	MustUnLocked(k4, store)
+	// The locks of the same transaction are not counted again.
+	MustPrewritePut(k1, k1, v, 10, store)
+
+	MustCommit(k1, 10, 11, store)
+	MustPrewritePut(k4, k4, v, 30, store)
+	MustLocked(k4, false, store)
+}
+
+func (s *testMvccSuite) TestApplyBatch(c *C) {
+	store, err := NewTestStore("TestApplyBatch", "TestApplyBatch", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	ka, kb, kc := []byte("ta"), []byte("tb"), []byte("tc")
+	MustPrewritePut(kb, kb, []byte("b"), 1, store)
+	MustCommit(kb, 1, 2, store)
+
+	lock := &mvcc.MvccLock{
+		MvccLockHdr: mvcc.MvccLockHdr{StartTS: 20, TTL: 100, Op: uint8(kvrpcpb.Op_Put), PrimaryLen: uint16(len(kc))},
+		Primary:     kc,
+		Value:       []byte("c"),
+	}
+	ops := []BatchOp{
+		{Type: BatchOpPut, Key: ka, Value: []byte("a")},
+		{Type: BatchOpDelete, Key: kb},
+		{Type: BatchOpLock, Key: kc, Lock: lock},
+	}
+
+	// Keys out of the region reject the whole batch.
+	badOps := append(append([]BatchOp{}, ops...), BatchOp{Type: BatchOpPut, Key: []byte("ua"), Value: []byte("x")})
+	c.Assert(store.MvccStore.ApplyBatch(store.newReqCtx(), 10, 11, badOps), NotNil)
+	MustGetNone(ka, 20, store)
+	MustGetVal(kb, []byte("b"), 20, store)
+	MustUnLocked(kc, store)
+	// So do duplicated keys.
+	badOps = append(append([]BatchOp{}, ops...), BatchOp{Type: BatchOpDelete, Key: ka})
+	c.Assert(store.MvccStore.ApplyBatch(store.newReqCtx(), 10, 11, badOps), NotNil)
+	MustGetNone(ka, 20, store)
+
+	c.Assert(store.MvccStore.ApplyBatch(store.newReqCtx(), 10, 11, ops), IsNil)
+	MustGetVal(ka, []byte("a"), 11, store)
+	MustGetNone(ka, 10, store)
+	MustGetNone(kb, 11, store)
+	MustGetVal(kb, []byte("b"), 10, store)
+	MustLocked(kc, false, store)
+	injected := store.MvccStore.getLock(store.newReqCtx(), kc)
+	c.Assert(injected.StartTS, Equals, uint64(20))
+	c.Assert(injected.Value, BytesEquals, []byte("c"))
+}
+
+func (s *testMvccSuite) TestCleanupTxn(c *C) {
+	store, err := NewTestStore("TestCleanupTxn", "TestCleanupTxn", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	pk, sk1, sk2 := []byte("ta"), []byte("tb"), []byte("tc")
+	v := []byte("v")
+	for _, key := range [][]byte{pk, sk1, sk2} {
+		MustPrewritePut(pk, key, v, 10, store)
+	}
+	MustRollbackKey(sk1, 10, store)
+	MustRollbackKey(sk2, 10, store)
+	MustLocked(pk, false, store)
+
+	// Only primaries can be cleaned up.
+	MustPrewritePut(pk, []byte("td"), v, 10, store)
+	c.Assert(store.MvccStore.CleanupTxn(store.newReqCtx(), []byte("td"), 10), NotNil)
+	MustRollbackKey([]byte("td"), 10, store)
+
+	c.Assert(store.MvccStore.CleanupTxn(store.newReqCtx(), pk, 10), IsNil)
+	for _, key := range [][]byte{pk, sk1, sk2} {
+		MustUnLocked(key, store)
+		MustGetRollback(key, 10, store)
+	}
+	// Idempotent.
+	c.Assert(store.MvccStore.CleanupTxn(store.newReqCtx(), pk, 10), IsNil)
+	MustUnLocked(pk, store)
+	MustGetRollback(pk, 10, store)
+
+	// Committed transactions are not rolled back.
+	MustPrewritePut(pk, pk, v, 20, store)
+	MustCommit(pk, 20, 21, store)
+	err = store.MvccStore.CleanupTxn(store.newReqCtx(), pk, 20)
+	c.Assert(err, NotNil)
+	_, ok := errors.Cause(err).(ErrAlreadyCommitted)
+	c.Assert(ok, IsTrue)
+}
+
+// headerCodec prefixes the values with a schema version byte.
+type headerCodec struct {
+	version byte
+}
+
+func (h headerCodec) Encode(value []byte) []byte {
+	return append([]byte{h.version}, value...)
+}
+
+func (h headerCodec) Decode(stored []byte) ([]byte, error) {
+	if stored[0] != h.version {
+		return nil, errors.Errorf("unexpected schema version %d", stored[0])
+	}
+	return stored[1:], nil
+}
+
+func (s *testMvccSuite) TestValueCodec(c *C) {
+	store, err := NewTestStore("TestValueCodec", "TestValueCodec", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	store.MvccStore.SetValueCodec(headerCodec{version: 7})
+
+	k1, k2 := []byte("ta"), []byte("tb")
+	MustPrewritePut(k1, k1, []byte("v1"), 10, store)
+	MustPrewritePut(k1, k2, []byte("v2"), 10, store)
+	MustCommit(k1, 10, 11, store)
+	MustCommit(k2, 10, 11, store)
+	MustGetVal(k1, []byte("v1"), 20, store)
+	MustGetVal(k2, []byte("v2"), 20, store)
+
+	// Deletes are not encoded.
+	MustPrewriteDelete(k2, k2, 30, store)
+	MustCommit(k2, 30, 31, store)
+	MustGetNone(k2, 40, store)
+
+	txn := store.MvccStore.db.NewTransaction(false)
+	defer txn.Discard()
+	txn.SetReadTS(20)
+	item, err := txn.Get(k1)
+	c.Assert(err, IsNil)
+	stored, err := item.ValueCopy(nil)
+	c.Assert(err, IsNil)
+	c.Assert(stored, BytesEquals, []byte{7, 'v', '1'})
+
+	pairs := store.MvccStore.Scan(store.newReqCtx(), &kvrpcpb.ScanRequest{StartKey: k1, EndKey: []byte("tz"), Limit: 10, Version: 20})
+	c.Assert(pairs, HasLen, 2)
+	c.Assert(pairs[0].Value, BytesEquals, []byte("v1"))
+	c.Assert(pairs[1].Value, BytesEquals, []byte("v2"))
+}
+
+type lockAnnotatedPair struct {
+	key, value []byte
+	lockTS     uint64
+}
+
+type lockAnnotatingProcessor struct {
+	pairs []*lockAnnotatedPair
+}
+
+func (p *lockAnnotatingProcessor) Process(key, value []byte) error {
+	p.pairs = append(p.pairs, &lockAnnotatedPair{key: safeCopy(key), value: safeCopy(value)})
+	return nil
+}
+
+func (p *lockAnnotatingProcessor) SkipValue() bool {
+	return false
+}
+
+func (p *lockAnnotatingProcessor) AnnotateLock(key []byte, lockStartTS uint64) {
+	p.pairs[len(p.pairs)-1].lockTS = lockStartTS
+}
+
+func (s *testMvccSuite) TestScanLockAnnotation(c *C) {
+	store, err := NewTestStore("TestScanLockAnnotation", "TestScanLockAnnotation", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	keys := [][]byte{[]byte("ta"), []byte("tb"), []byte("tc"), []byte("td")}
+	for _, key := range keys {
+		MustPrewritePut(keys[0], key, []byte("v"), 10, store)
+		MustCommit(key, 10, 11, store)
+	}
+	MustPrewritePut(keys[1], keys[1], []byte("v1"), 20, store)
+	MustPrewriteDelete(keys[3], keys[3], 30, store)
+
+	reader := store.newReqCtx().getDBReader()
+	proc := &lockAnnotatingProcessor{}
+	c.Assert(reader.Scan(keys[0], []byte("tz"), 10, 15, proc), IsNil)
+	c.Assert(proc.pairs, HasLen, 4)
+	for _, pair := range proc.pairs {
+		c.Assert(pair.lockTS, Equals, uint64(0))
+	}
+
+	reader.SetLockStore(store.MvccStore.lockStore)
+	proc = &lockAnnotatingProcessor{}
+	c.Assert(reader.Scan(keys[0], []byte("tz"), 10, 15, proc), IsNil)
+	c.Assert(proc.pairs, HasLen, 4)
+	expected := []uint64{0, 20, 0, 30}
+	for i, pair := range proc.pairs {
+		c.Assert(pair.key, BytesEquals, keys[i])
+		c.Assert(pair.value, BytesEquals, []byte("v"))
+		c.Assert(pair.lockTS, Equals, expected[i])
+	}
+}
+
+func (s *testMvccSuite) TestReverseScan(c *C) {
+	store, err := NewTestStore("TestReverseScan", "TestReverseScan", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	for _, key := range []string{"ta", "tb", "tc", "td"} {
+		MustPrewritePut([]byte(key), []byte(key), []byte("v1"), 10, store)
+		MustCommit([]byte(key), 10, 11, store)
+	}
+	MustPrewritePut([]byte("ta"), []byte("ta"), []byte("v2"), 20, store)
+	MustCommit([]byte("ta"), 20, 21, store)
+	MustPrewriteDelete([]byte("tc"), []byte("tc"), 30, store)
+	MustCommit([]byte("tc"), 30, 31, store)
+	MustPrewritePut([]byte("td"), []byte("td"), []byte("v3"), 40, store)
+
+	reverseScan := func(limit int, ts uint64, lockStore bool) []string {
+		reader := store.newReqCtx().getDBReader()
+		if lockStore {
+			reader.SetLockStore(store.MvccStore.lockStore)
+		}
+		proc := &lockAnnotatingProcessor{}
+		c.Assert(reader.ReverseScan([]byte("ta"), []byte("tz"), limit, ts, proc), IsNil)
+		var pairs []string
+		for _, pair := range proc.pairs {
+			pairs = append(pairs, fmt.Sprintf("%s:%s:%d", pair.key, pair.value, pair.lockTS))
+		}
+		return pairs
+	}
+	// The latest version not after the read ts is read, and the deleted keys are skipped.
+	c.Assert(reverseScan(10, 15, false), DeepEquals, []string{"td:v1:0", "tc:v1:0", "tb:v1:0", "ta:v1:0"})
+	c.Assert(reverseScan(10, 25, false), DeepEquals, []string{"td:v1:0", "tc:v1:0", "tb:v1:0", "ta:v2:0"})
+	c.Assert(reverseScan(10, 35, false), DeepEquals, []string{"td:v1:0", "tb:v1:0", "ta:v2:0"})
+	c.Assert(reverseScan(2, 35, false), DeepEquals, []string{"td:v1:0", "tb:v1:0"})
+	c.Assert(reverseScan(10, 5, false), HasLen, 0)
+	// The locks are annotated like the forward scan.
+	c.Assert(reverseScan(2, 35, true), DeepEquals, []string{"td:v1:40", "tb:v1:0"})
+}
+
+func (s *testMvccSuite) TestReadOwnIntent(c *C) {
+	store, err := NewTestStore("TestReadOwnIntent", "TestReadOwnIntent", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	k1, k2, k3 := []byte("ta"), []byte("tb"), []byte("tc")
+	for _, key := range [][]byte{k1, k2, k3} {
+		MustPrewritePut(k1, key, []byte("v1"), 10, store)
+		MustCommit(key, 10, 11, store)
+	}
+	MustPrewritePut(k1, k1, []byte("v2"), 20, store)
+	MustPrewriteDelete(k1, k2, 20, store)
+	MustPrewriteLock(k1, k3, 20, store)
+
+	reader := store.newReqCtx().getDBReader()
+	reader.SetLockStore(store.MvccStore.lockStore)
+	val, err := reader.Get(k1, 20)
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("v1"))
+
+	reader.SetReadOwnIntent(true)
+	val, err = reader.Get(k1, 20)
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("v2"))
+	val, err = reader.Get(k2, 20)
+	c.Assert(err, IsNil)
+	c.Assert(val, HasLen, 0)
+	// A Lock intent doesn't change the value, the committed value is read.
+	val, err = reader.Get(k3, 20)
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("v1"))
+	// The intent of another transaction is never read.
+	val, err = reader.Get(k1, 30)
+	c.Assert(err, IsNil)
+	c.Assert(val, BytesEquals, []byte("v1"))
+}
+
+func (s *testMvccSuite) TestKeyspaceSafePoint(c *C) {
+	store, err := NewTestStore("TestKeyspaceSafePoint", "TestKeyspaceSafePoint", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	// The second byte of the key is the keyspace, 'g' is not a keyspace.
+	sp := store.MvccStore.safePoint
+	sp.SetKeyspaceClassifier(func(key []byte) (string, bool) {
+		if len(key) < 2 || key[1] == 'g' {
+			return "", false
+		}
+		return string(key[1]), true
+	})
+	store.MvccStore.UpdateSafePoint(100)
+	c.Assert(store.MvccStore.UpdateKeyspaceSafePoint("a", 50), IsNil)
+	c.Assert(store.MvccStore.UpdateKeyspaceSafePoint("b", 200), IsNil)
+	c.Assert(sp.minTS(), Equals, uint64(50))
+	// Keyspace safe points can only increase.
+	c.Assert(store.MvccStore.UpdateKeyspaceSafePoint("b", 150), IsNil)
+
+	f := sp.CreateCompactionFilter(0, nil, nil).(*GCCompactionFilter)
+	deleted := func(key []byte, commitTS uint64) badger.Decision {
+		return f.Filter(key, nil, mvcc.NewDBUserMeta(commitTS-1, commitTS))
+	}
+	rolledBack := func(key []byte, startTS uint64) badger.Decision {
+		return f.Filter(mvcc.EncodeExtraTxnStatusKey(key, startTS), nil, mvcc.NewDBUserMeta(startTS, 0))
+	}
+	c.Assert(deleted([]byte("ta1"), 120), Equals, badger.DecisionKeep)
+	c.Assert(deleted([]byte("ta1"), 40), Equals, badger.DecisionMarkTombstone)
+	c.Assert(deleted([]byte("tb1"), 120), Equals, badger.DecisionMarkTombstone)
+	c.Assert(deleted([]byte("tb1"), 220), Equals, badger.DecisionKeep)
+	c.Assert(deleted([]byte("tg1"), 120), Equals, badger.DecisionKeep)
+	c.Assert(deleted([]byte("tg1"), 80), Equals, badger.DecisionMarkTombstone)
+	// Keyspaces without safe point use the global safe point.
+	c.Assert(deleted([]byte("tc1"), 80), Equals, badger.DecisionMarkTombstone)
+
+	c.Assert(rolledBack([]byte("ta1"), 120), Equals, badger.DecisionKeep)
+	c.Assert(rolledBack([]byte("tb1"), 120), Equals, badger.DecisionDrop)
+	c.Assert(rolledBack([]byte("tg1"), 120), Equals, badger.DecisionKeep)
+}
+
+func (s *testMvccSuite) TestMinCommitTsForVisibility(c *C) {
+	store, err := NewTestStore("TestMinCommitTsForVisibility", "TestMinCommitTsForVisibility", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	visible, locked, lockedAbove, newer, absent := []byte("ta"), []byte("tb"), []byte("tc"), []byte("td"), []byte("te")
+	for _, key := range [][]byte{visible, locked, lockedAbove} {
+		MustPrewritePut(key, key, []byte("v"), 10, store)
+		MustCommit(key, 10, 11, store)
+	}
+	MustPrewritePut(locked, locked, []byte("v1"), 15, store)
+	MustPrewritePut(lockedAbove, lockedAbove, []byte("v1"), 25, store)
+	MustPrewritePut(newer, newer, []byte("v"), 29, store)
+	MustCommit(newer, 29, 30, store)
+
+	check := func(key []byte, expected KeyVisibility) {
+		vis, err := store.MvccStore.MinCommitTsForVisibility(store.newReqCtx(), key, 20)
+		c.Assert(err, IsNil)
+		c.Assert(*vis, Equals, expected, Commentf("key %q", key))
+	}
+	check(visible, KeyVisibility{Condition: VersionVisible, LatestCommitTS: 11, MinReadTS: 11})
+	check(locked, KeyVisibility{Condition: VersionLocked, LatestCommitTS: 11, LockStartTS: 15, MinReadTS: 11})
+	check(lockedAbove, KeyVisibility{Condition: VersionVisible, LatestCommitTS: 11, MinReadTS: 11})
+	check(newer, KeyVisibility{Condition: VersionCommittedAfter, LatestCommitTS: 30, MinReadTS: 30})
+	check(absent, KeyVisibility{Condition: VersionNotExist})
+}
+
+// newTestStandAloneRegionManager creates a StandAloneRegionManager without the background workers, it has a
+// region 100 with the range [t, u).
+func newTestStandAloneRegionManager(store *TestStore) (*StandAloneRegionManager, *regionCtx) {
+	rm := &StandAloneRegionManager{
+		bundle:        &mvcc.DBBundle{DB: store.MvccStore.db, LockStore: store.MvccStore.lockStore},
+		pdc:           NewMockPD(store.RegionManager),
+		regionSize:    math.MaxInt64 / 2,
+		splitCooldown: time.Minute,
+		closeCh:       make(chan struct{}),
+		regionManager: regionManager{
+			regions:   make(map[uint64]*regionCtx),
+			storeMeta: &metapb.Store{Id: 1},
+			latches:   newLatches(),
+		},
+	}
+	region := newRegionCtx(&metapb.Region{
+		Id:          100,
+		StartKey:    codec.EncodeBytes(nil, []byte("t")),
+		EndKey:      codec.EncodeBytes(nil, []byte("u")),
+		RegionEpoch: &metapb.RegionEpoch{ConfVer: 1, Version: 1},
+		Peers:       []*metapb.Peer{{Id: 101, StoreId: 1}},
+	}, rm.latches, nil)
+	rm.regions[region.meta.Id] = region
+	return rm, region
+}
+
+func (s *testMvccSuite) TestSplitRegionByKeys(c *C) {
+	store, err := NewTestStore("TestSplitRegionByKeys", "TestSplitRegionByKeys", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	rm, region := newTestStandAloneRegionManager(store)
+	rm.splitKeys = 10
+	region.createTime = time.Now().Add(-time.Hour)
+
+	var keys [][]byte
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("t%02d", i))
+		MustPrewritePut(key, key, key, 10, store)
+		keys = append(keys, key)
+	}
+	reqCtx := store.newReqCtx()
+	reqCtx.regCtx = region
+	c.Assert(store.MvccStore.Commit(reqCtx, keys, 10, 11), IsNil)
+	c.Assert(atomic.LoadInt64(&region.keysDiff), Equals, int64(20))
+
+	rm.checkSplitByKeys()
+	c.Assert(rm.regions, HasLen, 2)
+	right := rm.regions[100]
+	c.Assert(right.startKey, BytesEquals, []byte("t10"))
+	for id, r := range rm.regions {
+		if id != 100 {
+			c.Assert(r.endKey, BytesEquals, []byte("t10"))
+			c.Assert(r.approximateKeys, Equals, int64(10))
+		}
+	}
+	c.Assert(right.approximateKeys, Equals, int64(10))
+
+	// The new regions are in the cooldown, they are not split again even if the keys are over the limit.
+	right.keysDiff = 20
+	rm.checkSplitByKeys()
+	c.Assert(rm.regions, HasLen, 2)
+}
+
+func (s *testMvccSuite) TestSplitRegionBySize(c *C) {
+	store, err := NewTestStore("TestSplitRegionBySize", "TestSplitRegionBySize", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	rm, region := newTestStandAloneRegionManager(store)
+	rm.regionSize = 1000
+	var keys [][]byte
+	for i := 0; i < 40; i++ {
+		key := []byte(fmt.Sprintf("t%02d", i))
+		MustPrewritePut(key, key, bytes.Repeat([]byte("v"), 100), 10, store)
+		keys = append(keys, key)
+	}
+	reqCtx := store.newReqCtx()
+	reqCtx.regCtx = region
+	c.Assert(store.MvccStore.Commit(reqCtx, keys, 10, 11), IsNil)
+
+	// The region is about 4 times of the region size, it's split into 4 regions at once.
+	rm.checkSplitBySize()
+	c.Assert(rm.regions, HasLen, 4)
+	var regions []*regionCtx
+	for _, r := range rm.regions {
+		regions = append(regions, r)
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return bytes.Compare(regions[i].startKey, regions[j].startKey) < 0
+	})
+	c.Assert(regions[0].startKey, BytesEquals, []byte("t"))
+	c.Assert(regions[3].endKey, BytesEquals, []byte("u"))
+	c.Assert(regions[3].meta.Id, Equals, uint64(100))
+	for i, r := range regions {
+		if i > 0 {
+			c.Assert(r.startKey, BytesEquals, regions[i-1].endKey)
+		}
+		c.Assert(r.approximateSize <= 1500, IsTrue, Commentf("region %d size %d", r.meta.Id, r.approximateSize))
+	}
+
+	// The regions of the region size are not split again.
+	rm.checkSplitBySize()
+	c.Assert(rm.regions, HasLen, 4)
+}
+
+func (s *testMvccSuite) TestSplitRegionRequest(c *C) {
+	store, err := NewTestStore("TestSplitRegionRequest", "TestSplitRegionRequest", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+
+	rm, region := newTestStandAloneRegionManager(store)
+	for _, key := range [][]byte{[]byte("ta"), []byte("tc"), []byte("te")} {
+		MustPrewritePut(key, key, key, 10, store)
+		MustCommit(key, 10, 11, store)
+	}
+	rpcCtx := &kvrpcpb.Context{RegionId: region.meta.Id, RegionEpoch: region.getRegionEpoch()}
+
+	// The keys out of the region reject the split.
+	resp := rm.SplitRegion(&kvrpcpb.SplitRegionRequest{Context: rpcCtx, SplitKeys: [][]byte{[]byte("tb"), []byte("ua")}})
+	c.Assert(resp.RegionError.GetKeyNotInRegion(), NotNil)
+	c.Assert(rm.regions, HasLen, 1)
+
+	resp = rm.SplitRegion(&kvrpcpb.SplitRegionRequest{Context: rpcCtx, SplitKeys: [][]byte{[]byte("td"), []byte("tb"), []byte("td"), []byte("t")}})
+	c.Assert(resp.RegionError, IsNil)
+	c.Assert(resp.Regions, HasLen, 3)
+	c.Assert(rm.regions, HasLen, 3)
+	expected := [][2]string{{"t", "tb"}, {"tb", "td"}, {"td", "u"}}
+	for i, meta := range resp.Regions {
+		regCtx := rm.regions[meta.Id]
+		c.Assert(string(regCtx.startKey), Equals, expected[i][0])
+		c.Assert(string(regCtx.endKey), Equals, expected[i][1])
+		c.Assert(regCtx.approximateKeys, Equals, int64(1))
+	}
+	// The old region keeps its id and becomes the rightmost region with a new epoch.
+	c.Assert(resp.Regions[2].Id, Equals, uint64(100))
+	c.Assert(resp.Regions[2].RegionEpoch.Version, Equals, uint64(3))
+
+	// The stale epoch is rejected.
+	resp = rm.SplitRegion(&kvrpcpb.SplitRegionRequest{Context: rpcCtx, SplitKeys: [][]byte{[]byte("te")}})
+	c.Assert(resp.RegionError.GetEpochNotMatch(), NotNil)
+}
+
+func (s *testMvccSuite) TestValidate(c *C) {
+	store, err := NewTestStore("TestValidate", "TestValidate", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	store.bootstrapRegion()
+	store.splitRegion(2, []byte("tm"))
+
+	keys := [][]byte{[]byte("ta"), []byte("tb"), []byte("tn"), []byte("tp")}
+	for _, key := range keys {
+		MustPrewritePut(key, key, []byte("v"), 10, store)
+		MustCommit(key, 10, 11, store)
+	}
+	MustPrewritePut(keys[0], keys[0], []byte("v1"), 20, store)
+	MustRollbackKey(keys[0], 20, store)
+	MustPrewritePut(keys[1], keys[1], []byte("v1"), 30, store)
+	violations, err := store.MvccStore.Validate(store.RegionManager)
+	c.Assert(err, IsNil)
+	c.Assert(violations, HasLen, 0)
+
+	kvTxn := store.MvccStore.db.NewTransaction(true)
+	entries := []*badger.Entry{
+		// The commit ts is less than the start ts.
+		{Key: y.KeyWithTs([]byte("tc"), 40), UserMeta: mvcc.NewDBUserMeta(45, 40), Value: []byte("v")},
+		// The version is not the commit ts.
+		{Key: y.KeyWithTs([]byte("to"), 50), UserMeta: mvcc.NewDBUserMeta(48, 49), Value: []byte("v")},
+		// The committed transaction is rolled back.
+		{Key: y.KeyWithTs(mvcc.EncodeExtraTxnStatusKey(keys[2], 10), 10), UserMeta: mvcc.NewDBUserMeta(10, 0)},
+	}
+	for _, e := range entries {
+		c.Assert(kvTxn.SetEntry(e), IsNil)
+	}
+	c.Assert(kvTxn.Commit(), IsNil)
+	// The committed transaction has a lock left.
+	committedLock := mvcc.MvccLock{MvccLockHdr: mvcc.MvccLockHdr{StartTS: 10, Op: uint8(kvrpcpb.Op_Put)}}
+	store.MvccStore.lockStore.Put(keys[3], committedLock.MarshalBinary())
+	// The rolled back transaction has a lock left.
+	rolledBackLock := mvcc.MvccLock{MvccLockHdr: mvcc.MvccLockHdr{StartTS: 20, Op: uint8(kvrpcpb.Op_Put)}}
+	store.MvccStore.lockStore.Put(keys[0], rolledBackLock.MarshalBinary())
+
+	violations, err = store.MvccStore.Validate(store.RegionManager)
+	c.Assert(err, IsNil)
+	reasons := make(map[string]string)
+	for _, v := range violations {
+		reasons[string(v.Key)] = v.Reason
+	}
+	c.Assert(reasons, DeepEquals, map[string]string{
+		"tc": violationCommitBeforeStart,
+		"to": violationVersionMismatch,
+		"tn": violationRollbackCommitted,
+		"tp": violationCommittedLock,
+		"ta": violationRolledBackLock,
+	})
+}
+
+func (s *testMvccSuite) TestReadLockDump(c *C) {
+	store, err := NewTestStore("TestReadLockDump", "TestReadLockDump", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	MustPrewritePut([]byte("ta"), []byte("ta"), []byte("va"), 10, store)
+	MustPrewritePut([]byte("ta"), []byte("tb"), []byte("vb"), 10, store)
+	MustPrewritePut([]byte("tc"), []byte("tc"), []byte("vc"), 20, store)
+	c.Assert(store.MvccStore.dumpMemLocks(), IsNil)
+
+	var keys []string
+	err = ReadLockDump(filepath.Join(store.DBPath, LockDumpFile), func(key, val []byte) error {
+		lock := mvcc.DecodeLock(val)
+		keys = append(keys, fmt.Sprintf("%s:%d:%s", key, lock.StartTS, lock.Primary))
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Assert(keys, DeepEquals, []string{"ta:10:ta", "tb:10:ta", "tc:20:tc"})
+}
@@ -358,6 +358,7 @@ func (d *peerMsgHandler) onRaftBaseTick() {
 	if d.peer.PendingRemove {
 		return
 	}
+	d.peer.expireReplicaReads(time.Duration(d.ctx.cfg.RaftElectionTimeoutTicks) * d.ctx.cfg.RaftBaseTickInterval)
 	// When having pending snapshot, if election timeout is met, it can't pass
 	// the pending conf change check because first index has been updated to
 	// a value that is larger than last index.
@@ -1026,7 +1027,8 @@ func (d *peerMsgHandler) preProposeRaftCommand(rlog raftlog.RaftLog) (*raft_cmdp
 	// Check whether the store has the right peer to handle the request.
 	regionID := d.regionID()
 	leaderID := d.peer.LeaderId()
-	if !d.peer.IsLeader() {
+	// A follower serves the replica reads with the read index.
+	if !d.peer.IsLeader() && !isReplicaRead(req) {
 		leader := d.peer.getPeerFromCache(leaderID)
 		return nil, &ErrNotLeader{regionID, leader}
 	}
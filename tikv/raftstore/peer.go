@@ -56,6 +56,8 @@ type ReadIndexRequest struct {
 	id             uint64
 	cmds           []*ReqCbPair
 	renewLeaseTime *time.Time
+	// readIndex is the commit index returned by the read index, the read is served once it's applied.
+	readIndex uint64
 }
 
 func NewReadIndexRequest(id uint64, cmds []*ReqCbPair, renewLeaseTime *time.Time) *ReadIndexRequest {
@@ -352,6 +354,7 @@ func NewPeer(storeId uint64, cfg *Config, engines *Engines, region *metapb.Regio
 	p.leaderChecker.region = unsafe.Pointer(region)
 	p.leaderChecker.term.Store(p.Term())
 	p.leaderChecker.appliedIndexTerm.Store(ps.appliedIndexTerm)
+	p.leaderChecker.appliedIndex.Store(ps.AppliedIndex())
 
 	// If this region has only one peer and I am the one, campaign directly.
 	if len(region.GetPeers()) == 1 && region.GetPeers()[0].GetStoreId() == storeId {
@@ -1078,6 +1081,10 @@ func (p *Peer) HandleRaftReadyApply(kv *mvcc.DBBundle, applyMsgs *applyMsgs, rea
 }
 
 func (p *Peer) ApplyReads(kv *mvcc.DBBundle, ready *raft.Ready) {
+	if !p.IsLeader() {
+		p.applyReplicaReads(kv, ready)
+		return
+	}
 	var proposeTime *time.Time
 	if p.readyToHandleRead() {
 		for _, state := range ready.ReadStates {
@@ -1102,6 +1109,7 @@ func (p *Peer) ApplyReads(kv *mvcc.DBBundle, ready *raft.Ready) {
 				panic(fmt.Sprintf("request ctx: %v not equal to read id: %v", state.RequestCtx, read.binaryId()))
 			}
 			p.pendingReads.readyCnt += 1
+			read.readIndex = state.Index
 			proposeTime = read.renewLeaseTime
 		}
 	}
@@ -1123,6 +1131,66 @@ func (p *Peer) ApplyReads(kv *mvcc.DBBundle, ready *raft.Ready) {
 	}
 }
 
+// applyReplicaReads records the read indexes returned by the leader for the replica reads of a follower. The
+// leader may drop a read index request silently, the reads before the returned one are stale then.
+func (p *Peer) applyReplicaReads(kv *mvcc.DBBundle, ready *raft.Ready) {
+	for _, state := range ready.ReadStates {
+		for p.pendingReads.readyCnt < len(p.pendingReads.reads) {
+			read := p.pendingReads.reads[p.pendingReads.readyCnt]
+			if bytes.Equal(state.RequestCtx, read.binaryId()) {
+				read.readIndex = state.Index
+				p.pendingReads.readyCnt += 1
+				break
+			}
+			for _, reqCb := range read.cmds {
+				NotifyStaleReq(p.Term(), reqCb.Cb)
+			}
+			p.pendingReads.reads = append(p.pendingReads.reads[:p.pendingReads.readyCnt], p.pendingReads.reads[p.pendingReads.readyCnt+1:]...)
+		}
+	}
+	if ready.SoftState != nil {
+		p.pendingReads.ClearUncommitted(p.Term())
+	}
+	p.handleReplicaReads(kv)
+}
+
+// handleReplicaReads serves the replica reads of a follower whose read indexes are applied.
+func (p *Peer) handleReplicaReads(kv *mvcc.DBBundle) {
+	for p.pendingReads.readyCnt > 0 {
+		read := p.pendingReads.reads[0]
+		if p.Store().AppliedIndex() < read.readIndex || p.isSplitting() || p.isMerging() {
+			return
+		}
+		p.pendingReads.PopFront()
+		p.pendingReads.readyCnt -= 1
+		for _, reqCb := range read.cmds {
+			resp := p.handleRead(kv, reqCb.Req, true)
+			reqCb.Cb.Done(resp)
+		}
+		read.cmds = nil
+	}
+}
+
+// expireReplicaReads drops the replica reads of a follower still waiting for the read index after timeout, the
+// read index request may be dropped by the leader.
+func (p *Peer) expireReplicaReads(timeout time.Duration) {
+	if p.IsLeader() {
+		return
+	}
+	reads := p.pendingReads.reads[p.pendingReads.readyCnt:]
+	var expired int
+	for expired < len(reads) && time.Since(*reads[expired].renewLeaseTime) > timeout {
+		for _, reqCb := range reads[expired].cmds {
+			NotifyStaleReq(p.Term(), reqCb.Cb)
+		}
+		reads[expired].cmds = nil
+		expired++
+	}
+	if expired > 0 {
+		p.pendingReads.reads = append(p.pendingReads.reads[:p.pendingReads.readyCnt], reads[expired:]...)
+	}
+}
+
 func (p *Peer) PostApply(kv *mvcc.DBBundle, applyState applyState, appliedIndexTerm uint64, merged bool, applyMetrics applyMetrics) bool {
 	hasReady := false
 	if p.IsApplyingSnapshot() {
@@ -1136,6 +1204,7 @@ func (p *Peer) PostApply(kv *mvcc.DBBundle, applyState applyState, appliedIndexT
 	progressToBeUpdated := p.Store().appliedIndexTerm != appliedIndexTerm
 	p.Store().applyState = applyState
 	p.Store().appliedIndexTerm = appliedIndexTerm
+	p.leaderChecker.appliedIndex.Store(applyState.appliedIndex)
 
 	p.PeerStat.WrittenBytes += applyMetrics.writtenBytes
 	p.PeerStat.WrittenKeys += applyMetrics.writtenKeys
@@ -1151,7 +1220,9 @@ func (p *Peer) PostApply(kv *mvcc.DBBundle, applyState applyState, appliedIndexT
 		hasReady = true
 	}
 
-	if p.pendingReads.readyCnt > 0 && p.readyToHandleRead() {
+	if !p.IsLeader() {
+		p.handleReplicaReads(kv)
+	} else if p.pendingReads.readyCnt > 0 && p.readyToHandleRead() {
 		for i := 0; i < p.pendingReads.readyCnt; i++ {
 			read := p.pendingReads.PopFront()
 			if read == nil {
@@ -1401,10 +1472,18 @@ func (p *Peer) readIndex(cfg *Config, req *raft_cmdpb.RaftCmdRequest, errResp *r
 		return false
 	}
 
+	isLeader := p.IsLeader()
+	if !isLeader && p.LeaderId() == InvalidID {
+		// The follower forwards the read index request to the leader, it's dropped if there is no leader.
+		BindRespError(errResp, &ErrNotLeader{p.regionId, nil})
+		cb.Done(errResp)
+		return false
+	}
+
 	now := time.Now()
 	renewLeaseTime := &now
 	readsLen := len(p.pendingReads.reads)
-	if readsLen > 0 {
+	if isLeader && readsLen > 0 {
 		read := p.pendingReads.reads[readsLen-1]
 		if read.renewLeaseTime.Add(cfg.RaftStoreMaxLeaderLease).After(*renewLeaseTime) {
 			read.cmds = append(read.cmds, &ReqCbPair{Req: req, Cb: cb})
@@ -1423,7 +1502,7 @@ func (p *Peer) readIndex(cfg *Config, req *raft_cmdpb.RaftCmdRequest, errResp *r
 	pendingReadCount := p.RaftGroup.Raft.PendingReadCount()
 	readyReadCount := p.RaftGroup.Raft.ReadyReadCount()
 
-	if pendingReadCount == lastPendingReadCount && readyReadCount == lastReadyReadCount {
+	if isLeader && pendingReadCount == lastPendingReadCount && readyReadCount == lastReadyReadCount {
 		// The message gets dropped silently, can't be handled anymore.
 		NotifyStaleReq(p.Term(), cb)
 		return false
@@ -1434,7 +1513,7 @@ func (p *Peer) readIndex(cfg *Config, req *raft_cmdpb.RaftCmdRequest, errResp *r
 
 	// TimeoutNow has been sent out, so we need to propose explicitly to
 	// update leader lease.
-	if p.leaderLease.Inspect(renewLeaseTime) == LeaseState_Suspect {
+	if isLeader && p.leaderLease.Inspect(renewLeaseTime) == LeaseState_Suspect {
 		req := new(raft_cmdpb.RaftCmdRequest)
 		if index, err := p.ProposeNormal(cfg, raftlog.NewRequest(req)); err == nil {
 			meta := &ProposalMeta{
@@ -1696,6 +1775,19 @@ func (p *Peer) inspect(rlog raftlog.RaftLog) (RequestPolicy, error) {
 	return Inspect(p, req)
 }
 
+// isReplicaRead returns true if the request is a read allowed on a follower.
+func isReplicaRead(req *raft_cmdpb.RaftCmdRequest) bool {
+	if !req.GetHeader().GetReplicaRead() || req.AdminRequest != nil || len(req.Requests) == 0 {
+		return false
+	}
+	for _, r := range req.Requests {
+		if r.CmdType != raft_cmdpb.CmdType_Get && r.CmdType != raft_cmdpb.CmdType_Snap {
+			return false
+		}
+	}
+	return true
+}
+
 func Inspect(i RequestInspector, req *raft_cmdpb.RaftCmdRequest) (RequestPolicy, error) {
 	if req.AdminRequest != nil {
 		if GetChangePeerCmd(req) != nil {
@@ -1728,7 +1820,7 @@ func Inspect(i RequestInspector, req *raft_cmdpb.RaftCmdRequest) (RequestPolicy,
 		return RequestPolicy_ProposeNormal, nil
 	}
 
-	if req.Header != nil && req.Header.ReadQuorum {
+	if req.Header != nil && (req.Header.ReadQuorum || req.Header.ReplicaRead) {
 		return RequestPolicy_ReadIndex, nil
 	}
 
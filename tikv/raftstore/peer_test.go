@@ -193,6 +193,15 @@ func TestRequestInspector(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, inspectPolicy, RequestPolicy_ReadIndex)
 
+	// Replica read
+	req.Header = &raft_cmdpb.RaftRequestHeader{ReplicaRead: true}
+	inspectPolicy, err = inspector.inspect(req)
+	assert.Nil(t, err)
+	assert.Equal(t, inspectPolicy, RequestPolicy_ReadIndex)
+	assert.True(t, isReplicaRead(req))
+	req.Requests = append(req.Requests, &raft_cmdpb.Request{CmdType: raft_cmdpb.CmdType_Put})
+	assert.False(t, isReplicaRead(req))
+
 	// Err(_)
 	var errTbl []*raft_cmdpb.RaftCmdRequest
 	for _, op := range []raft_cmdpb.CmdType{raft_cmdpb.CmdType_Prewrite, raft_cmdpb.CmdType_Invalid} {
@@ -30,6 +30,8 @@ import (
 
 type LeaderChecker interface {
 	IsLeader(ctx *kvrpcpb.Context, router *RaftstoreRouter) *errorpb.Error
+	// AppliedIndex returns the applied index of the peer.
+	AppliedIndex() uint64
 }
 
 type leaderChecker struct {
@@ -37,6 +39,7 @@ type leaderChecker struct {
 	invalid          atomic.Bool
 	term             atomic.Uint64
 	appliedIndexTerm atomic.Uint64
+	appliedIndex     atomic.Uint64
 	leaderLease      unsafe.Pointer // *RemoteLease
 	region           unsafe.Pointer // *metapb.Region
 }
@@ -60,6 +63,7 @@ func (c *leaderChecker) IsLeader(ctx *kvrpcpb.Context, router *RaftstoreRouter)
 		RegionEpoch: ctx.RegionEpoch,
 		Term:        ctx.Term,
 		SyncLog:     ctx.SyncLog,
+		ReplicaRead: ctx.ReplicaRead,
 	}
 	cmd := &raft_cmdpb.RaftCmdRequest{
 		Header:   header,
@@ -83,6 +87,10 @@ func (c *leaderChecker) IsLeader(ctx *kvrpcpb.Context, router *RaftstoreRouter)
 	return nil
 }
 
+func (c *leaderChecker) AppliedIndex() uint64 {
+	return c.appliedIndex.Load()
+}
+
 func (c *leaderChecker) isExpired(ctx *kvrpcpb.Context, snapTime *time.Time) (bool, error) {
 	if c.invalid.Load() {
 		return false, &ErrRegionNotFound{RegionId: ctx.RegionId}
@@ -113,7 +121,12 @@ func (c *leaderChecker) isExpired(ctx *kvrpcpb.Context, snapTime *time.Time) (bo
 		return false, err
 	}
 
-	if appliedIndexTerm != term {
+	// The stale reads are served by any peer whose resolved ts covers the read ts, which is checked by the caller.
+	if ctx.StaleRead {
+		return false, nil
+	}
+	// The replica reads are always served with the read index, they can be served by the followers.
+	if ctx.ReplicaRead || appliedIndexTerm != term {
 		return true, nil
 	}
 	return lease.Inspect(snapTime) == LeaseState_Expired, nil
@@ -0,0 +1,518 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/unistore/tikv/dbreader"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+)
+
+// The raw keys are stored in a key space of their own under InternalRawKeyPrefix, so the transactions never read
+// or lock them and the raw reads never see the transactional keys. A raw write is a single version of the data
+// key, the latest version is read and the older ones are dropped by the GC like the overwritten transactional
+// versions. The raw API of a region reads and writes the raw data keys of the raw keys in its range.
+
+// When the raw ttl is enabled, the expire time of a raw value is kept as the start ts of its user meta, so the
+// value is stored as is and only the values put with a ttl expire. The expired keys are hidden from the reads
+// and purged in background.
+
+// ErrRawEmptyValue is returned when putting an empty raw value, an empty value is stored as a delete.
+var ErrRawEmptyValue = errors.New("raw value must not be empty")
+
+// ErrRawTTLDisabled is returned when putting a raw value with a ttl while the raw ttl is disabled.
+var ErrRawTTLDisabled = errors.New("raw ttl is not enabled")
+
+// rawNow returns the current time used by the raw ttl, it's replaced in tests.
+var rawNow = time.Now
+
+// rawExpireTS returns the expire time in unix seconds of a value put now with the ttl in seconds, 0 means
+// the value never expires.
+func rawExpireTS(ttl uint64) uint64 {
+	if ttl == 0 {
+		return 0
+	}
+	return uint64(rawNow().Unix()) + ttl
+}
+
+func rawExpired(expireTS, now uint64) bool {
+	return expireTS != 0 && expireTS <= now
+}
+
+func (store *MVCCStore) rawTTLEnabled() bool {
+	return store.conf != nil && store.conf.Server.RawEnableTTL
+}
+
+// rawDataKey returns the key the raw key is stored at.
+func rawDataKey(key []byte) []byte {
+	dataKey := make([]byte, 0, len(InternalRawKeyPrefix)+len(key))
+	return append(append(dataKey, InternalRawKeyPrefix...), key...)
+}
+
+// isRawDataKey returns true if the key is the data key of a raw key.
+func isRawDataKey(key []byte) bool {
+	return bytes.HasPrefix(key, InternalRawKeyPrefix)
+}
+
+// rawRegionRange returns the range of the raw data keys of the region.
+func rawRegionRange(regCtx *regionCtx) (start, end []byte) {
+	return rawDataRange(regCtx.startKey, regCtx.endKey)
+}
+
+// rawDataRange returns the range of the raw data keys of the raw keys in [startKey, endKey), an empty end key or
+// InternalKeyPrefix is the end of the raw key space.
+func rawDataRange(startKey, endKey []byte) (start, end []byte) {
+	start = rawDataKey(startKey)
+	if len(endKey) == 0 || bytes.Equal(endKey, InternalKeyPrefix) {
+		return start, dbreader.PrefixNext(InternalRawKeyPrefix)
+	}
+	return start, rawDataKey(endKey)
+}
+
+// rawItemExpireTS returns the expire time of a raw item, it's kept as the start ts of the user meta.
+func rawItemExpireTS(item *badger.Item) uint64 {
+	if len(item.UserMeta()) == 0 {
+		return 0
+	}
+	return mvcc.DBUserMeta(item.UserMeta()).StartTS()
+}
+
+// rawItemValue returns a copy of the value of the raw item and its expire time, nil is returned if the key is
+// deleted or expired.
+func (store *MVCCStore) rawItemValue(item *badger.Item, now uint64) ([]byte, uint64, error) {
+	if item.IsEmpty() {
+		return nil, 0, nil
+	}
+	expireTS := rawItemExpireTS(item)
+	if rawExpired(expireTS, now) {
+		return nil, 0, nil
+	}
+	val, err := item.ValueCopy(nil)
+	if err == nil {
+		val, err = store.decodeValue(val)
+	}
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	return val, expireTS, nil
+}
+
+// rawGetByTxn returns a copy of the latest value of the raw key in the txn and its expire time, nil is returned
+// if the key doesn't exist, is deleted or is expired.
+func (store *MVCCStore) rawGetByTxn(txn *badger.Txn, key []byte) ([]byte, uint64, error) {
+	txn.SetReadTS(maxSystemTS)
+	item, err := txn.Get(rawDataKey(key))
+	if err == badger.ErrKeyNotFound {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	return store.rawItemValue(item, uint64(rawNow().Unix()))
+}
+
+// checkKeysInRegion returns an error if any of the keys is out of the region of the request.
+func checkKeysInRegion(regCtx *regionCtx, keys ...[]byte) error {
+	for _, key := range keys {
+		if regCtx.lessThanStartKey(key) || regCtx.greaterEqualEndKey(key) {
+			return errors.Errorf("key %q is not in region %d", key, regCtx.meta.GetId())
+		}
+	}
+	return nil
+}
+
+// rawWriteVersion allocates the version of a raw write of the data keys. The versions are composed from the
+// local clock like the timestamps, so the GC drops the overwritten raw versions once the safe point passes
+// them, and a version is greater than the versions allocated before and the latest versions of the keys, so
+// the write is the latest version of the keys. The keys must be latched.
+func (store *MVCCStore) rawWriteVersion(txn *badger.Txn, dataKeys [][]byte) (uint64, error) {
+	txn.SetReadTS(maxSystemTS)
+	version := oracle.ComposeTS(oracle.GetPhysical(time.Now()), 0)
+	for _, key := range dataKeys {
+		item, err := txn.Get(key)
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if item.Version() >= version {
+			version = item.Version() + 1
+		}
+	}
+	for {
+		last := atomic.LoadUint64(&store.rawVersion)
+		next := version
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapUint64(&store.rawVersion, last, next) {
+			return next, nil
+		}
+	}
+}
+
+// RawGet returns the latest value of the key, nil if the key doesn't exist, is deleted or is expired.
+func (store *MVCCStore) RawGet(reqCtx *requestCtx, key []byte) ([]byte, error) {
+	val, _, err := store.rawGet(reqCtx, key)
+	return val, err
+}
+
+// RawGetKeyTTL returns the remaining ttl in seconds of the key, 0 if the key never expires. notFound is true
+// if the key doesn't exist, is deleted or is expired.
+func (store *MVCCStore) RawGetKeyTTL(reqCtx *requestCtx, key []byte) (ttl uint64, notFound bool, err error) {
+	if !store.rawTTLEnabled() {
+		return 0, false, ErrRawTTLDisabled
+	}
+	val, expireTS, err := store.rawGet(reqCtx, key)
+	if err != nil || val == nil {
+		return 0, val == nil, err
+	}
+	if expireTS == 0 {
+		return 0, false, nil
+	}
+	return expireTS - uint64(rawNow().Unix()), false, nil
+}
+
+func (store *MVCCStore) rawGet(reqCtx *requestCtx, key []byte) ([]byte, uint64, error) {
+	if err := checkKeysInRegion(reqCtx.regCtx, key); err != nil {
+		return nil, 0, err
+	}
+	txn := store.db.NewTransaction(false)
+	defer txn.Discard()
+	return store.rawGetByTxn(txn, key)
+}
+
+// RawBatchGet returns the latest values of the existing keys.
+func (store *MVCCStore) RawBatchGet(reqCtx *requestCtx, keys [][]byte) ([]*kvrpcpb.KvPair, error) {
+	if err := checkKeysInRegion(reqCtx.regCtx, keys...); err != nil {
+		return nil, err
+	}
+	txn := store.db.NewTransaction(false)
+	defer txn.Discard()
+	var pairs []*kvrpcpb.KvPair
+	for _, key := range keys {
+		val, _, err := store.rawGetByTxn(txn, key)
+		if err != nil {
+			return nil, err
+		}
+		if val != nil {
+			pairs = append(pairs, &kvrpcpb.KvPair{Key: key, Value: val})
+		}
+	}
+	return pairs, nil
+}
+
+// RawScan returns the latest values of at most limit keys in the range. In a forward scan the range is
+// [startKey, endKey), in a reverse scan startKey is the exclusive upper bound and endKey is the inclusive
+// lower bound, the keys are returned from the upper bound down. The range is bounded by the region, an
+// empty bound means the bound of the region.
+func (store *MVCCStore) RawScan(reqCtx *requestCtx, startKey, endKey []byte, limit int, keyOnly, reverse bool) ([]*kvrpcpb.KvPair, error) {
+	if limit <= 0 {
+		return nil, nil
+	}
+	lower, upper := startKey, endKey
+	if reverse {
+		lower, upper = endKey, startKey
+	}
+	regionStart, regionEnd := rawRegionRange(reqCtx.regCtx)
+	if lower = rawDataKey(lower); bytes.Compare(lower, regionStart) < 0 {
+		lower = regionStart
+	}
+	if len(upper) == 0 {
+		upper = regionEnd
+	} else if upper = rawDataKey(upper); bytes.Compare(upper, regionEnd) > 0 {
+		upper = regionEnd
+	}
+	txn := store.db.NewTransaction(false)
+	defer txn.Discard()
+	txn.SetReadTS(maxSystemTS)
+	it := dbreader.NewIterator(txn, reverse, lower, upper)
+	defer it.Close()
+	seekKey := lower
+	if reverse {
+		seekKey = upper
+	}
+	now := uint64(rawNow().Unix())
+	var pairs []*kvrpcpb.KvPair
+	var iterated int
+	for it.Seek(seekKey); it.Valid() && len(pairs) < limit; it.Next() {
+		item := it.Item()
+		key := item.Key()
+		if bytes.Compare(key, lower) < 0 || bytes.Compare(key, upper) >= 0 {
+			if reverse && bytes.Equal(key, upper) {
+				continue
+			}
+			break
+		}
+		if iterated%contextCheckKeys == 0 {
+			if err := reqCtx.checkContext(); err != nil {
+				return nil, err
+			}
+		}
+		iterated++
+		if item.IsEmpty() || rawExpired(rawItemExpireTS(item), now) {
+			continue
+		}
+		pair := &kvrpcpb.KvPair{Key: safeCopy(key[len(InternalRawKeyPrefix):])}
+		if !keyOnly {
+			val, _, err := store.rawItemValue(item, now)
+			if err != nil {
+				return nil, err
+			}
+			pair.Value = val
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs, nil
+}
+
+// RawPut writes the values of the keys in one batch, the values expire after ttl seconds if ttl > 0.
+func (store *MVCCStore) RawPut(reqCtx *requestCtx, keys, values [][]byte, ttl uint64) error {
+	for _, val := range values {
+		if err := store.checkRawPut(val, ttl); err != nil {
+			return err
+		}
+	}
+	return store.rawWrite(reqCtx, keys, values, rawExpireTS(ttl))
+}
+
+// checkRawPut checks the value and the ttl of a raw put.
+func (store *MVCCStore) checkRawPut(val []byte, ttl uint64) error {
+	if len(val) == 0 {
+		return ErrRawEmptyValue
+	}
+	if ttl > 0 && !store.rawTTLEnabled() {
+		return ErrRawTTLDisabled
+	}
+	return nil
+}
+
+// RawCompareAndSwap puts the value of the key if its current value is previousValue, or if it doesn't exist
+// when previousNotExist is set. The key is latched from the compare to the swap, so it's atomic with the other
+// raw writes of the key. The current value is returned, nil means the key doesn't exist.
+func (store *MVCCStore) RawCompareAndSwap(reqCtx *requestCtx, key, value, previousValue []byte, previousNotExist bool,
+	ttl uint64) (current []byte, succeed bool, err error) {
+	regCtx := reqCtx.regCtx
+	if err = checkKeysInRegion(regCtx, key); err != nil {
+		return nil, false, err
+	}
+	if err = store.checkRawPut(value, ttl); err != nil {
+		return nil, false, err
+	}
+	hashVals := keysToHashVals(key)
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+	reqCtx.trace("acquire latches")
+
+	txn := store.db.NewTransaction(false)
+	current, _, err = store.rawGetByTxn(txn, key)
+	txn.Discard()
+	if err != nil {
+		return nil, false, err
+	}
+	if previousNotExist {
+		succeed = current == nil
+	} else {
+		succeed = current != nil && bytes.Equal(current, previousValue)
+	}
+	if !succeed {
+		return current, false, nil
+	}
+	return current, true, store.rawWriteLatched(reqCtx, [][]byte{key}, [][]byte{value}, rawExpireTS(ttl))
+}
+
+// RawDelete deletes the keys in one batch.
+func (store *MVCCStore) RawDelete(reqCtx *requestCtx, keys [][]byte) error {
+	return store.rawWrite(reqCtx, keys, nil, 0)
+}
+
+// rawWrite writes the keys as a new version in one write batch, the keys are deleted if values is nil.
+// All the keys are latched during the write, so the batch is atomic with the other raw writes.
+func (store *MVCCStore) rawWrite(reqCtx *requestCtx, keys, values [][]byte, expireTS uint64) error {
+	regCtx := reqCtx.regCtx
+	if err := checkKeysInRegion(regCtx, keys...); err != nil {
+		return err
+	}
+	keys, values = dedupRawKeys(keys, values)
+	hashVals := keysToHashVals(keys...)
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+	reqCtx.trace("acquire latches")
+	return store.rawWriteLatched(reqCtx, keys, values, expireTS)
+}
+
+// dedupRawKeys removes the duplicated keys of a raw write batch, the last value of a key is kept, so every key
+// has a single version in the batch.
+func dedupRawKeys(keys, values [][]byte) ([][]byte, [][]byte) {
+	if len(keys) <= 1 {
+		return keys, values
+	}
+	last := make(map[string]int, len(keys))
+	for i, key := range keys {
+		last[string(key)] = i
+	}
+	if len(last) == len(keys) {
+		return keys, values
+	}
+	dedupKeys := make([][]byte, 0, len(last))
+	var dedupValues [][]byte
+	for i, key := range keys {
+		if last[string(key)] != i {
+			continue
+		}
+		dedupKeys = append(dedupKeys, key)
+		if values != nil {
+			dedupValues = append(dedupValues, values[i])
+		}
+	}
+	return dedupKeys, dedupValues
+}
+
+// rawWriteLatched is rawWrite of the keys which are already latched. The values expire at expireTS if it's
+// not 0, the deletes never expire.
+func (store *MVCCStore) rawWriteLatched(reqCtx *requestCtx, keys, values [][]byte, expireTS uint64) error {
+	regCtx := reqCtx.regCtx
+	dataKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		dataKeys[i] = rawDataKey(key)
+	}
+	if values == nil {
+		expireTS = 0
+	}
+	txn := store.db.NewTransaction(false)
+	version, err := store.rawWriteVersion(txn, dataKeys)
+	txn.Discard()
+	if err != nil {
+		return err
+	}
+	// The expire time is the start ts of the batch, so it's kept in the user meta of the versions.
+	batch := store.dbWriter.NewWriteBatch(expireTS, version, reqCtx.rpcCtx)
+	var diff int
+	for i, dataKey := range dataKeys {
+		lock := &mvcc.MvccLock{MvccLockHdr: mvcc.MvccLockHdr{StartTS: expireTS, Op: uint8(kvrpcpb.Op_Del)}}
+		if values != nil {
+			lock.Op = uint8(kvrpcpb.Op_Put)
+			lock.Value = store.encodeValue(values[i])
+		}
+		batch.Commit(dataKey, lock)
+		diff += len(keys[i]) + len(lock.Value)
+	}
+	atomic.AddInt64(&regCtx.diff, int64(diff))
+	atomic.AddInt64(&regCtx.keysDiff, int64(len(keys)))
+	return store.writeData(reqCtx, batch)
+}
+
+// rawPurgeBatchSize is the max number of expired keys deleted in one batch by the purge.
+const rawPurgeBatchSize = 256
+
+// PurgeExpiredRawKeys deletes the expired raw keys in the region of the request and returns the number of
+// keys deleted. Only the raw data keys with an expire time are checked, the keys are deleted as new versions,
+// and the old versions are removed by the GC.
+func (store *MVCCStore) PurgeExpiredRawKeys(reqCtx *requestCtx) (int, error) {
+	if !store.rawTTLEnabled() {
+		return 0, nil
+	}
+	startKey, endKey := rawRegionRange(reqCtx.regCtx)
+	now := uint64(rawNow().Unix())
+	var purged int
+	for {
+		keys, nextKey, err := store.scanExpiredRawKeys(reqCtx, startKey, endKey, now)
+		if err != nil {
+			return purged, err
+		}
+		if len(keys) > 0 {
+			n, err := store.rawDeleteExpired(reqCtx, keys, now)
+			purged += n
+			if err != nil {
+				return purged, err
+			}
+		}
+		if nextKey == nil {
+			return purged, nil
+		}
+		startKey = nextKey
+	}
+}
+
+// scanExpiredRawKeys returns at most rawPurgeBatchSize raw keys expired at now in the range of the data keys,
+// and the data key to resume the scan, which is nil if the range is exhausted.
+func (store *MVCCStore) scanExpiredRawKeys(reqCtx *requestCtx, startKey, endKey []byte, now uint64) (keys [][]byte, nextKey []byte, err error) {
+	txn := store.db.NewTransaction(false)
+	defer txn.Discard()
+	txn.SetReadTS(maxSystemTS)
+	it := dbreader.NewIterator(txn, false, startKey, endKey)
+	defer it.Close()
+	var iterated int
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		item := it.Item()
+		if exceedEndKey(item.Key(), endKey) {
+			break
+		}
+		if iterated%contextCheckKeys == 0 {
+			if err = reqCtx.checkContext(); err != nil {
+				return nil, nil, err
+			}
+		}
+		iterated++
+		if len(keys) == rawPurgeBatchSize {
+			return keys, safeCopy(item.Key()), nil
+		}
+		if !item.IsEmpty() && rawExpired(rawItemExpireTS(item), now) {
+			keys = append(keys, safeCopy(item.Key()[len(InternalRawKeyPrefix):]))
+		}
+	}
+	return keys, nil, nil
+}
+
+// rawDeleteExpired deletes the keys which are still expired after they are latched, a key may be put again
+// after it's found expired.
+func (store *MVCCStore) rawDeleteExpired(reqCtx *requestCtx, keys [][]byte, now uint64) (int, error) {
+	regCtx := reqCtx.regCtx
+	hashVals := keysToHashVals(keys...)
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+
+	txn := store.db.NewTransaction(false)
+	txn.SetReadTS(maxSystemTS)
+	expired := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		item, err := txn.Get(rawDataKey(key))
+		if err == badger.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			txn.Discard()
+			return 0, errors.Trace(err)
+		}
+		if !item.IsEmpty() && rawExpired(rawItemExpireTS(item), now) {
+			expired = append(expired, key)
+		}
+	}
+	txn.Discard()
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	if err := store.rawWriteLatched(reqCtx, expired, nil, 0); err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ngaut/unistore/metrics"
+	"github.com/ngaut/unistore/tikv/raftstore"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+)
+
+// The read pools of the server, the point gets, scans and coprocessor requests run on pools of their own so
+// heavy scans or analytical queries can't take all the workers needed by the point gets.
+const (
+	pointReadPool = "point"
+	scanReadPool  = "scan"
+	copReadPool   = "coprocessor"
+)
+
+// readPool runs the read requests on a fixed number of workers. The tasks that can't be taken by a worker
+// wait in a bounded queue, a task is rejected with ServerIsBusy if the queue is full.
+type readPool struct {
+	name    string
+	tasks   chan *readTask
+	closeCh <-chan struct{}
+}
+
+type readTask struct {
+	fn   func()
+	done chan struct{}
+	// state is readTaskQueued until the task is taken by a worker or dropped by its request.
+	state    int32
+	queuedAt time.Time
+}
+
+const (
+	readTaskQueued int32 = iota
+	readTaskRunning
+	readTaskDropped
+)
+
+// newReadPool returns a read pool of the server, or nil if workers is 0.
+func (svr *Server) newReadPool(name string, workers, queueSize int) *readPool {
+	if workers <= 0 {
+		return nil
+	}
+	return newReadPool(name, workers, queueSize, svr.closeCh, &svr.wg)
+}
+
+// newReadPool starts the workers of the pool, they exit when closeCh is closed.
+func newReadPool(name string, workers, queueSize int, closeCh <-chan struct{}, wg *sync.WaitGroup) *readPool {
+	p := &readPool{
+		name:    name,
+		tasks:   make(chan *readTask, queueSize),
+		closeCh: closeCh,
+	}
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.runWorker(wg)
+	}
+	return p
+}
+
+func (p *readPool) runWorker(wg *sync.WaitGroup) {
+	defer wg.Done()
+	queueLength := metrics.ReadPoolQueueLength.WithLabelValues(p.name)
+	waitDuration := metrics.ReadPoolWaitDuration.WithLabelValues(p.name)
+	for {
+		select {
+		case <-p.closeCh:
+			return
+		case task := <-p.tasks:
+			queueLength.Dec()
+			if !atomic.CompareAndSwapInt32(&task.state, readTaskQueued, readTaskRunning) {
+				continue
+			}
+			waitDuration.Observe(time.Since(task.queuedAt).Seconds())
+			task.fn()
+			close(task.done)
+		}
+	}
+}
+
+// runInReadPool runs fn on a worker of the pool and waits for it. If the pool is nil, fn runs on the request's
+// goroutine. The reader slot is acquired right before fn runs, so the queued requests don't hold the slots.
+// It returns a ServerIsBusy error if the queue of the pool is full, the server is stopping or no reader slot
+// is free, and the error of checkContext if the request is done before a worker takes fn, fn is not run then.
+func (req *requestCtx) runInReadPool(p *readPool, fn func()) error {
+	var regErr *errorpb.Error
+	run := func() {
+		if regErr = req.acquireReaderSlot(); regErr != nil {
+			return
+		}
+		req.processStart = time.Now()
+		fn()
+	}
+	if p == nil {
+		run()
+		return req.readerSlotError(regErr)
+	}
+	task := &readTask{fn: run, done: make(chan struct{}), queuedAt: time.Now()}
+	select {
+	case p.tasks <- task:
+		metrics.ReadPoolQueueLength.WithLabelValues(p.name).Inc()
+	default:
+		return &raftstore.RaftError{RequestErr: newServerIsBusyErr(p.name+" read pool is full", len(p.tasks))}
+	}
+	var ctxDone <-chan struct{}
+	if req.ctx != nil {
+		ctxDone = req.ctx.Done()
+	}
+	select {
+	case <-task.done:
+		req.trace("run in " + p.name + " read pool")
+		return req.readerSlotError(regErr)
+	case <-ctxDone:
+		if atomic.CompareAndSwapInt32(&task.state, readTaskQueued, readTaskDropped) {
+			return req.checkContext()
+		}
+	case <-p.closeCh:
+		if atomic.CompareAndSwapInt32(&task.state, readTaskQueued, readTaskDropped) {
+			return &raftstore.RaftError{RequestErr: newServerIsBusyErr("server is stopping", 0)}
+		}
+	}
+	// The task is taken by a worker, it checks the context itself.
+	<-task.done
+	return req.readerSlotError(regErr)
+}
+
+func (req *requestCtx) readerSlotError(regErr *errorpb.Error) error {
+	if regErr != nil {
+		return &raftstore.RaftError{RequestErr: regErr}
+	}
+	return nil
+}
@@ -16,12 +16,18 @@ package tikv
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
+	"github.com/gogo/protobuf/proto"
+	"github.com/ngaut/unistore/lockstore"
 	"github.com/ngaut/unistore/metrics"
 	"github.com/ngaut/unistore/pd"
 	"github.com/ngaut/unistore/tikv/mvcc"
@@ -35,6 +41,7 @@ import (
 	"github.com/pingcap/kvproto/pkg/pdpb"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/util/codec"
+	"github.com/pingcap/tidb/util/mathutil"
 	"github.com/zhangjinpeng1987/raft"
 	"go.uber.org/zap"
 	"golang.org/x/net/context"
@@ -45,6 +52,7 @@ var (
 	InternalRegionMetaPrefix = append(InternalKeyPrefix, "region"...)
 	InternalStoreMetaKey     = append(InternalKeyPrefix, "store"...)
 	InternalSafePointKey     = append(InternalKeyPrefix, "safepoint"...)
+	InternalRawKeyPrefix     = append(InternalKeyPrefix, "raw"...)
 )
 
 func InternalRegionMetaKey(regionId uint64) []byte {
@@ -58,66 +66,98 @@ type regionCtx struct {
 	endKey          []byte
 	approximateSize int64
 	diff            int64
+	approximateKeys int64
+	keysDiff        int64 // number of keys committed since the last split check
+	readOnly        int32
+	resolvedTS      uint64
+	resolvedTSPin   int32 // 1 if the resolved ts is forced by tests, the tracker doesn't advance it
+	leader          int32 // 1 if the local peer is the raft leader, updated by the role changes
+	createTime      time.Time
+	lastAccessTime  int64 // unix nano
+	dataVersion     uint64
+	lockCount       int64 // number of locks in the region, only maintained in the stand-alone mode
+	// initialized is false if the region is created by a raft message and its data is not yet installed
+	// by a snapshot, the region has no peers and range in this state.
+	initialized bool
 
 	latches       *latches
 	leaderChecker raftstore.LeaderChecker
 }
 
+// latches serializes the commands on the same keys like the scheduler latches of TiKV. Each key has a queue of
+// the commands on it, a command holds the latch of a key when it's the head of the queue, and the latch is passed
+// to the next command in the queue when it's released, so the commands on a key are granted in FIFO order. The
+// commands acquire the latches in the order of the key hashes, so they can't deadlock.
+//
+// The keys are striped to the slots by the high bits of their hashes, and each slot has its own mutex on its own
+// cache line, so the commands on different keys rarely contend.
 type latches struct {
-	slots [256]map[uint64]*sync.WaitGroup
-	locks [256]sync.Mutex
+	shift uint
+	slots []latchSlot
+}
+
+type latchSlot struct {
+	mu     sync.Mutex
+	queues map[uint64][]chan struct{}
+	_      [48]byte // Pad the slot to a cache line.
 }
 
+const minLatchSlots = 256
+
+// newLatches creates the latches with a power of 2 slots, it's 64 slots per CPU and at least minLatchSlots.
 func newLatches() *latches {
-	l := &latches{}
-	for i := 0; i < 256; i++ {
-		l.slots[i] = map[uint64]*sync.WaitGroup{}
+	n := minLatchSlots
+	for n < runtime.GOMAXPROCS(0)*64 {
+		n <<= 1
+	}
+	l := &latches{
+		shift: uint(64 - bits.TrailingZeros(uint(n))),
+		slots: make([]latchSlot, n),
+	}
+	for i := range l.slots {
+		l.slots[i].queues = map[uint64][]chan struct{}{}
 	}
 	return l
 }
 
-func (l *latches) acquire(keyHashes []uint64) (waitCnt int) {
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	for _, hash := range keyHashes {
-		waitCnt += l.acquireOne(hash, wg)
-	}
-	return
+func (l *latches) slot(hash uint64) *latchSlot {
+	return &l.slots[hash>>l.shift]
 }
 
-func (l *latches) acquireOne(hash uint64, wg *sync.WaitGroup) (waitCnt int) {
-	slotID := hash >> 56
-	for {
-		m := l.slots[slotID]
-		l.locks[slotID].Lock()
-		w, ok := m[hash]
-		if !ok {
-			m[hash] = wg
-		}
-		l.locks[slotID].Unlock()
-		if ok {
-			w.Wait()
+// acquire waits for the latches of keyHashes in order, it returns the number of the latches waited for.
+func (l *latches) acquire(keyHashes []uint64) (waitCnt int) {
+	// The command waits for one latch at a time, the channel is signaled when the latch is passed to it.
+	granted := make(chan struct{}, 1)
+	for _, hash := range keyHashes {
+		slot := l.slot(hash)
+		slot.mu.Lock()
+		queue := slot.queues[hash]
+		slot.queues[hash] = append(queue, granted)
+		slot.mu.Unlock()
+		if len(queue) > 0 {
+			metrics.LatchQueueLength.Observe(float64(len(queue)))
+			metrics.LatchWaiters.Inc()
+			<-granted
+			metrics.LatchWaiters.Dec()
 			waitCnt++
-			continue
 		}
-		return
 	}
+	return
 }
 
+// release releases the latches of keyHashes held by the command and passes them to the next commands.
 func (l *latches) release(keyHashes []uint64) {
-	var w *sync.WaitGroup
 	for _, hash := range keyHashes {
-		slotID := hash >> 56
-		l.locks[slotID].Lock()
-		m := l.slots[slotID]
-		if w == nil {
-			w = m[hash]
+		slot := l.slot(hash)
+		slot.mu.Lock()
+		queue := slot.queues[hash][1:]
+		if len(queue) == 0 {
+			delete(slot.queues, hash)
+		} else {
+			slot.queues[hash] = queue
+			queue[0] <- struct{}{}
 		}
-		delete(m, hash)
-		l.locks[slotID].Unlock()
-	}
-	if w != nil {
-		w.Done()
+		slot.mu.Unlock()
 	}
 }
 
@@ -127,7 +167,11 @@ func newRegionCtx(meta *metapb.Region, latches *latches, checker raftstore.Leade
 		latches:       latches,
 		regionEpoch:   unsafe.Pointer(meta.GetRegionEpoch()),
 		leaderChecker: checker,
+		createTime:    time.Now(),
+		initialized:   len(meta.GetPeers()) > 0,
 	}
+	regCtx.touch()
+	regCtx.bumpDataVersion()
 	regCtx.startKey = regCtx.rawStartKey()
 	regCtx.endKey = regCtx.rawEndKey()
 	if len(regCtx.endKey) == 0 {
@@ -145,6 +189,95 @@ func (ri *regionCtx) updateRegionEpoch(epoch *metapb.RegionEpoch) {
 	atomic.StorePointer(&ri.regionEpoch, (unsafe.Pointer)(epoch))
 }
 
+func (ri *regionCtx) isReadOnly() bool {
+	return atomic.LoadInt32(&ri.readOnly) == 1
+}
+
+func (ri *regionCtx) setReadOnly(readOnly bool) {
+	var val int32
+	if readOnly {
+		val = 1
+	}
+	atomic.StoreInt32(&ri.readOnly, val)
+}
+
+// getResolvedTS returns the ts that all the transactions committed before it are already applied to the region.
+func (ri *regionCtx) getResolvedTS() uint64 {
+	return atomic.LoadUint64(&ri.resolvedTS)
+}
+
+func (ri *regionCtx) setResolvedTS(ts uint64) {
+	atomic.StoreUint64(&ri.resolvedTS, ts)
+}
+
+func (ri *regionCtx) isResolvedTSPinned() bool {
+	return atomic.LoadInt32(&ri.resolvedTSPin) == 1
+}
+
+// advanceResolvedTS sets the resolved ts to ts if it's greater, it returns the resolved ts after the update.
+func (ri *regionCtx) advanceResolvedTS(ts uint64) uint64 {
+	for {
+		old := atomic.LoadUint64(&ri.resolvedTS)
+		if ts <= old {
+			return old
+		}
+		if atomic.CompareAndSwapUint64(&ri.resolvedTS, old, ts) {
+			return ts
+		}
+	}
+}
+
+// isLeader returns true if the local peer is the leader of the region. The regions without a raft group are
+// always led by the local peer.
+func (ri *regionCtx) isLeader() bool {
+	return ri.leaderChecker == nil || atomic.LoadInt32(&ri.leader) == 1
+}
+
+func (ri *regionCtx) setLeader(isLeader bool) {
+	var val int32
+	if isLeader {
+		val = 1
+	}
+	atomic.StoreInt32(&ri.leader, val)
+}
+
+// touch updates the last access time of the region.
+func (ri *regionCtx) touch() {
+	atomic.StoreInt64(&ri.lastAccessTime, time.Now().UnixNano())
+}
+
+func (ri *regionCtx) getLastAccessTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&ri.lastAccessTime))
+}
+
+// dataVersionAlloc allocates the data versions of all regions, it starts from the boot time so the versions
+// are not reused by a restarted store or a recreated region.
+var dataVersionAlloc = uint64(time.Now().UnixNano())
+
+// bumpDataVersion increases the data version of the region, it's called after data is committed or rolled back.
+func (ri *regionCtx) bumpDataVersion() {
+	for {
+		// The version is allocated after loading the old one, so it's always greater.
+		old := atomic.LoadUint64(&ri.dataVersion)
+		if atomic.CompareAndSwapUint64(&ri.dataVersion, old, atomic.AddUint64(&dataVersionAlloc, 1)) {
+			return
+		}
+	}
+}
+
+func (ri *regionCtx) getDataVersion() uint64 {
+	return atomic.LoadUint64(&ri.dataVersion)
+}
+
+// readIndex returns the index a read of the region is served at once the leader is checked. It's the applied
+// index of the local peer in the raft mode, the stand-alone regions have no raft log so the data version is used.
+func (ri *regionCtx) readIndex() uint64 {
+	if ri.leaderChecker == nil {
+		return ri.getDataVersion()
+	}
+	return ri.leaderChecker.AppliedIndex()
+}
+
 func (ri *regionCtx) rawStartKey() []byte {
 	if len(ri.meta.StartKey) == 0 {
 		return nil
@@ -210,6 +343,10 @@ func (ri *regionCtx) unmarshal(data []byte) error {
 	ri.startKey = ri.rawStartKey()
 	ri.endKey = ri.rawEndKey()
 	ri.regionEpoch = unsafe.Pointer(ri.meta.RegionEpoch)
+	ri.initialized = len(ri.meta.Peers) > 0
+	ri.createTime = time.Now()
+	ri.touch()
+	ri.bumpDataVersion()
 	return nil
 }
 
@@ -243,6 +380,13 @@ type RegionOptions struct {
 	StoreAddr  string
 	PDAddr     string
 	RegionSize int64
+
+	// RegionSplitKeys is the number of keys that a region is split by, 0 disables the split by keys.
+	RegionSplitKeys int64
+	// RegionSplitCooldown is the min age of a region before it can be split by keys.
+	RegionSplitCooldown time.Duration
+	// SplitCheckInterval is the interval of checking the regions to split.
+	SplitCheckInterval time.Duration
 }
 
 type RegionManager interface {
@@ -251,7 +395,13 @@ type RegionManager interface {
 	SplitRegion(req *kvrpcpb.SplitRegionRequest) *kvrpcpb.SplitRegionResponse
 	GetStoreIDByAddr(addr string) (uint64, error)
 	GetStoreAddrByStoreId(storeId uint64) (string, error)
+	SetRegionReadOnly(regionID uint64, readOnly bool) error
+	GetRegionAccessTime(regionID uint64) (createTime, lastAccessTime time.Time, err error)
+	IdleRegions(idleTime time.Duration) []uint64
+	RegionDataVersion(regionID uint64) (uint64, error)
 	Close() error
+	forEachRegion(f func(*regionCtx))
+	addRegionLocks(regionID uint64, delta int64)
 }
 
 type regionManager struct {
@@ -259,6 +409,9 @@ type regionManager struct {
 	mu        sync.RWMutex
 	regions   map[uint64]*regionCtx
 	latches   *latches
+	// mergedRegions maps the id of a merged region to the id of the region it's merged into, so the requests
+	// of the merged region get EpochNotMatch with the new region instead of RegionNotFound.
+	mergedRegions map[uint64]uint64
 }
 
 func (rm *regionManager) GetStoreIDByAddr(addr string) (uint64, error) {
@@ -297,6 +450,9 @@ func (rm *regionManager) GetRegionFromCtx(ctx *kvrpcpb.Context) (*regionCtx, *er
 	ri := rm.regions[ctx.RegionId]
 	rm.mu.RUnlock()
 	if ri == nil {
+		if regErr := rm.mergedRegionError(ctx.RegionId); regErr != nil {
+			return nil, regErr
+		}
 		return nil, &errorpb.Error{
 			Message: "region not found",
 			RegionNotFound: &errorpb.RegionNotFound{
@@ -304,6 +460,15 @@ func (rm *regionManager) GetRegionFromCtx(ctx *kvrpcpb.Context) (*regionCtx, *er
 			},
 		}
 	}
+	if !ri.initialized {
+		// The region can't serve requests until the snapshot is applied, the client should back off and retry.
+		return nil, &errorpb.Error{
+			Message: fmt.Sprintf("region %d is not initialized", ctx.GetRegionId()),
+			RegionNotFound: &errorpb.RegionNotFound{
+				RegionId: ctx.GetRegionId(),
+			},
+		}
+	}
 	// Region epoch does not match.
 	if rm.isEpochStale(ri.getRegionEpoch(), ctx.GetRegionEpoch()) {
 		return nil, &errorpb.Error{
@@ -322,10 +487,184 @@ func (rm *regionManager) GetRegionFromCtx(ctx *kvrpcpb.Context) (*regionCtx, *er
 	return ri, nil
 }
 
+// SetRegionReadOnly marks the region as read-only or writable. Write requests to a read-only region
+// are rejected with a retryable error, read requests are still served.
+func (rm *regionManager) SetRegionReadOnly(regionID uint64, readOnly bool) error {
+	rm.mu.RLock()
+	ri := rm.regions[regionID]
+	rm.mu.RUnlock()
+	if ri == nil {
+		return errors.Errorf("region %d not found", regionID)
+	}
+	ri.setReadOnly(readOnly)
+	return nil
+}
+
+// GetRegionAccessTime returns the time the region is created and the time it is last accessed by a request.
+func (rm *regionManager) GetRegionAccessTime(regionID uint64) (createTime, lastAccessTime time.Time, err error) {
+	rm.mu.RLock()
+	ri := rm.regions[regionID]
+	rm.mu.RUnlock()
+	if ri == nil {
+		return time.Time{}, time.Time{}, errors.Errorf("region %d not found", regionID)
+	}
+	return ri.createTime, ri.getLastAccessTime(), nil
+}
+
+// RegionDataVersion returns the data version of the region, the version increases every time data of the
+// region is committed or rolled back.
+func (rm *regionManager) RegionDataVersion(regionID uint64) (uint64, error) {
+	rm.mu.RLock()
+	ri := rm.regions[regionID]
+	rm.mu.RUnlock()
+	if ri == nil {
+		return 0, errors.Errorf("region %d not found", regionID)
+	}
+	return ri.getDataVersion(), nil
+}
+
+// IdleRegions returns the IDs of the regions that are not accessed for at least idleTime.
+func (rm *regionManager) IdleRegions(idleTime time.Duration) []uint64 {
+	now := time.Now()
+	var ids []uint64
+	rm.mu.RLock()
+	for id, ri := range rm.regions {
+		if now.Sub(ri.getLastAccessTime()) >= idleTime {
+			ids = append(ids, id)
+		}
+	}
+	rm.mu.RUnlock()
+	return ids
+}
+
+func (rm *regionManager) forEachRegion(f func(*regionCtx)) {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	for _, ri := range rm.regions {
+		f(ri)
+	}
+}
+
+// addRegionLocks adds delta to the number of locks of the region, it's called after the locks are written.
+func (rm *regionManager) addRegionLocks(regionID uint64, delta int64) {
+	rm.mu.RLock()
+	ri := rm.regions[regionID]
+	rm.mu.RUnlock()
+	if ri != nil {
+		atomic.AddInt64(&ri.lockCount, delta)
+	}
+}
+
+// countLocks counts the locks in the range of the region, it's called when the region is created by a split
+// or loaded, the later lock writes update the count.
+func (ri *regionCtx) countLocks(ls *lockstore.MemStore) {
+	var cnt int64
+	it := ls.NewIterator()
+	for it.Seek(ri.startKey); it.Valid() && !ri.greaterEqualEndKey(it.Key()); it.Next() {
+		cnt++
+	}
+	atomic.StoreInt64(&ri.lockCount, cnt)
+}
+
 func (rm *regionManager) isEpochStale(lhs, rhs *metapb.RegionEpoch) bool {
 	return lhs.GetConfVer() != rhs.GetConfVer() || lhs.GetVersion() != rhs.GetVersion()
 }
 
+// mergedRegionError returns EpochNotMatch with the region that the region is merged into, nil if the region
+// is not merged.
+func (rm *regionManager) mergedRegionError(regionID uint64) *errorpb.Error {
+	rm.mu.RLock()
+	defer rm.mu.RUnlock()
+	targetID, ok := rm.mergedRegions[regionID]
+	if !ok {
+		return nil
+	}
+	target := rm.regions[targetID]
+	if target == nil {
+		return nil
+	}
+	return &errorpb.Error{
+		Message: fmt.Sprintf("region %d is merged into region %d", regionID, targetID),
+		EpochNotMatch: &errorpb.EpochNotMatch{
+			CurrentRegions: []*metapb.Region{proto.Clone(target.meta).(*metapb.Region)},
+		},
+	}
+}
+
+// mergeRegions merges the source region into the adjacent target region. The merged region has the id and
+// peers of the target region, the range of both regions, and an epoch version greater than both of them, so
+// the requests of both regions with the old epochs get EpochNotMatch. The meta of the source region is saved
+// as empty, so it's not loaded again. onMerged is called with the regions while the regions are locked.
+func (rm *regionManager) mergeRegions(bundle *mvcc.DBBundle, sourceID, targetID uint64,
+	onMerged func(source, oldTarget, merged *regionCtx)) (merged *regionCtx, err error) {
+	rm.mu.RLock()
+	source, target := rm.regions[sourceID], rm.regions[targetID]
+	rm.mu.RUnlock()
+	if source == nil || target == nil || sourceID == targetID {
+		return nil, errors.Errorf("invalid regions to merge, source %d, target %d", sourceID, targetID)
+	}
+	srcMeta, tgtMeta := source.meta, target.meta
+	meta := &metapb.Region{
+		Id:       tgtMeta.Id,
+		StartKey: tgtMeta.StartKey,
+		EndKey:   tgtMeta.EndKey,
+		RegionEpoch: &metapb.RegionEpoch{
+			ConfVer: mathutil.MaxUint64(srcMeta.RegionEpoch.ConfVer, tgtMeta.RegionEpoch.ConfVer),
+			Version: mathutil.MaxUint64(srcMeta.RegionEpoch.Version, tgtMeta.RegionEpoch.Version) + 1,
+		},
+		Peers: tgtMeta.Peers,
+	}
+	switch {
+	case len(srcMeta.EndKey) > 0 && bytes.Equal(srcMeta.EndKey, tgtMeta.StartKey):
+		meta.StartKey = srcMeta.StartKey
+	case len(tgtMeta.EndKey) > 0 && bytes.Equal(tgtMeta.EndKey, srcMeta.StartKey):
+		meta.EndKey = srcMeta.EndKey
+	default:
+		return nil, errors.Errorf("region %d and region %d are not adjacent", sourceID, targetID)
+	}
+	merged = newRegionCtx(meta, rm.latches, target.leaderChecker)
+	merged.approximateSize = source.approximateSize + atomic.LoadInt64(&source.diff) + target.approximateSize + atomic.LoadInt64(&target.diff)
+	merged.approximateKeys = atomic.LoadInt64(&source.approximateKeys) + atomic.LoadInt64(&target.approximateKeys)
+	merged.lockCount = atomic.LoadInt64(&source.lockCount) + atomic.LoadInt64(&target.lockCount)
+	err = bundle.DB.Update(func(txn *badger.Txn) error {
+		ts := atomic.AddUint64(&bundle.StateTS, 1)
+		err1 := txn.SetEntry(&badger.Entry{
+			Key:   y.KeyWithTs(InternalRegionMetaKey(merged.meta.Id), ts),
+			Value: merged.marshal(),
+		})
+		if err1 != nil {
+			return errors.Trace(err1)
+		}
+		return errors.Trace(txn.SetEntry(&badger.Entry{
+			Key:   y.KeyWithTs(InternalRegionMetaKey(sourceID), ts),
+			Value: []byte{},
+		}))
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	rm.mu.Lock()
+	delete(rm.regions, sourceID)
+	rm.regions[targetID] = merged
+	if rm.mergedRegions == nil {
+		rm.mergedRegions = make(map[uint64]uint64)
+	}
+	rm.mergedRegions[sourceID] = targetID
+	for id, mergedInto := range rm.mergedRegions {
+		// The regions merged into the source are merged into the target now.
+		if mergedInto == sourceID {
+			rm.mergedRegions[id] = targetID
+		}
+	}
+	if onMerged != nil {
+		onMerged(source, target, merged)
+	}
+	rm.mu.Unlock()
+	log.Info("region merged", zap.Uint64("source", sourceID), zap.Uint64("target", targetID),
+		zap.Stringer("epoch", merged.meta.RegionEpoch))
+	return merged, nil
+}
+
 func (rm *regionManager) loadFromLocal(bundle *mvcc.DBBundle, f func(*regionCtx)) error {
 	err := bundle.DB.View(func(txn *badger.Txn) error {
 		item, err1 := txn.Get(InternalStoreMetaKey)
@@ -351,6 +690,10 @@ func (rm *regionManager) loadFromLocal(bundle *mvcc.DBBundle, f func(*regionCtx)
 			if err1 != nil {
 				return err1
 			}
+			// The meta of a merged region is empty.
+			if len(val) == 0 {
+				continue
+			}
 			r := new(regionCtx)
 			err := r.unmarshal(val)
 			if err != nil {
@@ -503,6 +846,10 @@ func (rm *RaftRegionManager) runEventHandler() {
 			rm.mu.RLock()
 			region := rm.regions[x.regionId]
 			rm.mu.RUnlock()
+			if region == nil {
+				continue
+			}
+			region.setLeader(x.newState == raft.StateLeader)
 			if bytes.Compare(region.startKey, []byte{}) == 0 && len(region.meta.Peers) > 0 {
 				newRole := Follower
 				if x.newState == raft.StateLeader {
@@ -529,12 +876,25 @@ func (rm *RaftRegionManager) SplitRegion(req *kvrpcpb.SplitRegionRequest) *kvrpc
 
 type StandAloneRegionManager struct {
 	regionManager
-	bundle     *mvcc.DBBundle
-	pdc        pd.Client
-	clusterID  uint64
-	regionSize int64
-	closeCh    chan struct{}
-	wg         sync.WaitGroup
+	bundle        *mvcc.DBBundle
+	pdc           pd.Client
+	clusterID     uint64
+	regionSize    int64
+	splitKeys     int64
+	splitCooldown time.Duration
+	// splitCheckInterval is the interval of the split worker.
+	splitCheckInterval time.Duration
+	// splitMu serializes the splits of the split worker and the SplitRegion requests.
+	splitMu sync.Mutex
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+// SetSplitSize changes the region size and the number of keys the regions are split by, 0 splitKeys disables
+// the split by keys.
+func (rm *StandAloneRegionManager) SetSplitSize(regionSize, splitKeys int64) {
+	atomic.StoreInt64(&rm.regionSize, regionSize)
+	atomic.StoreInt64(&rm.splitKeys, splitKeys)
 }
 
 func NewStandAloneRegionManager(bundle *mvcc.DBBundle, opts RegionOptions, pdc pd.Client) *StandAloneRegionManager {
@@ -542,11 +902,14 @@ func NewStandAloneRegionManager(bundle *mvcc.DBBundle, opts RegionOptions, pdc p
 	clusterID := pdc.GetClusterID(context.TODO())
 	log.S().Infof("cluster id %v", clusterID)
 	rm := &StandAloneRegionManager{
-		bundle:     bundle,
-		pdc:        pdc,
-		clusterID:  clusterID,
-		regionSize: opts.RegionSize,
-		closeCh:    make(chan struct{}),
+		bundle:             bundle,
+		pdc:                pdc,
+		clusterID:          clusterID,
+		regionSize:         opts.RegionSize,
+		splitKeys:          opts.RegionSplitKeys,
+		splitCooldown:      opts.RegionSplitCooldown,
+		closeCh:            make(chan struct{}),
+		splitCheckInterval: opts.SplitCheckInterval,
 		regionManager: regionManager{
 			regions:   make(map[uint64]*regionCtx),
 			storeMeta: new(metapb.Store),
@@ -743,7 +1106,11 @@ func (s *sampler) scanKey(key []byte, size int64) {
 }
 
 func (s *sampler) getSplitKeyAndSize() ([]byte, int64) {
-	targetSize := s.totalSize * 2 / 3
+	return s.getSplitKeyAndSizeAt(s.totalSize * 2 / 3)
+}
+
+// getSplitKeyAndSizeAt returns the first sampled key whose left size reaches targetSize.
+func (s *sampler) getSplitKeyAndSizeAt(targetSize int64) ([]byte, int64) {
 	for _, sample := range s.samples[:s.length] {
 		if sample.leftSize >= targetSize {
 			return sample.key, sample.leftSize
@@ -752,28 +1119,91 @@ func (s *sampler) getSplitKeyAndSize() ([]byte, int64) {
 	return []byte{}, 0
 }
 
+// RegionStats is the approximate size and number of keys of a region.
+type RegionStats struct {
+	RegionID        uint64
+	ApproximateSize int64
+	ApproximateKeys int64
+}
+
+// regionStatsSampleKeys is the number of keys read at most from every region to estimate its stats after a split.
+const regionStatsSampleKeys = 4096
+
+// sampleRegionStats reads at most maxKeys latest versions of the region, only the keys and the value sizes in
+// the index are read. complete is true if the region has no more keys, the stats are exact then.
+func sampleRegionStats(db *badger.DB, region *regionCtx, maxKeys int) (stats *RegionStats, complete bool, err error) {
+	stats = &RegionStats{RegionID: region.meta.Id}
+	err = db.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.IteratorOptions{})
+		defer iter.Close()
+		for iter.Seek(region.startKey); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if region.greaterEqualEndKey(item.Key()) {
+				break
+			}
+			if stats.ApproximateKeys == int64(maxKeys) {
+				return nil
+			}
+			stats.ApproximateSize += int64(len(item.Key()) + item.ValueSize())
+			stats.ApproximateKeys++
+		}
+		complete = true
+		return nil
+	})
+	return stats, complete, errors.Trace(err)
+}
+
+// estimateSplitStats estimates the stats of the regions created by splitting a region of parentSize bytes and
+// parentKeys keys, at most maxKeys keys are read from every region so the split never scans the whole region.
+// The small regions are counted exactly, the rest of the parent's stats is shared by the large ones, a large
+// region is at least as large as its sample.
+func estimateSplitStats(db *badger.DB, regions []*regionCtx, parentSize, parentKeys int64, maxKeys int) ([]*RegionStats, error) {
+	stats := make([]*RegionStats, len(regions))
+	var large []*RegionStats
+	for i, region := range regions {
+		regionStats, complete, err := sampleRegionStats(db, region, maxKeys)
+		if err != nil {
+			return nil, err
+		}
+		stats[i] = regionStats
+		if complete {
+			parentSize -= regionStats.ApproximateSize
+			parentKeys -= regionStats.ApproximateKeys
+		} else {
+			large = append(large, regionStats)
+		}
+	}
+	for _, regionStats := range large {
+		if size := parentSize / int64(len(large)); size > regionStats.ApproximateSize {
+			regionStats.ApproximateSize = size
+		}
+		if keys := parentKeys / int64(len(large)); keys > regionStats.ApproximateKeys {
+			regionStats.ApproximateKeys = keys
+		}
+	}
+	return stats, nil
+}
+
+// defaultSplitCheckInterval is the interval of the split worker if it's not set in the options.
+const defaultSplitCheckInterval = 5 * time.Second
+
 func (rm *StandAloneRegionManager) runSplitWorker() {
 	defer rm.wg.Done()
-	ticker := time.NewTicker(time.Second * 5)
-	var regionsToCheck []*regionCtx
+	interval := rm.splitCheckInterval
+	if interval <= 0 {
+		interval = defaultSplitCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 	var regionsToSave []*regionCtx
 	for {
-		regionsToCheck = regionsToCheck[:0]
-		rm.mu.RLock()
-		for _, ri := range rm.regions {
-			if ri.approximateSize+atomic.LoadInt64(&ri.diff) > rm.regionSize*3/2 {
-				regionsToCheck = append(regionsToCheck, ri)
-			}
-		}
-		rm.mu.RUnlock()
-		for _, ri := range regionsToCheck {
-			rm.splitCheckRegion(ri)
-		}
+		rm.checkSplitBySize()
+		rm.checkSplitByKeys()
 
 		regionsToSave = regionsToSave[:0]
 		rm.mu.RLock()
 		for _, ri := range rm.regions {
-			if atomic.LoadInt64(&ri.diff) > rm.regionSize/8 {
+			if atomic.LoadInt64(&ri.diff) > atomic.LoadInt64(&rm.regionSize)/8 {
 				regionsToSave = append(regionsToSave, ri)
 			}
 		}
@@ -791,7 +1221,8 @@ func (rm *StandAloneRegionManager) saveSize(regionsToSave []*regionCtx) {
 	err1 := rm.bundle.DB.Update(func(txn *badger.Txn) error {
 		ts := atomic.AddUint64(&rm.bundle.StateTS, 1)
 		for _, ri := range regionsToSave {
-			ri.approximateSize += atomic.LoadInt64(&ri.diff)
+			// The diff is moved to the approximate size, so it's not counted again by the next save.
+			ri.approximateSize += atomic.SwapInt64(&ri.diff, 0)
 			err := txn.SetEntry(&badger.Entry{
 				Key:   y.KeyWithTs(InternalRegionMetaKey(ri.meta.Id), ts),
 				Value: ri.marshal(),
@@ -807,6 +1238,22 @@ func (rm *StandAloneRegionManager) saveSize(regionsToSave []*regionCtx) {
 	}
 }
 
+// checkSplitBySize splits the regions whose approximate size, including the size written since the last
+// check, is over 1.5 times of the region size.
+func (rm *StandAloneRegionManager) checkSplitBySize() {
+	var regionsToCheck []*regionCtx
+	rm.mu.RLock()
+	for _, ri := range rm.regions {
+		if ri.approximateSize+atomic.LoadInt64(&ri.diff) > atomic.LoadInt64(&rm.regionSize)*3/2 {
+			regionsToCheck = append(regionsToCheck, ri)
+		}
+	}
+	rm.mu.RUnlock()
+	for _, ri := range regionsToCheck {
+		rm.splitCheckRegion(ri)
+	}
+}
+
 func (rm *StandAloneRegionManager) splitCheckRegion(region *regionCtx) error {
 	s := newSampler()
 	err := rm.bundle.DB.View(func(txn *badger.Txn) error {
@@ -827,9 +1274,13 @@ func (rm *StandAloneRegionManager) splitCheckRegion(region *regionCtx) error {
 	}
 	// Need to update the diff to avoid split check again.
 	atomic.StoreInt64(&region.diff, s.totalSize-region.approximateSize)
-	if s.totalSize < rm.regionSize {
+	regionSize := atomic.LoadInt64(&rm.regionSize)
+	if s.totalSize < regionSize {
 		return nil
 	}
+	if s.totalSize >= regionSize*2 {
+		return rm.splitRegionBySize(region, s)
+	}
 	splitKey, leftSize := s.getSplitKeyAndSize()
 	log.Info("try to split region", zap.Uint64("id", region.meta.Id), zap.Binary("split key", splitKey),
 		zap.Int64("left size", leftSize), zap.Int64("right size", s.totalSize-leftSize))
@@ -840,7 +1291,114 @@ func (rm *StandAloneRegionManager) splitCheckRegion(region *regionCtx) error {
 	return errors.Trace(err)
 }
 
+// splitRegionBySize splits a region which is much larger than the region size into the regions of about the
+// region size at once, so a region which grows fast doesn't need many rounds of the split worker.
+func (rm *StandAloneRegionManager) splitRegionBySize(region *regionCtx, s *sampler) error {
+	rm.splitMu.Lock()
+	defer rm.splitMu.Unlock()
+	var splitted int64
+	regionSize := atomic.LoadInt64(&rm.regionSize)
+	for target := regionSize; target <= s.totalSize-regionSize/2; target += regionSize {
+		splitKey, leftSize := s.getSplitKeyAndSizeAt(target)
+		if len(splitKey) == 0 || leftSize <= splitted || bytes.Compare(splitKey, region.startKey) <= 0 {
+			continue
+		}
+		log.Info("try to split region", zap.Uint64("id", region.meta.Id), zap.Binary("split key", splitKey),
+			zap.Int64("left size", leftSize-splitted), zap.Int64("right size", s.totalSize-leftSize))
+		if _, err := rm.splitRegionLocked(region, splitKey, s.totalSize-splitted, leftSize-splitted); err != nil {
+			log.Error("split region failed", zap.Error(err))
+			return errors.Trace(err)
+		}
+		splitted = leftSize
+		rm.mu.RLock()
+		region = rm.regions[region.meta.Id]
+		rm.mu.RUnlock()
+	}
+	return nil
+}
+
+// checkSplitByKeys splits the regions that have more keys than the limit. The regions younger than the
+// cooldown are skipped, so the new regions are not split again before the key count settles.
+func (rm *StandAloneRegionManager) checkSplitByKeys() {
+	splitKeys := atomic.LoadInt64(&rm.splitKeys)
+	if splitKeys <= 0 {
+		return
+	}
+	var regionsToCheck []*regionCtx
+	rm.mu.RLock()
+	for _, ri := range rm.regions {
+		if time.Since(ri.createTime) < rm.splitCooldown {
+			continue
+		}
+		if atomic.LoadInt64(&ri.approximateKeys)+atomic.LoadInt64(&ri.keysDiff) > splitKeys {
+			regionsToCheck = append(regionsToCheck, ri)
+		}
+	}
+	rm.mu.RUnlock()
+	for _, ri := range regionsToCheck {
+		rm.splitCheckRegionByKeys(ri)
+	}
+}
+
+func (rm *StandAloneRegionManager) splitCheckRegionByKeys(region *regionCtx) error {
+	// The sampler is fed with one per key, so its size is the number of keys.
+	s := newSampler()
+	var totalSize int64
+	err := rm.bundle.DB.View(func(txn *badger.Txn) error {
+		iter := txn.NewIterator(badger.IteratorOptions{})
+		defer iter.Close()
+		for iter.Seek(region.startKey); iter.Valid(); iter.Next() {
+			item := iter.Item()
+			if region.greaterEqualEndKey(item.Key()) {
+				break
+			}
+			s.scanKey(item.Key(), 1)
+			totalSize += int64(len(item.Key()) + item.ValueSize())
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("sample region failed", zap.Error(err))
+		return errors.Trace(err)
+	}
+	// Reset the counter to avoid split check again.
+	atomic.StoreInt64(&region.approximateKeys, s.totalSize)
+	atomic.StoreInt64(&region.keysDiff, 0)
+	if s.totalSize <= atomic.LoadInt64(&rm.splitKeys) {
+		return nil
+	}
+	// The split key is the first key of the right region, so the left region has the keys before it.
+	splitKey, leftKeys := s.getSplitKeyAndSizeAt(s.totalSize/2 + 1)
+	if len(splitKey) == 0 {
+		return nil
+	}
+	leftKeys--
+	leftSize := totalSize * leftKeys / s.totalSize
+	log.Info("try to split region by keys", zap.Uint64("id", region.meta.Id), zap.Binary("split key", splitKey),
+		zap.Int64("left keys", leftKeys), zap.Int64("right keys", s.totalSize-leftKeys))
+	err = rm.splitRegion(region, splitKey, totalSize, leftSize)
+	if err != nil {
+		log.Error("split region failed", zap.Error(err))
+	}
+	return errors.Trace(err)
+}
+
 func (rm *StandAloneRegionManager) splitRegion(oldRegionCtx *regionCtx, splitKey []byte, oldSize, leftSize int64) error {
+	rm.splitMu.Lock()
+	defer rm.splitMu.Unlock()
+	_, err := rm.splitRegionLocked(oldRegionCtx, splitKey, oldSize, leftSize)
+	return err
+}
+
+// splitRegionLocked splits the region at the split key and returns the new left region, the right region keeps
+// the id of the old region. The split mutex must be held.
+func (rm *StandAloneRegionManager) splitRegionLocked(oldRegionCtx *regionCtx, splitKey []byte, oldSize, leftSize int64) (*regionCtx, error) {
+	rm.mu.RLock()
+	current := rm.regions[oldRegionCtx.meta.Id]
+	rm.mu.RUnlock()
+	if current != oldRegionCtx {
+		return nil, errors.Errorf("region %d is changed during the split", oldRegionCtx.meta.Id)
+	}
 	oldRegion := oldRegionCtx.meta
 	rightMeta := &metapb.Region{
 		Id:       oldRegion.Id,
@@ -856,7 +1414,7 @@ func (rm *StandAloneRegionManager) splitRegion(oldRegionCtx *regionCtx, splitKey
 	right.approximateSize = oldSize - leftSize
 	id, err := rm.pdc.AllocID(context.Background())
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 	leftMeta := &metapb.Region{
 		Id:       id,
@@ -870,6 +1428,10 @@ func (rm *StandAloneRegionManager) splitRegion(oldRegionCtx *regionCtx, splitKey
 	}
 	left := newRegionCtx(leftMeta, rm.latches, nil)
 	left.approximateSize = leftSize
+	if oldKeys := atomic.LoadInt64(&oldRegionCtx.approximateKeys); oldKeys > 0 && oldSize > 0 {
+		left.approximateKeys = oldKeys * leftSize / oldSize
+		right.approximateKeys = oldKeys - left.approximateKeys
+	}
 	err1 := rm.bundle.DB.Update(func(txn *badger.Txn) error {
 		ts := atomic.AddUint64(&rm.bundle.StateTS, 1)
 		err := txn.SetEntry(&badger.Entry{
@@ -886,12 +1448,14 @@ func (rm *StandAloneRegionManager) splitRegion(oldRegionCtx *regionCtx, splitKey
 		return errors.Trace(err)
 	})
 	if err1 != nil {
-		return errors.Trace(err1)
+		return nil, errors.Trace(err1)
 	}
 	rm.mu.Lock()
 	rm.regions[left.meta.Id] = left
 	rm.regions[right.meta.Id] = right
 	rm.mu.Unlock()
+	left.countLocks(rm.bundle.LockStore)
+	right.countLocks(rm.bundle.LockStore)
 	rm.pdc.ReportRegion(&pdpb.RegionHeartbeatRequest{
 		Region:          right.meta,
 		Leader:          right.meta.Peers[0],
@@ -905,11 +1469,90 @@ func (rm *StandAloneRegionManager) splitRegion(oldRegionCtx *regionCtx, splitKey
 	log.Info("region splitted", zap.Uint64("old id", oldRegion.Id),
 		zap.Uint64("left id", left.meta.Id), zap.Int64("left size", left.approximateSize),
 		zap.Uint64("right id", right.meta.Id), zap.Int64("right size", right.approximateSize))
-	return nil
+	return left, nil
 }
 
+// SplitRegion splits the region at the split keys, the split keys are raw keys and must be in the region. The
+// region keeps its id and becomes the rightmost region, the regions are returned in the key order.
 func (rm *StandAloneRegionManager) SplitRegion(req *kvrpcpb.SplitRegionRequest) *kvrpcpb.SplitRegionResponse {
-	return &kvrpcpb.SplitRegionResponse{}
+	rm.splitMu.Lock()
+	defer rm.splitMu.Unlock()
+	region, regErr := rm.GetRegionFromCtx(req.Context)
+	if regErr != nil {
+		return &kvrpcpb.SplitRegionResponse{RegionError: regErr}
+	}
+	splitKeys := make([][]byte, 0, len(req.SplitKeys))
+	for _, key := range req.SplitKeys {
+		if region.lessThanStartKey(key) || region.greaterEqualEndKey(key) {
+			return &kvrpcpb.SplitRegionResponse{RegionError: &errorpb.Error{
+				Message: fmt.Sprintf("split key %q is not in region %d", key, region.meta.Id),
+				KeyNotInRegion: &errorpb.KeyNotInRegion{
+					Key:      key,
+					RegionId: region.meta.Id,
+					StartKey: region.meta.StartKey,
+					EndKey:   region.meta.EndKey,
+				},
+			}}
+		}
+		// The start key doesn't split the region.
+		if !bytes.Equal(key, region.startKey) {
+			splitKeys = append(splitKeys, key)
+		}
+	}
+	sort.Slice(splitKeys, func(i, j int) bool {
+		return bytes.Compare(splitKeys[i], splitKeys[j]) < 0
+	})
+	parentSize := region.approximateSize + atomic.LoadInt64(&region.diff)
+	parentKeys := atomic.LoadInt64(&region.approximateKeys) + atomic.LoadInt64(&region.keysDiff)
+	regions := make([]*metapb.Region, 0, len(splitKeys)+1)
+	for i, key := range splitKeys {
+		if i > 0 && bytes.Equal(key, splitKeys[i-1]) {
+			continue
+		}
+		left, err := rm.splitRegionLocked(region, key, region.approximateSize, 0)
+		if err != nil {
+			return &kvrpcpb.SplitRegionResponse{RegionError: &errorpb.Error{Message: err.Error()}, Regions: regions}
+		}
+		regions = append(regions, proto.Clone(left.meta).(*metapb.Region))
+		rm.mu.RLock()
+		region = rm.regions[region.meta.Id]
+		rm.mu.RUnlock()
+	}
+	regions = append(regions, proto.Clone(region.meta).(*metapb.Region))
+	// The sizes are unknown until the split, estimate them so the split worker checks the new regions.
+	regCtxs := make([]*regionCtx, 0, len(regions))
+	rm.mu.RLock()
+	for _, meta := range regions {
+		regCtxs = append(regCtxs, rm.regions[meta.Id])
+	}
+	rm.mu.RUnlock()
+	stats, err := estimateSplitStats(rm.bundle.DB, regCtxs, parentSize, parentKeys, regionStatsSampleKeys)
+	if err != nil {
+		log.Warn("estimate region stats failed", zap.Error(err))
+		return &kvrpcpb.SplitRegionResponse{Regions: regions}
+	}
+	for i, regCtx := range regCtxs {
+		regCtx.approximateSize = stats[i].ApproximateSize
+		atomic.StoreInt64(&regCtx.approximateKeys, stats[i].ApproximateKeys)
+	}
+	return &kvrpcpb.SplitRegionResponse{Regions: regions}
+}
+
+// MergeRegions merges the source region into the adjacent target region and returns the merged region, the
+// merged region keeps the id of the target region. It's serialized with the splits.
+func (rm *StandAloneRegionManager) MergeRegions(sourceID, targetID uint64) (*metapb.Region, error) {
+	rm.splitMu.Lock()
+	defer rm.splitMu.Unlock()
+	merged, err := rm.mergeRegions(rm.bundle, sourceID, targetID, nil)
+	if err != nil {
+		return nil, err
+	}
+	rm.pdc.ReportRegion(&pdpb.RegionHeartbeatRequest{
+		Region:          merged.meta,
+		Leader:          merged.meta.Peers[0],
+		ApproximateSize: uint64(merged.approximateSize),
+	})
+	return proto.Clone(merged.meta).(*metapb.Region), nil
 }
 
 func (rm *StandAloneRegionManager) Close() error {
@@ -0,0 +1,160 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"context"
+	"time"
+
+	"github.com/ngaut/unistore/config"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// The resolved ts of a region is the ts that all the transactions committed at or before it are applied to the
+// region, so the stale reads at or below it are served by any peer. It's advanced by the leader of the region to
+// the min of a PD ts and the start ts of the locks in the region, a transaction not yet prewritten when the PD ts
+// is allocated gets a greater commit ts. The followers in the raft mode don't advance it, they may be behind the
+// leader.
+
+// advanceTSDisabledWait is the interval the resolved ts tracker checks if it's enabled by the config reload.
+const advanceTSDisabledWait = time.Second
+
+func (svr *Server) runResolvedTSTracker() {
+	defer svr.wg.Done()
+	for {
+		wait := config.ParseDuration(svr.Config().Server.AdvanceTSInterval)
+		if wait <= 0 {
+			wait = advanceTSDisabledWait
+		}
+		select {
+		case <-svr.closeCh:
+			return
+		case <-time.After(wait):
+		}
+		if config.ParseDuration(svr.Config().Server.AdvanceTSInterval) <= 0 {
+			continue
+		}
+		physical, logical, err := svr.mvccStore.pdClient.GetTS(context.Background())
+		if err != nil {
+			log.Warn("get ts to advance the resolved ts failed", zap.Error(err))
+			continue
+		}
+		svr.advanceResolvedTS(uint64(physical)<<18 + uint64(logical))
+	}
+}
+
+// advanceResolvedTS advances the resolved ts of the regions led by the local peers with ts, and sends the resolved
+// ts to the CDC subscriptions.
+func (svr *Server) advanceResolvedTS(ts uint64) {
+	store := svr.mvccStore
+	regions := make(map[uint64]*regionCtx)
+	svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+		regions[regCtx.meta.Id] = regCtx
+	})
+	// The max read ts is updated first so the async commits are committed after ts.
+	store.updateMaxReadTS(ts)
+	advance := func(regCtx *regionCtx) {
+		if regCtx.isLeader() && !regCtx.isResolvedTSPinned() {
+			regCtx.advanceResolvedTS(store.minLockTS(regCtx.rawStartKey(), regCtx.rawEndKey(), ts))
+		}
+	}
+	observer := store.cdcObserver
+	observer.mu.RLock()
+	subscribed := make(map[uint64]struct{}, len(observer.regions))
+	for regionID := range observer.regions {
+		subscribed[regionID] = struct{}{}
+	}
+	observer.mu.RUnlock()
+	// The regions without a subscription don't block the writes. A region subscribed after this gets the commits
+	// finished before the subscription from the incremental scan, which is sent before the resolved ts.
+	for regionID, regCtx := range regions {
+		if _, ok := subscribed[regionID]; !ok {
+			advance(regCtx)
+		}
+	}
+	if len(subscribed) == 0 {
+		return
+	}
+	// The locks of the subscribed regions are scanned without a write in progress, so the rows of a commit that
+	// removes a lock are sent to the CDC subscriptions before the resolved ts passes the commit ts.
+	observer.mu.Lock()
+	defer observer.mu.Unlock()
+	for regionID := range subscribed {
+		if regCtx := regions[regionID]; regCtx != nil {
+			advance(regCtx)
+		}
+	}
+	observer.sendResolvedTS(regions)
+}
+
+// minLockTS returns the min start ts of the locks in [start, end) that are not greater than maxTS, maxTS is
+// returned if there is none. The pessimistic locks are skipped, the keys are prewritten before committed.
+func (store *MVCCStore) minLockTS(start, end []byte, maxTS uint64) uint64 {
+	minTS := maxTS
+	it := store.lockStore.NewIterator()
+	for it.Seek(start); it.Valid(); it.Next() {
+		if exceedEndKey(it.Key(), end) {
+			break
+		}
+		lock := mvcc.DecodeLock(it.Value())
+		if lock.Op != uint8(kvrpcpb.Op_PessimisticLock) && lock.StartTS < minTS {
+			minTS = lock.StartTS
+		}
+	}
+	return minTS
+}
+
+// CheckLeader returns the regions whose leader in the request is confirmed by the local peers. It doesn't change
+// the resolved ts, which is only advanced by the tracker of the leader.
+func (svr *Server) CheckLeader(ctx context.Context, req *kvrpcpb.CheckLeaderRequest) (*kvrpcpb.CheckLeaderResponse, error) {
+	regions := make(map[uint64]*regionCtx)
+	svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+		regions[regCtx.meta.Id] = regCtx
+	})
+	resp := &kvrpcpb.CheckLeaderResponse{Ts: req.Ts}
+	for _, info := range req.Regions {
+		if regCtx := regions[info.RegionId]; regCtx != nil && svr.checkLeaderInfo(regCtx, info) {
+			resp.Regions = append(resp.Regions, info.RegionId)
+		}
+	}
+	return resp, nil
+}
+
+func (svr *Server) checkLeaderInfo(regCtx *regionCtx, info *kvrpcpb.LeaderInfo) bool {
+	epoch := regCtx.getRegionEpoch()
+	if info.RegionEpoch.GetVersion() != epoch.GetVersion() || info.RegionEpoch.GetConfVer() != epoch.GetConfVer() {
+		return false
+	}
+	// The first peer is the leader of the regions without a raft group.
+	if regCtx.leaderChecker == nil {
+		return len(regCtx.meta.Peers) > 0 && regCtx.meta.Peers[0].Id == info.PeerId
+	}
+	// The follower doesn't know the leader, it only checks the leader is another peer of the region.
+	localPeerID := svr.localRPCContext(regCtx).GetPeer().GetId()
+	if regCtx.isLeader() {
+		return localPeerID == info.PeerId
+	}
+	if localPeerID == info.PeerId {
+		return false
+	}
+	for _, peer := range regCtx.meta.Peers {
+		if peer.Id == info.PeerId {
+			return true
+		}
+	}
+	return false
+}
@@ -14,15 +14,24 @@
 package tikv
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/ngaut/unistore/config"
+	"github.com/ngaut/unistore/metrics"
 	"github.com/ngaut/unistore/tikv/dbreader"
 	"github.com/ngaut/unistore/tikv/raftstore"
 	"github.com/ngaut/unistore/util/lockwaiter"
+	"github.com/opentracing/opentracing-go"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/coprocessor"
 	deadlockPb "github.com/pingcap/kvproto/pkg/deadlock"
@@ -36,6 +45,7 @@ import (
 	"github.com/pingcap/tidb/store/mockstore/unistore/cophandler"
 	"github.com/pingcap/tipb/go-tipb"
 	"go.uber.org/zap"
+	"google.golang.org/grpc/metadata"
 )
 
 var _ tikvpb.TikvServer = new(Server)
@@ -48,22 +58,96 @@ type Server struct {
 	wg            sync.WaitGroup
 	refCount      int32
 	stopped       int32
+	readerLimiter *slotLimiter
+	writerLimiter *slotLimiter
+	// The read pools are nil if their requests run on the request goroutines.
+	pointReadPool *readPool
+	scanReadPool  *readPool
+	copReadPool   *readPool
+	// maxTraceEvents is the max number of trace events kept for a request, 0 means no limit.
+	maxTraceEvents int
+	// maxRequestSize is the max size of a write request, 0 means no limit.
+	maxRequestSize int64
+	// scanEpochCheckKeys is the number of keys a scan iterates between the checks of the region epoch.
+	scanEpochCheckKeys int
+	// lockCounting is true if the regions keep the counts of their locks.
+	lockCounting bool
+
+	// activeRequests tracks the running requests by trace id so they can be cancelled.
+	activeMu       sync.Mutex
+	activeRequests map[string]map[*requestCtx]struct{}
+	traceIDAlloc   uint64
+
+	// closeCh stops the background workers of the server.
+	closeCh chan struct{}
+
+	slowLog *slowLogger
+
+	// conf is the effective config, the online items are changed by ReloadConfig.
+	confMu sync.Mutex
+	conf   config.Config
+
+	// tracer reports the spans of the requests, it's nil if the tracing is disabled.
+	tracer       opentracing.Tracer
+	tracerCloser io.Closer
 }
 
 func NewServer(rm RegionManager, store *MVCCStore, innerServer InnerServer) *Server {
-	return &Server{
+	svr := &Server{
 		mvccStore:     store,
 		regionManager: rm,
 		innerServer:   innerServer,
+		closeCh:       make(chan struct{}),
+		slowLog:       newSlowLogger(config.DefaultConf.Server),
+		// The size limit applies to the servers created without a config too.
+		maxRequestSize: config.DefaultConf.Server.MaxRequestSize,
+		conf:           config.DefaultConf,
+	}
+	if store != nil && store.conf != nil {
+		svr.conf = *store.conf
+		serverConf := store.conf.Server
+		svr.slowLog = newSlowLogger(serverConf)
+		svr.maxTraceEvents = serverConf.MaxTraceEvents
+		svr.maxRequestSize = serverConf.MaxRequestSize
+		svr.scanEpochCheckKeys = serverConf.ScanEpochCheckKeys
+		if serverConf.MaxOpenReaders > 0 {
+			svr.readerLimiter = newSlotLimiter(serverConf.MaxOpenReaders, config.ParseDuration(serverConf.ReaderWaitTimeout))
+		}
+		if serverConf.MaxRunningWrites > 0 {
+			svr.writerLimiter = newSlotLimiter(serverConf.MaxRunningWrites, config.ParseDuration(serverConf.WriterWaitTimeout))
+		}
+		svr.pointReadPool = svr.newReadPool(pointReadPool, serverConf.ReadPoolPointWorkers, serverConf.ReadPoolQueueSize)
+		svr.scanReadPool = svr.newReadPool(scanReadPool, serverConf.ReadPoolScanWorkers, serverConf.ReadPoolQueueSize)
+		svr.copReadPool = svr.newReadPool(copReadPool, serverConf.ReadPoolCopWorkers, serverConf.ReadPoolQueueSize)
+		if serverConf.RawEnableTTL {
+			if interval := config.ParseDuration(serverConf.RawTTLCheckInterval); interval > 0 {
+				svr.wg.Add(1)
+				go svr.runRawTTLChecker(interval)
+			}
+		}
+		if serverConf.TraceAgentAddr != "" {
+			tracer, closer, err := newTracer(serverConf.TraceAgentAddr, serverConf.TraceSampleRate)
+			if err != nil {
+				log.Warn("create tracer failed, the tracing is disabled", zap.Error(err))
+			} else {
+				svr.tracer, svr.tracerCloser = tracer, closer
+			}
+		}
+		svr.startLockCounting()
+		svr.wg.Add(1)
+		go svr.runMetricsUpdater()
+		if store.pdClient != nil {
+			svr.wg.Add(1)
+			go svr.runResolvedTSTracker()
+		}
 	}
+	return svr
 }
 
-const requestMaxSize = 6 * 1024 * 1024
-
 func (svr *Server) checkRequestSize(size int) *errorpb.Error {
 	// TiKV has a limitation on raft log size.
 	// mocktikv has no raft inside, so we check the request's size instead.
-	if size >= requestMaxSize {
+	if svr.maxRequestSize > 0 && int64(size) >= svr.maxRequestSize {
 		return &errorpb.Error{
 			RaftEntryTooLarge: &errorpb.RaftEntryTooLarge{},
 		}
@@ -71,14 +155,26 @@ func (svr *Server) checkRequestSize(size int) *errorpb.Error {
 	return nil
 }
 
-func (svr *Server) Stop() {
+// shutdownCancelWait is the max time the cancelled requests are waited for on shutdown.
+const shutdownCancelWait = time.Second
+
+// Stop stops the server. New requests are rejected with a retryable error, and the in-flight requests are waited
+// for up to server.shutdown-timeout before the remaining ones are cancelled. The engine is closed once all the
+// requests finish. An error is returned if the timeout is hit, the engine is left open if the cancelled requests
+// are still running.
+func (svr *Server) Stop() error {
 	atomic.StoreInt32(&svr.stopped, 1)
-	for {
-		if atomic.LoadInt32(&svr.refCount) == 0 {
-			break
+	var err error
+	if !svr.waitRequests(config.ParseDuration(svr.Config().Server.ShutdownTimeout)) {
+		cancelled := svr.cancelAllRequests()
+		log.Warn("shutdown timeout, cancel the running requests", zap.Int("count", cancelled))
+		err = errors.Errorf("shutdown timeout, %d requests are cancelled", cancelled)
+		if !svr.waitRequests(shutdownCancelWait) {
+			return errors.Errorf("shutdown timeout, %d requests are still running", atomic.LoadInt32(&svr.refCount))
 		}
-		time.Sleep(time.Millisecond * 10)
 	}
+	close(svr.closeCh)
+	svr.wg.Wait()
 
 	if err := svr.mvccStore.Close(); err != nil {
 		log.Error("close mvcc store failed", zap.Error(err))
@@ -86,9 +182,109 @@ func (svr *Server) Stop() {
 	if err := svr.regionManager.Close(); err != nil {
 		log.Error("close region manager failed", zap.Error(err))
 	}
-	if err := svr.innerServer.Stop(); err != nil {
-		log.Error("close inner server failed", zap.Error(err))
+	if svr.innerServer != nil {
+		if err := svr.innerServer.Stop(); err != nil {
+			log.Error("close inner server failed", zap.Error(err))
+		}
 	}
+	if svr.tracerCloser != nil {
+		if err := svr.tracerCloser.Close(); err != nil {
+			log.Error("close tracer failed", zap.Error(err))
+		}
+	}
+	return err
+}
+
+// waitRequests waits for the in-flight requests to finish, it returns false if they don't finish in timeout. A
+// timeout of 0 waits forever.
+func (svr *Server) waitRequests(timeout time.Duration) bool {
+	start := time.Now()
+	for atomic.LoadInt32(&svr.refCount) > 0 {
+		if timeout > 0 && time.Since(start) > timeout {
+			return false
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return true
+}
+
+// cancelAllRequests cancels the running requests and returns the number of them.
+func (svr *Server) cancelAllRequests() int {
+	svr.activeMu.Lock()
+	defer svr.activeMu.Unlock()
+	var cnt int
+	for _, reqs := range svr.activeRequests {
+		for req := range reqs {
+			req.cancel()
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// ServerStats is a snapshot of the load of the server.
+type ServerStats struct {
+	// InFlightRequests is the number of requests being processed.
+	InFlightRequests int `json:"in_flight_requests"`
+	// ReaderQueueDepth is the number of read requests waiting for a DB reader.
+	ReaderQueueDepth int `json:"reader_queue_depth"`
+	// WriterQueueDepth is the number of write requests waiting for a write slot.
+	WriterQueueDepth int `json:"writer_queue_depth"`
+	// AsyncResolveQueueDepth is the number of async lock resolutions not yet finished.
+	AsyncResolveQueueDepth int `json:"async_resolve_queue_depth"`
+	// RegionsWithLocks is the number of regions that have outstanding locks.
+	RegionsWithLocks int `json:"regions_with_locks"`
+}
+
+// Stats returns the current stats of the server. The counters are read atomically, the regions with locks
+// are read from the lock counts of the regions, the raft mode doesn't count the locks and seeks the lock
+// store for every region instead.
+func (svr *Server) Stats() ServerStats {
+	stats := ServerStats{
+		InFlightRequests:       int(atomic.LoadInt32(&svr.refCount)),
+		AsyncResolveQueueDepth: int(atomic.LoadInt32(&svr.mvccStore.asyncResolvePending)),
+	}
+	if svr.readerLimiter != nil {
+		stats.ReaderQueueDepth = int(atomic.LoadInt32(&svr.readerLimiter.waiting))
+	}
+	if svr.writerLimiter != nil {
+		stats.WriterQueueDepth = int(atomic.LoadInt32(&svr.writerLimiter.waiting))
+	}
+	if svr.lockCounting {
+		svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+			if atomic.LoadInt64(&regCtx.lockCount) > 0 {
+				stats.RegionsWithLocks++
+			}
+		})
+		return stats
+	}
+	var regions []*regionCtx
+	svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+		regions = append(regions, regCtx)
+	})
+	for _, regCtx := range regions {
+		if svr.mvccStore.hasLocks(regCtx) {
+			stats.RegionsWithLocks++
+		}
+	}
+	return stats
+}
+
+// startLockCounting counts the locks of the regions and keeps the counts with the lock writes, it's only
+// supported by the stand-alone writer.
+func (svr *Server) startLockCounting() {
+	if svr.mvccStore.flowController == nil || svr.regionManager == nil {
+		return
+	}
+	writer, ok := svr.mvccStore.flowController.DBWriter.(*dbWriter)
+	if !ok {
+		return
+	}
+	writer.lockCounter = svr.regionManager.addRegionLocks
+	svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+		regCtx.countLocks(svr.mvccStore.lockStore)
+	})
+	svr.lockCounting = true
 }
 
 func (svr *Server) GetStoreIdByAddr(addr string) (uint64, error) {
@@ -112,106 +308,602 @@ type requestCtx struct {
 	storeId          uint64
 	asyncMinCommitTS uint64
 	onePCCommitTS    uint64
+	readerSlot       bool
+	writerSlot       bool
+	// epochCheckKeys is the number of keys a scan iterates between the checks of the region epoch.
+	epochCheckKeys int
+	// ctx is the gRPC context of the request, its deadline is checked by the handlers.
+	ctx context.Context
+	// execDeadline is the deadline of the max execution duration of the request, it's zero if there is none.
+	execDeadline time.Time
+	// cancel cancels ctx, it's called by Server.CancelRequest with the trace id of the request.
+	cancel        context.CancelFunc
+	traceID       string
+	traces        []traceEvent
+	droppedTraces int
+	// span is the span of the request reported to the tracer, it's nil if the tracing is disabled.
+	span opentracing.Span
+	// startTS and key are the start ts and the first key of the request, they are reported by the slow log.
+	startTS uint64
+	key     []byte
+	// dryRun is set when prewrite only checks the mutations without writing locks.
+	dryRun bool
+	// processStart is the time a read starts to run after waiting for the reader slot and the read pool.
+	processStart time.Time
+}
+
+type traceEvent struct {
+	event   string
+	elapsed time.Duration
+}
+
+// trace records an event of the request. If the number of events exceeds the limit of the server,
+// the first and the last half of the events are kept and the events in the middle are dropped.
+func (req *requestCtx) trace(event string) {
+	ev := traceEvent{event: event, elapsed: time.Since(req.startTime)}
+	limit := req.svr.maxTraceEvents
+	if limit <= 0 || len(req.traces) < limit {
+		req.traces = append(req.traces, ev)
+		return
+	}
+	// Drop the oldest event of the tail half.
+	if head := (limit + 1) / 2; head < limit {
+		copy(req.traces[head:], req.traces[head+1:])
+		req.traces[limit-1] = ev
+	}
+	req.droppedTraces++
+}
+
+// setTxnInfo sets the start ts and the first key of the request for the slow log.
+func (req *requestCtx) setTxnInfo(startTS uint64, key []byte) {
+	req.startTS = startTS
+	req.key = key
+}
+
+func firstKey(keys [][]byte) []byte {
+	if len(keys) == 0 {
+		return nil
+	}
+	return keys[0]
 }
 
-func newRequestCtx(svr *Server, ctx *kvrpcpb.Context, method string) (*requestCtx, error) {
+// formatTraces formats the retained trace events, the dropped events are summarized by their count.
+func (req *requestCtx) formatTraces() string {
+	var b strings.Builder
+	head := len(req.traces)
+	if req.droppedTraces > 0 {
+		head = (len(req.traces) + 1) / 2
+	}
+	for i, ev := range req.traces {
+		if i == head {
+			fmt.Fprintf(&b, "... %d events dropped ..., ", req.droppedTraces)
+		}
+		fmt.Fprintf(&b, "%s:%v", ev.event, ev.elapsed)
+		if i < len(req.traces)-1 {
+			b.WriteString(", ")
+		}
+	}
+	return b.String()
+}
+
+func newRequestCtx(ctx context.Context, svr *Server, rpcCtx *kvrpcpb.Context, method string) (*requestCtx, error) {
 	atomic.AddInt32(&svr.refCount, 1)
 	if atomic.LoadInt32(&svr.stopped) > 0 {
 		atomic.AddInt32(&svr.refCount, -1)
 		return nil, ErrRetryable("server is closed")
 	}
 	req := &requestCtx{
-		svr:       svr,
-		method:    method,
-		startTime: time.Now(),
-		rpcCtx:    ctx,
+		svr:            svr,
+		method:         method,
+		startTime:      time.Now(),
+		rpcCtx:         rpcCtx,
+		traceID:        svr.traceIDFromCtx(ctx),
+		epochCheckKeys: svr.scanEpochCheckKeys,
+	}
+	if ms := rpcCtx.GetMaxExecutionDurationMs(); ms > 0 {
+		req.execDeadline = req.startTime.Add(time.Duration(ms) * time.Millisecond)
+		req.ctx, req.cancel = context.WithDeadline(ctx, req.execDeadline)
+	} else {
+		req.ctx, req.cancel = context.WithCancel(ctx)
 	}
-	req.regCtx, req.regErr = svr.regionManager.GetRegionFromCtx(ctx)
-	storeAddr, storeId, regErr := svr.regionManager.GetStoreInfoFromCtx(ctx)
+	svr.registerRequest(req)
+	if svr.tracer != nil {
+		req.span = svr.startSpan(ctx, method, req.startTime)
+	}
+	req.regCtx, req.regErr = svr.regionManager.GetRegionFromCtx(rpcCtx)
+	if req.regCtx != nil {
+		req.regCtx.touch()
+	}
+	storeAddr, storeId, regErr := svr.regionManager.GetStoreInfoFromCtx(rpcCtx)
 	req.storeAddr = storeAddr
 	req.storeId = storeId
 	if regErr != nil {
 		req.regErr = regErr
 	}
+	if req.regErr == nil {
+		if err := req.checkDeadline(); err != nil {
+			req.regErr = extractRegionError(err)
+		}
+	}
 	return req, nil
 }
 
+// traceIDMetadataKey is the gRPC metadata key of the trace id of a request.
+const traceIDMetadataKey = "trace-id"
+
+// traceIDFromCtx returns the trace id in the gRPC metadata, or allocates one if the client doesn't set it.
+func (svr *Server) traceIDFromCtx(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(traceIDMetadataKey); len(ids) > 0 && ids[0] != "" {
+			return ids[0]
+		}
+	}
+	return strconv.FormatUint(atomic.AddUint64(&svr.traceIDAlloc, 1), 10)
+}
+
+func (svr *Server) registerRequest(req *requestCtx) {
+	svr.activeMu.Lock()
+	defer svr.activeMu.Unlock()
+	if svr.activeRequests == nil {
+		svr.activeRequests = make(map[string]map[*requestCtx]struct{})
+	}
+	reqs := svr.activeRequests[req.traceID]
+	if reqs == nil {
+		reqs = make(map[*requestCtx]struct{})
+		svr.activeRequests[req.traceID] = reqs
+	}
+	reqs[req] = struct{}{}
+}
+
+func (svr *Server) unregisterRequest(req *requestCtx) {
+	svr.activeMu.Lock()
+	defer svr.activeMu.Unlock()
+	reqs := svr.activeRequests[req.traceID]
+	delete(reqs, req)
+	if len(reqs) == 0 {
+		delete(svr.activeRequests, req.traceID)
+	}
+}
+
+// CancelRequest cancels the running requests with the trace id and returns the number of them. The trace id is
+// set by the client in the "trace-id" gRPC metadata, or allocated by the server and logged with slow requests.
+// A cancelled scan stops at the next check of the region epoch and returns a cancellation error.
+func (svr *Server) CancelRequest(traceID string) int {
+	svr.activeMu.Lock()
+	defer svr.activeMu.Unlock()
+	reqs := svr.activeRequests[traceID]
+	for req := range reqs {
+		req.cancel()
+	}
+	if len(reqs) > 0 {
+		log.Info("requests cancelled", zap.String("trace id", traceID), zap.Int("count", len(reqs)))
+	}
+	return len(reqs)
+}
+
+// checkCanceled returns ErrRequestCanceled if the request is cancelled by Server.CancelRequest.
+func (req *requestCtx) checkCanceled() error {
+	if req.ctx != nil && req.ctx.Err() == context.Canceled {
+		return ErrRequestCanceled
+	}
+	return nil
+}
+
+// checkEpoch returns an error with the region error if the region of the request is split, merged or
+// removed after the request started, so that long scans don't read beyond the current range of the region.
+func (req *requestCtx) checkEpoch() error {
+	if _, regErr := req.svr.regionManager.GetRegionFromCtx(req.rpcCtx); regErr != nil {
+		return &raftstore.RaftError{RequestErr: regErr}
+	}
+	return nil
+}
+
+// checkDeadline returns a region error if the deadline of the gRPC context has been exceeded,
+// so that the handlers stop early instead of doing work whose result the client won't receive.
+// ErrMaxExecutionTimeExceeded is returned instead if the max execution duration of the request is exceeded,
+// retrying the request wouldn't finish in time either.
+func (req *requestCtx) checkDeadline() error {
+	if req.ctx == nil || req.ctx.Err() != context.DeadlineExceeded {
+		return nil
+	}
+	if !req.execDeadline.IsZero() && !time.Now().Before(req.execDeadline) {
+		return ErrMaxExecutionTimeExceeded
+	}
+	return &raftstore.RaftError{RequestErr: &errorpb.Error{
+		Message: fmt.Sprintf("deadline exceeded, method %s, elapsed %v", req.method, time.Since(req.startTime)),
+	}}
+}
+
+// checkContext returns the error of a request that is cancelled or whose deadline has been exceeded.
+func (req *requestCtx) checkContext() error {
+	if err := req.checkCanceled(); err != nil {
+		return err
+	}
+	return req.checkDeadline()
+}
+
+// contextCheckKeys is the max number of keys a scan iterates between the checks of the request context.
+const contextCheckKeys = 256
+
+// newScanChecker returns the range checker of the scans called every interval keys. The cancelled or timed out
+// requests are stopped at every check, the region epoch is checked every epochCheckKeys keys if it's enabled.
+func (req *requestCtx) newScanChecker(interval int) func() error {
+	var uncheckedKeys int
+	return func() error {
+		if err := req.checkContext(); err != nil {
+			return err
+		}
+		if req.epochCheckKeys <= 0 {
+			return nil
+		}
+		uncheckedKeys += interval
+		if uncheckedKeys < req.epochCheckKeys {
+			return nil
+		}
+		uncheckedKeys = 0
+		return req.checkEpoch()
+	}
+}
+
 // For read-only requests that doesn't acquire latches, this function must be called after all locks has been checked.
 func (req *requestCtx) getDBReader() *dbreader.DBReader {
 	if req.reader == nil {
 		mvccStore := req.svr.mvccStore
 		txn := mvccStore.db.NewTransaction(false)
 		req.reader = dbreader.NewDBReader(req.regCtx.startKey, req.regCtx.endKey, txn)
+		req.reader.SetValueCodec(mvccStore.valueCodec)
+		interval := contextCheckKeys
+		if req.epochCheckKeys > 0 && req.epochCheckKeys < interval {
+			interval = req.epochCheckKeys
+		}
+		req.reader.SetRangeChecker(interval, req.newScanChecker(interval))
 	}
 	return req.reader
 }
 
+const (
+	busyBackoffBaseMs = 10
+	busyBackoffMaxMs  = 2000
+)
+
+// newServerIsBusyErr builds a ServerIsBusy region error with an estimated backoff, the backoff grows
+// with the number of queued requests so that clients don't retry at the same time.
+func newServerIsBusyErr(reason string, queueDepth int) *errorpb.Error {
+	backoffMs := uint64(busyBackoffBaseMs * (queueDepth + 1))
+	if backoffMs > busyBackoffMaxMs {
+		backoffMs = busyBackoffMaxMs
+	}
+	return &errorpb.Error{
+		Message: reason,
+		ServerIsBusy: &errorpb.ServerIsBusy{
+			Reason:    reason,
+			BackoffMs: backoffMs,
+		},
+	}
+}
+
+// checkStaleRead checks if the region has applied all the data visible to a stale read at readTS.
+func (req *requestCtx) checkStaleRead(readTS uint64) *errorpb.Error {
+	resolvedTS := req.regCtx.getResolvedTS()
+	if readTS > resolvedTS {
+		return &errorpb.Error{
+			Message: fmt.Sprintf("data is not ready, region %d, read ts %d, resolved ts %d",
+				req.regCtx.meta.GetId(), readTS, resolvedTS),
+			DataIsNotReady: &errorpb.DataIsNotReady{
+				RegionId: req.regCtx.meta.GetId(),
+				PeerId:   req.rpcCtx.GetPeer().GetId(),
+				SafeTs:   resolvedTS,
+			},
+		}
+	}
+	return nil
+}
+
+// checkReadTS checks the read ts of a stale read, the other reads are always served at their read ts.
+func (req *requestCtx) checkReadTS(readTS uint64) *errorpb.Error {
+	if !req.rpcCtx.GetStaleRead() {
+		return nil
+	}
+	return req.checkStaleRead(readTS)
+}
+
+// checkWritable returns ErrRegionReadOnly if the region is marked read-only.
+func (req *requestCtx) checkWritable() error {
+	if req.regCtx.isReadOnly() {
+		return ErrRegionReadOnly
+	}
+	return nil
+}
+
+// acquireReaderSlot reserves a DB reader slot for a read-only request. If the number of open readers
+// has reached the limit, it waits for a slot until timeout and returns a ServerIsBusy error.
+func (req *requestCtx) acquireReaderSlot() *errorpb.Error {
+	limiter := req.svr.readerLimiter
+	if limiter == nil || req.readerSlot {
+		return nil
+	}
+	if ok, queued := limiter.acquire(req.rpcCtx.GetPriority()); !ok {
+		return newServerIsBusyErr("too many open readers", queued)
+	}
+	req.trace("acquire reader")
+	req.readerSlot = true
+	return nil
+}
+
+// acquireWriterSlot reserves a write slot for a transactional write request. If the number of running
+// writes has reached the limit, it waits for a slot until timeout and returns a ServerIsBusy error.
+func (req *requestCtx) acquireWriterSlot() *errorpb.Error {
+	limiter := req.svr.writerLimiter
+	if limiter == nil || req.writerSlot {
+		return nil
+	}
+	if ok, queued := limiter.acquire(req.rpcCtx.GetPriority()); !ok {
+		return newServerIsBusyErr("too many running writes", queued)
+	}
+	req.trace("acquire writer")
+	req.writerSlot = true
+	return nil
+}
+
+// releaseWriterSlot releases the write slot early, a request must not hold it while waiting for a lock.
+func (req *requestCtx) releaseWriterSlot() {
+	if req.writerSlot {
+		req.writerSlot = false
+		req.svr.writerLimiter.release()
+	}
+}
+
+// execDetailsV2 returns the wait and process time of the read and the keys read by it.
+func (req *requestCtx) execDetailsV2() *kvrpcpb.ExecDetailsV2 {
+	processStart := req.processStart
+	if processStart.IsZero() {
+		processStart = req.startTime
+	}
+	var scanned, processed int
+	if req.reader != nil {
+		scanned, processed = req.reader.ScanStats()
+	}
+	return &kvrpcpb.ExecDetailsV2{
+		TimeDetail: &kvrpcpb.TimeDetail{
+			WaitWallTimeMs:    processStart.Sub(req.startTime).Milliseconds(),
+			ProcessWallTimeMs: time.Since(processStart).Milliseconds(),
+		},
+		ScanDetailV2: &kvrpcpb.ScanDetailV2{
+			ProcessedVersions: uint64(processed),
+			TotalVersions:     uint64(scanned),
+		},
+	}
+}
+
 func (req *requestCtx) finish() {
 	atomic.AddInt32(&req.svr.refCount, -1)
+	metrics.GrpcMsgDuration.WithLabelValues(req.method).Observe(time.Since(req.startTime).Seconds())
+	if req.regErr != nil {
+		metrics.GrpcRegionErrors.WithLabelValues(req.method).Inc()
+	}
+	if req.span != nil {
+		req.finishSpan()
+	}
+	if req.cancel != nil {
+		req.svr.unregisterRequest(req)
+		req.cancel()
+	}
+	if duration := time.Since(req.startTime); req.svr.slowLog.isSlow(req.method, duration) {
+		req.svr.slowLog.log(req, duration)
+	}
 	if req.reader != nil {
 		req.reader.Close()
 	}
+	if req.readerSlot {
+		req.svr.readerLimiter.release()
+	}
+	req.releaseWriterSlot()
+}
+
+// slotLimiter limits the number of requests running concurrently on a path. The requests that
+// can't get a slot wait in one queue per priority, a released slot is handed to the oldest waiter
+// of the highest priority so low priority background jobs can't starve latency-sensitive requests.
+type slotLimiter struct {
+	mu      sync.Mutex
+	free    int
+	queues  [numPriorities][]chan struct{}
+	timeout time.Duration
+	waiting int32
+}
+
+const numPriorities = 3
+
+// priorityIndex maps a command priority to its queue index, a smaller index is served first.
+func priorityIndex(pri kvrpcpb.CommandPri) int {
+	switch pri {
+	case kvrpcpb.CommandPri_High:
+		return 0
+	case kvrpcpb.CommandPri_Low:
+		return 2
+	default:
+		return 1
+	}
+}
+
+func newSlotLimiter(limit int, timeout time.Duration) *slotLimiter {
+	return &slotLimiter{
+		free:    limit,
+		timeout: timeout,
+	}
+}
+
+// queuedUntil returns the number of the waiting requests of the same or higher priority, it must be called
+// with the lock held.
+func (l *slotLimiter) queuedUntil(idx int) int {
+	queued := 0
+	for i := 0; i <= idx; i++ {
+		queued += len(l.queues[i])
+	}
+	return queued
+}
+
+// acquire returns whether a slot is acquired and the number of waiting requests of the same or higher
+// priority. It's the number queued ahead when a slot is acquired, and the number still waiting when the
+// request is rejected, so the backoff hint reflects the queue at the rejection.
+func (l *slotLimiter) acquire(pri kvrpcpb.CommandPri) (bool, int) {
+	idx := priorityIndex(pri)
+	l.mu.Lock()
+	queued := l.queuedUntil(idx)
+	if l.free > 0 && queued == 0 {
+		l.free--
+		l.mu.Unlock()
+		return true, 0
+	}
+	ch := make(chan struct{}, 1)
+	l.queues[idx] = append(l.queues[idx], ch)
+	l.mu.Unlock()
+	atomic.AddInt32(&l.waiting, 1)
+	defer atomic.AddInt32(&l.waiting, -1)
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true, queued
+	case <-timer.C:
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, waiter := range l.queues[idx] {
+		if waiter == ch {
+			l.queues[idx] = append(l.queues[idx][:i], l.queues[idx][i+1:]...)
+			return false, l.queuedUntil(idx)
+		}
+	}
+	// The slot was handed to us after the timer fired.
+	return true, queued
+}
+
+// release hands the slot to the highest priority waiter, or returns it to the free slots.
+func (l *slotLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i := range l.queues {
+		if len(l.queues[i]) > 0 {
+			ch := l.queues[i][0]
+			l.queues[i] = l.queues[i][1:]
+			ch <- struct{}{}
+			return
+		}
+	}
+	l.free++
 }
 
 func (svr *Server) KvGet(ctx context.Context, req *kvrpcpb.GetRequest) (*kvrpcpb.GetResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvGet")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvGet")
 	if err != nil {
 		return &kvrpcpb.GetResponse{Error: convertToKeyError(err)}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.Version, req.Key)
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.GetResponse{RegionError: reqCtx.regErr}, nil
 	}
-	err = svr.mvccStore.CheckKeysLock(req.GetVersion(), req.Context.ResolvedLocks, req.Key)
+	if regErr := reqCtx.checkReadTS(req.GetVersion()); regErr != nil {
+		return &kvrpcpb.GetResponse{RegionError: regErr}, nil
+	}
+	var resp *kvrpcpb.GetResponse
+	if err = reqCtx.runInReadPool(svr.pointReadPool, func() { resp = svr.kvGet(reqCtx, req) }); err != nil {
+		resp = new(kvrpcpb.GetResponse)
+		resp.Error, resp.RegionError = convertToPBError(err)
+	}
+	resp.ExecDetailsV2 = reqCtx.execDetailsV2()
+	return resp, nil
+}
+
+func (svr *Server) kvGet(reqCtx *requestCtx, req *kvrpcpb.GetRequest) *kvrpcpb.GetResponse {
+	if err := svr.mvccStore.CheckReadTS(req.GetVersion()); err != nil {
+		return &kvrpcpb.GetResponse{Error: convertToKeyError(err)}
+	}
+	err := svr.mvccStore.CheckKeysLock(req.GetVersion(), req.Context.ResolvedLocks, req.Key)
 	if err != nil {
-		return &kvrpcpb.GetResponse{Error: convertToKeyError(err)}, nil
+		return &kvrpcpb.GetResponse{Error: convertToKeyError(err)}
+	}
+	reqCtx.trace("check lock")
+	if err = reqCtx.checkDeadline(); err != nil {
+		return &kvrpcpb.GetResponse{RegionError: extractRegionError(err)}
 	}
 	reader := reqCtx.getDBReader()
 	val, err := reader.Get(req.Key, req.GetVersion())
+	reqCtx.trace("get value")
 	if err != nil {
 		return &kvrpcpb.GetResponse{
 			Error: convertToKeyError(err),
-		}, nil
+		}
 	}
 	val = safeCopy(val)
 	return &kvrpcpb.GetResponse{
 		Value: val,
-	}, nil
+	}
 }
 
 func (svr *Server) KvScan(ctx context.Context, req *kvrpcpb.ScanRequest) (*kvrpcpb.ScanResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvScan")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvScan")
 	if err != nil {
 		return &kvrpcpb.ScanResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.Version, req.StartKey)
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.ScanResponse{RegionError: reqCtx.regErr}, nil
 	}
-	pairs := svr.mvccStore.Scan(reqCtx, req)
+	if regErr := reqCtx.checkReadTS(req.GetVersion()); regErr != nil {
+		return &kvrpcpb.ScanResponse{RegionError: regErr}, nil
+	}
+	if err = svr.mvccStore.CheckReadTS(req.GetVersion()); err != nil {
+		return &kvrpcpb.ScanResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	var pairs []*kvrpcpb.KvPair
+	if err = reqCtx.runInReadPool(svr.scanReadPool, func() { pairs = svr.mvccStore.Scan(reqCtx, req) }); err != nil {
+		if regErr := extractRegionError(err); regErr != nil {
+			return &kvrpcpb.ScanResponse{RegionError: regErr}, nil
+		}
+		return &kvrpcpb.ScanResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
 	return &kvrpcpb.ScanResponse{
 		Pairs: pairs,
+		// Set if the region is changed during the scan, the pairs are read before the change.
+		RegionError: reqCtx.regErr,
 	}, nil
 }
 
 func (svr *Server) KvPessimisticLock(ctx context.Context, req *kvrpcpb.PessimisticLockRequest) (*kvrpcpb.PessimisticLockResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "PessimisticLock")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "PessimisticLock")
 	if err != nil {
 		return &kvrpcpb.PessimisticLockResponse{Errors: []*kvrpcpb.KeyError{convertToKeyError(err)}}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.StartVersion, req.PrimaryLock)
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.PessimisticLockResponse{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := reqCtx.acquireWriterSlot(); regErr != nil {
+		return &kvrpcpb.PessimisticLockResponse{RegionError: regErr}, nil
+	}
+	if regErr := reqCtx.checkFlowControl(); regErr != nil {
+		return &kvrpcpb.PessimisticLockResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.PessimisticLockResponse{Errors: []*kvrpcpb.KeyError{convertToKeyError(err)}}, nil
+	}
 	resp := &kvrpcpb.PessimisticLockResponse{}
 	waiter, err := svr.mvccStore.PessimisticLock(reqCtx, req, resp)
 	resp.Errors, resp.RegionError = convertToPBErrors(err)
 	if waiter == nil {
 		return resp, nil
 	}
-	result := waiter.Wait()
+	reqCtx.releaseWriterSlot()
+	result := waiter.WaitContext(reqCtx.ctx)
 	svr.mvccStore.DeadlockDetectCli.CleanUpWaitFor(req.StartVersion, waiter.LockTS, waiter.KeyHash)
 	svr.mvccStore.lockWaiterManager.CleanUp(waiter)
+	if result.WakeupSleepTime == lockwaiter.WaitCanceled {
+		resp.Errors, resp.RegionError = convertToPBErrors(reqCtx.checkContext())
+		return resp, nil
+	}
 	if result.WakeupSleepTime == lockwaiter.WaitTimeout {
 		return resp, nil
 	}
@@ -254,7 +946,7 @@ func (svr *Server) KvPessimisticLock(ctx context.Context, req *kvrpcpb.Pessimist
 }
 
 func (svr *Server) KVPessimisticRollback(ctx context.Context, req *kvrpcpb.PessimisticRollbackRequest) (*kvrpcpb.PessimisticRollbackResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "PessimisticRollback")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "PessimisticRollback")
 	if err != nil {
 		return &kvrpcpb.PessimisticRollbackResponse{Errors: []*kvrpcpb.KeyError{convertToKeyError(err)}}, nil
 	}
@@ -262,6 +954,12 @@ func (svr *Server) KVPessimisticRollback(ctx context.Context, req *kvrpcpb.Pessi
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.PessimisticRollbackResponse{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := reqCtx.acquireWriterSlot(); regErr != nil {
+		return &kvrpcpb.PessimisticRollbackResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.PessimisticRollbackResponse{Errors: []*kvrpcpb.KeyError{convertToKeyError(err)}}, nil
+	}
 	err = svr.mvccStore.PessimisticRollback(reqCtx, req)
 	resp := &kvrpcpb.PessimisticRollbackResponse{}
 	resp.Errors, resp.RegionError = convertToPBErrors(err)
@@ -269,14 +967,21 @@ func (svr *Server) KVPessimisticRollback(ctx context.Context, req *kvrpcpb.Pessi
 }
 
 func (svr *Server) KvTxnHeartBeat(ctx context.Context, req *kvrpcpb.TxnHeartBeatRequest) (*kvrpcpb.TxnHeartBeatResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "TxnHeartBeat")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "TxnHeartBeat")
 	if err != nil {
 		return &kvrpcpb.TxnHeartBeatResponse{Error: convertToKeyError(err)}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.StartVersion, req.PrimaryLock)
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.TxnHeartBeatResponse{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := reqCtx.acquireWriterSlot(); regErr != nil {
+		return &kvrpcpb.TxnHeartBeatResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.TxnHeartBeatResponse{Error: convertToKeyError(err)}, nil
+	}
 	lockTTL, err := svr.mvccStore.TxnHeartBeat(reqCtx, req)
 	resp := &kvrpcpb.TxnHeartBeatResponse{LockTtl: lockTTL}
 	resp.Error, resp.RegionError = convertToPBError(err)
@@ -284,14 +989,25 @@ func (svr *Server) KvTxnHeartBeat(ctx context.Context, req *kvrpcpb.TxnHeartBeat
 }
 
 func (svr *Server) KvCheckTxnStatus(ctx context.Context, req *kvrpcpb.CheckTxnStatusRequest) (*kvrpcpb.CheckTxnStatusResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvCheckTxnStatus")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvCheckTxnStatus")
 	if err != nil {
 		return &kvrpcpb.CheckTxnStatusResponse{Error: convertToKeyError(err)}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.LockTs, req.PrimaryKey)
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.CheckTxnStatusResponse{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := reqCtx.acquireWriterSlot(); regErr != nil {
+		return &kvrpcpb.CheckTxnStatusResponse{RegionError: regErr}, nil
+	}
+	// Checking the status may roll back the transaction or push its min commit ts.
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.CheckTxnStatusResponse{Error: convertToKeyError(err)}, nil
+	}
+	if err = checkKeysInRegion(reqCtx.regCtx, req.PrimaryKey); err != nil {
+		return &kvrpcpb.CheckTxnStatusResponse{Error: convertToKeyError(err)}, nil
+	}
 	txnStatus, err := svr.mvccStore.CheckTxnStatus(reqCtx, req)
 	ttl := uint64(0)
 	if txnStatus.lockInfo != nil {
@@ -307,15 +1023,38 @@ func (svr *Server) KvCheckTxnStatus(ctx context.Context, req *kvrpcpb.CheckTxnSt
 	return resp, nil
 }
 
+// BatchCheckTxnStatus checks the status of many transactions in one call, the primary keys may belong to
+// different regions so every request carries its own context and is checked against its own region, and
+// it rolls back a missing transaction only if it sets rollback_if_not_exist. Errors are reported per request.
+func (svr *Server) BatchCheckTxnStatus(ctx context.Context, reqs []*kvrpcpb.CheckTxnStatusRequest) ([]*kvrpcpb.CheckTxnStatusResponse, error) {
+	resps := make([]*kvrpcpb.CheckTxnStatusResponse, 0, len(reqs))
+	for _, req := range reqs {
+		resp, err := svr.KvCheckTxnStatus(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		resps = append(resps, resp)
+	}
+	return resps, nil
+}
+
 func (svr *Server) KvCheckSecondaryLocks(ctx context.Context, req *kvrpcpb.CheckSecondaryLocksRequest) (*kvrpcpb.CheckSecondaryLocksResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvCheckSecondaryLocks")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvCheckSecondaryLocks")
 	if err != nil {
 		return &kvrpcpb.CheckSecondaryLocksResponse{Error: convertToKeyError(err)}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.StartVersion, firstKey(req.Keys))
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.CheckSecondaryLocksResponse{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := reqCtx.acquireWriterSlot(); regErr != nil {
+		return &kvrpcpb.CheckSecondaryLocksResponse{RegionError: regErr}, nil
+	}
+	// The missing locks are rolled back to prevent the transaction from committing.
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.CheckSecondaryLocksResponse{Error: convertToKeyError(err)}, nil
+	}
 	locksStatus, err := svr.mvccStore.CheckSecondaryLocks(reqCtx, req.Keys, req.StartVersion)
 	resp := &kvrpcpb.CheckSecondaryLocksResponse{}
 	if err == nil {
@@ -328,14 +1067,27 @@ func (svr *Server) KvCheckSecondaryLocks(ctx context.Context, req *kvrpcpb.Check
 }
 
 func (svr *Server) KvPrewrite(ctx context.Context, req *kvrpcpb.PrewriteRequest) (*kvrpcpb.PrewriteResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvPrewrite")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvPrewrite")
 	if err != nil {
 		return &kvrpcpb.PrewriteResponse{Errors: []*kvrpcpb.KeyError{convertToKeyError(err)}}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.StartVersion, req.PrimaryLock)
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.PrewriteResponse{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := svr.checkRequestSize(req.Size()); regErr != nil {
+		return &kvrpcpb.PrewriteResponse{RegionError: regErr}, nil
+	}
+	if regErr := reqCtx.acquireWriterSlot(); regErr != nil {
+		return &kvrpcpb.PrewriteResponse{RegionError: regErr}, nil
+	}
+	if regErr := reqCtx.checkFlowControl(); regErr != nil {
+		return &kvrpcpb.PrewriteResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.PrewriteResponse{Errors: []*kvrpcpb.KeyError{convertToKeyError(err)}}, nil
+	}
 	err = svr.mvccStore.Prewrite(reqCtx, req)
 	resp := &kvrpcpb.PrewriteResponse{}
 	if reqCtx.asyncMinCommitTS > 0 {
@@ -349,14 +1101,21 @@ func (svr *Server) KvPrewrite(ctx context.Context, req *kvrpcpb.PrewriteRequest)
 }
 
 func (svr *Server) KvCommit(ctx context.Context, req *kvrpcpb.CommitRequest) (*kvrpcpb.CommitResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvCommit")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvCommit")
 	if err != nil {
 		return &kvrpcpb.CommitResponse{Error: convertToKeyError(err)}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.StartVersion, firstKey(req.Keys))
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.CommitResponse{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := reqCtx.acquireWriterSlot(); regErr != nil {
+		return &kvrpcpb.CommitResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.CommitResponse{Error: convertToKeyError(err)}, nil
+	}
 	resp := new(kvrpcpb.CommitResponse)
 	err = svr.mvccStore.Commit(reqCtx, req.Keys, req.GetStartVersion(), req.GetCommitVersion())
 	if err != nil {
@@ -365,20 +1124,60 @@ func (svr *Server) KvCommit(ctx context.Context, req *kvrpcpb.CommitRequest) (*k
 	return resp, nil
 }
 
-func (svr *Server) KvImport(context.Context, *kvrpcpb.ImportRequest) (*kvrpcpb.ImportResponse, error) {
-	// TODO
+// KvImport writes the mutations as committed at the commit version, bypassing the two-phase commit. The request
+// has no region context, the mutations are grouped by the regions of this store and imported region by region.
+func (svr *Server) KvImport(ctx context.Context, req *kvrpcpb.ImportRequest) (*kvrpcpb.ImportResponse, error) {
+	groups, err := svr.groupImportMutations(req.Mutations)
+	if err != nil {
+		return &kvrpcpb.ImportResponse{Error: err.Error()}, nil
+	}
+	for _, group := range groups {
+		resp := svr.importRegion(ctx, group, req.GetCommitVersion())
+		if resp.RegionError != nil || resp.Error != "" {
+			return resp, nil
+		}
+	}
 	return &kvrpcpb.ImportResponse{}, nil
 }
 
+func (svr *Server) importRegion(ctx context.Context, group *importGroup, commitTS uint64) *kvrpcpb.ImportResponse {
+	reqCtx, err := newRequestCtx(ctx, svr, svr.localRPCContext(group.regCtx), "KvImport")
+	if err != nil {
+		return &kvrpcpb.ImportResponse{Error: err.Error()}
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.ImportResponse{RegionError: reqCtx.regErr}
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.ImportResponse{Error: err.Error()}
+	}
+	err = svr.mvccStore.Import(reqCtx, group.mutations, commitTS)
+	if regErr := extractRegionError(err); regErr != nil {
+		return &kvrpcpb.ImportResponse{RegionError: regErr}
+	}
+	if err != nil {
+		return &kvrpcpb.ImportResponse{Error: err.Error()}
+	}
+	return &kvrpcpb.ImportResponse{}
+}
+
 func (svr *Server) KvCleanup(ctx context.Context, req *kvrpcpb.CleanupRequest) (*kvrpcpb.CleanupResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvCleanup")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvCleanup")
 	if err != nil {
 		return &kvrpcpb.CleanupResponse{Error: convertToKeyError(err)}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.StartVersion, req.Key)
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.CleanupResponse{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := reqCtx.acquireWriterSlot(); regErr != nil {
+		return &kvrpcpb.CleanupResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.CleanupResponse{Error: convertToKeyError(err)}, nil
+	}
 	err = svr.mvccStore.Cleanup(reqCtx, req.Key, req.StartVersion, req.CurrentTs)
 	resp := new(kvrpcpb.CleanupResponse)
 	if committed, ok := err.(ErrAlreadyCommitted); ok {
@@ -391,29 +1190,47 @@ func (svr *Server) KvCleanup(ctx context.Context, req *kvrpcpb.CleanupRequest) (
 }
 
 func (svr *Server) KvBatchGet(ctx context.Context, req *kvrpcpb.BatchGetRequest) (*kvrpcpb.BatchGetResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvBatchGet")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvBatchGet")
 	if err != nil {
 		return &kvrpcpb.BatchGetResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.Version, firstKey(req.Keys))
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.BatchGetResponse{RegionError: reqCtx.regErr}, nil
 	}
-	pairs := svr.mvccStore.BatchGet(reqCtx, req.Keys, req.GetVersion())
+	if regErr := reqCtx.checkReadTS(req.GetVersion()); regErr != nil {
+		return &kvrpcpb.BatchGetResponse{RegionError: regErr}, nil
+	}
+	var pairs []*kvrpcpb.KvPair
+	if err = reqCtx.runInReadPool(svr.pointReadPool, func() { pairs = svr.mvccStore.BatchGet(reqCtx, req.Keys, req.GetVersion()) }); err != nil {
+		if regErr := extractRegionError(err); regErr != nil {
+			return &kvrpcpb.BatchGetResponse{RegionError: regErr}, nil
+		}
+		return &kvrpcpb.BatchGetResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
 	return &kvrpcpb.BatchGetResponse{
-		Pairs: pairs,
+		Pairs:         pairs,
+		ExecDetailsV2: reqCtx.execDetailsV2(),
 	}, nil
 }
 
 func (svr *Server) KvBatchRollback(ctx context.Context, req *kvrpcpb.BatchRollbackRequest) (*kvrpcpb.BatchRollbackResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvBatchRollback")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvBatchRollback")
 	if err != nil {
 		return &kvrpcpb.BatchRollbackResponse{Error: convertToKeyError(err)}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.StartVersion, firstKey(req.Keys))
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.BatchRollbackResponse{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := reqCtx.acquireWriterSlot(); regErr != nil {
+		return &kvrpcpb.BatchRollbackResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.BatchRollbackResponse{Error: convertToKeyError(err)}, nil
+	}
 	resp := new(kvrpcpb.BatchRollbackResponse)
 	err = svr.mvccStore.Rollback(reqCtx, req.Keys, req.StartVersion)
 	resp.Error, resp.RegionError = convertToPBError(err)
@@ -421,7 +1238,7 @@ func (svr *Server) KvBatchRollback(ctx context.Context, req *kvrpcpb.BatchRollba
 }
 
 func (svr *Server) KvScanLock(ctx context.Context, req *kvrpcpb.ScanLockRequest) (*kvrpcpb.ScanLockResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvScanLock")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvScanLock")
 	if err != nil {
 		return &kvrpcpb.ScanLockResponse{Error: convertToKeyError(err)}, nil
 	}
@@ -430,19 +1247,26 @@ func (svr *Server) KvScanLock(ctx context.Context, req *kvrpcpb.ScanLockRequest)
 		return &kvrpcpb.ScanLockResponse{RegionError: reqCtx.regErr}, nil
 	}
 	log.Debug("kv scan lock")
-	locks, err := svr.mvccStore.ScanLock(reqCtx, req.MaxVersion, int(req.Limit))
+	locks, err := svr.mvccStore.ScanLock(reqCtx, req.StartKey, req.MaxVersion, int(req.Limit))
 	return &kvrpcpb.ScanLockResponse{Error: convertToKeyError(err), Locks: locks}, nil
 }
 
 func (svr *Server) KvResolveLock(ctx context.Context, req *kvrpcpb.ResolveLockRequest) (*kvrpcpb.ResolveLockResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvResolveLock")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvResolveLock")
 	if err != nil {
 		return &kvrpcpb.ResolveLockResponse{Error: convertToKeyError(err)}, nil
 	}
 	defer reqCtx.finish()
+	reqCtx.setTxnInfo(req.StartVersion, firstKey(req.Keys))
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.ResolveLockResponse{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := reqCtx.acquireWriterSlot(); regErr != nil {
+		return &kvrpcpb.ResolveLockResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.ResolveLockResponse{Error: convertToKeyError(err)}, nil
+	}
 	resp := &kvrpcpb.ResolveLockResponse{}
 	if len(req.TxnInfos) > 0 {
 		for _, txnInfo := range req.TxnInfos {
@@ -462,17 +1286,33 @@ func (svr *Server) KvResolveLock(ctx context.Context, req *kvrpcpb.ResolveLockRe
 }
 
 func (svr *Server) KvGC(ctx context.Context, req *kvrpcpb.GCRequest) (*kvrpcpb.GCResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvGC")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvGC")
 	if err != nil {
 		return &kvrpcpb.GCResponse{Error: convertToKeyError(err)}, nil
 	}
 	defer reqCtx.finish()
+	if svr.mvccStore.IsGCPaused() && svr.mvccStore.conf.GC.PausedPolicy == gcPausedReject {
+		return &kvrpcpb.GCResponse{Error: convertToKeyError(ErrGCPaused)}, nil
+	}
 	svr.mvccStore.UpdateSafePoint(req.SafePoint)
 	return &kvrpcpb.GCResponse{}, nil
 }
 
+// gcPausedReject is the GC paused policy that rejects KvGC requests while GC is paused.
+const gcPausedReject = "reject"
+
+// PauseGC pauses GC at runtime, e.g. during a backup, the safe point stops advancing until ResumeGC is called.
+func (svr *Server) PauseGC() {
+	svr.mvccStore.PauseGC()
+}
+
+// ResumeGC resumes GC paused by PauseGC.
+func (svr *Server) ResumeGC() {
+	svr.mvccStore.ResumeGC()
+}
+
 func (svr *Server) KvDeleteRange(ctx context.Context, req *kvrpcpb.DeleteRangeRequest) (*kvrpcpb.DeleteRangeResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "KvDeleteRange")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "KvDeleteRange")
 	if err != nil {
 		return &kvrpcpb.DeleteRangeResponse{Error: convertToKeyError(err).String()}, nil
 	}
@@ -480,6 +1320,12 @@ func (svr *Server) KvDeleteRange(ctx context.Context, req *kvrpcpb.DeleteRangeRe
 	if reqCtx.regErr != nil {
 		return &kvrpcpb.DeleteRangeResponse{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := reqCtx.acquireWriterSlot(); regErr != nil {
+		return &kvrpcpb.DeleteRangeResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return &kvrpcpb.DeleteRangeResponse{Error: convertToKeyError(err).String()}, nil
+	}
 	err = svr.mvccStore.dbWriter.DeleteRange(req.StartKey, req.EndKey, reqCtx.regCtx)
 	if err != nil {
 		log.Error("delete range failed", zap.Error(err))
@@ -488,36 +1334,416 @@ func (svr *Server) KvDeleteRange(ctx context.Context, req *kvrpcpb.DeleteRangeRe
 }
 
 // RawKV commands.
-func (svr *Server) RawGet(context.Context, *kvrpcpb.RawGetRequest) (*kvrpcpb.RawGetResponse, error) {
-	return &kvrpcpb.RawGetResponse{}, nil
+func (svr *Server) RawGet(ctx context.Context, req *kvrpcpb.RawGetRequest) (*kvrpcpb.RawGetResponse, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "RawGet")
+	if err != nil {
+		return &kvrpcpb.RawGetResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawGetResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.acquireReaderSlot(); regErr != nil {
+		return &kvrpcpb.RawGetResponse{RegionError: regErr}, nil
+	}
+	val, err := svr.mvccStore.RawGet(reqCtx, req.Key)
+	if err != nil {
+		return &kvrpcpb.RawGetResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.RawGetResponse{Value: val}, nil
+}
+
+func (svr *Server) RawPut(ctx context.Context, req *kvrpcpb.RawPutRequest) (*kvrpcpb.RawPutResponse, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "RawPut")
+	if err != nil {
+		return &kvrpcpb.RawPutResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawPutResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := svr.checkRequestSize(req.Size()); regErr != nil {
+		return &kvrpcpb.RawPutResponse{RegionError: regErr}, nil
+	}
+	if regErr := reqCtx.checkFlowControl(); regErr != nil {
+		return &kvrpcpb.RawPutResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err == nil {
+		err = svr.mvccStore.RawPut(reqCtx, [][]byte{req.Key}, [][]byte{req.Value}, 0)
+	}
+	resp := &kvrpcpb.RawPutResponse{}
+	resp.RegionError, resp.Error = convertToRawErrors(err)
+	return resp, nil
+}
+
+func (svr *Server) RawDelete(ctx context.Context, req *kvrpcpb.RawDeleteRequest) (*kvrpcpb.RawDeleteResponse, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "RawDelete")
+	if err != nil {
+		return &kvrpcpb.RawDeleteResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawDeleteResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := svr.checkRequestSize(req.Size()); regErr != nil {
+		return &kvrpcpb.RawDeleteResponse{RegionError: regErr}, nil
+	}
+	if regErr := reqCtx.checkFlowControl(); regErr != nil {
+		return &kvrpcpb.RawDeleteResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err == nil {
+		err = svr.mvccStore.RawDelete(reqCtx, [][]byte{req.Key})
+	}
+	resp := &kvrpcpb.RawDeleteResponse{}
+	resp.RegionError, resp.Error = convertToRawErrors(err)
+	return resp, nil
+}
+
+func (svr *Server) RawScan(ctx context.Context, req *kvrpcpb.RawScanRequest) (*kvrpcpb.RawScanResponse, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "RawScan")
+	if err != nil {
+		return &kvrpcpb.RawScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawScanResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.acquireReaderSlot(); regErr != nil {
+		return &kvrpcpb.RawScanResponse{RegionError: regErr}, nil
+	}
+	pairs, err := svr.mvccStore.RawScan(reqCtx, req.StartKey, req.EndKey, int(req.Limit), req.KeyOnly, req.Reverse)
+	if regErr := extractRegionError(err); regErr != nil {
+		return &kvrpcpb.RawScanResponse{RegionError: regErr}, nil
+	} else if err != nil {
+		return &kvrpcpb.RawScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	return &kvrpcpb.RawScanResponse{Kvs: pairs}, nil
+}
+
+// RawBatchDelete deletes the keys atomically, all the keys are latched and deleted in one write batch, so it
+// behaves like the atomic mode of TiKV and can be mixed with RawCompareAndSwap.
+func (svr *Server) RawBatchDelete(ctx context.Context, req *kvrpcpb.RawBatchDeleteRequest) (*kvrpcpb.RawBatchDeleteResponse, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "RawBatchDelete")
+	if err != nil {
+		return &kvrpcpb.RawBatchDeleteResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchDeleteResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := svr.checkRequestSize(req.Size()); regErr != nil {
+		return &kvrpcpb.RawBatchDeleteResponse{RegionError: regErr}, nil
+	}
+	if regErr := reqCtx.checkFlowControl(); regErr != nil {
+		return &kvrpcpb.RawBatchDeleteResponse{RegionError: regErr}, nil
+	}
+	if err = reqCtx.checkWritable(); err == nil {
+		err = svr.mvccStore.RawDelete(reqCtx, req.Keys)
+	}
+	resp := &kvrpcpb.RawBatchDeleteResponse{}
+	resp.RegionError, resp.Error = convertToRawErrors(err)
+	return resp, nil
+}
+
+func (svr *Server) RawBatchGet(ctx context.Context, req *kvrpcpb.RawBatchGetRequest) (*kvrpcpb.RawBatchGetResponse, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "RawBatchGet")
+	if err != nil {
+		return &kvrpcpb.RawBatchGetResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchGetResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.acquireReaderSlot(); regErr != nil {
+		return &kvrpcpb.RawBatchGetResponse{RegionError: regErr}, nil
+	}
+	pairs, err := svr.mvccStore.RawBatchGet(reqCtx, req.Keys)
+	if err != nil {
+		return &kvrpcpb.RawBatchGetResponse{Pairs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	return &kvrpcpb.RawBatchGetResponse{Pairs: pairs}, nil
+}
+
+// RawBatchPut puts the pairs atomically, all the keys are latched and written in one write batch, so it
+// behaves like the atomic mode of TiKV and can be mixed with RawCompareAndSwap. The last pair wins if a key
+// is put more than once.
+func (svr *Server) RawBatchPut(ctx context.Context, req *kvrpcpb.RawBatchPutRequest) (*kvrpcpb.RawBatchPutResponse, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "RawBatchPut")
+	if err != nil {
+		return &kvrpcpb.RawBatchPutResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchPutResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := svr.checkRequestSize(req.Size()); regErr != nil {
+		return &kvrpcpb.RawBatchPutResponse{RegionError: regErr}, nil
+	}
+	if regErr := reqCtx.checkFlowControl(); regErr != nil {
+		return &kvrpcpb.RawBatchPutResponse{RegionError: regErr}, nil
+	}
+	keys := make([][]byte, 0, len(req.Pairs))
+	values := make([][]byte, 0, len(req.Pairs))
+	for _, pair := range req.Pairs {
+		keys = append(keys, pair.Key)
+		values = append(values, pair.Value)
+	}
+	if err = reqCtx.checkWritable(); err == nil {
+		err = svr.mvccStore.RawPut(reqCtx, keys, values, 0)
+	}
+	resp := &kvrpcpb.RawBatchPutResponse{}
+	resp.RegionError, resp.Error = convertToRawErrors(err)
+	return resp, nil
+}
+
+// RawBatchScan scans every range with the limit of EachLimit, the pairs of the ranges are returned in the
+// order of the ranges.
+func (svr *Server) RawBatchScan(ctx context.Context, req *kvrpcpb.RawBatchScanRequest) (*kvrpcpb.RawBatchScanResponse, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "RawBatchScan")
+	if err != nil {
+		return &kvrpcpb.RawBatchScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.RawBatchScanResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.acquireReaderSlot(); regErr != nil {
+		return &kvrpcpb.RawBatchScanResponse{RegionError: regErr}, nil
+	}
+	var kvs []*kvrpcpb.KvPair
+	for _, r := range req.Ranges {
+		pairs, err := svr.mvccStore.RawScan(reqCtx, r.StartKey, r.EndKey, int(req.EachLimit), req.KeyOnly, req.Reverse)
+		if regErr := extractRegionError(err); regErr != nil {
+			return &kvrpcpb.RawBatchScanResponse{RegionError: regErr}, nil
+		} else if err != nil {
+			return &kvrpcpb.RawBatchScanResponse{Kvs: []*kvrpcpb.KvPair{{Error: convertToKeyError(err)}}}, nil
+		}
+		kvs = append(kvs, pairs...)
+	}
+	return &kvrpcpb.RawBatchScanResponse{Kvs: kvs}, nil
+}
+
+// RawIncrement atomically adds delta to the integer value of the key and returns the new value.
+// There is no RawIncrement RPC in kvproto yet, so it's called directly by the embedding programs.
+func (svr *Server) RawIncrement(ctx context.Context, rpcCtx *kvrpcpb.Context, key []byte, delta int64) (int64, *errorpb.Error, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, rpcCtx, "RawIncrement")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return 0, reqCtx.regErr, nil
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return 0, nil, err
+	}
+	val, err := svr.mvccStore.RawIncrement(reqCtx, key, delta)
+	if regErr := extractRegionError(err); regErr != nil {
+		return 0, regErr, nil
+	}
+	return val, nil, err
 }
 
-func (svr *Server) RawPut(context.Context, *kvrpcpb.RawPutRequest) (*kvrpcpb.RawPutResponse, error) {
-	return &kvrpcpb.RawPutResponse{}, nil
+// RawPutWithTTL puts the key with a value which expires after ttl seconds, 0 means the value never expires.
+// The raw ttl must be enabled by the raw-enable-ttl config, there is no ttl in RawPutRequest of kvproto yet,
+// so it's called directly by the embedding programs.
+func (svr *Server) RawPutWithTTL(ctx context.Context, rpcCtx *kvrpcpb.Context, key, value []byte, ttl uint64) (*errorpb.Error, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, rpcCtx, "RawPutWithTTL")
+	if err != nil {
+		return nil, err
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return reqCtx.regErr, nil
+	}
+	if err = reqCtx.checkWritable(); err == nil {
+		err = svr.mvccStore.RawPut(reqCtx, [][]byte{key}, [][]byte{value}, ttl)
+	}
+	if regErr := extractRegionError(err); regErr != nil {
+		return regErr, nil
+	}
+	return nil, err
+}
+
+// RawGetKeyTTL returns the remaining ttl in seconds of the key, 0 if the key never expires. notFound is true
+// if the key doesn't exist or is expired. There is no RawGetKeyTTL RPC in kvproto yet, so it's called
+// directly by the embedding programs.
+func (svr *Server) RawGetKeyTTL(ctx context.Context, rpcCtx *kvrpcpb.Context, key []byte) (ttl uint64, notFound bool, regErr *errorpb.Error, err error) {
+	reqCtx, err := newRequestCtx(ctx, svr, rpcCtx, "RawGetKeyTTL")
+	if err != nil {
+		return 0, false, nil, err
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return 0, false, reqCtx.regErr, nil
+	}
+	if regErr = reqCtx.acquireReaderSlot(); regErr != nil {
+		return 0, false, regErr, nil
+	}
+	ttl, notFound, err = svr.mvccStore.RawGetKeyTTL(reqCtx, key)
+	if regErr = extractRegionError(err); regErr != nil {
+		return 0, false, regErr, nil
+	}
+	return ttl, notFound, nil, err
+}
+
+// RawCASRequest is the request of RawCompareAndSwap, the value is put if the current value of the key is
+// PreviousValue, or if the key doesn't exist when PreviousNotExist is set.
+type RawCASRequest struct {
+	Context          *kvrpcpb.Context
+	Key              []byte
+	Value            []byte
+	PreviousNotExist bool
+	PreviousValue    []byte
+	// Ttl is the ttl in seconds of the value, it requires the raw ttl to be enabled.
+	Ttl uint64
+}
+
+// RawCASResponse is the response of RawCompareAndSwap, the previous value is the value before the swap, or
+// the current value if the swap fails.
+type RawCASResponse struct {
+	RegionError      *errorpb.Error
+	Error            string
+	Succeed          bool
+	PreviousNotExist bool
+	PreviousValue    []byte
+}
+
+// RawCompareAndSwap atomically compares and swaps the value of a raw key. There is no RawCAS RPC in kvproto
+// yet, so the request and response mirror the ones of TiKV and it's called directly by the embedding programs.
+func (svr *Server) RawCompareAndSwap(ctx context.Context, req *RawCASRequest) (*RawCASResponse, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "RawCompareAndSwap")
+	if err != nil {
+		return &RawCASResponse{Error: err.Error()}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &RawCASResponse{RegionError: reqCtx.regErr}, nil
+	}
+	resp := &RawCASResponse{}
+	if err = reqCtx.checkWritable(); err == nil {
+		var previous []byte
+		previous, resp.Succeed, err = svr.mvccStore.RawCompareAndSwap(reqCtx, req.Key, req.Value, req.PreviousValue,
+			req.PreviousNotExist, req.Ttl)
+		resp.PreviousValue, resp.PreviousNotExist = previous, previous == nil
+	}
+	if err != nil {
+		resp = &RawCASResponse{}
+		resp.RegionError, resp.Error = convertToRawErrors(err)
+	}
+	return resp, nil
 }
 
-func (svr *Server) RawDelete(context.Context, *kvrpcpb.RawDeleteRequest) (*kvrpcpb.RawDeleteResponse, error) {
-	return &kvrpcpb.RawDeleteResponse{}, nil
+// metricsUpdateInterval is the interval to update the gauges that are not maintained by the requests.
+const metricsUpdateInterval = 15 * time.Second
+
+func (svr *Server) runMetricsUpdater() {
+	defer svr.wg.Done()
+	ticker := time.NewTicker(metricsUpdateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-svr.closeCh:
+			return
+		case <-ticker.C:
+			svr.updateMetrics()
+		}
+	}
 }
 
-func (svr *Server) RawScan(context.Context, *kvrpcpb.RawScanRequest) (*kvrpcpb.RawScanResponse, error) {
-	return &kvrpcpb.RawScanResponse{}, nil
+// engineFileTypes are the file types of the kv engine reported by the metrics, the LSM tables, the blobs of the
+// large values and the value log.
+var engineFileTypes = []string{"sst", "blob", "vlog"}
+
+func (svr *Server) updateMetrics() {
+	var regions int
+	svr.regionManager.forEachRegion(func(*regionCtx) {
+		regions++
+	})
+	metrics.RegionCount.Set(float64(regions))
+
+	// The kv engine is in the kv sub directory of the data directory.
+	files, err := ioutil.ReadDir(filepath.Join(svr.mvccStore.dir, "kv"))
+	if err != nil {
+		log.Warn("read engine dir failed", zap.Error(err))
+		return
+	}
+	sizes := make(map[string]int64, len(engineFileTypes))
+	counts := make(map[string]int, len(engineFileTypes))
+	for _, f := range files {
+		tp := strings.TrimPrefix(filepath.Ext(f.Name()), ".")
+		sizes[tp] += f.Size()
+		counts[tp]++
+	}
+	for _, tp := range engineFileTypes {
+		metrics.EngineSize.WithLabelValues(tp).Set(float64(sizes[tp]))
+		metrics.EngineFiles.WithLabelValues(tp).Set(float64(counts[tp]))
+	}
 }
 
-func (svr *Server) RawBatchDelete(context.Context, *kvrpcpb.RawBatchDeleteRequest) (*kvrpcpb.RawBatchDeleteResponse, error) {
-	return &kvrpcpb.RawBatchDeleteResponse{}, nil
+// runRawTTLChecker purges the expired raw keys periodically until the server is stopped.
+func (svr *Server) runRawTTLChecker(interval time.Duration) {
+	defer svr.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-svr.closeCh:
+			return
+		case <-ticker.C:
+			svr.purgeExpiredRawKeys()
+		}
+	}
 }
 
-func (svr *Server) RawBatchGet(context.Context, *kvrpcpb.RawBatchGetRequest) (*kvrpcpb.RawBatchGetResponse, error) {
-	return &kvrpcpb.RawBatchGetResponse{}, nil
+// purgeExpiredRawKeys deletes the expired raw keys of all the regions and returns the number of keys deleted.
+func (svr *Server) purgeExpiredRawKeys() int {
+	var regions []*regionCtx
+	svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+		regions = append(regions, regCtx)
+	})
+	var purged int
+	for _, regCtx := range regions {
+		n, err := svr.purgeRegionExpiredRawKeys(regCtx)
+		if err != nil {
+			log.Warn("purge expired raw keys failed", zap.Uint64("region", regCtx.meta.Id), zap.Error(err))
+		}
+		purged += n
+	}
+	if purged > 0 {
+		log.Info("purged expired raw keys", zap.Int("keys", purged))
+	}
+	return purged
 }
 
-func (svr *Server) RawBatchPut(context.Context, *kvrpcpb.RawBatchPutRequest) (*kvrpcpb.RawBatchPutResponse, error) {
-	return &kvrpcpb.RawBatchPutResponse{}, nil
+// localRPCContext builds the rpc context of the region's peer on this store, for the requests that are not
+// sent with a region context.
+func (svr *Server) localRPCContext(regCtx *regionCtx) *kvrpcpb.Context {
+	rpcCtx := &kvrpcpb.Context{RegionId: regCtx.meta.Id, RegionEpoch: regCtx.getRegionEpoch()}
+	_, storeID, _ := svr.regionManager.GetStoreInfoFromCtx(rpcCtx)
+	for _, peer := range regCtx.meta.Peers {
+		if peer.StoreId == storeID {
+			rpcCtx.Peer = peer
+		}
+	}
+	return rpcCtx
 }
 
-func (svr *Server) RawBatchScan(context.Context, *kvrpcpb.RawBatchScanRequest) (*kvrpcpb.RawBatchScanResponse, error) {
-	return &kvrpcpb.RawBatchScanResponse{}, nil
+func (svr *Server) purgeRegionExpiredRawKeys(regCtx *regionCtx) (int, error) {
+	reqCtx, err := newRequestCtx(context.Background(), svr, svr.localRPCContext(regCtx), "PurgeExpiredRawKeys")
+	if err != nil {
+		return 0, err
+	}
+	defer reqCtx.finish()
+	// The region may be split, merged or read only, it's purged in the next round.
+	if reqCtx.regErr != nil || reqCtx.checkWritable() != nil {
+		return 0, nil
+	}
+	n, err := svr.mvccStore.PurgeExpiredRawKeys(reqCtx)
+	if extractRegionError(err) != nil {
+		return n, nil
+	}
+	return n, err
 }
 
 func (svr *Server) RawDeleteRange(context.Context, *kvrpcpb.RawDeleteRangeRequest) (*kvrpcpb.RawDeleteRangeResponse, error) {
@@ -525,15 +1751,68 @@ func (svr *Server) RawDeleteRange(context.Context, *kvrpcpb.RawDeleteRangeReques
 }
 
 // SQL push down commands.
-func (svr *Server) Coprocessor(_ context.Context, req *coprocessor.Request) (*coprocessor.Response, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "Coprocessor")
+func (svr *Server) Coprocessor(ctx context.Context, req *coprocessor.Request) (*coprocessor.Response, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "Coprocessor")
 	if err != nil {
 		return &coprocessor.Response{OtherError: convertToKeyError(err).String()}, nil
 	}
 	defer reqCtx.finish()
+	var rangeStart []byte
+	if len(req.Ranges) > 0 {
+		rangeStart = req.Ranges[0].Start
+	}
+	reqCtx.setTxnInfo(req.StartTs, rangeStart)
 	if reqCtx.regErr != nil {
 		return &coprocessor.Response{RegionError: reqCtx.regErr}, nil
 	}
+	if regErr := reqCtx.checkReadTS(req.StartTs); regErr != nil {
+		return &coprocessor.Response{RegionError: regErr}, nil
+	}
+	// The version is loaded before reading, so the data committed during the request bumps it.
+	dataVersion := reqCtx.regCtx.getDataVersion()
+	if req.IsCacheEnabled && req.CacheIfMatchVersion == dataVersion && svr.copCacheValid(req) {
+		return &coprocessor.Response{IsCacheHit: true, CacheLastVersion: dataVersion, CanBeCached: true}, nil
+	}
+	var resp *coprocessor.Response
+	err = reqCtx.runInReadPool(svr.copReadPool, func() { resp = svr.handleCopRequest(reqCtx, req) })
+	// The scans of the executors stop early if the request is cancelled or timed out, the partial result is
+	// replaced by the error.
+	if err == nil {
+		err = reqCtx.checkContext()
+	}
+	if err != nil {
+		if regErr := extractRegionError(err); regErr != nil {
+			return &coprocessor.Response{RegionError: regErr}, nil
+		}
+		return &coprocessor.Response{OtherError: err.Error()}, nil
+	}
+	if req.IsCacheEnabled {
+		resp.CacheLastVersion = dataVersion
+		resp.CanBeCached = resp.RegionError == nil && resp.Locked == nil && resp.OtherError == ""
+	}
+	if resp.ExecDetailsV2 == nil {
+		resp.ExecDetailsV2 = reqCtx.execDetailsV2()
+	}
+	return resp, nil
+}
+
+// copCacheValid checks if the result cached by the client at the current data version is still valid for the
+// request. The version isn't bumped by prewrite, so the locks in the ranges are checked like the reads do, the
+// request is executed to report the lock if there is one.
+func (svr *Server) copCacheValid(req *coprocessor.Request) bool {
+	if req.CacheIfMatchVersion == 0 {
+		return false
+	}
+	for _, r := range req.Ranges {
+		if svr.mvccStore.CheckRangeLock(req.StartTs, r.Start, r.End, req.Context.ResolvedLocks) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// handleCopRequest executes the coprocessor request with the MPP task of the request if there is one.
+func (svr *Server) handleCopRequest(reqCtx *requestCtx, req *coprocessor.Request) *coprocessor.Response {
 	var mppTaskHandler *cophandler.MPPTaskHandler
 	if mockRegionRM, ok := svr.regionManager.(*MockRegionManager); ok {
 		mppTaskHandlerMap := mockRegionRM.getMPPTaskSet(reqCtx.storeId)
@@ -545,14 +1824,74 @@ func (svr *Server) Coprocessor(_ context.Context, req *coprocessor.Request) (*co
 	}
 	return cophandler.HandleCopRequestWithMPPCtx(reqCtx.getDBReader(), svr.mvccStore.lockStore, req, &cophandler.MPPCtx{
 		RPCClient: svr.RPCClient, StoreAddr: reqCtx.storeAddr, TaskHandler: mppTaskHandler,
-	}), nil
+	})
 }
 
-func (svr *Server) CoprocessorStream(*coprocessor.Request, tikvpb.Tikv_CoprocessorStreamServer) error {
-	// TODO
+// CoprocessorStream handles the request like Coprocessor and streams the result, every chunk of a DAG result
+// is sent in a response of its own. The request is executed as a whole, so the stream only splits the result.
+func (svr *Server) CoprocessorStream(req *coprocessor.Request, streamServer tikvpb.Tikv_CoprocessorStreamServer) error {
+	resp, err := svr.Coprocessor(streamServer.Context(), req)
+	if err != nil {
+		return err
+	}
+	if req.Tp != kv.ReqTypeDAG {
+		return streamServer.Send(resp)
+	}
+	for _, streamResp := range splitCopStreamResponse(resp) {
+		if err = streamServer.Send(streamResp); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// splitCopStreamResponse splits the DAG response into the stream responses, the data of a stream response is
+// a tipb.StreamResponse that holds a chunk of the rows. The warnings are sent with the first chunk and the
+// output counts, execution summaries and exec details are sent with the last chunk.
+func splitCopStreamResponse(resp *coprocessor.Response) []*coprocessor.Response {
+	if resp.RegionError != nil || resp.Locked != nil || resp.OtherError != "" {
+		return []*coprocessor.Response{resp}
+	}
+	var selResp tipb.SelectResponse
+	if err := selResp.Unmarshal(resp.Data); err != nil {
+		return []*coprocessor.Response{{OtherError: err.Error()}}
+	}
+	if selResp.Error != nil {
+		return []*coprocessor.Response{encodeCopStreamResponse(&tipb.StreamResponse{Error: selResp.Error})}
+	}
+	chunks := selResp.Chunks
+	if len(chunks) == 0 {
+		// Send an empty chunk so the client gets the output counts.
+		chunks = []tipb.Chunk{{}}
+	}
+	streamResps := make([]*coprocessor.Response, 0, len(chunks))
+	for i := range chunks {
+		data, err := chunks[i].Marshal()
+		if err != nil {
+			return []*coprocessor.Response{{OtherError: err.Error()}}
+		}
+		streamResp := &tipb.StreamResponse{Data: data}
+		if i == 0 {
+			streamResp.Warnings = selResp.Warnings
+		}
+		if i == len(chunks)-1 {
+			streamResp.OutputCounts = selResp.OutputCounts
+			streamResp.ExecutionSummaries = selResp.ExecutionSummaries
+		}
+		streamResps = append(streamResps, encodeCopStreamResponse(streamResp))
+	}
+	streamResps[len(streamResps)-1].ExecDetails = resp.ExecDetails
+	return streamResps
+}
+
+func encodeCopStreamResponse(streamResp *tipb.StreamResponse) *coprocessor.Response {
+	data, err := streamResp.Marshal()
+	if err != nil {
+		return &coprocessor.Response{OtherError: err.Error()}
+	}
+	return &coprocessor.Response{Data: data}
+}
+
 type RegionError struct {
 	err *errorpb.Error
 }
@@ -561,53 +1900,62 @@ func (regionError *RegionError) Error() string {
 	return regionError.err.Message
 }
 
+// BatchCoprocessor executes the DAG request on every region of the request and sends a batch response for
+// every region. It stops at the first region that fails, a region error is returned as the error of the
+// stream, and the other errors are sent in the OtherError of the batch response.
 func (svr *Server) BatchCoprocessor(req *coprocessor.BatchRequest, batchCopServer tikvpb.Tikv_BatchCoprocessorServer) error {
-	reqCtxs := make([]*requestCtx, 0, len(req.Regions))
-	defer func() {
-		for _, ctx := range reqCtxs {
-			ctx.finish()
-		}
-	}()
 	for _, ri := range req.Regions {
-		cop := coprocessor.Request{
+		regionCtx := *req.Context
+		regionCtx.RegionEpoch = ri.RegionEpoch
+		regionCtx.RegionId = ri.RegionId
+		cop := &coprocessor.Request{
+			Context: &regionCtx,
 			Tp:      kv.ReqTypeDAG,
 			Data:    req.Data,
 			StartTs: req.StartTs,
 			Ranges:  ri.Ranges,
 		}
-		regionCtx := *req.Context
-		regionCtx.RegionEpoch = ri.RegionEpoch
-		regionCtx.RegionId = ri.RegionId
-		cop.Context = &regionCtx
-
-		reqCtx, err := newRequestCtx(svr, &regionCtx, "Coprocessor")
+		batchResp, err := svr.handleBatchCopRegion(batchCopServer.Context(), cop)
 		if err != nil {
 			return err
 		}
-		reqCtxs = append(reqCtxs, reqCtx)
-		if reqCtx.regErr != nil {
-			return &RegionError{err: reqCtx.regErr}
-		}
-		var mppTaskHandler *cophandler.MPPTaskHandler
-		if mockRegionRM, ok := svr.regionManager.(*MockRegionManager); ok {
-			mppTaskHandlerMap := mockRegionRM.getMPPTaskSet(reqCtx.storeId)
-			if mppTaskHandlerMap != nil {
-				if th, ok := mppTaskHandlerMap[int64(req.Context.TaskId)]; ok {
-					mppTaskHandler = th
-				}
-			}
-		}
-		copResponse := cophandler.HandleCopRequestWithMPPCtx(reqCtx.getDBReader(), svr.mvccStore.lockStore, &cop, &cophandler.MPPCtx{
-			RPCClient: svr.RPCClient, StoreAddr: reqCtx.storeAddr, TaskHandler: mppTaskHandler,
-		})
-		err = batchCopServer.Send(&coprocessor.BatchResponse{Data: copResponse.Data})
-		if err != nil {
+		if err = batchCopServer.Send(batchResp); err != nil {
 			return err
 		}
+		if batchResp.OtherError != "" {
+			return nil
+		}
 	}
 	return nil
 }
 
+// handleBatchCopRegion executes the request of a region of a batch coprocessor request, the request context
+// is finished when the region is done, so the DB reader isn't held until the whole batch is done.
+func (svr *Server) handleBatchCopRegion(ctx context.Context, cop *coprocessor.Request) (*coprocessor.BatchResponse, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, cop.Context, "BatchCoprocessor")
+	if err != nil {
+		return nil, err
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return nil, &RegionError{err: reqCtx.regErr}
+	}
+	if regErr := reqCtx.acquireReaderSlot(); regErr != nil {
+		return nil, &RegionError{err: regErr}
+	}
+	copResp := svr.handleCopRequest(reqCtx, cop)
+	batchResp := &coprocessor.BatchResponse{Data: copResp.Data, ExecDetails: copResp.ExecDetails}
+	switch {
+	case copResp.RegionError != nil:
+		return nil, &RegionError{err: copResp.RegionError}
+	case copResp.Locked != nil:
+		batchResp.OtherError = fmt.Sprintf("key %q is locked by %d", copResp.Locked.Key, copResp.Locked.LockVersion)
+	case copResp.OtherError != "":
+		batchResp.OtherError = copResp.OtherError
+	}
+	return batchResp, nil
+}
+
 func (mrm *MockRegionManager) getMPPTaskHandle(rpcClient client.Client, meta *mpp.TaskMeta, createdIfNotExist bool, storeId uint64) (*cophandler.MPPTaskHandler, bool, error) {
 	set := mrm.getMPPTaskSet(storeId)
 	if set == nil {
@@ -733,7 +2081,7 @@ func (svr *Server) BatchRaft(stream tikvpb.Tikv_BatchRaftServer) error {
 
 // Region commands.
 func (svr *Server) SplitRegion(ctx context.Context, req *kvrpcpb.SplitRegionRequest) (*kvrpcpb.SplitRegionResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "SplitRegion")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "SplitRegion")
 	if err != nil {
 		return &kvrpcpb.SplitRegionResponse{RegionError: &errorpb.Error{Message: err.Error()}}, nil
 	}
@@ -741,14 +2089,36 @@ func (svr *Server) SplitRegion(ctx context.Context, req *kvrpcpb.SplitRegionRequ
 	return svr.regionManager.SplitRegion(req), nil
 }
 
-func (svr *Server) ReadIndex(context.Context, *kvrpcpb.ReadIndexRequest) (*kvrpcpb.ReadIndexResponse, error) {
-	// TODO:
-	return &kvrpcpb.ReadIndexResponse{}, nil
+// ReadIndex returns the index the region has applied after the leader is confirmed, the reads served at the index
+// are linearizable. If the start ts is set, it's also used to update the max read ts and the locks in the ranges
+// visible to it are returned, like the reads at the start ts.
+func (svr *Server) ReadIndex(ctx context.Context, req *kvrpcpb.ReadIndexRequest) (*kvrpcpb.ReadIndexResponse, error) {
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "ReadIndex")
+	if err != nil {
+		return &kvrpcpb.ReadIndexResponse{RegionError: &errorpb.Error{Message: err.Error()}}, nil
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &kvrpcpb.ReadIndexResponse{RegionError: reqCtx.regErr}, nil
+	}
+	if regErr := reqCtx.acquireReaderSlot(); regErr != nil {
+		return &kvrpcpb.ReadIndexResponse{RegionError: regErr}, nil
+	}
+	if req.StartTs > 0 {
+		for _, r := range req.Ranges {
+			err = svr.mvccStore.CheckRangeLock(req.StartTs, r.StartKey, r.EndKey, req.Context.ResolvedLocks)
+			if err != nil {
+				keyErr, regErr := convertToPBError(err)
+				return &kvrpcpb.ReadIndexResponse{RegionError: regErr, Locked: keyErr.GetLocked()}, nil
+			}
+		}
+	}
+	return &kvrpcpb.ReadIndexResponse{ReadIndex: reqCtx.regCtx.readIndex()}, nil
 }
 
 // transaction debugger commands.
 func (svr *Server) MvccGetByKey(ctx context.Context, req *kvrpcpb.MvccGetByKeyRequest) (*kvrpcpb.MvccGetByKeyResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "MvccGetByKey")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "MvccGetByKey")
 	if err != nil {
 		return &kvrpcpb.MvccGetByKeyResponse{Error: err.Error()}, nil
 	}
@@ -766,7 +2136,7 @@ func (svr *Server) MvccGetByKey(ctx context.Context, req *kvrpcpb.MvccGetByKeyRe
 }
 
 func (svr *Server) MvccGetByStartTs(ctx context.Context, req *kvrpcpb.MvccGetByStartTsRequest) (*kvrpcpb.MvccGetByStartTsResponse, error) {
-	reqCtx, err := newRequestCtx(svr, req.Context, "MvccGetByStartTs")
+	reqCtx, err := newRequestCtx(ctx, svr, req.Context, "MvccGetByStartTs")
 	if err != nil {
 		return &kvrpcpb.MvccGetByStartTsResponse{Error: err.Error()}, nil
 	}
@@ -784,12 +2154,61 @@ func (svr *Server) MvccGetByStartTs(ctx context.Context, req *kvrpcpb.MvccGetByS
 	return resp, nil
 }
 
+// UnsafeDestroyRange deletes all the data and locks in the range of all the regions on this store, TiDB calls it
+// after the GC safe point passes the drop of a table or an index, so the data is never read again.
 func (svr *Server) UnsafeDestroyRange(ctx context.Context, req *kvrpcpb.UnsafeDestroyRangeRequest) (*kvrpcpb.UnsafeDestroyRangeResponse, error) {
 	start, end := req.GetStartKey(), req.GetEndKey()
-	svr.mvccStore.DeleteFileInRange(start, end)
+	// The internal keys are never destroyed, the raw keys are destroyed to the end if the end is InternalKeyPrefix.
+	if len(end) == 0 || bytes.Compare(end, InternalKeyPrefix) > 0 {
+		end = InternalKeyPrefix
+	}
+	if bytes.Compare(start, end) >= 0 {
+		return &kvrpcpb.UnsafeDestroyRangeResponse{}, nil
+	}
+	var regions []*regionCtx
+	svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+		// The end key of the last region is empty if it's loaded from the local storage.
+		if bytes.Compare(regCtx.startKey, end) < 0 && !regCtx.greaterEqualEndKey(start) {
+			regions = append(regions, regCtx)
+		}
+	})
+	// The locks are deleted by the write batches of the regions, so the lock store is written by the writer only.
+	for _, regCtx := range regions {
+		if err := svr.destroyRegionLocks(ctx, regCtx, start, end); err != nil {
+			log.Warn("destroy locks failed", zap.Uint64("region", regCtx.meta.Id), zap.Error(err))
+			return &kvrpcpb.UnsafeDestroyRangeResponse{Error: err.Error()}, nil
+		}
+	}
+	if err := svr.mvccStore.UnsafeDestroyRange(start, end); err != nil {
+		log.Warn("destroy range failed", zap.Error(err))
+		return &kvrpcpb.UnsafeDestroyRangeResponse{Error: err.Error()}, nil
+	}
+	// The results cached by the coprocessor are invalidated.
+	for _, regCtx := range regions {
+		regCtx.bumpDataVersion()
+	}
 	return &kvrpcpb.UnsafeDestroyRangeResponse{}, nil
 }
 
+func (svr *Server) destroyRegionLocks(ctx context.Context, regCtx *regionCtx, start, end []byte) error {
+	if bytes.Compare(start, regCtx.startKey) < 0 {
+		start = regCtx.startKey
+	}
+	if regCtx.greaterThanEndKey(end) {
+		end = regCtx.endKey
+	}
+	reqCtx, err := newRequestCtx(ctx, svr, svr.localRPCContext(regCtx), "UnsafeDestroyRange")
+	if err != nil {
+		return err
+	}
+	defer reqCtx.finish()
+	// The range is destroyed again by the next GC round of TiDB if the region is changed.
+	if reqCtx.regErr != nil {
+		return errors.New(reqCtx.regErr.String())
+	}
+	return svr.mvccStore.DestroyLocks(reqCtx, start, end)
+}
+
 // deadlock detection related services
 // GetWaitForEntries tries to get the waitFor entries
 func (svr *Server) GetWaitForEntries(ctx context.Context,
@@ -823,9 +2242,13 @@ func (svr *Server) Detect(stream deadlockPb.Deadlock_DetectServer) error {
 	return nil
 }
 
-func (svr *Server) CheckLockObserver(context.Context, *kvrpcpb.CheckLockObserverRequest) (*kvrpcpb.CheckLockObserverResponse, error) {
-	// TODO: implement Observer
-	return &kvrpcpb.CheckLockObserverResponse{IsClean: true}, nil
+// CheckLockObserver returns the locks collected by the lock observer registered with the max ts.
+func (svr *Server) CheckLockObserver(ctx context.Context, req *kvrpcpb.CheckLockObserverRequest) (*kvrpcpb.CheckLockObserverResponse, error) {
+	locks, isClean, err := svr.mvccStore.lockObserver.check(req.MaxTs)
+	if err != nil {
+		return &kvrpcpb.CheckLockObserverResponse{Error: err.Error()}, nil
+	}
+	return &kvrpcpb.CheckLockObserverResponse{IsClean: isClean, Locks: locks}, nil
 }
 
 func (svr *Server) PhysicalScanLock(ctx context.Context, req *kvrpcpb.PhysicalScanLockRequest) (*kvrpcpb.PhysicalScanLockResponse, error) {
@@ -834,13 +2257,20 @@ func (svr *Server) PhysicalScanLock(ctx context.Context, req *kvrpcpb.PhysicalSc
 	return resp, nil
 }
 
-func (svr *Server) RegisterLockObserver(context.Context, *kvrpcpb.RegisterLockObserverRequest) (*kvrpcpb.RegisterLockObserverResponse, error) {
-	// TODO: implement Observer
+// RegisterLockObserver starts collecting the locks written with start ts not greater than the max ts.
+func (svr *Server) RegisterLockObserver(ctx context.Context, req *kvrpcpb.RegisterLockObserverRequest) (*kvrpcpb.RegisterLockObserverResponse, error) {
+	if req.MaxTs == 0 {
+		return &kvrpcpb.RegisterLockObserverResponse{Error: "max ts of lock observer must be greater than 0"}, nil
+	}
+	svr.mvccStore.lockObserver.register(req.MaxTs)
 	return &kvrpcpb.RegisterLockObserverResponse{}, nil
 }
 
-func (svr *Server) RemoveLockObserver(context.Context, *kvrpcpb.RemoveLockObserverRequest) (*kvrpcpb.RemoveLockObserverResponse, error) {
-	// TODO: implement Observer
+// RemoveLockObserver stops the lock observer registered with the max ts.
+func (svr *Server) RemoveLockObserver(ctx context.Context, req *kvrpcpb.RemoveLockObserverRequest) (*kvrpcpb.RemoveLockObserverResponse, error) {
+	if err := svr.mvccStore.lockObserver.remove(req.MaxTs); err != nil {
+		return &kvrpcpb.RemoveLockObserverResponse{Error: err.Error()}, nil
+	}
 	return &kvrpcpb.RemoveLockObserverResponse{}, nil
 }
 
@@ -868,8 +2298,15 @@ func (svr *Server) VerDeleteRange(context.Context, *kvrpcpb.VerDeleteRangeReques
 	panic("unimplemented")
 }
 
-func (svr *Server) CheckLeader(context.Context, *kvrpcpb.CheckLeaderRequest) (*kvrpcpb.CheckLeaderResponse, error) {
-	panic("unimplemented")
+// convertToRawErrors converts the error of a raw write to the region error or the error message of the response.
+func convertToRawErrors(err error) (*errorpb.Error, string) {
+	if err == nil {
+		return nil, ""
+	}
+	if regErr := extractRegionError(err); regErr != nil {
+		return regErr, ""
+	}
+	return nil, err.Error()
 }
 
 func convertToKeyError(err error) *kvrpcpb.KeyError {
@@ -879,20 +2316,24 @@ func convertToKeyError(err error) *kvrpcpb.KeyError {
 	causeErr := errors.Cause(err)
 	switch x := causeErr.(type) {
 	case *ErrLocked:
+		metrics.KeyErrors.WithLabelValues("locked").Inc()
 		return &kvrpcpb.KeyError{
 			Locked: x.Lock.ToLockInfo(x.Key),
 		}
 	case ErrRetryable:
+		metrics.KeyErrors.WithLabelValues("retryable").Inc()
 		return &kvrpcpb.KeyError{
 			Retryable: x.Error(),
 		}
 	case *ErrKeyAlreadyExists:
+		metrics.KeyErrors.WithLabelValues("already_exist").Inc()
 		return &kvrpcpb.KeyError{
 			AlreadyExist: &kvrpcpb.AlreadyExist{
 				Key: x.Key,
 			},
 		}
 	case *ErrConflict:
+		metrics.KeyErrors.WithLabelValues("conflict").Inc()
 		return &kvrpcpb.KeyError{
 			Conflict: &kvrpcpb.WriteConflict{
 				StartTs:          x.StartTS,
@@ -902,6 +2343,7 @@ func convertToKeyError(err error) *kvrpcpb.KeyError {
 			},
 		}
 	case *ErrDeadlock:
+		metrics.KeyErrors.WithLabelValues("deadlock").Inc()
 		return &kvrpcpb.KeyError{
 			Deadlock: &kvrpcpb.Deadlock{
 				LockKey:         x.LockKey,
@@ -910,6 +2352,7 @@ func convertToKeyError(err error) *kvrpcpb.KeyError {
 			},
 		}
 	case *ErrCommitExpire:
+		metrics.KeyErrors.WithLabelValues("commit_ts_expired").Inc()
 		return &kvrpcpb.KeyError{
 			CommitTsExpired: &kvrpcpb.CommitTsExpired{
 				StartTs:           x.StartTs,
@@ -919,6 +2362,7 @@ func convertToKeyError(err error) *kvrpcpb.KeyError {
 			},
 		}
 	case *ErrTxnNotFound:
+		metrics.KeyErrors.WithLabelValues("txn_not_found").Inc()
 		return &kvrpcpb.KeyError{
 			TxnNotFound: &kvrpcpb.TxnNotFound{
 				StartTs:    x.StartTS,
@@ -926,6 +2370,7 @@ func convertToKeyError(err error) *kvrpcpb.KeyError {
 			},
 		}
 	default:
+		metrics.KeyErrors.WithLabelValues("abort").Inc()
 		return &kvrpcpb.KeyError{
 			Abort: err.Error(),
 		}
@@ -16,7 +16,9 @@ package tikv
 import (
 	"context"
 	"io"
+	"sync"
 
+	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
@@ -35,6 +37,8 @@ func (p respIDPair) appendTo(batchResp *tikvpb.BatchCommandsResponse) {
 type batchRequestHandler struct {
 	respCh  chan respIDPair
 	closeCh chan struct{}
+	// wg tracks the requests being handled, closeCh is closed after all of them are done.
+	wg sync.WaitGroup
 
 	svr    *Server
 	stream tikvpb.Tikv_BatchCommandsServer
@@ -60,6 +64,8 @@ func (h *batchRequestHandler) start() error {
 		if err := h.dispatchBatchRequest(ctx); err != nil {
 			log.Warn("dispatch batch request failed", zap.Error(err))
 		}
+		// The responses of the requests received before the client closes the stream are still sent.
+		h.wg.Wait()
 		close(h.closeCh)
 	}()
 
@@ -68,13 +74,22 @@ func (h *batchRequestHandler) start() error {
 	return err
 }
 
-func (h *batchRequestHandler) handleRequest(id uint64, req *tikvpb.BatchCommandsRequest_Request) {
-	resp, err := h.svr.handleBatchRequest(h.stream.Context(), req)
+func (h *batchRequestHandler) handleRequest(ctx context.Context, id uint64, req *tikvpb.BatchCommandsRequest_Request) {
+	defer h.wg.Done()
+	resp, err := h.svr.handleBatchRequest(ctx, req)
 	if err != nil {
-		log.Warn("handle batch request failed", zap.Error(err))
-		return
+		log.Warn("handle batch request failed", zap.Uint64("id", id), zap.Error(err))
+		// Every request is answered, or the client waits for the response until it times out. The client
+		// fails the request fast on the response of the unexpected type.
+		resp = &tikvpb.BatchCommandsResponse_Response{
+			Cmd: &tikvpb.BatchCommandsResponse_Response_Empty{Empty: &tikvpb.BatchCommandsEmptyResponse{}},
+		}
+	}
+	select {
+	case h.respCh <- respIDPair{id: id, resp: resp}:
+	case <-ctx.Done():
+		// The stream is broken, nobody receives the response.
 	}
-	h.respCh <- respIDPair{id: id, resp: resp}
 }
 
 func (h *batchRequestHandler) dispatchBatchRequest(ctx context.Context) error {
@@ -93,9 +108,13 @@ func (h *batchRequestHandler) dispatchBatchRequest(ctx context.Context) error {
 			return err
 		}
 
-		for i, req := range batchReq.GetRequests() {
-			id := batchReq.GetRequestIds()[i]
-			go h.handleRequest(id, req)
+		reqs, ids := batchReq.GetRequests(), batchReq.GetRequestIds()
+		if len(reqs) != len(ids) {
+			return errors.Errorf("mismatched batch request: %d requests, %d ids", len(reqs), len(ids))
+		}
+		for i, req := range reqs {
+			h.wg.Add(1)
+			go h.handleRequest(ctx, ids[i], req)
 		}
 	}
 }
@@ -154,6 +173,12 @@ func (svr *Server) handleBatchRequest(ctx context.Context, req *tikvpb.BatchComm
 			return nil, err
 		}
 		return &tikvpb.BatchCommandsResponse_Response{Cmd: &tikvpb.BatchCommandsResponse_Response_PessimisticRollback{PessimisticRollback: res}}, nil
+	case *tikvpb.BatchCommandsRequest_Request_CheckSecondaryLocks:
+		res, err := svr.KvCheckSecondaryLocks(ctx, req.CheckSecondaryLocks)
+		if err != nil {
+			return nil, err
+		}
+		return &tikvpb.BatchCommandsResponse_Response{Cmd: &tikvpb.BatchCommandsResponse_Response_CheckSecondaryLocks{CheckSecondaryLocks: res}}, nil
 	case *tikvpb.BatchCommandsRequest_Request_TxnHeartBeat:
 		res, err := svr.KvTxnHeartBeat(ctx, req.TxnHeartBeat)
 		if err != nil {
@@ -178,6 +203,12 @@ func (svr *Server) handleBatchRequest(ctx context.Context, req *tikvpb.BatchComm
 			return nil, err
 		}
 		return &tikvpb.BatchCommandsResponse_Response{Cmd: &tikvpb.BatchCommandsResponse_Response_Commit{Commit: res}}, nil
+	case *tikvpb.BatchCommandsRequest_Request_Import:
+		res, err := svr.KvImport(ctx, req.Import)
+		if err != nil {
+			return nil, err
+		}
+		return &tikvpb.BatchCommandsResponse_Response{Cmd: &tikvpb.BatchCommandsResponse_Response_Import{Import: res}}, nil
 	case *tikvpb.BatchCommandsRequest_Request_Cleanup:
 		res, err := svr.KvCleanup(ctx, req.Cleanup)
 		if err != nil {
@@ -262,6 +293,12 @@ func (svr *Server) handleBatchRequest(ctx context.Context, req *tikvpb.BatchComm
 			return nil, err
 		}
 		return &tikvpb.BatchCommandsResponse_Response{Cmd: &tikvpb.BatchCommandsResponse_Response_RawScan{RawScan: res}}, nil
+	case *tikvpb.BatchCommandsRequest_Request_RawBatchScan:
+		res, err := svr.RawBatchScan(ctx, req.RawBatchScan)
+		if err != nil {
+			return nil, err
+		}
+		return &tikvpb.BatchCommandsResponse_Response{Cmd: &tikvpb.BatchCommandsResponse_Response_RawBatchScan{RawBatchScan: res}}, nil
 	case *tikvpb.BatchCommandsRequest_Request_RawDeleteRange:
 		res, err := svr.RawDeleteRange(ctx, req.RawDeleteRange)
 		if err != nil {
@@ -278,5 +315,5 @@ func (svr *Server) handleBatchRequest(ctx context.Context, req *tikvpb.BatchComm
 		res := &tikvpb.BatchCommandsEmptyResponse{TestId: req.Empty.TestId}
 		return &tikvpb.BatchCommandsResponse_Response{Cmd: &tikvpb.BatchCommandsResponse_Response_Empty{Empty: res}}, nil
 	}
-	return nil, nil
+	return nil, errors.Errorf("unsupported batch command %T", req.GetCmd())
 }
@@ -0,0 +1,3064 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgryski/go-farm"
+	"github.com/gogo/protobuf/proto"
+	"github.com/ngaut/unistore/config"
+	"github.com/ngaut/unistore/metrics"
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+	. "github.com/pingcap/check"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/backup"
+	"github.com/pingcap/kvproto/pkg/cdcpb"
+	"github.com/pingcap/kvproto/pkg/coprocessor"
+	"github.com/pingcap/kvproto/pkg/debugpb"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/tikvpb"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var _ = Suite(&testServerSuite{})
+
+type testServerSuite struct{}
+
+// bootstrapRegion bootstraps the test store with a single region covering the whole key space.
+func (ts *TestStore) bootstrapRegion() *kvrpcpb.Context {
+	store := &metapb.Store{Id: 1, Address: "127.0.0.1:10086"}
+	region := &metapb.Region{
+		Id:          2,
+		RegionEpoch: &metapb.RegionEpoch{},
+		Peers:       []*metapb.Peer{{Id: 3, StoreId: store.Id}},
+	}
+	ts.c.Assert(ts.RegionManager.Bootstrap([]*metapb.Store{store}, region), IsNil)
+	return ts.regionRPCCtx(region.Id)
+}
+
+// splitRegion splits the region at the raw key and returns the rpc context of the new region on the right.
+func (ts *TestStore) splitRegion(regionID uint64, rawKey []byte) *kvrpcpb.Context {
+	newID := ts.RegionManager.AllocID()
+	peerID := ts.RegionManager.AllocID()
+	ts.RegionManager.Split(regionID, newID, rawKey, []uint64{peerID}, peerID)
+	return ts.regionRPCCtx(newID)
+}
+
+func (ts *TestStore) regionRPCCtx(regionID uint64) *kvrpcpb.Context {
+	region := ts.RegionManager.GetRegion(regionID)
+	return &kvrpcpb.Context{
+		RegionId:    region.Id,
+		RegionEpoch: region.RegionEpoch,
+		Peer:        region.Peers[0],
+	}
+}
+
+// pinResolvedTS forces the resolved ts of the region to check the stale reads around it, the resolved ts tracker
+// doesn't advance it after that.
+func (rm *MockRegionManager) pinResolvedTS(regionID, ts uint64) error {
+	rm.mu.RLock()
+	ri := rm.regions[regionID]
+	rm.mu.RUnlock()
+	if ri == nil {
+		return errors.Errorf("region %d not found", regionID)
+	}
+	atomic.StoreInt32(&ri.resolvedTSPin, 1)
+	ri.setResolvedTS(ts)
+	return nil
+}
+
+func kvPrewriteReq(rpcCtx *kvrpcpb.Context, key, value []byte, startTS uint64) *kvrpcpb.PrewriteRequest {
+	return &kvrpcpb.PrewriteRequest{
+		Context:      rpcCtx,
+		Mutations:    []*kvrpcpb.Mutation{newMutation(kvrpcpb.Op_Put, key, value)},
+		PrimaryLock:  key,
+		StartVersion: startTS,
+		LockTtl:      lockTTL,
+	}
+}
+
+func (s *testServerSuite) TestReaderLimit(c *C) {
+	store, err := NewTestStore("TestReaderLimit", "TestReaderLimit", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	store.Svr.readerLimiter = newSlotLimiter(1, 10*time.Millisecond)
+
+	reqCtx1 := store.newReqCtx()
+	c.Assert(reqCtx1.acquireReaderSlot(), IsNil)
+	reqCtx2 := store.newReqCtx()
+	regErr := reqCtx2.acquireReaderSlot()
+	c.Assert(regErr, NotNil)
+	c.Assert(regErr.ServerIsBusy, NotNil)
+
+	reqCtx1.finish()
+	c.Assert(reqCtx2.acquireReaderSlot(), IsNil)
+	reqCtx2.finish()
+}
+
+func (s *testServerSuite) TestServerIsBusyBackoff(c *C) {
+	c.Assert(newServerIsBusyErr("busy", 0).ServerIsBusy.BackoffMs, Equals, uint64(busyBackoffBaseMs))
+	c.Assert(newServerIsBusyErr("busy", 1000).ServerIsBusy.BackoffMs, Equals, uint64(busyBackoffMaxMs))
+
+	store, err := NewTestStore("TestServerIsBusyBackoff", "TestServerIsBusyBackoff", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	limiter := newSlotLimiter(1, 100*time.Millisecond)
+	store.Svr.readerLimiter = limiter
+	holder := store.newReqCtx()
+	c.Assert(holder.acquireReaderSlot(), IsNil)
+	defer holder.finish()
+
+	// The backoff is computed from the requests still waiting when the request is rejected, they're queued
+	// after it started waiting.
+	var prevBackoff uint64
+	for _, depth := range []int{0, 2, 5} {
+		rejected := make(chan *errorpb.Error, 1)
+		go func() {
+			rejected <- store.newReqCtx().acquireReaderSlot()
+		}()
+		for atomic.LoadInt32(&limiter.waiting) < 1 {
+			time.Sleep(time.Millisecond)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < depth; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				store.newReqCtx().acquireReaderSlot()
+			}()
+		}
+		for int(atomic.LoadInt32(&limiter.waiting)) < depth+1 {
+			time.Sleep(time.Millisecond)
+		}
+		regErr := <-rejected
+		c.Assert(regErr, NotNil)
+		c.Assert(regErr.ServerIsBusy, NotNil)
+		c.Assert(regErr.ServerIsBusy.BackoffMs, Greater, prevBackoff)
+		prevBackoff = regErr.ServerIsBusy.BackoffMs
+		wg.Wait()
+	}
+}
+
+func (s *testServerSuite) TestSlotLimiterPriority(c *C) {
+	limiter := newSlotLimiter(1, time.Second)
+	ok, _ := limiter.acquire(kvrpcpb.CommandPri_Low)
+	c.Assert(ok, IsTrue)
+
+	order := make(chan kvrpcpb.CommandPri, 3)
+	var wg sync.WaitGroup
+	for i, pri := range []kvrpcpb.CommandPri{kvrpcpb.CommandPri_Low, kvrpcpb.CommandPri_Normal, kvrpcpb.CommandPri_High} {
+		wg.Add(1)
+		go func(pri kvrpcpb.CommandPri) {
+			defer wg.Done()
+			ok, _ := limiter.acquire(pri)
+			c.Check(ok, IsTrue)
+			order <- pri
+			limiter.release()
+		}(pri)
+		for int(atomic.LoadInt32(&limiter.waiting)) <= i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	limiter.release()
+	wg.Wait()
+	c.Assert(<-order, Equals, kvrpcpb.CommandPri_High)
+	c.Assert(<-order, Equals, kvrpcpb.CommandPri_Normal)
+	c.Assert(<-order, Equals, kvrpcpb.CommandPri_Low)
+	ok, queued := limiter.acquire(kvrpcpb.CommandPri_Low)
+	c.Assert(ok, IsTrue)
+	c.Assert(queued, Equals, 0)
+}
+
+func (s *testServerSuite) TestWriterLimit(c *C) {
+	store, err := NewTestStore("TestWriterLimit", "TestWriterLimit", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	svr.writerLimiter = newSlotLimiter(1, 10*time.Millisecond)
+
+	holder := store.newReqCtx()
+	c.Assert(holder.acquireWriterSlot(), IsNil)
+	resp, err := svr.KvPrewrite(context.Background(), kvPrewriteReq(rpcCtx, []byte("ta"), []byte("v"), 10))
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, NotNil)
+	c.Assert(resp.RegionError.ServerIsBusy, NotNil)
+	MustUnLocked([]byte("ta"), store)
+	// Reads don't take write slots.
+	MustGetNone([]byte("ta"), 20, store)
+
+	holder.finish()
+	resp, err = svr.KvPrewrite(context.Background(), kvPrewriteReq(rpcCtx, []byte("ta"), []byte("v"), 10))
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, IsNil)
+	c.Assert(resp.Errors, HasLen, 0)
+	MustLocked([]byte("ta"), false, store)
+}
+
+func (s *testServerSuite) TestReadPools(c *C) {
+	store, err := NewTestStore("TestReadPools", "TestReadPools", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	MustLoad(10, 11, store, "ta:v", "tb:v")
+	closeCh := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(closeCh)
+		wg.Wait()
+	}()
+	svr.pointReadPool = newReadPool(pointReadPool, 1, 1, closeCh, &wg)
+	svr.scanReadPool = newReadPool(scanReadPool, 1, 2, closeCh, &wg)
+
+	// Block the worker of the scan pool.
+	running, unblock := make(chan struct{}), make(chan struct{})
+	go store.newReqCtx().runInReadPool(svr.scanReadPool, func() {
+		close(running)
+		<-unblock
+	})
+	<-running
+	scanReq := &kvrpcpb.ScanRequest{Context: rpcCtx, StartKey: []byte("t"), Limit: 10, Version: 20}
+
+	// The point gets don't wait for the scans.
+	getResp, err := svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte("ta"), Version: 20})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.RegionError, IsNil)
+	c.Assert(getResp.Value, BytesEquals, []byte("v"))
+
+	// A queued scan is dropped when its deadline is exceeded.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	scanResp, err := svr.KvScan(ctx, scanReq)
+	c.Assert(err, IsNil)
+	c.Assert(scanResp.RegionError, NotNil)
+	c.Assert(strings.Contains(scanResp.RegionError.Message, "deadline exceeded"), IsTrue)
+
+	// The scans beyond the queue size are rejected, the dropped scan is in the queue until a worker takes it.
+	queuedResp := make(chan *kvrpcpb.ScanResponse, 1)
+	go func() {
+		resp, _ := svr.KvScan(context.Background(), scanReq)
+		queuedResp <- resp
+	}()
+	for len(svr.scanReadPool.tasks) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	scanResp, err = svr.KvScan(context.Background(), scanReq)
+	c.Assert(err, IsNil)
+	c.Assert(scanResp.RegionError, NotNil)
+	c.Assert(scanResp.RegionError.ServerIsBusy, NotNil)
+
+	close(unblock)
+	scanResp = <-queuedResp
+	c.Assert(scanResp.RegionError, IsNil)
+	c.Assert(scanResp.Pairs, HasLen, 2)
+
+	// The queued requests don't hold the reader slots.
+	running, unblock = make(chan struct{}), make(chan struct{})
+	go store.newReqCtx().runInReadPool(svr.pointReadPool, func() {
+		close(running)
+		<-unblock
+	})
+	<-running
+	svr.readerLimiter = newSlotLimiter(1, 10*time.Millisecond)
+	queuedGet := make(chan *kvrpcpb.GetResponse, 1)
+	go func() {
+		resp, _ := svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte("ta"), Version: 20})
+		queuedGet <- resp
+	}()
+	for len(svr.pointReadPool.tasks) < 1 {
+		time.Sleep(time.Millisecond)
+	}
+	holder, err := newRequestCtx(context.Background(), svr, rpcCtx, "holder")
+	c.Assert(err, IsNil)
+	c.Assert(holder.acquireReaderSlot(), IsNil)
+	holder.finish()
+	close(unblock)
+	getResp = <-queuedGet
+	c.Assert(getResp.RegionError, IsNil)
+	c.Assert(getResp.Value, BytesEquals, []byte("v"))
+}
+
+func (s *testServerSuite) TestFlowControl(c *C) {
+	store, err := NewTestStore("TestFlowControl", "TestFlowControl", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	fc := store.MvccStore.flowController
+	atomic.StoreInt64(&fc.stallThreshold, int64(time.Second))
+
+	// The writes are rejected while the engine is stalled.
+	atomic.StoreInt64(&fc.latency, int64(3*time.Second))
+	atomic.StoreInt64(&fc.lastWrite, time.Now().UnixNano())
+	resp, err := svr.KvPrewrite(context.Background(), kvPrewriteReq(rpcCtx, []byte("ta"), []byte("v"), 10))
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, NotNil)
+	c.Assert(resp.RegionError.ServerIsBusy, NotNil)
+	c.Assert(resp.RegionError.ServerIsBusy.BackoffMs, Greater, uint64(busyBackoffBaseMs))
+	MustUnLocked([]byte("ta"), store)
+
+	// The stale average lets a write through, the fast write brings the average down.
+	atomic.StoreInt64(&fc.lastWrite, time.Now().Add(-2*time.Second).UnixNano())
+	resp, err = svr.KvPrewrite(context.Background(), kvPrewriteReq(rpcCtx, []byte("ta"), []byte("v"), 10))
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, IsNil)
+	c.Assert(time.Duration(atomic.LoadInt64(&fc.latency)) < 3*time.Second, IsTrue)
+	MustCommit([]byte("ta"), 10, 11, store)
+
+	// The writes are rejected if too many writes are pending.
+	atomic.StoreInt32(&fc.maxPending, 1)
+	atomic.StoreInt32(&fc.pending, 1)
+	rawResp, err := svr.RawPut(context.Background(), &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte("rk"), Value: []byte("v")})
+	c.Assert(err, IsNil)
+	c.Assert(rawResp.RegionError, NotNil)
+	c.Assert(rawResp.RegionError.ServerIsBusy, NotNil)
+	delResp, err := svr.RawBatchDelete(context.Background(), &kvrpcpb.RawBatchDeleteRequest{Context: rpcCtx, Keys: [][]byte{[]byte("rk")}})
+	c.Assert(err, IsNil)
+	c.Assert(delResp.RegionError.GetServerIsBusy(), NotNil)
+	atomic.StoreInt32(&fc.pending, 0)
+	rawResp, err = svr.RawPut(context.Background(), &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte("rk"), Value: []byte("v")})
+	c.Assert(err, IsNil)
+	c.Assert(rawResp.RegionError, IsNil)
+}
+
+func (s *testServerSuite) TestReloadConfig(c *C) {
+	store, err := NewTestStore("TestReloadConfig", "TestReloadConfig", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+
+	conf := svr.Config()
+	conf.Server.SlowLogThreshold = "1ms"
+	conf.Server.WriteStallThreshold = "2s"
+	conf.GC.GracePeriod = "10s"
+	// Not an online item.
+	conf.Server.MaxRequestSize = 1
+	c.Assert(svr.ReloadConfig(&conf), IsNil)
+	c.Assert(svr.slowLog.isSlow("KvGet", 2*time.Millisecond), IsTrue)
+	c.Assert(atomic.LoadInt64(&store.MvccStore.flowController.stallThreshold), Equals, int64(2*time.Second))
+	c.Assert(atomic.LoadInt64(&store.MvccStore.gcGracePeriod), Equals, int64(10*time.Second))
+	effective := svr.Config()
+	c.Assert(effective.Server.SlowLogThreshold, Equals, "1ms")
+	c.Assert(effective.GC.GracePeriod, Equals, "10s")
+	c.Assert(effective.Server.MaxRequestSize, Equals, config.DefaultConf.Server.MaxRequestSize)
+
+	// Nothing is applied if an item is invalid.
+	conf.Server.SlowLogThreshold = "1h"
+	conf.GC.GracePeriod = "invalid"
+	c.Assert(svr.ReloadConfig(&conf), NotNil)
+	c.Assert(svr.Config().Server.SlowLogThreshold, Equals, "1ms")
+	c.Assert(svr.slowLog.isSlow("KvGet", 2*time.Millisecond), IsTrue)
+}
+
+func (s *testServerSuite) TestStatusHandler(c *C) {
+	store, err := NewTestStore("TestStatusHandler", "TestStatusHandler", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	leftCtx := store.bootstrapRegion()
+	rightCtx := store.splitRegion(leftCtx.RegionId, []byte("tm"))
+	var reloaded int
+	handler := store.Svr.StatusHandler(func() error {
+		reloaded++
+		return nil
+	})
+	get := func(method, url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+		return w
+	}
+
+	w := get("GET", "/regions")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var regions []RegionInfo
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &regions), IsNil)
+	c.Assert(regions, HasLen, 2)
+	c.Assert(regions[0].ID, Equals, leftCtx.RegionId)
+	c.Assert(regions[0].EndKey, Equals, hex.EncodeToString([]byte("tm")))
+	c.Assert(regions[1].ID, Equals, rightCtx.RegionId)
+	c.Assert(regions[1].StartKey, Equals, hex.EncodeToString([]byte("tm")))
+	c.Assert(regions[1].EndKey, Equals, "")
+	c.Assert(regions[1].Version, Equals, rightCtx.RegionEpoch.Version)
+
+	w = get("GET", fmt.Sprintf("/regions?id=%d", rightCtx.RegionId))
+	var region RegionInfo
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &region), IsNil)
+	c.Assert(region, DeepEquals, regions[1])
+	c.Assert(get("GET", "/regions?id=12345").Code, Equals, http.StatusNotFound)
+
+	w = get("GET", "/stats")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	var stats ServerStats
+	c.Assert(json.Unmarshal(w.Body.Bytes(), &stats), IsNil)
+
+	w = get("GET", "/config")
+	c.Assert(w.Code, Equals, http.StatusOK)
+	c.Assert(strings.Contains(w.Body.String(), "slow-log-threshold"), IsTrue)
+	c.Assert(get("GET", "/config/reload").Code, Equals, http.StatusMethodNotAllowed)
+	c.Assert(get("POST", "/config/reload").Code, Equals, http.StatusOK)
+	c.Assert(reloaded, Equals, 1)
+	c.Assert(get("GET", "/debug/pprof/").Code, Equals, http.StatusOK)
+	c.Assert(get("GET", "/status").Code, Equals, http.StatusOK)
+}
+
+func (s *testServerSuite) TestRegionReadOnly(c *C) {
+	store, err := NewTestStore("TestRegionReadOnly", "TestRegionReadOnly", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	leftCtx := store.bootstrapRegion()
+	rightCtx := store.splitRegion(leftCtx.RegionId, []byte("tm"))
+	leftCtx = store.regionRPCCtx(leftCtx.RegionId)
+
+	k1, k2 := []byte("ta"), []byte("tx")
+	v := []byte("v")
+	MustPrewritePut(k1, k1, v, 1, store)
+	MustCommit(k1, 1, 2, store)
+
+	c.Assert(store.RegionManager.SetRegionReadOnly(leftCtx.RegionId, true), IsNil)
+	prewriteResp, err := svr.KvPrewrite(context.Background(), kvPrewriteReq(leftCtx, k1, v, 3))
+	c.Assert(err, IsNil)
+	c.Assert(prewriteResp.Errors, HasLen, 1)
+	c.Assert(prewriteResp.Errors[0].Retryable, Not(Equals), "")
+	MustUnLocked(k1, store)
+	// The handlers that may write rollback records or push locks are rejected as well.
+	heartBeatResp, err := svr.KvTxnHeartBeat(context.Background(), &kvrpcpb.TxnHeartBeatRequest{
+		Context: leftCtx, PrimaryLock: k1, StartVersion: 1, AdviseLockTtl: 100,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(heartBeatResp.Error, NotNil)
+	secondaryResp, err := svr.KvCheckSecondaryLocks(context.Background(), &kvrpcpb.CheckSecondaryLocksRequest{
+		Context: leftCtx, Keys: [][]byte{k1}, StartVersion: 3,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(secondaryResp.Error, NotNil)
+	rawResp, err := svr.RawPut(context.Background(), &kvrpcpb.RawPutRequest{Context: leftCtx, Key: k1, Value: v})
+	c.Assert(err, IsNil)
+	c.Assert(rawResp.Error, Not(Equals), "")
+	getResp, err := svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: leftCtx, Key: k1, Version: 3})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.RegionError, IsNil)
+	c.Assert(getResp.Value, BytesEquals, v)
+
+	// Other regions are still writable.
+	prewriteResp, err = svr.KvPrewrite(context.Background(), kvPrewriteReq(rightCtx, k2, v, 3))
+	c.Assert(err, IsNil)
+	c.Assert(prewriteResp.Errors, HasLen, 0)
+	c.Assert(prewriteResp.RegionError, IsNil)
+	MustLocked(k2, false, store)
+
+	c.Assert(store.RegionManager.SetRegionReadOnly(leftCtx.RegionId, false), IsNil)
+	prewriteResp, err = svr.KvPrewrite(context.Background(), kvPrewriteReq(leftCtx, k1, v, 3))
+	c.Assert(err, IsNil)
+	c.Assert(prewriteResp.Errors, HasLen, 0)
+	MustLocked(k1, false, store)
+}
+
+func (s *testServerSuite) TestBatchCheckTxnStatus(c *C) {
+	store, err := NewTestStore("TestBatchCheckTxnStatus", "TestBatchCheckTxnStatus", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	leftCtx := store.bootstrapRegion()
+	rightCtx := store.splitRegion(leftCtx.RegionId, []byte("tk3"))
+	leftCtx = store.regionRPCCtx(leftCtx.RegionId)
+
+	alive, committed, rolledBack, missing := []byte("tk1"), []byte("tk2"), []byte("tk3"), []byte("tk4")
+	v := []byte("v")
+	MustPrewriteOptimistic(alive, alive, v, 10, 100000, 10, store)
+	MustPrewritePut(committed, committed, v, 20, store)
+	MustCommit(committed, 20, 25, store)
+	MustPrewritePut(rolledBack, rolledBack, v, 30, store)
+	MustRollbackKey(rolledBack, 30, store)
+
+	currentTS := oracle.ComposeTS(1, 0)
+	checkReq := func(rpcCtx *kvrpcpb.Context, primary []byte, lockTS uint64, rollbackIfNotExist bool) *kvrpcpb.CheckTxnStatusRequest {
+		return &kvrpcpb.CheckTxnStatusRequest{
+			Context: rpcCtx, PrimaryKey: primary, LockTs: lockTS, CallerStartTs: 50, CurrentTs: currentTS,
+			RollbackIfNotExist: rollbackIfNotExist,
+		}
+	}
+	resps, err := store.Svr.BatchCheckTxnStatus(context.Background(), []*kvrpcpb.CheckTxnStatusRequest{
+		checkReq(leftCtx, alive, 10, true),
+		checkReq(leftCtx, committed, 20, true),
+		checkReq(rightCtx, rolledBack, 30, true),
+		checkReq(rightCtx, missing, 40, false),
+		checkReq(rightCtx, missing, 45, true),
+		// The primary is checked against the region of its own request.
+		checkReq(leftCtx, missing, 46, true),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resps, HasLen, 6)
+	for _, resp := range resps[:3] {
+		c.Assert(resp.Error, IsNil)
+		c.Assert(resp.RegionError, IsNil)
+	}
+	c.Assert(resps[0].LockInfo, NotNil)
+	c.Assert(resps[0].LockInfo.LockVersion, Equals, uint64(10))
+	c.Assert(resps[1].CommitVersion, Equals, uint64(25))
+	c.Assert(resps[1].LockInfo, IsNil)
+	c.Assert(resps[2].CommitVersion, Equals, uint64(0))
+	c.Assert(resps[2].LockInfo, IsNil)
+
+	// The missing transaction is only rolled back if the request asks for it.
+	c.Assert(resps[3].Error, NotNil)
+	c.Assert(resps[3].Error.TxnNotFound, NotNil)
+	c.Assert(store.MvccStore.checkExtraTxnStatus(store.newReqCtx(), missing, 40).isRollback, IsFalse)
+	c.Assert(resps[4].Error, IsNil)
+	c.Assert(resps[4].Action, Equals, kvrpcpb.Action_LockNotExistRollback)
+	MustGetRollback(missing, 45, store)
+	c.Assert(resps[5].Error, NotNil)
+	c.Assert(resps[5].Action, Equals, kvrpcpb.Action_NoAction)
+}
+
+func (s *testServerSuite) TestKvCheckTxnStatus(c *C) {
+	store, err := NewTestStore("TestKvCheckTxnStatus", "TestKvCheckTxnStatus", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	ctx := context.Background()
+	pk, v := []byte("tpk"), []byte("v")
+	checkTxnStatus := func(lockTS, currentTS uint64, rollbackIfNotExist bool) *kvrpcpb.CheckTxnStatusResponse {
+		resp, err := svr.KvCheckTxnStatus(ctx, &kvrpcpb.CheckTxnStatusRequest{
+			Context:            rpcCtx,
+			PrimaryKey:         pk,
+			LockTs:             lockTS,
+			CallerStartTs:      currentTS,
+			CurrentTs:          currentTS,
+			RollbackIfNotExist: rollbackIfNotExist,
+		})
+		c.Assert(err, IsNil)
+		c.Assert(resp.RegionError, IsNil)
+		return resp
+	}
+
+	// The lock is alive.
+	startTS := oracle.ComposeTS(100, 0)
+	prewriteResp, err := svr.KvPrewrite(ctx, kvPrewriteReq(rpcCtx, pk, v, startTS))
+	c.Assert(err, IsNil)
+	c.Assert(prewriteResp.Errors, HasLen, 0)
+	resp := checkTxnStatus(startTS, oracle.ComposeTS(120, 0), true)
+	c.Assert(resp.Error, IsNil)
+	c.Assert(resp.LockTtl, Equals, lockTTL)
+	c.Assert(resp.LockInfo.LockVersion, Equals, startTS)
+
+	// The status can't be checked in a read-only region.
+	c.Assert(store.RegionManager.SetRegionReadOnly(rpcCtx.RegionId, true), IsNil)
+	resp = checkTxnStatus(startTS, oracle.ComposeTS(200, 0), true)
+	c.Assert(resp.Error, NotNil)
+	MustLocked(pk, false, store)
+	c.Assert(store.RegionManager.SetRegionReadOnly(rpcCtx.RegionId, false), IsNil)
+
+	// The expired lock is rolled back.
+	resp = checkTxnStatus(startTS, oracle.ComposeTS(200, 0), true)
+	c.Assert(resp.Error, IsNil)
+	c.Assert(resp.Action, Equals, kvrpcpb.Action_TTLExpireRollback)
+	MustUnLocked(pk, store)
+	MustGetRollback(pk, startTS, store)
+
+	// The lock doesn't exist.
+	startTS = oracle.ComposeTS(300, 0)
+	resp = checkTxnStatus(startTS, oracle.ComposeTS(300, 0), false)
+	c.Assert(resp.Error.GetTxnNotFound(), NotNil)
+	resp = checkTxnStatus(startTS, oracle.ComposeTS(300, 0), true)
+	c.Assert(resp.Error, IsNil)
+	c.Assert(resp.Action, Equals, kvrpcpb.Action_LockNotExistRollback)
+	MustGetRollback(pk, startTS, store)
+
+	// The transaction is committed.
+	startTS = oracle.ComposeTS(400, 0)
+	MustPrewritePut(pk, pk, v, startTS, store)
+	MustCommit(pk, startTS, startTS+1, store)
+	resp = checkTxnStatus(startTS, oracle.ComposeTS(500, 0), true)
+	c.Assert(resp.Error, IsNil)
+	c.Assert(resp.CommitVersion, Equals, startTS+1)
+}
+
+func (s *testServerSuite) TestLockObserver(c *C) {
+	store, err := NewTestStore("TestLockObserver", "TestLockObserver", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	ctx := context.Background()
+
+	MustPrewritePut([]byte("ta"), []byte("ta"), []byte("v"), 10, store)
+	registerResp, err := svr.RegisterLockObserver(ctx, &kvrpcpb.RegisterLockObserverRequest{MaxTs: 100})
+	c.Assert(err, IsNil)
+	c.Assert(registerResp.Error, Equals, "")
+	// The locks written before the registration are found by the physical scan.
+	scanResp, err := svr.PhysicalScanLock(ctx, &kvrpcpb.PhysicalScanLockRequest{MaxTs: 100, Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(scanResp.Locks, HasLen, 1)
+
+	MustPrewritePut([]byte("tb"), []byte("tb"), []byte("v"), 50, store)
+	MustPrewritePut([]byte("tc"), []byte("tc"), []byte("v"), 200, store)
+	MustAcquirePessimisticLock([]byte("td"), []byte("td"), 60, 60, store)
+	checkResp, err := svr.CheckLockObserver(ctx, &kvrpcpb.CheckLockObserverRequest{MaxTs: 100})
+	c.Assert(err, IsNil)
+	c.Assert(checkResp.Error, Equals, "")
+	c.Assert(checkResp.IsClean, IsTrue)
+	c.Assert(checkResp.Locks, HasLen, 1)
+	c.Assert(checkResp.Locks[0].Key, BytesEquals, []byte("tb"))
+	c.Assert(checkResp.Locks[0].LockVersion, Equals, uint64(50))
+
+	checkResp, err = svr.CheckLockObserver(ctx, &kvrpcpb.CheckLockObserverRequest{MaxTs: 90})
+	c.Assert(err, IsNil)
+	c.Assert(checkResp.Error, Not(Equals), "")
+
+	// Registering with the same max ts keeps the collected locks.
+	_, err = svr.RegisterLockObserver(ctx, &kvrpcpb.RegisterLockObserverRequest{MaxTs: 100})
+	c.Assert(err, IsNil)
+	checkResp, err = svr.CheckLockObserver(ctx, &kvrpcpb.CheckLockObserverRequest{MaxTs: 100})
+	c.Assert(err, IsNil)
+	c.Assert(checkResp.Locks, HasLen, 1)
+
+	removeResp, err := svr.RemoveLockObserver(ctx, &kvrpcpb.RemoveLockObserverRequest{MaxTs: 100})
+	c.Assert(err, IsNil)
+	c.Assert(removeResp.Error, Equals, "")
+	checkResp, err = svr.CheckLockObserver(ctx, &kvrpcpb.CheckLockObserverRequest{MaxTs: 100})
+	c.Assert(err, IsNil)
+	c.Assert(checkResp.Error, Not(Equals), "")
+}
+
+func (s *testServerSuite) TestLockObserverDirty(c *C) {
+	o := &lockObserver{}
+	o.register(100)
+	lock := &mvcc.MvccLock{MvccLockHdr: mvcc.MvccLockHdr{StartTS: 10, Op: uint8(kvrpcpb.Op_Put)}}
+	for i := 0; i < maxObservedLocks; i++ {
+		o.observe([][]byte{[]byte(fmt.Sprintf("t%d", i))}, []*mvcc.MvccLock{lock})
+	}
+	locks, isClean, err := o.check(100)
+	c.Assert(err, IsNil)
+	c.Assert(isClean, IsTrue)
+	c.Assert(locks, HasLen, maxObservedLocks)
+	o.observe([][]byte{[]byte("tx")}, []*mvcc.MvccLock{lock})
+	locks, isClean, err = o.check(100)
+	c.Assert(err, IsNil)
+	c.Assert(isClean, IsFalse)
+	c.Assert(locks, HasLen, 0)
+}
+
+// disableAdvanceTS stops the resolved ts tracker of the server, so the resolved ts set by the test is kept.
+func disableAdvanceTS(svr *Server) {
+	svr.confMu.Lock()
+	svr.conf.Server.AdvanceTSInterval = "0s"
+	svr.confMu.Unlock()
+}
+
+func (s *testServerSuite) TestStaleReadResolvedTs(c *C) {
+	store, err := NewTestStore("TestStaleReadResolvedTs", "TestStaleReadResolvedTs", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	disableAdvanceTS(store.Svr)
+	rpcCtx := store.bootstrapRegion()
+
+	c.Assert(store.RegionManager.pinResolvedTS(rpcCtx.RegionId, 100), IsNil)
+	reqCtx, err := newRequestCtx(context.Background(), store.Svr, rpcCtx, "TestStaleRead")
+	c.Assert(err, IsNil)
+	c.Assert(reqCtx.regErr, IsNil)
+	c.Assert(reqCtx.checkStaleRead(99), IsNil)
+	c.Assert(reqCtx.checkStaleRead(100), IsNil)
+	c.Assert(reqCtx.checkStaleRead(101), NotNil)
+	reqCtx.finish()
+
+	// Rewind the resolved ts.
+	c.Assert(store.RegionManager.pinResolvedTS(rpcCtx.RegionId, 50), IsNil)
+	reqCtx, err = newRequestCtx(context.Background(), store.Svr, rpcCtx, "TestStaleRead")
+	c.Assert(err, IsNil)
+	c.Assert(reqCtx.checkStaleRead(50), IsNil)
+	c.Assert(reqCtx.checkStaleRead(60), NotNil)
+	reqCtx.finish()
+	// The tracker doesn't advance the pinned resolved ts.
+	store.Svr.advanceResolvedTS(200)
+	regCtx, regErr := store.RegionManager.GetRegionFromCtx(rpcCtx)
+	c.Assert(regErr, IsNil)
+	c.Assert(regCtx.getResolvedTS(), Equals, uint64(50))
+
+	c.Assert(store.RegionManager.pinResolvedTS(rpcCtx.RegionId+100, 50), NotNil)
+}
+
+func (s *testServerSuite) TestResolvedTS(c *C) {
+	store, err := NewTestStore("TestResolvedTS", "TestResolvedTS", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	disableAdvanceTS(svr)
+	rpcCtx := store.bootstrapRegion()
+	rightCtx := store.splitRegion(rpcCtx.RegionId, []byte("tm"))
+	leftCtx := store.regionRPCCtx(rpcCtx.RegionId)
+	getResolvedTS := func(regionID uint64) uint64 {
+		for _, region := range svr.Regions() {
+			if region.ID == regionID {
+				return region.ResolvedTS
+			}
+		}
+		c.Fatalf("region %d not found", regionID)
+		return 0
+	}
+
+	// The resolved ts of the region with a lock doesn't pass the start ts of the lock.
+	resp, err := svr.KvPrewrite(context.Background(), kvPrewriteReq(leftCtx, []byte("ta"), []byte("v"), 30))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Errors, HasLen, 0)
+	svr.advanceResolvedTS(50)
+	c.Assert(getResolvedTS(leftCtx.RegionId), Equals, uint64(30))
+	c.Assert(getResolvedTS(rightCtx.RegionId), Equals, uint64(50))
+
+	commitResp, err := svr.KvCommit(context.Background(), &kvrpcpb.CommitRequest{Context: leftCtx,
+		Keys: [][]byte{[]byte("ta")}, StartVersion: 30, CommitVersion: 40})
+	c.Assert(err, IsNil)
+	c.Assert(commitResp.Error, IsNil)
+	svr.advanceResolvedTS(60)
+	c.Assert(getResolvedTS(leftCtx.RegionId), Equals, uint64(60))
+	// The resolved ts never goes back.
+	svr.advanceResolvedTS(55)
+	c.Assert(getResolvedTS(rightCtx.RegionId), Equals, uint64(60))
+	// The regions without a CDC subscription are advanced with a write in progress.
+	observer := store.MvccStore.cdcObserver
+	observer.mu.RLock()
+	svr.advanceResolvedTS(65)
+	observer.mu.RUnlock()
+	c.Assert(getResolvedTS(rightCtx.RegionId), Equals, uint64(65))
+
+	checkResp, err := svr.CheckLeader(context.Background(), &kvrpcpb.CheckLeaderRequest{Ts: 70, Regions: []*kvrpcpb.LeaderInfo{
+		{RegionId: leftCtx.RegionId, PeerId: leftCtx.Peer.Id, RegionEpoch: leftCtx.RegionEpoch},
+		{RegionId: rightCtx.RegionId, PeerId: rightCtx.Peer.Id, RegionEpoch: &metapb.RegionEpoch{}},
+		{RegionId: rightCtx.RegionId + 100, PeerId: rightCtx.Peer.Id, RegionEpoch: rightCtx.RegionEpoch},
+	}})
+	c.Assert(err, IsNil)
+	c.Assert(checkResp.Ts, Equals, uint64(70))
+	c.Assert(checkResp.Regions, DeepEquals, []uint64{leftCtx.RegionId})
+	// The check doesn't advance the resolved ts.
+	c.Assert(getResolvedTS(leftCtx.RegionId), Equals, uint64(65))
+}
+
+func (s *testServerSuite) TestTraceLimit(c *C) {
+	store, err := NewTestStore("TestTraceLimit", "TestTraceLimit", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	store.Svr.maxTraceEvents = 4
+
+	reqCtx := store.newReqCtx()
+	defer reqCtx.finish()
+	for i := 0; i < 100; i++ {
+		reqCtx.trace(fmt.Sprintf("event-%d", i))
+	}
+	c.Assert(reqCtx.traces, HasLen, 4)
+	c.Assert(reqCtx.droppedTraces, Equals, 96)
+	var events []string
+	for _, ev := range reqCtx.traces {
+		events = append(events, ev.event)
+	}
+	c.Assert(events, DeepEquals, []string{"event-0", "event-1", "event-98", "event-99"})
+	traces := reqCtx.formatTraces()
+	c.Assert(strings.Contains(traces, "event-1:"), IsTrue)
+	c.Assert(strings.Contains(traces, "96 events dropped"), IsTrue)
+	c.Assert(strings.Index(traces, "dropped") < strings.Index(traces, "event-98"), IsTrue)
+
+	// No limit.
+	store.Svr.maxTraceEvents = 0
+	reqCtx2 := store.newReqCtx()
+	defer reqCtx2.finish()
+	for i := 0; i < 100; i++ {
+		reqCtx2.trace("event")
+	}
+	c.Assert(reqCtx2.traces, HasLen, 100)
+	c.Assert(reqCtx2.droppedTraces, Equals, 0)
+}
+
+func (s *testServerSuite) TestHistoricalRead(c *C) {
+	store, err := NewTestStore("TestHistoricalRead", "TestHistoricalRead", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+
+	k := []byte("tk")
+	MustPrewritePut(k, k, []byte("v1"), 5, store)
+	MustCommit(k, 5, 10, store)
+	MustPrewriteDelete(k, k, 15, store)
+	MustCommit(k, 15, 20, store)
+	MustPrewritePut(k, k, []byte("v2"), 25, store)
+	MustRollbackKey(k, 25, store)
+	MustPrewritePut(k, k, []byte("v3"), 35, store)
+	MustCommit(k, 35, 40, store)
+
+	for _, tt := range []struct {
+		readTS uint64
+		value  []byte
+	}{
+		{5, nil}, {10, []byte("v1")}, {15, []byte("v1")}, {20, nil}, {30, nil}, {40, []byte("v3")}, {50, []byte("v3")},
+	} {
+		getResp, err := svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: rpcCtx, Key: k, Version: tt.readTS})
+		c.Assert(err, IsNil)
+		c.Assert(getResp.Error, IsNil)
+		c.Assert(getResp.Value, BytesEquals, tt.value, Commentf("read ts %d", tt.readTS))
+
+		scanResp, err := svr.KvScan(context.Background(), &kvrpcpb.ScanRequest{Context: rpcCtx, StartKey: k, Limit: 10, Version: tt.readTS})
+		c.Assert(err, IsNil)
+		if tt.value == nil {
+			c.Assert(scanResp.Pairs, HasLen, 0, Commentf("read ts %d", tt.readTS))
+		} else {
+			c.Assert(scanResp.Pairs, HasLen, 1, Commentf("read ts %d", tt.readTS))
+			c.Assert(scanResp.Pairs[0].Value, BytesEquals, tt.value)
+		}
+	}
+
+	store.MvccStore.UpdateSafePoint(30)
+	getResp, err := svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: rpcCtx, Key: k, Version: 15})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Error, NotNil)
+	c.Assert(strings.Contains(getResp.Error.Abort, "GC too early"), IsTrue)
+	scanResp, err := svr.KvScan(context.Background(), &kvrpcpb.ScanRequest{Context: rpcCtx, StartKey: k, Limit: 10, Version: 15})
+	c.Assert(err, IsNil)
+	c.Assert(scanResp.Pairs, HasLen, 1)
+	c.Assert(scanResp.Pairs[0].Error, NotNil)
+	getResp, err = svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: rpcCtx, Key: k, Version: 30})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Error, IsNil)
+	c.Assert(getResp.Value, HasLen, 0)
+}
+
+func (s *testServerSuite) TestSplitRegionStats(c *C) {
+	store, err := NewTestStore("TestSplitRegionStats", "TestSplitRegionStats", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	rpcCtx := store.bootstrapRegion()
+
+	startTS := uint64(10)
+	for _, prefix := range []string{"ta", "tz"} {
+		n := 30
+		if prefix == "tz" {
+			n = 10
+		}
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("%s%02d", prefix, i))
+			MustPrewritePut(key, key, []byte("value"), startTS, store)
+			MustCommit(key, startTS, startTS+1, store)
+			startTS += 2
+		}
+	}
+
+	resp, stats := store.RegionManager.SplitRegionWithStats(&kvrpcpb.SplitRegionRequest{
+		Context:   rpcCtx,
+		SplitKeys: [][]byte{[]byte("tm")},
+	})
+	c.Assert(resp.RegionError, IsNil)
+	c.Assert(resp.Regions, HasLen, 2)
+	c.Assert(stats, HasLen, 2)
+	c.Assert(stats[0].RegionID, Equals, resp.Regions[0].Id)
+	c.Assert(stats[1].RegionID, Equals, resp.Regions[1].Id)
+	c.Assert(stats[0].ApproximateKeys, Equals, int64(30))
+	c.Assert(stats[1].ApproximateKeys, Equals, int64(10))
+	c.Assert(stats[0].ApproximateSize, Equals, 3*stats[1].ApproximateSize)
+
+	// Only the samples of the large regions are read, the rest of the parent's stats is given to them.
+	var regions []*regionCtx
+	for _, meta := range resp.Regions {
+		regCtx, regErr := store.RegionManager.GetRegionFromCtx(store.regionRPCCtx(meta.Id))
+		c.Assert(regErr, IsNil)
+		regions = append(regions, regCtx)
+	}
+	parentSize := stats[0].ApproximateSize + stats[1].ApproximateSize
+	sampled, err := estimateSplitStats(store.MvccStore.db, regions, parentSize, 40, 20)
+	c.Assert(err, IsNil)
+	c.Assert(sampled[0].ApproximateKeys, Equals, int64(30))
+	c.Assert(sampled[0].ApproximateSize, Equals, stats[0].ApproximateSize)
+	c.Assert(sampled[1].ApproximateKeys, Equals, int64(10))
+	// The parent's stats are stale, the large region is at least as large as its sample.
+	sampled, err = estimateSplitStats(store.MvccStore.db, regions, 0, 0, 20)
+	c.Assert(err, IsNil)
+	c.Assert(sampled[0].ApproximateKeys, Equals, int64(20))
+}
+
+func (s *testServerSuite) TestPauseGC(c *C) {
+	store, err := NewTestStore("TestPauseGC", "TestPauseGC", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	conf := *store.MvccStore.conf
+	store.MvccStore.conf = &conf
+	rpcCtx := store.bootstrapRegion()
+
+	k := []byte("tk")
+	MustPrewritePut(k, k, []byte("v1"), 10, store)
+	MustCommit(k, 10, 11, store)
+	MustPrewritePut(k, k, []byte("v2"), 20, store)
+	MustCommit(k, 20, 21, store)
+
+	svr.PauseGC()
+	resp, err := svr.KvGC(context.Background(), &kvrpcpb.GCRequest{Context: rpcCtx, SafePoint: 15})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Error, IsNil)
+	store.MvccStore.UpdateSafePoint(25)
+	c.Assert(store.MvccStore.safePoint.getTS(), Equals, uint64(0))
+	MustGetVal(k, []byte("v1"), 12, store)
+	c.Assert(store.MvccStore.CheckReadTS(12), IsNil)
+
+	svr.ResumeGC()
+	c.Assert(store.MvccStore.safePoint.getTS(), Equals, uint64(25))
+	c.Assert(store.MvccStore.CheckReadTS(12), NotNil)
+
+	conf.GC.PausedPolicy = gcPausedReject
+	svr.PauseGC()
+	resp, err = svr.KvGC(context.Background(), &kvrpcpb.GCRequest{Context: rpcCtx, SafePoint: 30})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Error, NotNil)
+	c.Assert(resp.Error.Retryable, Not(Equals), "")
+	svr.ResumeGC()
+	c.Assert(store.MvccStore.safePoint.getTS(), Equals, uint64(25))
+	resp, err = svr.KvGC(context.Background(), &kvrpcpb.GCRequest{Context: rpcCtx, SafePoint: 30})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Error, IsNil)
+	c.Assert(store.MvccStore.safePoint.getTS(), Equals, uint64(30))
+}
+
+func (s *testServerSuite) TestRegionAccessTime(c *C) {
+	store, err := NewTestStore("TestRegionAccessTime", "TestRegionAccessTime", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	leftCtx := store.bootstrapRegion()
+	rightCtx := store.splitRegion(leftCtx.RegionId, []byte("tm"))
+	leftCtx = store.regionRPCCtx(leftCtx.RegionId)
+	rm := store.RegionManager
+
+	_, rightAccess, err := rm.GetRegionAccessTime(rightCtx.RegionId)
+	c.Assert(err, IsNil)
+	time.Sleep(100 * time.Millisecond)
+	_, err = store.Svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: leftCtx, Key: []byte("ta"), Version: 1})
+	c.Assert(err, IsNil)
+
+	leftCreate, leftAccess, err := rm.GetRegionAccessTime(leftCtx.RegionId)
+	c.Assert(err, IsNil)
+	c.Assert(leftAccess.Sub(leftCreate) >= 100*time.Millisecond, IsTrue)
+	_, rightAccess2, err := rm.GetRegionAccessTime(rightCtx.RegionId)
+	c.Assert(err, IsNil)
+	c.Assert(rightAccess2, Equals, rightAccess)
+	c.Assert(rm.IdleRegions(50*time.Millisecond), DeepEquals, []uint64{rightCtx.RegionId})
+
+	_, _, err = rm.GetRegionAccessTime(rightCtx.RegionId + 100)
+	c.Assert(err, NotNil)
+}
+
+func (s *testServerSuite) TestUninitializedRegion(c *C) {
+	store, err := NewTestStore("TestUninitializedRegion", "TestUninitializedRegion", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	initializedCtx := store.bootstrapRegion()
+
+	// A region created by a raft message has no peers and range until the snapshot is applied.
+	rm := store.RegionManager
+	regionID := rm.AllocID()
+	uninitialized := newRegionCtx(&metapb.Region{Id: regionID, RegionEpoch: &metapb.RegionEpoch{}}, rm.latches, nil)
+	rm.mu.Lock()
+	rm.regions[regionID] = uninitialized
+	rm.mu.Unlock()
+
+	rpcCtx := &kvrpcpb.Context{RegionId: regionID, RegionEpoch: &metapb.RegionEpoch{}}
+	getResp, err := store.Svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte("ta"), Version: 1})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.RegionError, NotNil)
+	c.Assert(getResp.RegionError.RegionNotFound, NotNil)
+	c.Assert(strings.Contains(getResp.RegionError.Message, "not initialized"), IsTrue)
+
+	getResp, err = store.Svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: initializedCtx, Key: []byte("ta"), Version: 1})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.RegionError, IsNil)
+}
+
+func (s *testServerSuite) TestServerStats(c *C) {
+	store, err := NewTestStore("TestServerStats", "TestServerStats", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	leftCtx := store.bootstrapRegion()
+	rightCtx := store.splitRegion(leftCtx.RegionId, []byte("tm"))
+	leftCtx = store.regionRPCCtx(leftCtx.RegionId)
+
+	stats := svr.Stats()
+	c.Assert(stats.InFlightRequests, Equals, 0)
+	c.Assert(stats.RegionsWithLocks, Equals, 0)
+
+	_, err = svr.KvPrewrite(context.Background(), kvPrewriteReq(rightCtx, []byte("tx"), []byte("v"), 10))
+	c.Assert(err, IsNil)
+	c.Assert(svr.Stats().RegionsWithLocks, Equals, 1)
+
+	// Block the readers so the requests stay in flight.
+	limiter := newSlotLimiter(1, time.Second)
+	svr.readerLimiter = limiter
+	holder, err := newRequestCtx(context.Background(), svr, leftCtx, "holder")
+	c.Assert(err, IsNil)
+	c.Assert(holder.acquireReaderSlot(), IsNil)
+	const concurrency = 5
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: leftCtx, Key: []byte("ta"), Version: 20})
+		}()
+	}
+	for atomic.LoadInt32(&limiter.waiting) < concurrency {
+		time.Sleep(time.Millisecond)
+	}
+	stats = svr.Stats()
+	c.Assert(stats.InFlightRequests, Equals, concurrency+1)
+	c.Assert(stats.ReaderQueueDepth, Equals, concurrency)
+	holder.finish()
+	wg.Wait()
+	stats = svr.Stats()
+	c.Assert(stats.InFlightRequests, Equals, 0)
+	c.Assert(stats.ReaderQueueDepth, Equals, 0)
+}
+
+func (s *testServerSuite) TestServerStatsLockCount(c *C) {
+	store, err := NewTestStore("TestServerStatsLockCount", "TestServerStatsLockCount", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	leftCtx := store.bootstrapRegion()
+	_, err = svr.KvPrewrite(context.Background(), kvPrewriteReq(leftCtx, []byte("tx"), []byte("v"), 10))
+	c.Assert(err, IsNil)
+
+	// The test store writes through the raft writer, switch to the stand-alone writer to count the locks.
+	bundle := &mvcc.DBBundle{DB: store.MvccStore.db, LockStore: store.MvccStore.lockStore}
+	writer := NewDBWriter(&config.DefaultConf, bundle, nil)
+	writer.Open()
+	defer writer.Close()
+	store.MvccStore.flowController.DBWriter = writer
+	svr.startLockCounting()
+	c.Assert(svr.lockCounting, IsTrue)
+	c.Assert(svr.Stats().RegionsWithLocks, Equals, 1)
+
+	// The split counts the locks of the new regions.
+	rightCtx := store.splitRegion(leftCtx.RegionId, []byte("tm"))
+	leftCtx = store.regionRPCCtx(leftCtx.RegionId)
+	c.Assert(svr.Stats().RegionsWithLocks, Equals, 1)
+	_, err = svr.KvPrewrite(context.Background(), kvPrewriteReq(leftCtx, []byte("ta"), []byte("v"), 20))
+	c.Assert(err, IsNil)
+	c.Assert(svr.Stats().RegionsWithLocks, Equals, 2)
+
+	commitResp, err := svr.KvCommit(context.Background(), &kvrpcpb.CommitRequest{
+		Context: rightCtx, Keys: [][]byte{[]byte("tx")}, StartVersion: 10, CommitVersion: 11,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(commitResp.Error, IsNil)
+	c.Assert(svr.Stats().RegionsWithLocks, Equals, 1)
+	commitResp, err = svr.KvCommit(context.Background(), &kvrpcpb.CommitRequest{
+		Context: leftCtx, Keys: [][]byte{[]byte("ta")}, StartVersion: 20, CommitVersion: 21,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(commitResp.Error, IsNil)
+	c.Assert(svr.Stats().RegionsWithLocks, Equals, 0)
+}
+
+func (s *testServerSuite) TestRequestDeadline(c *C) {
+	store, err := NewTestStore("TestRequestDeadline", "TestRequestDeadline", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	start := time.Now()
+	getResp, err := svr.KvGet(ctx, &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte("ta"), Version: 10})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.RegionError, NotNil)
+	c.Assert(strings.Contains(getResp.RegionError.Message, "deadline exceeded"), IsTrue)
+	prewriteResp, err := svr.KvPrewrite(ctx, kvPrewriteReq(rpcCtx, []byte("ta"), []byte("v"), 10))
+	c.Assert(err, IsNil)
+	c.Assert(prewriteResp.RegionError, NotNil)
+	c.Assert(strings.Contains(prewriteResp.RegionError.Message, "deadline exceeded"), IsTrue)
+	c.Assert(time.Since(start) < time.Second, IsTrue)
+
+	// Nothing is written by the expired request.
+	prewriteResp, err = svr.KvPrewrite(context.Background(), kvPrewriteReq(rpcCtx, []byte("ta"), []byte("v"), 20))
+	c.Assert(err, IsNil)
+	c.Assert(prewriteResp.RegionError, IsNil)
+	c.Assert(prewriteResp.Errors, HasLen, 0)
+}
+
+func (s *testServerSuite) TestRawIncrement(c *C) {
+	store, err := NewTestStore("TestRawIncrement", "TestRawIncrement", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+
+	// The key is created with the delta.
+	val, regErr, err := svr.RawIncrement(context.Background(), rpcCtx, []byte("ta"), 5)
+	c.Assert(err, IsNil)
+	c.Assert(regErr, IsNil)
+	c.Assert(val, Equals, int64(5))
+	val, _, err = svr.RawIncrement(context.Background(), rpcCtx, []byte("ta"), -7)
+	c.Assert(err, IsNil)
+	c.Assert(val, Equals, int64(-2))
+	getResp, err := svr.RawGet(context.Background(), &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("ta")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, BytesEquals, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe})
+
+	// Non-integer values can't be incremented.
+	_, err = svr.RawPut(context.Background(), &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte("tb"), Value: []byte("v")})
+	c.Assert(err, IsNil)
+	_, _, err = svr.RawIncrement(context.Background(), rpcCtx, []byte("tb"), 1)
+	c.Assert(err, NotNil)
+
+	const concurrency, increments = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				_, _, err := svr.RawIncrement(context.Background(), rpcCtx, []byte("tc"), 1)
+				c.Check(err, IsNil)
+			}
+		}()
+	}
+	wg.Wait()
+	val, _, err = svr.RawIncrement(context.Background(), rpcCtx, []byte("tc"), 0)
+	c.Assert(err, IsNil)
+	c.Assert(val, Equals, int64(concurrency*increments))
+}
+
+func (s *testServerSuite) TestRegionDataVersion(c *C) {
+	store, err := NewTestStore("TestRegionDataVersion", "TestRegionDataVersion", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	rm := store.RegionManager
+
+	v0, err := rm.RegionDataVersion(rpcCtx.RegionId)
+	c.Assert(err, IsNil)
+	_, err = svr.KvPrewrite(context.Background(), kvPrewriteReq(rpcCtx, []byte("ta"), []byte("v"), 10))
+	c.Assert(err, IsNil)
+	_, err = svr.KvPrewrite(context.Background(), kvPrewriteReq(rpcCtx, []byte("tb"), []byte("v"), 10))
+	c.Assert(err, IsNil)
+	// Prewrite doesn't change the committed data.
+	v1, err := rm.RegionDataVersion(rpcCtx.RegionId)
+	c.Assert(err, IsNil)
+	c.Assert(v1, Equals, v0)
+
+	commitResp, err := svr.KvCommit(context.Background(), &kvrpcpb.CommitRequest{
+		Context: rpcCtx, Keys: [][]byte{[]byte("ta")}, StartVersion: 10, CommitVersion: 11,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(commitResp.Error, IsNil)
+	v2, err := rm.RegionDataVersion(rpcCtx.RegionId)
+	c.Assert(err, IsNil)
+	c.Assert(v2 > v1, IsTrue)
+
+	rollbackResp, err := svr.KvBatchRollback(context.Background(), &kvrpcpb.BatchRollbackRequest{
+		Context: rpcCtx, Keys: [][]byte{[]byte("tb")}, StartVersion: 10,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(rollbackResp.Error, IsNil)
+	v3, err := rm.RegionDataVersion(rpcCtx.RegionId)
+	c.Assert(err, IsNil)
+	c.Assert(v3 > v2, IsTrue)
+
+	_, err = rm.RegionDataVersion(rpcCtx.RegionId + 100)
+	c.Assert(err, NotNil)
+}
+
+func (s *testServerSuite) TestCopCache(c *C) {
+	store, err := NewTestStore("TestCopCache", "TestCopCache", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	ctx := context.Background()
+
+	version, err := store.RegionManager.RegionDataVersion(rpcCtx.RegionId)
+	c.Assert(err, IsNil)
+	copReq := func(startTS, cacheVersion uint64) *coprocessor.Request {
+		return &coprocessor.Request{
+			Context: rpcCtx, StartTs: startTS, Ranges: []*coprocessor.KeyRange{{Start: []byte("t"), End: []byte("u")}},
+			IsCacheEnabled: true, CacheIfMatchVersion: cacheVersion,
+		}
+	}
+	resp, err := svr.Coprocessor(ctx, copReq(20, version))
+	c.Assert(err, IsNil)
+	c.Assert(resp.IsCacheHit, IsTrue)
+	c.Assert(resp.CanBeCached, IsTrue)
+	c.Assert(resp.CacheLastVersion, Equals, version)
+
+	// A lock visible to the request invalidates the cached result.
+	_, err = svr.KvPrewrite(ctx, kvPrewriteReq(rpcCtx, []byte("ta"), []byte("v"), 10))
+	c.Assert(err, IsNil)
+	resp, err = svr.Coprocessor(ctx, copReq(20, version))
+	c.Assert(err, IsNil)
+	c.Assert(resp.IsCacheHit, IsFalse)
+	resp, err = svr.Coprocessor(ctx, copReq(5, version))
+	c.Assert(err, IsNil)
+	c.Assert(resp.IsCacheHit, IsTrue)
+
+	commitResp, err := svr.KvCommit(ctx, &kvrpcpb.CommitRequest{
+		Context: rpcCtx, Keys: [][]byte{[]byte("ta")}, StartVersion: 10, CommitVersion: 11,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(commitResp.Error, IsNil)
+	resp, err = svr.Coprocessor(ctx, copReq(20, version))
+	c.Assert(err, IsNil)
+	c.Assert(resp.IsCacheHit, IsFalse)
+	c.Assert(resp.CacheLastVersion > version, IsTrue)
+	// The request without a cached result never hits.
+	resp, err = svr.Coprocessor(ctx, copReq(20, 0))
+	c.Assert(err, IsNil)
+	c.Assert(resp.IsCacheHit, IsFalse)
+}
+
+func (s *testServerSuite) TestScanEpochChange(c *C) {
+	store, err := NewTestStore("TestScanEpochChange", "TestScanEpochChange", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	keys := [][]byte{[]byte("ta"), []byte("tb"), []byte("tc"), []byte("td"), []byte("te"), []byte("tf")}
+	for _, key := range keys {
+		MustPrewritePut(key, key, []byte("v"), 10, store)
+		MustCommit(key, 10, 11, store)
+	}
+	// A lock after the split point of the scan is not returned with the partial result.
+	MustPrewritePut([]byte("te"), []byte("te"), []byte("v"), 20, store)
+
+	reqCtx, err := newRequestCtx(context.Background(), svr, rpcCtx, "KvScan")
+	c.Assert(err, IsNil)
+	defer reqCtx.finish()
+	// Split the region before the epoch is checked for the first time.
+	var split bool
+	reqCtx.getDBReader().SetRangeChecker(3, func() error {
+		if !split {
+			split = true
+			store.splitRegion(rpcCtx.RegionId, []byte("tm"))
+		}
+		return reqCtx.checkEpoch()
+	})
+	pairs := svr.mvccStore.Scan(reqCtx, &kvrpcpb.ScanRequest{Context: rpcCtx, StartKey: []byte("ta"), Limit: 100, Version: 30})
+	c.Assert(reqCtx.regErr, NotNil)
+	c.Assert(reqCtx.regErr.EpochNotMatch, NotNil)
+	c.Assert(pairs, HasLen, 3)
+	for i, pair := range pairs {
+		c.Assert(pair.Error, IsNil)
+		c.Assert(pair.Key, BytesEquals, keys[i])
+	}
+
+	// The scan of the stale region is rejected at the start.
+	resp, err := svr.KvScan(context.Background(), &kvrpcpb.ScanRequest{Context: rpcCtx, StartKey: []byte("ta"), Limit: 100, Version: 30})
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, NotNil)
+	c.Assert(resp.Pairs, HasLen, 0)
+}
+
+func (s *testServerSuite) TestScanRange(c *C) {
+	store, err := NewTestStore("TestScanRange", "TestScanRange", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	for _, key := range []string{"ta", "tb", "tc", "td", "te", "tf"} {
+		MustPrewritePut([]byte(key), []byte(key), []byte("v"), 10, store)
+		MustCommit([]byte(key), 10, 11, store)
+	}
+	rightCtx := store.splitRegion(rpcCtx.RegionId, []byte("td"))
+	leftCtx := store.regionRPCCtx(rpcCtx.RegionId)
+	scan := func(rpcCtx *kvrpcpb.Context, start, end string, reverse bool) []string {
+		resp, err := svr.KvScan(context.Background(), &kvrpcpb.ScanRequest{Context: rpcCtx, StartKey: []byte(start),
+			EndKey: []byte(end), Limit: 100, Version: 20, Reverse: reverse})
+		c.Assert(err, IsNil)
+		c.Assert(resp.RegionError, IsNil)
+		var keys []string
+		for _, pair := range resp.Pairs {
+			c.Assert(pair.Error, IsNil)
+			keys = append(keys, string(pair.Key))
+		}
+		return keys
+	}
+
+	c.Assert(scan(leftCtx, "ta", "tc", false), DeepEquals, []string{"ta", "tb"})
+	// The end key is clamped to the region.
+	c.Assert(scan(leftCtx, "tb", "tz", false), DeepEquals, []string{"tb", "tc"})
+	c.Assert(scan(leftCtx, "tb", "", false), DeepEquals, []string{"tb", "tc"})
+	c.Assert(scan(rightCtx, "tb", "te", false), DeepEquals, []string{"td"})
+	// The reverse scan reads [EndKey, StartKey) backwards.
+	c.Assert(scan(rightCtx, "tf", "td", true), DeepEquals, []string{"te", "td"})
+	c.Assert(scan(rightCtx, "", "", true), DeepEquals, []string{"tf", "te", "td"})
+	c.Assert(scan(leftCtx, "tz", "", true), DeepEquals, []string{"tc", "tb", "ta"})
+
+	// The values are omitted by key_only.
+	for _, req := range []*kvrpcpb.ScanRequest{
+		{StartKey: []byte("ta"), EndKey: []byte("tc")},
+		{StartKey: []byte("tc"), EndKey: []byte("ta"), Reverse: true},
+	} {
+		req.Context, req.Limit, req.Version, req.KeyOnly = leftCtx, 100, 20, true
+		resp, err := svr.KvScan(context.Background(), req)
+		c.Assert(err, IsNil)
+		c.Assert(resp.Pairs, HasLen, 2)
+		for _, pair := range resp.Pairs {
+			c.Assert(pair.Error, IsNil)
+			c.Assert(pair.Value, HasLen, 0)
+		}
+	}
+}
+
+func (s *testServerSuite) TestExecDetails(c *C) {
+	store, err := NewTestStore("TestExecDetails", "TestExecDetails", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	MustPrewritePut([]byte("ta"), []byte("ta"), []byte("v"), 10, store)
+	MustCommit([]byte("ta"), 10, 11, store)
+	MustPrewriteDelete([]byte("tb"), []byte("tb"), 12, store)
+	MustCommit([]byte("tb"), 12, 13, store)
+
+	getResp, err := svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte("ta"), Version: 20})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.ExecDetailsV2.TimeDetail, NotNil)
+	c.Assert(getResp.ExecDetailsV2.ScanDetailV2.TotalVersions, Equals, uint64(1))
+	c.Assert(getResp.ExecDetailsV2.ScanDetailV2.ProcessedVersions, Equals, uint64(1))
+
+	// The deleted key is scanned but not processed, the missing key is neither.
+	batchResp, err := svr.KvBatchGet(context.Background(), &kvrpcpb.BatchGetRequest{Context: rpcCtx,
+		Keys: [][]byte{[]byte("ta"), []byte("tb"), []byte("tc")}, Version: 20})
+	c.Assert(err, IsNil)
+	c.Assert(batchResp.ExecDetailsV2.ScanDetailV2.TotalVersions, Equals, uint64(2))
+	c.Assert(batchResp.ExecDetailsV2.ScanDetailV2.ProcessedVersions, Equals, uint64(1))
+}
+
+type recordingSink struct {
+	mu     sync.Mutex
+	events []*ChangeEvent
+	// block blocks Send until it's closed.
+	block chan struct{}
+}
+
+func (s *recordingSink) Send(ev *ChangeEvent) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	s.events = append(s.events, ev)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *recordingSink) recorded() []*ChangeEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*ChangeEvent{}, s.events...)
+}
+
+// waitRecorded waits until n events are recorded or a second passes.
+func (s *recordingSink) waitRecorded(n int) []*ChangeEvent {
+	for i := 0; i < 100 && len(s.recorded()) < n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s.recorded()
+}
+
+func (s *testServerSuite) TestChangeSink(c *C) {
+	store, err := NewTestStore("TestChangeSink", "TestChangeSink", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	conf := *store.MvccStore.conf
+	store.MvccStore.conf = &conf
+
+	sink := &recordingSink{}
+	svr.SetChangeSink(sink)
+	k1, k2 := []byte("ta"), []byte("tb")
+	MustPrewritePut(k1, k1, []byte("v1"), 10, store)
+	MustPrewritePut(k1, k2, []byte("v2"), 10, store)
+	c.Assert(store.MvccStore.Commit(store.newReqCtx(), [][]byte{k1, k2}, 10, 11), IsNil)
+	MustPrewriteDelete(k2, k2, 20, store)
+	MustCommit(k2, 20, 21, store)
+	// Locks don't change the data.
+	MustPrewriteLock(k1, k1, 30, store)
+	MustCommit(k1, 30, 31, store)
+	MustPrewritePut(k1, k1, []byte("v3"), 40, store)
+	MustCommit(k1, 40, 41, store)
+
+	expected := []*ChangeEvent{
+		{RegionID: 1, Key: k1, Value: []byte("v1"), Op: kvrpcpb.Op_Put, StartTS: 10, CommitTS: 11},
+		{RegionID: 1, Key: k2, Value: []byte("v2"), Op: kvrpcpb.Op_Put, StartTS: 10, CommitTS: 11},
+		{RegionID: 1, Key: k2, Op: kvrpcpb.Op_Del, StartTS: 20, CommitTS: 21},
+		{RegionID: 1, Key: k1, Value: []byte("v3"), Op: kvrpcpb.Op_Put, StartTS: 40, CommitTS: 41},
+	}
+	c.Assert(sink.waitRecorded(len(expected)), DeepEquals, expected)
+
+	// The events are dropped when the buffer of a slow sink is full.
+	conf.Server.ChangeBufferSize = 1
+	conf.Server.ChangeOverflowPolicy = changeOverflowDrop
+	slowSink := &recordingSink{block: make(chan struct{})}
+	svr.SetChangeSink(slowSink)
+	keys := [][]byte{[]byte("tc"), []byte("td"), []byte("te")}
+	for _, key := range keys {
+		MustPrewritePut(keys[0], key, []byte("v"), 50, store)
+	}
+	c.Assert(store.MvccStore.Commit(store.newReqCtx(), keys, 50, 51), IsNil)
+	close(slowSink.block)
+	dropped := svr.DroppedChangeEvents()
+	c.Assert(dropped > 0, IsTrue)
+	svr.SetChangeSink(nil)
+	c.Assert(int64(len(slowSink.recorded()))+dropped, Equals, int64(len(keys)))
+}
+
+func (s *testServerSuite) TestChangeSinkWritePaths(c *C) {
+	store, err := NewTestStore("TestChangeSinkWritePaths", "TestChangeSinkWritePaths", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	ctx := context.Background()
+	sink := &recordingSink{}
+	svr.SetChangeSink(sink)
+
+	// The changes are captured by the writer, so every path writing the data publishes them.
+	ops := []BatchOp{{Type: BatchOpPut, Key: []byte("ta"), Value: []byte("va")}, {Type: BatchOpDelete, Key: []byte("tb")}}
+	c.Assert(store.MvccStore.ApplyBatch(store.newReqCtx(), 10, 11, ops), IsNil)
+	MustPrewritePut([]byte("tc"), []byte("tc"), []byte("vc"), 20, store)
+	locks, err := store.MvccStore.ScanLock(store.newReqCtx(), nil, 30, 10)
+	c.Assert(err, IsNil)
+	c.Assert(locks, HasLen, 1)
+	c.Assert(store.MvccStore.ResolveLockWithInfo(store.newReqCtx(), locks[0], 21), IsNil)
+	importResp, err := svr.KvImport(ctx, &kvrpcpb.ImportRequest{
+		Mutations:     []*kvrpcpb.Mutation{newMutation(kvrpcpb.Op_Put, []byte("td"), []byte("vd"))},
+		CommitVersion: 30,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(importResp.Error, Equals, "")
+	putResp, err := svr.RawPut(ctx, &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte("te"), Value: []byte("raw")})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, "")
+	_, regErr, err := svr.RawIncrement(ctx, rpcCtx, []byte("tf"), 1)
+	c.Assert(err, IsNil)
+	c.Assert(regErr, IsNil)
+
+	expected := []*ChangeEvent{
+		{RegionID: 1, Key: []byte("ta"), Value: []byte("va"), Op: kvrpcpb.Op_Put, StartTS: 10, CommitTS: 11},
+		{RegionID: 1, Key: []byte("tb"), Op: kvrpcpb.Op_Del, StartTS: 10, CommitTS: 11},
+		{RegionID: 1, Key: []byte("tc"), Value: []byte("vc"), Op: kvrpcpb.Op_Put, StartTS: 20, CommitTS: 21},
+		{RegionID: 2, Key: []byte("td"), Value: []byte("vd"), Op: kvrpcpb.Op_Put, StartTS: 29, CommitTS: 30},
+		{RegionID: 2, Key: []byte("te"), Value: []byte("raw"), Op: kvrpcpb.Op_Put, Raw: true},
+		{RegionID: 2, Key: []byte("tf"), Value: []byte{0, 0, 0, 0, 0, 0, 0, 1}, Op: kvrpcpb.Op_Put, Raw: true},
+	}
+	recorded := sink.waitRecorded(len(expected))
+	c.Assert(recorded, HasLen, len(expected))
+	for _, ev := range recorded {
+		// The versions of the raw writes are taken from the clock.
+		if ev.Raw {
+			c.Assert(ev.CommitTS > 0, IsTrue)
+			ev.CommitTS = 0
+		}
+	}
+	c.Assert(recorded, DeepEquals, expected)
+}
+
+// cancelOnDecodeCodec calls cancel once when the first value is decoded, it's used to cancel a running scan.
+type cancelOnDecodeCodec struct {
+	cancel func()
+}
+
+func (h *cancelOnDecodeCodec) Encode(value []byte) []byte {
+	return value
+}
+
+func (h *cancelOnDecodeCodec) Decode(stored []byte) ([]byte, error) {
+	if h.cancel != nil {
+		h.cancel()
+		h.cancel = nil
+	}
+	return stored, nil
+}
+
+func (s *testServerSuite) TestCancelRequest(c *C) {
+	store, err := NewTestStore("TestCancelRequest", "TestCancelRequest", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	svr.scanEpochCheckKeys = 4
+	codec := &cancelOnDecodeCodec{}
+	store.MvccStore.SetValueCodec(codec)
+	var pairs []string
+	for i := 0; i < 100; i++ {
+		pairs = append(pairs, fmt.Sprintf("t%03d:v", i))
+	}
+	MustLoad(10, 11, store, pairs...)
+
+	cancelled := -1
+	codec.cancel = func() {
+		cancelled = svr.CancelRequest("long-scan")
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(traceIDMetadataKey, "long-scan"))
+	resp, err := svr.KvScan(ctx, &kvrpcpb.ScanRequest{Context: rpcCtx, StartKey: []byte("t"), Limit: 1000, Version: 20})
+	c.Assert(err, IsNil)
+	c.Assert(cancelled, Equals, 1)
+	// The scan stops at the next check instead of reading all the keys.
+	c.Assert(resp.Pairs, HasLen, 1)
+	c.Assert(resp.Pairs[0].Error, NotNil)
+	c.Assert(resp.Pairs[0].Error.Abort, Equals, ErrRequestCanceled.Error())
+	// The finished request is no longer tracked.
+	c.Assert(svr.CancelRequest("long-scan"), Equals, 0)
+
+	// Other requests are not affected.
+	resp, err = svr.KvScan(context.Background(), &kvrpcpb.ScanRequest{Context: rpcCtx, StartKey: []byte("t"), Limit: 1000, Version: 20})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Pairs, HasLen, 100)
+
+	// The cancellation is checked even if the epoch is checked rarely.
+	svr.scanEpochCheckKeys = 100000
+	pairs = pairs[:0]
+	for i := 100; i < 4*contextCheckKeys; i++ {
+		pairs = append(pairs, fmt.Sprintf("t%03d:v", i))
+	}
+	MustLoad(10, 11, store, pairs...)
+	codec.cancel = func() {
+		cancelled = svr.CancelRequest("long-scan")
+	}
+	resp, err = svr.KvScan(ctx, &kvrpcpb.ScanRequest{Context: rpcCtx, StartKey: []byte("t"), Limit: 10000, Version: 20})
+	c.Assert(err, IsNil)
+	c.Assert(cancelled, Equals, 1)
+	c.Assert(len(resp.Pairs) <= contextCheckKeys, IsTrue)
+	lastPair := resp.Pairs[len(resp.Pairs)-1]
+	c.Assert(lastPair.Error, NotNil)
+	c.Assert(lastPair.Error.Abort, Equals, ErrRequestCanceled.Error())
+}
+
+func (s *testServerSuite) TestReplicaRead(c *C) {
+	store, err := NewTestStore("TestReplicaRead", "TestReplicaRead", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	MustLoad(10, 20, store, "ta:a1")
+	store.RegionManager.AddStore(4, "127.0.0.1:10087")
+	store.RegionManager.AddPeer(rpcCtx.RegionId, 4, 5)
+	leaderCtx := store.regionRPCCtx(rpcCtx.RegionId)
+	followerCtx := *leaderCtx
+	followerCtx.Peer = &metapb.Peer{Id: 5, StoreId: 4}
+
+	// The follower rejects the normal reads with the leader.
+	resp, err := svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: &followerCtx, Key: []byte("ta"), Version: 30})
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError.GetNotLeader(), NotNil)
+	c.Assert(resp.RegionError.GetNotLeader().Leader.Id, Equals, leaderCtx.Peer.Id)
+
+	followerCtx.ReplicaRead = true
+	resp, err = svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: &followerCtx, Key: []byte("ta"), Version: 30})
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, IsNil)
+	c.Assert(resp.Value, BytesEquals, []byte("a1"))
+
+	resp, err = svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: leaderCtx, Key: []byte("ta"), Version: 30})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Value, BytesEquals, []byte("a1"))
+}
+
+func (s *testServerSuite) TestStaleRead(c *C) {
+	store, err := NewTestStore("TestStaleRead", "TestStaleRead", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	disableAdvanceTS(svr)
+	rpcCtx := store.bootstrapRegion()
+	MustLoad(10, 20, store, "ta:a1")
+	store.RegionManager.AddStore(4, "127.0.0.1:10087")
+	store.RegionManager.AddPeer(rpcCtx.RegionId, 4, 5)
+	followerCtx := *store.regionRPCCtx(rpcCtx.RegionId)
+	followerCtx.Peer = &metapb.Peer{Id: 5, StoreId: 4}
+	followerCtx.StaleRead = true
+	c.Assert(store.RegionManager.pinResolvedTS(rpcCtx.RegionId, 30), IsNil)
+
+	// The stale read is served by the follower if the read ts is not above the resolved ts.
+	resp, err := svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: &followerCtx, Key: []byte("ta"), Version: 30})
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, IsNil)
+	c.Assert(resp.Value, BytesEquals, []byte("a1"))
+	batchResp, err := svr.KvBatchGet(context.Background(), &kvrpcpb.BatchGetRequest{Context: &followerCtx,
+		Keys: [][]byte{[]byte("ta")}, Version: 15})
+	c.Assert(err, IsNil)
+	c.Assert(batchResp.RegionError, IsNil)
+	c.Assert(batchResp.Pairs, HasLen, 0)
+
+	resp, err = svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: &followerCtx, Key: []byte("ta"), Version: 31})
+	c.Assert(err, IsNil)
+	notReady := resp.RegionError.GetDataIsNotReady()
+	c.Assert(notReady, NotNil)
+	c.Assert(notReady.RegionId, Equals, rpcCtx.RegionId)
+	c.Assert(notReady.PeerId, Equals, uint64(5))
+	c.Assert(notReady.SafeTs, Equals, uint64(30))
+	scanResp, err := svr.KvScan(context.Background(), &kvrpcpb.ScanRequest{Context: &followerCtx,
+		StartKey: []byte("t"), Limit: 10, Version: 31})
+	c.Assert(err, IsNil)
+	c.Assert(scanResp.RegionError.GetDataIsNotReady(), NotNil)
+
+	// The normal reads at the same ts are not limited by the resolved ts.
+	resp, err = svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte("ta"), Version: 31})
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, IsNil)
+	c.Assert(resp.Value, BytesEquals, []byte("a1"))
+}
+
+func (s *testServerSuite) TestReadIndex(c *C) {
+	store, err := NewTestStore("TestReadIndex", "TestReadIndex", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	MustPrewritePut([]byte("ta"), []byte("ta"), []byte("a1"), 30, store)
+	ranges := []*kvrpcpb.KeyRange{{StartKey: []byte("t"), EndKey: []byte("u")}}
+
+	resp, err := svr.ReadIndex(context.Background(), &kvrpcpb.ReadIndexRequest{Context: rpcCtx, StartTs: 20, Ranges: ranges})
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, IsNil)
+	c.Assert(resp.Locked, IsNil)
+	index := resp.ReadIndex
+
+	// The lock is visible to the start ts.
+	resp, err = svr.ReadIndex(context.Background(), &kvrpcpb.ReadIndexRequest{Context: rpcCtx, StartTs: 40, Ranges: ranges})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Locked, NotNil)
+	c.Assert(resp.Locked.LockVersion, Equals, uint64(30))
+
+	// The index advances after the commit.
+	commitResp, err := svr.KvCommit(context.Background(), &kvrpcpb.CommitRequest{Context: rpcCtx,
+		Keys: [][]byte{[]byte("ta")}, StartVersion: 30, CommitVersion: 35})
+	c.Assert(err, IsNil)
+	c.Assert(commitResp.Error, IsNil)
+	resp, err = svr.ReadIndex(context.Background(), &kvrpcpb.ReadIndexRequest{Context: rpcCtx, StartTs: 40, Ranges: ranges})
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, IsNil)
+	c.Assert(resp.Locked, IsNil)
+	c.Assert(resp.ReadIndex > index, IsTrue)
+}
+
+type mockEventFeedServer struct {
+	grpc.ServerStream
+	reqs   chan *cdcpb.ChangeDataRequest
+	events chan *cdcpb.Event
+	// rows are the received rows not returned by nextRow.
+	rows []*cdcpb.Event_Row
+}
+
+func (s *mockEventFeedServer) Recv() (*cdcpb.ChangeDataRequest, error) {
+	req, ok := <-s.reqs
+	if !ok {
+		return nil, io.EOF
+	}
+	return req, nil
+}
+
+func (s *mockEventFeedServer) Send(resp *cdcpb.ChangeDataEvent) error {
+	for _, ev := range resp.Events {
+		s.events <- ev
+	}
+	return nil
+}
+
+func (s *mockEventFeedServer) Context() context.Context {
+	return context.Background()
+}
+
+// nextRow returns the next row of the event feed, the resolved ts events are skipped.
+func (s *mockEventFeedServer) nextRow(c *C) *cdcpb.Event_Row {
+	for len(s.rows) == 0 {
+		select {
+		case ev := <-s.events:
+			c.Assert(ev.GetError(), IsNil)
+			s.rows = ev.GetEntries().GetEntries()
+		case <-time.After(5 * time.Second):
+			c.Fatal("wait for the cdc event timeout")
+		}
+	}
+	row := s.rows[0]
+	s.rows = s.rows[1:]
+	return row
+}
+
+// waitResolvedTS waits for the resolved ts of the event feed to be at least ts.
+func (s *mockEventFeedServer) waitResolvedTS(c *C, ts uint64) uint64 {
+	for {
+		select {
+		case ev := <-s.events:
+			c.Assert(ev.GetEntries(), IsNil)
+			if ev.GetResolvedTs() >= ts {
+				return ev.GetResolvedTs()
+			}
+		case <-time.After(5 * time.Second):
+			c.Fatal("wait for the cdc resolved ts timeout")
+		}
+	}
+}
+
+func (s *testServerSuite) TestEventFeed(c *C) {
+	store, err := NewTestStore("TestEventFeed", "TestEventFeed", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	getTS := func() uint64 {
+		physical, logical, err := store.MvccStore.pdClient.GetTS(context.Background())
+		c.Assert(err, IsNil)
+		return uint64(physical)<<18 + uint64(logical)
+	}
+	MustLoad(10, 20, store, "ta:a1")
+
+	stream := &mockEventFeedServer{reqs: make(chan *cdcpb.ChangeDataRequest), events: make(chan *cdcpb.Event, 16)}
+	done := make(chan error, 1)
+	go func() { done <- svr.EventFeed(stream) }()
+	stream.reqs <- &cdcpb.ChangeDataRequest{RegionId: rpcCtx.RegionId, RegionEpoch: rpcCtx.RegionEpoch,
+		CheckpointTs: 15, RequestId: 1}
+
+	// The incremental scan sends the changes committed after the checkpoint ts.
+	row := stream.nextRow(c)
+	c.Assert(row.Type, Equals, cdcpb.Event_COMMITTED)
+	c.Assert(row.Key, BytesEquals, []byte("ta"))
+	c.Assert(row.Value, BytesEquals, []byte("a1"))
+	c.Assert(row.CommitTs, Equals, uint64(20))
+	c.Assert(stream.nextRow(c).Type, Equals, cdcpb.Event_INITIALIZED)
+
+	startTS := getTS()
+	prewriteResp, err := svr.KvPrewrite(context.Background(), kvPrewriteReq(rpcCtx, []byte("tb"), []byte("b1"), startTS))
+	c.Assert(err, IsNil)
+	c.Assert(prewriteResp.Errors, HasLen, 0)
+	row = stream.nextRow(c)
+	c.Assert(row.Type, Equals, cdcpb.Event_PREWRITE)
+	c.Assert(row.OpType, Equals, cdcpb.Event_Row_PUT)
+	c.Assert(row.StartTs, Equals, startTS)
+	c.Assert(row.Value, BytesEquals, []byte("b1"))
+
+	// The resolved ts doesn't pass the lock.
+	svr.advanceResolvedTS(getTS())
+	c.Assert(stream.waitResolvedTS(c, startTS), Equals, startTS)
+
+	commitTS := getTS()
+	commitResp, err := svr.KvCommit(context.Background(), &kvrpcpb.CommitRequest{Context: rpcCtx,
+		Keys: [][]byte{[]byte("tb")}, StartVersion: startTS, CommitVersion: commitTS})
+	c.Assert(err, IsNil)
+	c.Assert(commitResp.Error, IsNil)
+	row = stream.nextRow(c)
+	c.Assert(row.Type, Equals, cdcpb.Event_COMMIT)
+	c.Assert(row.Key, BytesEquals, []byte("tb"))
+	c.Assert(row.CommitTs, Equals, commitTS)
+	svr.advanceResolvedTS(getTS())
+	stream.waitResolvedTS(c, commitTS)
+
+	rollbackResp, err := svr.KvBatchRollback(context.Background(), &kvrpcpb.BatchRollbackRequest{Context: rpcCtx,
+		Keys: [][]byte{[]byte("tc")}, StartVersion: getTS()})
+	c.Assert(err, IsNil)
+	c.Assert(rollbackResp.Error, IsNil)
+	row = stream.nextRow(c)
+	c.Assert(row.Type, Equals, cdcpb.Event_ROLLBACK)
+	c.Assert(row.Key, BytesEquals, []byte("tc"))
+
+	// The subscription fails after the region is split.
+	store.splitRegion(rpcCtx.RegionId, []byte("tm"))
+	svr.advanceResolvedTS(getTS())
+	for {
+		ev := <-stream.events
+		if evErr := ev.GetError(); evErr != nil {
+			c.Assert(evErr.EpochNotMatch, NotNil)
+			break
+		}
+	}
+	observer := svr.mvccStore.cdcObserver
+	observer.mu.RLock()
+	c.Assert(observer.regions, HasLen, 0)
+	observer.mu.RUnlock()
+
+	close(stream.reqs)
+	c.Assert(<-done, IsNil)
+}
+
+func (s *testServerSuite) TestEventFeedCongested(c *C) {
+	store, err := NewTestStore("TestEventFeedCongested", "TestEventFeedCongested", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+
+	// The stream doesn't receive the events until the writes are done.
+	stream := &mockEventFeedServer{reqs: make(chan *cdcpb.ChangeDataRequest), events: make(chan *cdcpb.Event)}
+	done := make(chan error, 1)
+	go func() { done <- svr.EventFeed(stream) }()
+	stream.reqs <- &cdcpb.ChangeDataRequest{RegionId: rpcCtx.RegionId, RegionEpoch: rpcCtx.RegionEpoch, RequestId: 1}
+	c.Assert(stream.nextRow(c).Type, Equals, cdcpb.Event_INITIALIZED)
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for i := 0; i < cdcEventBufferSize+cdcMaxEventsPerResponse+10; i++ {
+			resp, err := svr.KvBatchRollback(context.Background(), &kvrpcpb.BatchRollbackRequest{Context: rpcCtx,
+				Keys: [][]byte{[]byte("ta")}, StartVersion: uint64(10 + i)})
+			c.Check(err, IsNil)
+			c.Check(resp.Error, IsNil)
+		}
+	}()
+	select {
+	case <-written:
+	case <-time.After(10 * time.Second):
+		c.Fatal("the writes are blocked by the congested stream")
+	}
+
+	// The congested stream fails and its subscriptions are removed.
+	for {
+		select {
+		case <-stream.events:
+			continue
+		case err = <-done:
+		}
+		break
+	}
+	c.Assert(err, Equals, ErrCDCCongested)
+	observer := svr.mvccStore.cdcObserver
+	observer.mu.RLock()
+	c.Assert(observer.regions, HasLen, 0)
+	observer.mu.RUnlock()
+	close(stream.reqs)
+}
+
+func (s *testServerSuite) TestGracefulStop(c *C) {
+	store, err := NewTestStore("TestGracefulStop", "TestGracefulStop", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	svr.conf.Server.ShutdownTimeout = "100ms"
+
+	// The in-flight request only finishes when it's cancelled.
+	reqCtx, err := newRequestCtx(context.Background(), svr, rpcCtx, "KvGet")
+	c.Assert(err, IsNil)
+	finished := make(chan struct{})
+	go func() {
+		<-reqCtx.ctx.Done()
+		reqCtx.finish()
+		close(finished)
+	}()
+	stopErr := make(chan error, 1)
+	go func() {
+		stopErr <- svr.Stop()
+	}()
+	select {
+	case <-finished:
+		c.Fatal("the request is cancelled before the timeout")
+	case <-time.After(30 * time.Millisecond):
+	}
+	// New requests are rejected while the server is stopping.
+	_, err = newRequestCtx(context.Background(), svr, rpcCtx, "KvGet")
+	c.Assert(err, NotNil)
+
+	c.Assert(<-stopErr, ErrorMatches, "shutdown timeout, 1 requests are cancelled")
+	<-finished
+	c.Assert(atomic.LoadInt32(&svr.refCount), Equals, int32(0))
+}
+
+func (s *testServerSuite) TestRawGetPutDelete(c *C) {
+	store, err := NewTestStore("TestRawGetPutDelete", "TestRawGetPutDelete", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	ctx := context.Background()
+
+	getResp, err := svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("ra")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, IsNil)
+	putResp, err := svr.RawPut(ctx, &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte("ra"), Value: []byte("v1")})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.RegionError, IsNil)
+	c.Assert(putResp.Error, Equals, "")
+	putResp, err = svr.RawPut(ctx, &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte("ra"), Value: []byte("v2")})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, "")
+	getResp, err = svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("ra")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, BytesEquals, []byte("v2"))
+	putResp, err = svr.RawPut(ctx, &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte("ra")})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, ErrRawEmptyValue.Error())
+
+	batchPutResp, err := svr.RawBatchPut(ctx, &kvrpcpb.RawBatchPutRequest{Context: rpcCtx, Pairs: []*kvrpcpb.KvPair{
+		{Key: []byte("rb"), Value: []byte("b")}, {Key: []byte("rc"), Value: []byte("c")},
+	}})
+	c.Assert(err, IsNil)
+	c.Assert(batchPutResp.Error, Equals, "")
+	batchGetResp, err := svr.RawBatchGet(ctx, &kvrpcpb.RawBatchGetRequest{Context: rpcCtx,
+		Keys: [][]byte{[]byte("ra"), []byte("rb"), []byte("rc"), []byte("rd")}})
+	c.Assert(err, IsNil)
+	c.Assert(batchGetResp.Pairs, HasLen, 3)
+
+	delResp, err := svr.RawDelete(ctx, &kvrpcpb.RawDeleteRequest{Context: rpcCtx, Key: []byte("ra")})
+	c.Assert(err, IsNil)
+	c.Assert(delResp.Error, Equals, "")
+	getResp, err = svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("ra")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, IsNil)
+	batchDelResp, err := svr.RawBatchDelete(ctx, &kvrpcpb.RawBatchDeleteRequest{Context: rpcCtx, Keys: [][]byte{[]byte("rb"), []byte("rc")}})
+	c.Assert(err, IsNil)
+	c.Assert(batchDelResp.Error, Equals, "")
+	batchGetResp, err = svr.RawBatchGet(ctx, &kvrpcpb.RawBatchGetRequest{Context: rpcCtx, Keys: [][]byte{[]byte("rb"), []byte("rc")}})
+	c.Assert(err, IsNil)
+	c.Assert(batchGetResp.Pairs, HasLen, 0)
+
+	// The raw writes are versions of their own, the stored data is consistent.
+	violations, err := store.MvccStore.Validate(store.RegionManager)
+	c.Assert(err, IsNil)
+	c.Assert(violations, HasLen, 0)
+
+	// The region epoch is checked like the transactional requests.
+	staleCtx := *rpcCtx
+	staleCtx.RegionEpoch = &metapb.RegionEpoch{ConfVer: rpcCtx.RegionEpoch.ConfVer, Version: rpcCtx.RegionEpoch.Version + 1}
+	putResp, err = svr.RawPut(ctx, &kvrpcpb.RawPutRequest{Context: &staleCtx, Key: []byte("ra"), Value: []byte("v")})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.RegionError, NotNil)
+	getResp, err = svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: &staleCtx, Key: []byte("ra")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.RegionError, NotNil)
+}
+
+func (s *testServerSuite) TestRawKeySpace(c *C) {
+	store, err := NewTestStore("TestRawKeySpace", "TestRawKeySpace", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	ctx := context.Background()
+
+	MustPrewritePut([]byte("ta"), []byte("ta"), []byte("txn"), 10, store)
+	MustCommit([]byte("ta"), 10, 11, store)
+	MustPrewritePut([]byte("tb"), []byte("tb"), []byte("txn"), 20, store)
+	putResp, err := svr.RawBatchPut(ctx, &kvrpcpb.RawBatchPutRequest{Context: rpcCtx, Pairs: []*kvrpcpb.KvPair{
+		{Key: []byte("ta"), Value: []byte("raw")}, {Key: []byte("tc"), Value: []byte("raw")},
+	}})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, "")
+
+	// The raw write ignores the lock of the transaction, and the keys are not shared by the two APIs.
+	putResp, err = svr.RawPut(ctx, &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte("tb"), Value: []byte("raw")})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, "")
+	MustGetVal([]byte("ta"), []byte("txn"), 30, store)
+	MustGetNone([]byte("tc"), 30, store)
+	MustCommit([]byte("tb"), 20, 21, store)
+	MustGetVal([]byte("tb"), []byte("txn"), 30, store)
+	getResp, err := svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("ta")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, BytesEquals, []byte("raw"))
+	scanResp, err := svr.RawScan(ctx, &kvrpcpb.RawScanRequest{Context: rpcCtx, StartKey: []byte("t"), Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(scanResp.Kvs), DeepEquals, []string{"ta", "tb", "tc"})
+	scanResp, err = svr.RawScan(ctx, &kvrpcpb.RawScanRequest{Context: rpcCtx, Limit: 10, Reverse: true})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(scanResp.Kvs), DeepEquals, []string{"tc", "tb", "ta"})
+
+	// The raw deletes don't delete the transactional keys either.
+	delResp, err := svr.RawBatchDelete(ctx, &kvrpcpb.RawBatchDeleteRequest{Context: rpcCtx, Keys: [][]byte{[]byte("ta"), []byte("tb")}})
+	c.Assert(err, IsNil)
+	c.Assert(delResp.Error, Equals, "")
+	MustGetVal([]byte("ta"), []byte("txn"), 30, store)
+	MustGetVal([]byte("tb"), []byte("txn"), 30, store)
+
+	// The raw keys are split with the region.
+	rightCtx := store.splitRegion(rpcCtx.RegionId, []byte("tc"))
+	scanResp, err = svr.RawScan(ctx, &kvrpcpb.RawScanRequest{Context: rightCtx, Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(scanResp.Kvs), DeepEquals, []string{"tc"})
+	scanResp, err = svr.RawScan(ctx, &kvrpcpb.RawScanRequest{Context: store.regionRPCCtx(rpcCtx.RegionId), Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(scanResp.Kvs, HasLen, 0)
+}
+
+func rawScanKeys(pairs []*kvrpcpb.KvPair) []string {
+	keys := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		keys = append(keys, string(pair.Key))
+	}
+	return keys
+}
+
+func (s *testServerSuite) TestRawScan(c *C) {
+	store, err := NewTestStore("TestRawScan", "TestRawScan", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	ctx := context.Background()
+
+	var pairs []*kvrpcpb.KvPair
+	for _, key := range []string{"ra", "rb", "rc", "rd", "re"} {
+		pairs = append(pairs, &kvrpcpb.KvPair{Key: []byte(key), Value: []byte("v" + key)})
+	}
+	putResp, err := svr.RawBatchPut(ctx, &kvrpcpb.RawBatchPutRequest{Context: rpcCtx, Pairs: pairs})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, "")
+	delResp, err := svr.RawDelete(ctx, &kvrpcpb.RawDeleteRequest{Context: rpcCtx, Key: []byte("rc")})
+	c.Assert(err, IsNil)
+	c.Assert(delResp.Error, Equals, "")
+
+	scanResp, err := svr.RawScan(ctx, &kvrpcpb.RawScanRequest{Context: rpcCtx, StartKey: []byte("rb"), Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(scanResp.Kvs), DeepEquals, []string{"rb", "rd", "re"})
+	c.Assert(scanResp.Kvs[0].Value, BytesEquals, []byte("vrb"))
+	scanResp, err = svr.RawScan(ctx, &kvrpcpb.RawScanRequest{Context: rpcCtx, StartKey: []byte("ra"), EndKey: []byte("re"), Limit: 2})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(scanResp.Kvs), DeepEquals, []string{"ra", "rb"})
+
+	// The reverse scan starts from the exclusive upper bound in StartKey.
+	scanResp, err = svr.RawScan(ctx, &kvrpcpb.RawScanRequest{Context: rpcCtx, StartKey: []byte("re"), EndKey: []byte("rb"), Limit: 10, Reverse: true})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(scanResp.Kvs), DeepEquals, []string{"rd", "rb"})
+	scanResp, err = svr.RawScan(ctx, &kvrpcpb.RawScanRequest{Context: rpcCtx, Limit: 2, Reverse: true})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(scanResp.Kvs), DeepEquals, []string{"re", "rd"})
+
+	scanResp, err = svr.RawScan(ctx, &kvrpcpb.RawScanRequest{Context: rpcCtx, StartKey: []byte("ra"), Limit: 10, KeyOnly: true})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(scanResp.Kvs), DeepEquals, []string{"ra", "rb", "rd", "re"})
+	for _, pair := range scanResp.Kvs {
+		c.Assert(pair.Value, HasLen, 0)
+	}
+
+	batchResp, err := svr.RawBatchScan(ctx, &kvrpcpb.RawBatchScanRequest{Context: rpcCtx, EachLimit: 1, Ranges: []*kvrpcpb.KeyRange{
+		{StartKey: []byte("ra"), EndKey: []byte("rc")},
+		{StartKey: []byte("rc"), EndKey: []byte("rz")},
+	}})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(batchResp.Kvs), DeepEquals, []string{"ra", "rd"})
+	batchResp, err = svr.RawBatchScan(ctx, &kvrpcpb.RawBatchScanRequest{Context: rpcCtx, EachLimit: 2, Reverse: true, KeyOnly: true,
+		Ranges: []*kvrpcpb.KeyRange{{StartKey: []byte("rz"), EndKey: []byte("rc")}}})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(batchResp.Kvs), DeepEquals, []string{"re", "rd"})
+	c.Assert(batchResp.Kvs[0].Value, HasLen, 0)
+}
+
+func (s *testServerSuite) TestRawTTL(c *C) {
+	store, err := NewTestStore("TestRawTTL", "TestRawTTL", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	ctx := context.Background()
+
+	regErr, err := svr.RawPutWithTTL(ctx, rpcCtx, []byte("ra"), []byte("va"), 10)
+	c.Assert(regErr, IsNil)
+	c.Assert(err, Equals, ErrRawTTLDisabled)
+	// The value put before the ttl is enabled and the transactional value are never taken as expired.
+	longValue := []byte("value\x00\x00\x00\x00\x00\x00\x00\x01")
+	putResp, err := svr.RawPut(ctx, &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte("rd"), Value: longValue})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, "")
+	MustPrewritePut([]byte("ta"), []byte("ta"), longValue, 10, store)
+	MustCommit([]byte("ta"), 10, 11, store)
+
+	conf := *store.MvccStore.conf
+	conf.Server.RawEnableTTL = true
+	store.MvccStore.conf = &conf
+	now := time.Now()
+	rawNow = func() time.Time { return now }
+	defer func() { rawNow = time.Now }()
+
+	_, err = svr.RawPutWithTTL(ctx, rpcCtx, []byte("ra"), []byte("va"), 10)
+	c.Assert(err, IsNil)
+	_, err = svr.RawPutWithTTL(ctx, rpcCtx, []byte("rb"), []byte("vb"), 100)
+	c.Assert(err, IsNil)
+	putResp, err = svr.RawPut(ctx, &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte("rc"), Value: []byte("vc")})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, "")
+
+	ttl, notFound, _, err := svr.RawGetKeyTTL(ctx, rpcCtx, []byte("ra"))
+	c.Assert(err, IsNil)
+	c.Assert(notFound, IsFalse)
+	c.Assert(ttl, Equals, uint64(10))
+	ttl, notFound, _, err = svr.RawGetKeyTTL(ctx, rpcCtx, []byte("rc"))
+	c.Assert(err, IsNil)
+	c.Assert(notFound, IsFalse)
+	c.Assert(ttl, Equals, uint64(0))
+	getResp, err := svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("ra")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, BytesEquals, []byte("va"))
+
+	// ra is expired and hidden from the reads.
+	now = now.Add(20 * time.Second)
+	ttl, notFound, _, err = svr.RawGetKeyTTL(ctx, rpcCtx, []byte("rb"))
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(80))
+	_, notFound, _, err = svr.RawGetKeyTTL(ctx, rpcCtx, []byte("ra"))
+	c.Assert(err, IsNil)
+	c.Assert(notFound, IsTrue)
+	getResp, err = svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("ra")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, HasLen, 0)
+	getResp, err = svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("rd")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, BytesEquals, longValue)
+	scanResp, err := svr.RawScan(ctx, &kvrpcpb.RawScanRequest{Context: rpcCtx, StartKey: []byte("r"), Limit: 1})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(scanResp.Kvs), DeepEquals, []string{"rb"})
+	c.Assert(scanResp.Kvs[0].Value, BytesEquals, []byte("vb"))
+
+	// The purge deletes the expired key only.
+	c.Assert(svr.purgeExpiredRawKeys(), Equals, 1)
+	c.Assert(svr.purgeExpiredRawKeys(), Equals, 0)
+	now = time.Now()
+	_, notFound, _, err = svr.RawGetKeyTTL(ctx, rpcCtx, []byte("ra"))
+	c.Assert(err, IsNil)
+	c.Assert(notFound, IsTrue)
+	scanResp, err = svr.RawScan(ctx, &kvrpcpb.RawScanRequest{Context: rpcCtx, StartKey: []byte("r"), Limit: 10})
+	c.Assert(err, IsNil)
+	c.Assert(rawScanKeys(scanResp.Kvs), DeepEquals, []string{"rb", "rc", "rd"})
+	MustGetVal([]byte("ta"), longValue, 20, store)
+
+	// The expire time is kept by the increment.
+	_, err = svr.RawPutWithTTL(ctx, rpcCtx, []byte("re"), make([]byte, 8), 30)
+	c.Assert(err, IsNil)
+	_, _, err = svr.RawIncrement(ctx, rpcCtx, []byte("re"), 1)
+	c.Assert(err, IsNil)
+	ttl, _, _, err = svr.RawGetKeyTTL(ctx, rpcCtx, []byte("re"))
+	c.Assert(err, IsNil)
+	c.Assert(ttl, Equals, uint64(30))
+}
+
+func (s *testServerSuite) TestRawCompareAndSwap(c *C) {
+	store, err := NewTestStore("TestRawCompareAndSwap", "TestRawCompareAndSwap", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	ctx := context.Background()
+
+	resp, err := svr.RawCompareAndSwap(ctx, &RawCASRequest{Context: rpcCtx, Key: []byte("ra"), Value: []byte("v1"), PreviousNotExist: true})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Error, Equals, "")
+	c.Assert(resp.Succeed, IsTrue)
+	c.Assert(resp.PreviousNotExist, IsTrue)
+	resp, err = svr.RawCompareAndSwap(ctx, &RawCASRequest{Context: rpcCtx, Key: []byte("ra"), Value: []byte("v2"), PreviousNotExist: true})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Succeed, IsFalse)
+	c.Assert(resp.PreviousValue, BytesEquals, []byte("v1"))
+	resp, err = svr.RawCompareAndSwap(ctx, &RawCASRequest{Context: rpcCtx, Key: []byte("ra"), Value: []byte("v2"), PreviousValue: []byte("v0")})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Succeed, IsFalse)
+	c.Assert(resp.PreviousValue, BytesEquals, []byte("v1"))
+	resp, err = svr.RawCompareAndSwap(ctx, &RawCASRequest{Context: rpcCtx, Key: []byte("ra"), Value: []byte("v2"), PreviousValue: []byte("v1")})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Succeed, IsTrue)
+	c.Assert(resp.PreviousValue, BytesEquals, []byte("v1"))
+	getResp, err := svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("ra")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, BytesEquals, []byte("v2"))
+
+	resp, err = svr.RawCompareAndSwap(ctx, &RawCASRequest{Context: rpcCtx, Key: []byte("ra"), PreviousValue: []byte("v2")})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Error, Equals, ErrRawEmptyValue.Error())
+
+	// Concurrent swaps of a key are serialized, every increment succeeds once.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				for {
+					getResp, err := svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("rb")})
+					c.Assert(err, IsNil)
+					n := 0
+					if len(getResp.Value) > 0 {
+						n, err = strconv.Atoi(string(getResp.Value))
+						c.Assert(err, IsNil)
+					}
+					resp, err := svr.RawCompareAndSwap(ctx, &RawCASRequest{Context: rpcCtx, Key: []byte("rb"),
+						Value: []byte(strconv.Itoa(n + 1)), PreviousValue: getResp.Value, PreviousNotExist: n == 0})
+					c.Assert(err, IsNil)
+					if resp.Succeed {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	getResp, err = svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("rb")})
+	c.Assert(err, IsNil)
+	c.Assert(string(getResp.Value), Equals, "80")
+}
+
+func (s *testServerSuite) TestRawBatchAtomic(c *C) {
+	store, err := NewTestStore("TestRawBatchAtomic", "TestRawBatchAtomic", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	ctx := context.Background()
+
+	// The last pair of a duplicated key wins.
+	putResp, err := svr.RawBatchPut(ctx, &kvrpcpb.RawBatchPutRequest{Context: rpcCtx, Pairs: []*kvrpcpb.KvPair{
+		{Key: []byte("ra"), Value: []byte("v1")}, {Key: []byte("rb"), Value: []byte("v1")}, {Key: []byte("ra"), Value: []byte("v2")},
+	}})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, "")
+	getResp, err := svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("ra")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, BytesEquals, []byte("v2"))
+
+	// Nothing is written if a pair is invalid.
+	putResp, err = svr.RawBatchPut(ctx, &kvrpcpb.RawBatchPutRequest{Context: rpcCtx, Pairs: []*kvrpcpb.KvPair{
+		{Key: []byte("ra"), Value: []byte("v3")}, {Key: []byte("rb")},
+	}})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, ErrRawEmptyValue.Error())
+	getResp, err = svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("ra")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, BytesEquals, []byte("v2"))
+
+	// The readers never see a partial batch.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				val := []byte(fmt.Sprintf("v%d-%d", i, j))
+				resp, err := svr.RawBatchPut(ctx, &kvrpcpb.RawBatchPutRequest{Context: rpcCtx, Pairs: []*kvrpcpb.KvPair{
+					{Key: []byte("ra"), Value: val}, {Key: []byte("rb"), Value: val},
+				}})
+				c.Assert(err, IsNil)
+				c.Assert(resp.Error, Equals, "")
+				batchResp, err := svr.RawBatchGet(ctx, &kvrpcpb.RawBatchGetRequest{Context: rpcCtx, Keys: [][]byte{[]byte("ra"), []byte("rb")}})
+				c.Assert(err, IsNil)
+				c.Assert(batchResp.Pairs, HasLen, 2)
+				c.Assert(batchResp.Pairs[0].Value, BytesEquals, batchResp.Pairs[1].Value)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	delResp, err := svr.RawBatchDelete(ctx, &kvrpcpb.RawBatchDeleteRequest{Context: rpcCtx, Keys: [][]byte{[]byte("ra"), []byte("rb"), []byte("ra")}})
+	c.Assert(err, IsNil)
+	c.Assert(delResp.Error, Equals, "")
+	batchResp, err := svr.RawBatchGet(ctx, &kvrpcpb.RawBatchGetRequest{Context: rpcCtx, Keys: [][]byte{[]byte("ra"), []byte("rb")}})
+	c.Assert(err, IsNil)
+	c.Assert(batchResp.Pairs, HasLen, 0)
+}
+
+func (s *testServerSuite) TestSplitCopStreamResponse(c *C) {
+	selResp := &tipb.SelectResponse{
+		Chunks:       []tipb.Chunk{{RowsData: []byte("r1")}, {RowsData: []byte("r2")}, {RowsData: []byte("r3")}},
+		Warnings:     []*tipb.Error{{Code: 1, Msg: "warning"}},
+		OutputCounts: []int64{3},
+		ExecutionSummaries: []*tipb.ExecutorExecutionSummary{
+			{TimeProcessedNs: proto.Uint64(100), NumProducedRows: proto.Uint64(3), NumIterations: proto.Uint64(1)},
+		},
+	}
+	data, err := selResp.Marshal()
+	c.Assert(err, IsNil)
+	resps := splitCopStreamResponse(&coprocessor.Response{Data: data})
+	c.Assert(resps, HasLen, 3)
+	for i, resp := range resps {
+		var streamResp tipb.StreamResponse
+		c.Assert(streamResp.Unmarshal(resp.Data), IsNil)
+		var chunk tipb.Chunk
+		c.Assert(chunk.Unmarshal(streamResp.Data), IsNil)
+		c.Assert(string(chunk.RowsData), Equals, fmt.Sprintf("r%d", i+1))
+		c.Assert(streamResp.Warnings, HasLen, map[bool]int{true: 1}[i == 0])
+		c.Assert(streamResp.OutputCounts, HasLen, map[bool]int{true: 1}[i == 2])
+		c.Assert(streamResp.ExecutionSummaries, HasLen, map[bool]int{true: 1}[i == 2])
+	}
+	var streamResp tipb.StreamResponse
+	c.Assert(streamResp.Unmarshal(resps[2].Data), IsNil)
+	c.Assert(streamResp.ExecutionSummaries[0].GetNumProducedRows(), Equals, uint64(3))
+
+	// The output counts are sent even if there are no rows.
+	data, err = (&tipb.SelectResponse{OutputCounts: []int64{0}}).Marshal()
+	c.Assert(err, IsNil)
+	resps = splitCopStreamResponse(&coprocessor.Response{Data: data})
+	c.Assert(resps, HasLen, 1)
+	streamResp = tipb.StreamResponse{}
+	c.Assert(streamResp.Unmarshal(resps[0].Data), IsNil)
+	c.Assert(streamResp.OutputCounts, DeepEquals, []int64{0})
+
+	data, err = (&tipb.SelectResponse{Error: &tipb.Error{Msg: "failed"}}).Marshal()
+	c.Assert(err, IsNil)
+	resps = splitCopStreamResponse(&coprocessor.Response{Data: data})
+	c.Assert(resps, HasLen, 1)
+	c.Assert(streamResp.Unmarshal(resps[0].Data), IsNil)
+	c.Assert(streamResp.Error.Msg, Equals, "failed")
+
+	resp := &coprocessor.Response{OtherError: "other error"}
+	c.Assert(splitCopStreamResponse(resp), DeepEquals, []*coprocessor.Response{resp})
+}
+
+type mockBatchCopServer struct {
+	grpc.ServerStream
+	resps []*coprocessor.BatchResponse
+}
+
+func (s *mockBatchCopServer) Send(resp *coprocessor.BatchResponse) error {
+	s.resps = append(s.resps, resp)
+	return nil
+}
+
+func (s *mockBatchCopServer) Context() context.Context {
+	return context.Background()
+}
+
+func (s *testServerSuite) TestBatchCoprocessorErrors(c *C) {
+	store, err := NewTestStore("TestBatchCoprocessorErrors", "TestBatchCoprocessorErrors", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+
+	region := &coprocessor.RegionInfo{RegionId: rpcCtx.RegionId, RegionEpoch: rpcCtx.RegionEpoch,
+		Ranges: []*coprocessor.KeyRange{{Start: []byte("a"), End: []byte("z")}}}
+	// The invalid DAG fails the first region and the rest are skipped.
+	stream := &mockBatchCopServer{}
+	err = svr.BatchCoprocessor(&coprocessor.BatchRequest{Context: &kvrpcpb.Context{}, Data: []byte("invalid"), StartTs: 1,
+		Regions: []*coprocessor.RegionInfo{region, region}}, stream)
+	c.Assert(err, IsNil)
+	c.Assert(stream.resps, HasLen, 1)
+	c.Assert(stream.resps[0].OtherError, Not(Equals), "")
+
+	stream = &mockBatchCopServer{}
+	err = svr.BatchCoprocessor(&coprocessor.BatchRequest{Context: &kvrpcpb.Context{}, Data: []byte("invalid"), StartTs: 1,
+		Regions: []*coprocessor.RegionInfo{{RegionId: 100, RegionEpoch: rpcCtx.RegionEpoch}}}, stream)
+	regErr, ok := err.(*RegionError)
+	c.Assert(ok, IsTrue)
+	c.Assert(regErr.err.RegionNotFound, NotNil)
+	c.Assert(stream.resps, HasLen, 0)
+}
+
+func (s *testServerSuite) TestRegionMerge(c *C) {
+	store, err := NewTestStore("TestRegionMerge", "TestRegionMerge", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	store.bootstrapRegion()
+	rightCtx := store.splitRegion(2, []byte("tm"))
+	leftCtx := store.regionRPCCtx(2)
+	ctx := context.Background()
+
+	putResp, err := svr.RawPut(ctx, &kvrpcpb.RawPutRequest{Context: leftCtx, Key: []byte("ta"), Value: []byte("va")})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, "")
+	putResp, err = svr.RawPut(ctx, &kvrpcpb.RawPutRequest{Context: rightCtx, Key: []byte("tn"), Value: []byte("vn")})
+	c.Assert(err, IsNil)
+	c.Assert(putResp.Error, Equals, "")
+
+	c.Assert(store.RegionManager.Merge(2, 2), NotNil)
+	c.Assert(store.RegionManager.Merge(rightCtx.RegionId, 2), IsNil)
+	merged := store.RegionManager.GetRegion(2)
+	c.Assert(merged.StartKey, HasLen, 0)
+	c.Assert(merged.EndKey, HasLen, 0)
+	c.Assert(merged.RegionEpoch.Version > rightCtx.RegionEpoch.Version, IsTrue)
+
+	// The requests of both old regions get EpochNotMatch with the merged region.
+	for _, rpcCtx := range []*kvrpcpb.Context{leftCtx, rightCtx} {
+		getResp, err := svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte("tn")})
+		c.Assert(err, IsNil)
+		epochNotMatch := getResp.RegionError.GetEpochNotMatch()
+		c.Assert(epochNotMatch, NotNil)
+		c.Assert(epochNotMatch.CurrentRegions[0].Id, Equals, uint64(2))
+	}
+	mergedCtx := store.regionRPCCtx(2)
+	for key, val := range map[string]string{"ta": "va", "tn": "vn"} {
+		getResp, err := svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: mergedCtx, Key: []byte(key)})
+		c.Assert(err, IsNil)
+		c.Assert(getResp.RegionError, IsNil)
+		c.Assert(string(getResp.Value), Equals, val)
+	}
+	region, _ := store.RegionManager.GetRegionByKey([]byte("tn"))
+	c.Assert(region.Id, Equals, uint64(2))
+}
+
+func (s *testServerSuite) TestKvImport(c *C) {
+	store, err := NewTestStore("TestKvImport", "TestKvImport", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	conf := *store.MvccStore.conf
+	conf.Server.ImportBatchSize = 2
+	store.MvccStore.conf = &conf
+	store.bootstrapRegion()
+	rightCtx := store.splitRegion(2, []byte("tm"))
+	leftCtx := store.regionRPCCtx(2)
+	ctx := context.Background()
+
+	// The mutations span both regions and are written in several batches.
+	importResp, err := svr.KvImport(ctx, &kvrpcpb.ImportRequest{
+		Mutations: []*kvrpcpb.Mutation{
+			newMutation(kvrpcpb.Op_Put, []byte("tn"), []byte("vn")),
+			newMutation(kvrpcpb.Op_Put, []byte("ta"), []byte("va")),
+			newMutation(kvrpcpb.Op_Put, []byte("tb"), []byte("vb")),
+			newMutation(kvrpcpb.Op_Put, []byte("tc"), []byte("vc")),
+			newMutation(kvrpcpb.Op_Del, []byte("tc"), nil),
+		},
+		CommitVersion: 10,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(importResp.Error, Equals, "")
+	c.Assert(importResp.RegionError, IsNil)
+	for _, tt := range []struct {
+		rpcCtx *kvrpcpb.Context
+		key    string
+		val    string
+	}{{leftCtx, "ta", "va"}, {leftCtx, "tb", "vb"}, {leftCtx, "tc", ""}, {rightCtx, "tn", "vn"}} {
+		getResp, err := svr.KvGet(ctx, &kvrpcpb.GetRequest{Context: tt.rpcCtx, Key: []byte(tt.key), Version: 11})
+		c.Assert(err, IsNil)
+		c.Assert(getResp.Error, IsNil)
+		c.Assert(string(getResp.Value), Equals, tt.val, Commentf("key %s", tt.key))
+		// The imported versions are not visible to the reads before the commit version.
+		getResp, err = svr.KvGet(ctx, &kvrpcpb.GetRequest{Context: tt.rpcCtx, Key: []byte(tt.key), Version: 9})
+		c.Assert(err, IsNil)
+		c.Assert(getResp.Value, HasLen, 0)
+	}
+
+	// The locked keys are not imported.
+	prewriteResp, err := svr.KvPrewrite(ctx, kvPrewriteReq(leftCtx, []byte("td"), []byte("v"), 20))
+	c.Assert(err, IsNil)
+	c.Assert(prewriteResp.Errors, HasLen, 0)
+	importResp, err = svr.KvImport(ctx, &kvrpcpb.ImportRequest{
+		Mutations:     []*kvrpcpb.Mutation{newMutation(kvrpcpb.Op_Put, []byte("td"), []byte("vd"))},
+		CommitVersion: 30,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(importResp.Error, Not(Equals), "")
+
+	importResp, err = svr.KvImport(ctx, &kvrpcpb.ImportRequest{
+		Mutations: []*kvrpcpb.Mutation{newMutation(kvrpcpb.Op_Put, []byte("te"), []byte("ve"))},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(importResp.Error, Equals, ErrInvalidImportTS.Error())
+}
+
+type mockUploadServer struct {
+	grpc.ServerStream
+	reqs []*import_sstpb.UploadRequest
+}
+
+func (s *mockUploadServer) Recv() (*import_sstpb.UploadRequest, error) {
+	if len(s.reqs) == 0 {
+		return nil, io.EOF
+	}
+	req := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return req, nil
+}
+
+func (s *mockUploadServer) SendAndClose(*import_sstpb.UploadResponse) error {
+	return nil
+}
+
+// uploadSST builds an SST file of the sorted pairs and uploads it.
+func uploadSST(c *C, importer *SSTImporter, meta *import_sstpb.SSTMeta, pairs [][2][]byte) {
+	f, err := ioutil.TempFile("", "sst")
+	c.Assert(err, IsNil)
+	defer os.Remove(f.Name())
+	writer := rocksdb.NewSstFileWriter(f, rocksdb.NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for _, pair := range pairs {
+		c.Assert(writer.Put(pair[0], pair[1]), IsNil)
+	}
+	c.Assert(writer.Finish(), IsNil)
+	c.Assert(writer.Close(), IsNil)
+	data, err := ioutil.ReadFile(f.Name())
+	c.Assert(err, IsNil)
+	meta.Crc32 = crc32.ChecksumIEEE(data)
+	meta.Length = uint64(len(data))
+	stream := &mockUploadServer{reqs: []*import_sstpb.UploadRequest{
+		{Chunk: &import_sstpb.UploadRequest_Meta{Meta: meta}},
+		{Chunk: &import_sstpb.UploadRequest_Data{Data: data}},
+	}}
+	c.Assert(importer.Upload(stream), IsNil)
+}
+
+func (s *testServerSuite) TestSSTImporter(c *C) {
+	store, err := NewTestStore("TestSSTImporter", "TestSSTImporter", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	dir, err := ioutil.TempDir("", "import")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	importer, err := NewSSTImporter(svr, dir)
+	c.Assert(err, IsNil)
+	ctx := context.Background()
+
+	longVal := bytes.Repeat([]byte("v"), 300)
+	defaultMeta := &import_sstpb.SSTMeta{Uuid: []byte("u1"), CfName: cfDefault, RegionId: rpcCtx.RegionId, RegionEpoch: rpcCtx.RegionEpoch}
+	uploadSST(c, importer, defaultMeta, [][2][]byte{{encodeSSTKey([]byte("tb"), 10), longVal}})
+	writeMeta := &import_sstpb.SSTMeta{Uuid: []byte("u2"), CfName: cfWrite, RegionId: rpcCtx.RegionId, RegionEpoch: rpcCtx.RegionEpoch}
+	uploadSST(c, importer, writeMeta, [][2][]byte{
+		{encodeSSTKey([]byte("ta"), 11), encodeSSTWriteValue(sstWriteTypePut, 10, []byte("va"))},
+		{encodeSSTKey([]byte("tb"), 11), encodeSSTWriteValue(sstWriteTypePut, 10, nil)},
+		{encodeSSTKey([]byte("tc"), 11), encodeSSTWriteValue(sstWriteTypeDelete, 10, nil)},
+		{encodeSSTKey([]byte("tc"), 9), encodeSSTWriteValue(sstWriteTypePut, 8, []byte("vc"))},
+	})
+
+	// The sst of a stale epoch is rejected.
+	staleMeta := *writeMeta
+	staleMeta.RegionEpoch = &metapb.RegionEpoch{Version: rpcCtx.RegionEpoch.GetVersion() + 1}
+	ingestResp, err := importer.Ingest(ctx, &import_sstpb.IngestRequest{Context: rpcCtx, Sst: &staleMeta})
+	c.Assert(err, IsNil)
+	c.Assert(ingestResp.Error.GetEpochNotMatch(), NotNil)
+
+	// The default cf is written with the write cf.
+	ingestResp, err = importer.Ingest(ctx, &import_sstpb.IngestRequest{Context: rpcCtx, Sst: defaultMeta})
+	c.Assert(err, IsNil)
+	c.Assert(ingestResp.Error, IsNil)
+	getResp, err := svr.KvGet(ctx, &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte("tb"), Version: 20})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, HasLen, 0)
+	ingestResp, err = importer.Ingest(ctx, &import_sstpb.IngestRequest{Context: rpcCtx, Sst: writeMeta})
+	c.Assert(err, IsNil)
+	c.Assert(ingestResp.Error, IsNil)
+
+	for _, tt := range []struct {
+		key    string
+		readTS uint64
+		val    []byte
+	}{{"ta", 20, []byte("va")}, {"tb", 20, longVal}, {"tc", 20, nil}, {"tc", 10, []byte("vc")}, {"ta", 10, nil}} {
+		getResp, err = svr.KvGet(ctx, &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte(tt.key), Version: tt.readTS})
+		c.Assert(err, IsNil)
+		c.Assert(getResp.Error, IsNil)
+		c.Assert(string(getResp.Value), Equals, string(tt.val), Commentf("key %s read ts %d", tt.key, tt.readTS))
+	}
+	// The ingested files are removed.
+	_, err = os.Stat(importer.sstPath(writeMeta))
+	c.Assert(os.IsNotExist(err), IsTrue)
+}
+
+type mockBackupServer struct {
+	grpc.ServerStream
+	resps []*backup.BackupResponse
+}
+
+func (s *mockBackupServer) Send(resp *backup.BackupResponse) error {
+	s.resps = append(s.resps, resp)
+	return nil
+}
+
+func (s *mockBackupServer) Context() context.Context {
+	return context.Background()
+}
+
+type mockScanMvccServer struct {
+	grpc.ServerStream
+	resps []*debugpb.ScanMvccResponse
+}
+
+func (s *mockScanMvccServer) Send(resp *debugpb.ScanMvccResponse) error {
+	s.resps = append(s.resps, resp)
+	return nil
+}
+
+func (s *mockScanMvccServer) Context() context.Context {
+	return context.Background()
+}
+
+func (s *testServerSuite) TestDebugService(c *C) {
+	store, err := NewTestStore("TestDebugService", "TestDebugService", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	ctx := context.Background()
+	MustLoad(10, 20, store, "ta:a1", "tb:b1")
+	MustPrewritePut([]byte("tc"), []byte("tc"), []byte("c1"), 30, store)
+
+	getResp, err := svr.Get(ctx, &debugpb.GetRequest{Db: debugpb.DB_KV, Cf: "default", Key: []byte("ta")})
+	c.Assert(err, IsNil)
+	c.Assert(getResp.Value, BytesEquals, []byte("a1"))
+	getResp, err = svr.Get(ctx, &debugpb.GetRequest{Db: debugpb.DB_KV, Cf: "lock", Key: []byte("tc")})
+	c.Assert(err, IsNil)
+	c.Assert(mvcc.DecodeLock(getResp.Value).StartTS, Equals, uint64(30))
+	_, err = svr.Get(ctx, &debugpb.GetRequest{Db: debugpb.DB_KV, Cf: "write", Key: []byte("tc")})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+
+	stream := &mockScanMvccServer{}
+	c.Assert(svr.ScanMvcc(&debugpb.ScanMvccRequest{FromKey: []byte("t"), ToKey: []byte("u")}, stream), IsNil)
+	c.Assert(stream.resps, HasLen, 3)
+	for i, key := range []string{"ta", "tb", "tc"} {
+		c.Assert(stream.resps[i].Key, BytesEquals, []byte(key))
+	}
+	c.Assert(stream.resps[0].Info.Writes, HasLen, 1)
+	c.Assert(stream.resps[0].Info.Writes[0].CommitTs, Equals, uint64(20))
+	c.Assert(stream.resps[2].Info.Lock.StartTs, Equals, uint64(30))
+	stream = &mockScanMvccServer{}
+	c.Assert(svr.ScanMvcc(&debugpb.ScanMvccRequest{FromKey: []byte("tb"), Limit: 1}, stream), IsNil)
+	c.Assert(stream.resps, HasLen, 1)
+	c.Assert(stream.resps[0].Key, BytesEquals, []byte("tb"))
+
+	infoResp, err := svr.RegionInfo(ctx, &debugpb.RegionInfoRequest{RegionId: rpcCtx.RegionId})
+	c.Assert(err, IsNil)
+	c.Assert(infoResp.RegionLocalState.Region.Id, Equals, rpcCtx.RegionId)
+	_, err = svr.RegionInfo(ctx, &debugpb.RegionInfoRequest{RegionId: 12345})
+	c.Assert(status.Code(err), Equals, codes.NotFound)
+	sizeResp, err := svr.RegionSize(ctx, &debugpb.RegionSizeRequest{RegionId: rpcCtx.RegionId, Cfs: []string{"lock"}})
+	c.Assert(err, IsNil)
+	c.Assert(sizeResp.Entries, HasLen, 1)
+	c.Assert(sizeResp.Entries[0].Size_ > 0, IsTrue)
+
+	metricsResp, err := svr.GetMetrics(ctx, &debugpb.GetMetricsRequest{})
+	c.Assert(err, IsNil)
+	c.Assert(metricsResp.Prometheus, Not(Equals), "")
+	_, err = svr.Compact(ctx, &debugpb.CompactRequest{Db: debugpb.DB_KV})
+	c.Assert(status.Code(err), Equals, codes.Unimplemented)
+}
+
+func (s *testServerSuite) TestBackup(c *C) {
+	store, err := NewTestStore("TestBackup", "TestBackup", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	store.splitRegion(2, []byte("tm"))
+	dir, err := ioutil.TempDir("", "backup")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	longVal := bytes.Repeat([]byte("v"), 300)
+	for _, mutations := range [][]*kvrpcpb.Mutation{
+		{newMutation(kvrpcpb.Op_Put, []byte("ta"), []byte("va")), newMutation(kvrpcpb.Op_Put, []byte("tc"), []byte("vc")),
+			newMutation(kvrpcpb.Op_Put, []byte("tn"), longVal)},
+		{newMutation(kvrpcpb.Op_Del, []byte("tc"), nil)},
+	} {
+		importResp, err := svr.KvImport(ctx, &kvrpcpb.ImportRequest{Mutations: mutations, CommitVersion: store.MvccStore.getLatestTS() + 10})
+		c.Assert(err, IsNil)
+		c.Assert(importResp.Error, Equals, "")
+	}
+	req := &backup.BackupRequest{
+		StartKey:       []byte("t"),
+		EndKey:         []byte("u"),
+		EndVersion:     store.MvccStore.getLatestTS(),
+		StorageBackend: &backup.StorageBackend{Backend: &backup.StorageBackend_Local{Local: &backup.Local{Path: dir}}},
+	}
+	stream := &mockBackupServer{}
+	c.Assert(svr.Backup(req, stream), IsNil)
+	c.Assert(stream.resps, HasLen, 2)
+	var keys []string
+	for _, resp := range stream.resps {
+		c.Assert(resp.Error, IsNil)
+		for _, file := range resp.Files {
+			err = iterateSST(filepath.Join(dir, file.Name), func(sstKey, value []byte) error {
+				key, _, err := decodeSSTKey(sstKey)
+				c.Assert(err, IsNil)
+				keys = append(keys, file.Cf+":"+string(key))
+				return nil
+			})
+			c.Assert(err, IsNil)
+		}
+	}
+	// The deleted key is not backed up and the long value is in the default cf.
+	sort.Strings(keys)
+	c.Assert(keys, DeepEquals, []string{"default:tn", "write:ta", "write:tn"})
+	c.Assert(stream.resps[0].StartKey, BytesEquals, []byte("t"))
+	c.Assert(stream.resps[0].EndKey, BytesEquals, []byte("tm"))
+
+	// The locks before the backup ts fail the backup.
+	prewriteResp, err := svr.KvPrewrite(ctx, kvPrewriteReq(rpcCtx, []byte("tb"), []byte("v"), req.EndVersion-1))
+	c.Assert(err, IsNil)
+	c.Assert(prewriteResp.Errors, HasLen, 0)
+	stream = &mockBackupServer{}
+	c.Assert(svr.Backup(req, stream), IsNil)
+	c.Assert(stream.resps[0].Error.GetKvError().GetLocked(), NotNil)
+	c.Assert(stream.resps[1].Error, IsNil)
+}
+
+func (s *testServerSuite) TestUnsafeDestroyRange(c *C) {
+	store, err := NewTestStore("TestUnsafeDestroyRange", "TestUnsafeDestroyRange", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	ctx := context.Background()
+	// The range covers two regions.
+	rpcCtx := store.bootstrapRegion()
+	rightCtx := store.splitRegion(rpcCtx.RegionId, []byte("tc"))
+
+	MustLoad(10, 11, store, "ta:v1", "tb:v1", "tz:v1")
+	MustLoad(20, 21, store, "ta:v2")
+	MustPrewritePut([]byte("tc"), []byte("tc"), []byte("v"), 30, store)
+	MustRollbackKey([]byte("tb"), 40, store)
+	MustAcquirePessimisticLock([]byte("td"), []byte("td"), 50, 50, store)
+	leftCtx := store.regionRPCCtx(rpcCtx.RegionId)
+	rawPut := func(rpcCtx *kvrpcpb.Context, key string) {
+		resp, err := svr.RawPut(ctx, &kvrpcpb.RawPutRequest{Context: rpcCtx, Key: []byte(key), Value: []byte("raw")})
+		c.Assert(err, IsNil)
+		c.Assert(resp.Error, Equals, "")
+	}
+	rawGet := func(rpcCtx *kvrpcpb.Context, key string) []byte {
+		resp, err := svr.RawGet(ctx, &kvrpcpb.RawGetRequest{Context: rpcCtx, Key: []byte(key)})
+		c.Assert(err, IsNil)
+		c.Assert(resp.Error, Equals, "")
+		return resp.Value
+	}
+	rawPut(leftCtx, "tb")
+	rawPut(rightCtx, "tz")
+
+	resp, err := svr.UnsafeDestroyRange(ctx, &kvrpcpb.UnsafeDestroyRangeRequest{
+		StartKey: []byte("ta"),
+		EndKey:   []byte("tz"),
+	})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Error, Equals, "")
+	// All the versions, the locks and the rollback records in the range are deleted.
+	MustGetNone([]byte("ta"), 15, store)
+	MustGetNone([]byte("ta"), 100, store)
+	MustGetNone([]byte("tb"), 100, store)
+	MustUnLocked([]byte("tc"), store)
+	MustUnLocked([]byte("td"), store)
+	res := store.MvccStore.checkExtraTxnStatus(store.newReqCtx(), []byte("tb"), 40)
+	c.Assert(res.isRollback, IsFalse)
+	MustGetVal([]byte("tz"), []byte("v1"), 100, store)
+	// So are the raw keys.
+	c.Assert(rawGet(leftCtx, "tb"), IsNil)
+	c.Assert(rawGet(rightCtx, "tz"), BytesEquals, []byte("raw"))
+
+	// The empty end key destroys the data to the end, the internal keys are kept.
+	resp, err = svr.UnsafeDestroyRange(ctx, &kvrpcpb.UnsafeDestroyRangeRequest{StartKey: []byte("t")})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Error, Equals, "")
+	MustGetNone([]byte("tz"), 100, store)
+	c.Assert(rawGet(rightCtx, "tz"), IsNil)
+	MustPrewritePut([]byte("ta"), []byte("ta"), []byte("v3"), 110, store)
+	MustCommit([]byte("ta"), 110, 111, store)
+	MustGetVal([]byte("ta"), []byte("v3"), 120, store)
+
+	// The end key of the last region is empty after it's loaded from the local storage, it's unbounded.
+	lastRegion, err := svr.debugRegion(rightCtx.RegionId)
+	c.Assert(err, IsNil)
+	lastRegion.endKey = nil
+	MustPrewritePut([]byte("ty"), []byte("ty"), []byte("v"), 130, store)
+	resp, err = svr.UnsafeDestroyRange(ctx, &kvrpcpb.UnsafeDestroyRangeRequest{StartKey: []byte("tx"), EndKey: []byte("tz")})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Error, Equals, "")
+	MustUnLocked([]byte("ty"), store)
+}
+
+type mockBatchCommandsServer struct {
+	grpc.ServerStream
+	reqs  []*tikvpb.BatchCommandsRequest
+	resps []*tikvpb.BatchCommandsResponse
+}
+
+func (s *mockBatchCommandsServer) Recv() (*tikvpb.BatchCommandsRequest, error) {
+	if len(s.reqs) == 0 {
+		return nil, io.EOF
+	}
+	req := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return req, nil
+}
+
+func (s *mockBatchCommandsServer) Send(resp *tikvpb.BatchCommandsResponse) error {
+	s.resps = append(s.resps, resp)
+	return nil
+}
+
+func (s *mockBatchCommandsServer) Context() context.Context {
+	return context.Background()
+}
+
+func (s *testServerSuite) TestBatchCommands(c *C) {
+	store, err := NewTestStore("TestBatchCommands", "TestBatchCommands", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	MustLoad(10, 11, store, "ta:va")
+
+	stream := &mockBatchCommandsServer{reqs: []*tikvpb.BatchCommandsRequest{
+		{
+			Requests: []*tikvpb.BatchCommandsRequest_Request{
+				{Cmd: &tikvpb.BatchCommandsRequest_Request_Get{Get: &kvrpcpb.GetRequest{
+					Context: rpcCtx, Key: []byte("ta"), Version: 20}}},
+				{Cmd: &tikvpb.BatchCommandsRequest_Request_Prewrite{Prewrite: kvPrewriteReq(rpcCtx, []byte("tb"), []byte("vb"), 30)}},
+			},
+			RequestIds: []uint64{1, 2},
+		},
+		{
+			Requests: []*tikvpb.BatchCommandsRequest_Request{
+				{Cmd: &tikvpb.BatchCommandsRequest_Request_Empty{Empty: &tikvpb.BatchCommandsEmptyRequest{TestId: 100}}},
+				// The unsupported command is answered with an empty response.
+				{},
+			},
+			RequestIds: []uint64{3, 4},
+		},
+	}}
+	// The responses of all the requests are sent before the stream is closed.
+	c.Assert(svr.BatchCommands(stream), IsNil)
+	resps := make(map[uint64]*tikvpb.BatchCommandsResponse_Response)
+	for _, batchResp := range stream.resps {
+		c.Assert(batchResp.Responses, HasLen, len(batchResp.RequestIds))
+		for i, id := range batchResp.RequestIds {
+			resps[id] = batchResp.Responses[i]
+		}
+	}
+	c.Assert(resps, HasLen, 4)
+	c.Assert(resps[1].GetGet().Value, BytesEquals, []byte("va"))
+	c.Assert(resps[2].GetPrewrite().Errors, HasLen, 0)
+	c.Assert(resps[3].GetEmpty().TestId, Equals, uint64(100))
+	c.Assert(resps[4].GetEmpty(), NotNil)
+	MustLocked([]byte("tb"), false, store)
+}
+
+func counterValue(c *C, vec *prometheus.CounterVec, tp string) float64 {
+	m := &dto.Metric{}
+	c.Assert(vec.WithLabelValues(tp).Write(m), IsNil)
+	return m.GetCounter().GetValue()
+}
+
+func (s *testServerSuite) TestRequestMetrics(c *C) {
+	store, err := NewTestStore("TestRequestMetrics", "TestRequestMetrics", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	ctx := context.Background()
+	getCount, _ := histogramSample(c, metrics.GrpcMsgDuration, "KvGet")
+	lockedErrors := counterValue(c, metrics.KeyErrors, "locked")
+	regionErrors := counterValue(c, metrics.GrpcRegionErrors, "KvGet")
+
+	MustPrewritePut([]byte("ta"), []byte("ta"), []byte("v"), 10, store)
+	resp, err := svr.KvGet(ctx, &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte("ta"), Version: 20})
+	c.Assert(err, IsNil)
+	c.Assert(resp.Error.GetLocked(), NotNil)
+	staleCtx := *rpcCtx
+	staleCtx.RegionId = 100
+	resp, err = svr.KvGet(ctx, &kvrpcpb.GetRequest{Context: &staleCtx, Key: []byte("ta"), Version: 20})
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, NotNil)
+
+	count, _ := histogramSample(c, metrics.GrpcMsgDuration, "KvGet")
+	c.Assert(count-getCount, Equals, uint64(2))
+	c.Assert(counterValue(c, metrics.KeyErrors, "locked")-lockedErrors, Equals, float64(1))
+	c.Assert(counterValue(c, metrics.GrpcRegionErrors, "KvGet")-regionErrors, Equals, float64(1))
+}
+
+func (s *testServerSuite) TestRequestSpan(c *C) {
+	store, err := NewTestStore("TestRequestSpan", "TestRequestSpan", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	tracer := mocktracer.New()
+	svr.tracer = tracer
+	rpcCtx := store.bootstrapRegion()
+
+	// The span continues the trace of the client.
+	clientSpan := tracer.StartSpan("client")
+	carrier := opentracing.HTTPHeadersCarrier{}
+	c.Assert(tracer.Inject(clientSpan.Context(), opentracing.HTTPHeaders, carrier), IsNil)
+	md := metadata.MD{}
+	for k, v := range carrier {
+		md.Set(k, v...)
+	}
+	ctx := metadata.NewIncomingContext(context.Background(), md)
+	_, err = svr.KvGet(ctx, &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte("ta"), Version: 10})
+	c.Assert(err, IsNil)
+
+	spans := make(map[string]*mocktracer.MockSpan)
+	for _, span := range tracer.FinishedSpans() {
+		spans[span.OperationName] = span
+	}
+	reqSpan := spans["KvGet"]
+	c.Assert(reqSpan, NotNil)
+	clientCtx := clientSpan.Context().(mocktracer.MockSpanContext)
+	c.Assert(reqSpan.ParentID, Equals, clientCtx.SpanID)
+	c.Assert(reqSpan.SpanContext.TraceID, Equals, clientCtx.TraceID)
+	c.Assert(reqSpan.Tag("region.id"), Equals, rpcCtx.RegionId)
+	// The trace events are the child spans, every one starts at the end of the previous one.
+	checkLock, getValue := spans["check lock"], spans["get value"]
+	c.Assert(checkLock, NotNil)
+	c.Assert(getValue, NotNil)
+	c.Assert(checkLock.ParentID, Equals, reqSpan.SpanContext.SpanID)
+	c.Assert(checkLock.StartTime.Equal(reqSpan.StartTime), IsTrue)
+	c.Assert(getValue.StartTime.Equal(checkLock.FinishTime), IsTrue)
+}
+
+func (s *testServerSuite) TestSlowLog(c *C) {
+	store, err := NewTestStore("TestSlowLog", "TestSlowLog", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	dir, err := ioutil.TempDir("", "slowlog")
+	c.Assert(err, IsNil)
+	defer os.RemoveAll(dir)
+
+	conf := config.DefaultConf.Server
+	conf.SlowLogThreshold = "1h"
+	conf.SlowLogMethodThresholds = map[string]string{"KvGet": "1ns", "KvScan": "0"}
+	conf.SlowLogFile = filepath.Join(dir, "slow.log")
+	svr.slowLog = newSlowLogger(conf)
+	c.Assert(svr.slowLog.isSlow("KvGet", time.Millisecond), IsTrue)
+	c.Assert(svr.slowLog.isSlow("KvScan", time.Hour*2), IsFalse)
+	c.Assert(svr.slowLog.isSlow("KvCommit", time.Millisecond), IsFalse)
+
+	_, err = svr.KvGet(context.Background(), &kvrpcpb.GetRequest{Context: rpcCtx, Key: []byte("ta"), Version: 10})
+	c.Assert(err, IsNil)
+	_, err = svr.KvScan(context.Background(), &kvrpcpb.ScanRequest{Context: rpcCtx, StartKey: []byte("ta"), Limit: 1, Version: 10})
+	c.Assert(err, IsNil)
+
+	data, err := ioutil.ReadFile(conf.SlowLogFile)
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	c.Assert(lines, HasLen, 1)
+	var record struct {
+		Method    string `json:"method"`
+		RegionID  uint64 `json:"region_id"`
+		StartTS   uint64 `json:"start_ts"`
+		KeyDigest string `json:"key_digest"`
+		Phases    []struct {
+			Name string `json:"name"`
+		} `json:"phases"`
+	}
+	c.Assert(json.Unmarshal([]byte(lines[0]), &record), IsNil)
+	c.Assert(record.Method, Equals, "KvGet")
+	c.Assert(record.RegionID, Equals, rpcCtx.RegionId)
+	c.Assert(record.StartTS, Equals, uint64(10))
+	c.Assert(record.KeyDigest, Equals, fmt.Sprintf("%016x", farm.Fingerprint64([]byte("ta"))))
+	c.Assert(record.Phases, HasLen, 2)
+	c.Assert(record.Phases[0].Name, Equals, "check lock")
+	c.Assert(record.Phases[1].Name, Equals, "get value")
+}
+
+func (s *testServerSuite) TestStopOnDeadline(c *C) {
+	store, err := NewTestStore("TestStopOnDeadline", "TestStopOnDeadline", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	svr.scanEpochCheckKeys = 0
+	codec := &cancelOnDecodeCodec{}
+	store.MvccStore.SetValueCodec(codec)
+	var pairs []string
+	for i := 0; i < 3*contextCheckKeys; i++ {
+		pairs = append(pairs, fmt.Sprintf("t%04d:v", i))
+	}
+	MustLoad(10, 11, store, pairs...)
+
+	// The scan stops at the next check of the context once the deadline is exceeded.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	codec.cancel = func() {
+		<-ctx.Done()
+	}
+	resp, err := svr.KvScan(ctx, &kvrpcpb.ScanRequest{Context: rpcCtx, StartKey: []byte("t"), Limit: 10000, Version: 20})
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, NotNil)
+	c.Assert(len(resp.Pairs) < 3*contextCheckKeys, IsTrue)
+
+	// The lock wait stops when the deadline is exceeded.
+	MustAcquirePessimisticLock([]byte("ta"), []byte("ta"), 30, 30, store)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	lockResp, err := svr.KvPessimisticLock(ctx, &kvrpcpb.PessimisticLockRequest{
+		Context:      rpcCtx,
+		Mutations:    []*kvrpcpb.Mutation{{Op: kvrpcpb.Op_PessimisticLock, Key: []byte("ta")}},
+		PrimaryLock:  []byte("ta"),
+		StartVersion: 40,
+		ForUpdateTs:  40,
+		LockTtl:      lockTTL,
+		WaitTimeout:  10000,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(lockResp.RegionError, NotNil)
+	c.Assert(time.Since(start) < 5*time.Second, IsTrue)
+	MustPessimisticLocked([]byte("ta"), 30, 30, store)
+}
+
+func (s *testServerSuite) TestMaxExecutionDuration(c *C) {
+	store, err := NewTestStore("TestMaxExecutionDuration", "TestMaxExecutionDuration", c)
+	c.Assert(err, IsNil)
+	defer CleanTestStore(store)
+	svr := store.Svr
+	rpcCtx := store.bootstrapRegion()
+	codec := &cancelOnDecodeCodec{}
+	store.MvccStore.SetValueCodec(codec)
+	var pairs []string
+	for i := 0; i < 3*contextCheckKeys; i++ {
+		pairs = append(pairs, fmt.Sprintf("t%04d:v", i))
+	}
+	MustLoad(10, 11, store, pairs...)
+	limitedCtx := *rpcCtx
+	limitedCtx.MaxExecutionDurationMs = 20
+
+	// The scan stops at the next check of the context once the max execution duration is exceeded.
+	codec.cancel = func() {
+		time.Sleep(50 * time.Millisecond)
+	}
+	resp, err := svr.KvScan(context.Background(), &kvrpcpb.ScanRequest{Context: &limitedCtx, StartKey: []byte("t"), Limit: 10000, Version: 20})
+	c.Assert(err, IsNil)
+	c.Assert(resp.RegionError, IsNil)
+	c.Assert(resp.Pairs, HasLen, 1)
+	c.Assert(resp.Pairs[0].Error.GetAbort(), Equals, ErrMaxExecutionTimeExceeded.Error())
+
+	// The coprocessor request waiting for the read pool is timed out.
+	closeCh := make(chan struct{})
+	var wg sync.WaitGroup
+	defer func() {
+		close(closeCh)
+		wg.Wait()
+	}()
+	svr.copReadPool = newReadPool(copReadPool, 1, 1, closeCh, &wg)
+	running, unblock := make(chan struct{}), make(chan struct{})
+	go store.newReqCtx().runInReadPool(svr.copReadPool, func() {
+		close(running)
+		<-unblock
+	})
+	<-running
+	defer close(unblock)
+	copResp, err := svr.Coprocessor(context.Background(), &coprocessor.Request{
+		Context: &limitedCtx, StartTs: 20, Ranges: []*coprocessor.KeyRange{{Start: []byte("t"), End: []byte("u")}},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(copResp.RegionError, IsNil)
+	c.Assert(copResp.OtherError, Equals, ErrMaxExecutionTimeExceeded.Error())
+}
@@ -0,0 +1,125 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dgryski/go-farm"
+	"github.com/ngaut/unistore/config"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// slowLogger logs the requests slower than the threshold of their methods. The records are written to the slow
+// log file in JSON, or to the server log if the file is not set.
+type slowLogger struct {
+	logger *zap.Logger
+
+	// The thresholds can be changed by the config reload.
+	mu sync.RWMutex
+	// threshold is the threshold of the methods not in methodThresholds, 0 disables the slow log.
+	threshold        time.Duration
+	methodThresholds map[string]time.Duration
+}
+
+func newSlowLogger(conf config.Server) *slowLogger {
+	l := new(slowLogger)
+	l.setThresholds(conf)
+	if conf.SlowLogFile != "" {
+		logger, _, err := log.InitLogger(&log.Config{
+			Level:  "info",
+			Format: "json",
+			File:   log.FileLogConfig{Filename: conf.SlowLogFile},
+		})
+		if err == nil {
+			l.logger = logger
+		} else {
+			log.Warn("open slow log file failed, the slow requests are logged to the server log",
+				zap.String("file", conf.SlowLogFile), zap.Error(err))
+		}
+	}
+	return l
+}
+
+// setThresholds sets the thresholds of the config, the slow log file is not changed.
+func (l *slowLogger) setThresholds(conf config.Server) {
+	methodThresholds := make(map[string]time.Duration, len(conf.SlowLogMethodThresholds))
+	for method, threshold := range conf.SlowLogMethodThresholds {
+		methodThresholds[method] = config.ParseDuration(threshold)
+	}
+	threshold := config.ParseDuration(conf.SlowLogThreshold)
+	l.mu.Lock()
+	l.threshold, l.methodThresholds = threshold, methodThresholds
+	l.mu.Unlock()
+}
+
+func (l *slowLogger) isSlow(method string, duration time.Duration) bool {
+	l.mu.RLock()
+	threshold, ok := l.methodThresholds[method]
+	if !ok {
+		threshold = l.threshold
+	}
+	l.mu.RUnlock()
+	return threshold > 0 && duration > threshold
+}
+
+func (l *slowLogger) log(req *requestCtx, duration time.Duration) {
+	logger := l.logger
+	if logger == nil {
+		logger = log.L()
+	}
+	fields := []zap.Field{
+		zap.String("method", req.method),
+		zap.String("trace_id", req.traceID),
+		zap.Uint64("region_id", req.rpcCtx.GetRegionId()),
+		zap.Uint64("start_ts", req.startTS),
+		zap.Duration("duration", duration),
+		zap.Array("phases", slowLogPhases(req.traces)),
+	}
+	// The keys may hold user data, only their digests are logged.
+	if len(req.key) > 0 {
+		fields = append(fields, zap.String("key_digest", fmt.Sprintf("%016x", farm.Fingerprint64(req.key))))
+	}
+	if req.regErr != nil {
+		fields = append(fields, zap.String("region_error", req.regErr.String()))
+	}
+	if req.droppedTraces > 0 {
+		fields = append(fields, zap.Int("dropped_phases", req.droppedTraces))
+	}
+	logger.Warn("slow request", fields...)
+}
+
+// slowLogPhases are the trace events of a request logged as the phases, a phase lasts from the previous event to
+// its event.
+type slowLogPhases []traceEvent
+
+func (phases slowLogPhases) MarshalLogArray(enc zapcore.ArrayEncoder) error {
+	var prev time.Duration
+	for _, ev := range phases {
+		err := enc.AppendObject(zapcore.ObjectMarshalerFunc(func(enc zapcore.ObjectEncoder) error {
+			enc.AddString("name", ev.event)
+			enc.AddDuration("duration", ev.elapsed-prev)
+			return nil
+		}))
+		if err != nil {
+			return err
+		}
+		prev = ev.elapsed
+	}
+	return nil
+}
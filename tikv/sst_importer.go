@@ -0,0 +1,570 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/ngaut/unistore/tikv/raftstore"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/cdcpb"
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/import_sstpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+)
+
+// The SST files are in the format of TiKV: a key is 'z' followed by the memcomparable encoded key and the
+// descending encoded ts, the write CF has the commit records keyed by the commit ts, and the default CF has
+// the long values keyed by the start ts. Ingest translates the records into the versions of unistore.
+
+const (
+	sstDataKeyPrefix    = 'z'
+	sstShortValuePrefix = 'v'
+
+	sstWriteTypePut      = 'P'
+	sstWriteTypeDelete   = 'D'
+	sstWriteTypeLock     = 'L'
+	sstWriteTypeRollback = 'R'
+)
+
+var (
+	cfDefault = string(raftstore.CFDefault)
+	cfWrite   = string(raftstore.CFWrite)
+)
+
+// SSTImporter implements the ImportSST service, it's used by TiDB Lightning and BR to load data into unistore.
+// The uploaded and downloaded SST files are kept in a directory until they are ingested. Ingest is only
+// supported without raft.
+type SSTImporter struct {
+	svr *Server
+	dir string
+
+	mu   sync.Mutex
+	mode import_sstpb.SwitchMode
+	// pendingDefaults maps the region id to the ingested default CF files of the region, the long values in
+	// them are written with the write CF files ingested later.
+	pendingDefaults map[uint64][]string
+	downloadLimiter *rate.Limiter
+}
+
+// NewSSTImporter creates an SSTImporter which keeps the SST files in dir.
+func NewSSTImporter(svr *Server, dir string) (*SSTImporter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &SSTImporter{
+		svr:             svr,
+		dir:             dir,
+		pendingDefaults: make(map[uint64][]string),
+	}, nil
+}
+
+func (im *SSTImporter) sstPath(meta *import_sstpb.SSTMeta) string {
+	epoch := meta.GetRegionEpoch()
+	name := fmt.Sprintf("%x_%d_%d_%d_%s.sst", meta.GetUuid(), meta.GetRegionId(), epoch.GetConfVer(),
+		epoch.GetVersion(), meta.GetCfName())
+	return filepath.Join(im.dir, name)
+}
+
+func checkSSTMeta(meta *import_sstpb.SSTMeta) error {
+	if meta == nil {
+		return errors.New("sst meta is missing")
+	}
+	if cf := meta.GetCfName(); cf != cfDefault && cf != cfWrite {
+		return errors.Errorf("unsupported cf %q of sst", cf)
+	}
+	return nil
+}
+
+// SwitchMode only records the mode, unistore doesn't tune the engine for the import mode.
+func (im *SSTImporter) SwitchMode(ctx context.Context, req *import_sstpb.SwitchModeRequest) (*import_sstpb.SwitchModeResponse, error) {
+	im.mu.Lock()
+	im.mode = req.GetMode()
+	im.mu.Unlock()
+	log.Info("switch import mode", zap.Stringer("mode", req.GetMode()))
+	return &import_sstpb.SwitchModeResponse{}, nil
+}
+
+// Upload receives an SST file, the first chunk is the meta and the others are the data.
+func (im *SSTImporter) Upload(stream import_sstpb.ImportSST_UploadServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	meta := req.GetMeta()
+	if err = checkSSTMeta(meta); err != nil {
+		return err
+	}
+	path := im.sstPath(meta)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	err = im.receiveSST(stream, f, meta)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.Trace(err)
+	}
+	return stream.SendAndClose(&import_sstpb.UploadResponse{})
+}
+
+func (im *SSTImporter) receiveSST(stream import_sstpb.ImportSST_UploadServer, f *os.File, meta *import_sstpb.SSTMeta) error {
+	hash := crc32.NewIEEE()
+	var length uint64
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		data := req.GetData()
+		if _, err = f.Write(data); err != nil {
+			return err
+		}
+		hash.Write(data)
+		length += uint64(len(data))
+	}
+	if length != meta.GetLength() || hash.Sum32() != meta.GetCrc32() {
+		return errors.Errorf("sst length %d crc32 %d doesn't match the meta, length %d crc32 %d",
+			length, hash.Sum32(), meta.GetLength(), meta.GetCrc32())
+	}
+	return nil
+}
+
+// Ingest writes the data of an uploaded or downloaded SST file into the region.
+func (im *SSTImporter) Ingest(ctx context.Context, req *import_sstpb.IngestRequest) (*import_sstpb.IngestResponse, error) {
+	return im.ingest(ctx, req.GetContext(), []*import_sstpb.SSTMeta{req.GetSst()}), nil
+}
+
+// MultiIngest writes the data of several SST files into the region atomically.
+func (im *SSTImporter) MultiIngest(ctx context.Context, req *import_sstpb.MultiIngestRequest) (*import_sstpb.IngestResponse, error) {
+	return im.ingest(ctx, req.GetContext(), req.GetSsts()), nil
+}
+
+func (im *SSTImporter) ingest(ctx context.Context, rpcCtx *kvrpcpb.Context, metas []*import_sstpb.SSTMeta) *import_sstpb.IngestResponse {
+	reqCtx, err := newRequestCtx(ctx, im.svr, rpcCtx, "Ingest")
+	if err != nil {
+		return &import_sstpb.IngestResponse{Error: &errorpb.Error{Message: err.Error()}}
+	}
+	defer reqCtx.finish()
+	if reqCtx.regErr != nil {
+		return &import_sstpb.IngestResponse{Error: reqCtx.regErr}
+	}
+	if err = reqCtx.checkWritable(); err != nil {
+		return &import_sstpb.IngestResponse{Error: &errorpb.Error{Message: err.Error()}}
+	}
+	if im.svr.mvccStore.conf.Server.Raft {
+		return &import_sstpb.IngestResponse{Error: &errorpb.Error{Message: "ingest is not supported with raft"}}
+	}
+	regCtx := reqCtx.regCtx
+	epoch := regCtx.getRegionEpoch()
+	for _, meta := range metas {
+		if err = checkSSTMeta(meta); err != nil {
+			return &import_sstpb.IngestResponse{Error: &errorpb.Error{Message: err.Error()}}
+		}
+		sstEpoch := meta.GetRegionEpoch()
+		if meta.GetRegionId() != regCtx.meta.Id || sstEpoch.GetVersion() != epoch.GetVersion() ||
+			sstEpoch.GetConfVer() != epoch.GetConfVer() {
+			return &import_sstpb.IngestResponse{Error: &errorpb.Error{
+				Message: fmt.Sprintf("sst of region %d epoch %v doesn't match region %d epoch %v",
+					meta.GetRegionId(), sstEpoch, regCtx.meta.Id, epoch),
+				EpochNotMatch: &errorpb.EpochNotMatch{
+					CurrentRegions: []*metapb.Region{{
+						Id:          regCtx.meta.Id,
+						StartKey:    regCtx.meta.StartKey,
+						EndKey:      regCtx.meta.EndKey,
+						RegionEpoch: epoch,
+						Peers:       regCtx.meta.Peers,
+					}},
+				},
+			}}
+		}
+	}
+	err = im.ingestSSTs(reqCtx, metas)
+	if regErr := extractRegionError(err); regErr != nil {
+		return &import_sstpb.IngestResponse{Error: regErr}
+	}
+	if err != nil {
+		log.Warn("ingest sst failed", zap.Uint64("region", regCtx.meta.Id), zap.Error(err))
+		return &import_sstpb.IngestResponse{Error: &errorpb.Error{Message: err.Error()}}
+	}
+	return &import_sstpb.IngestResponse{}
+}
+
+func (im *SSTImporter) ingestSSTs(reqCtx *requestCtx, metas []*import_sstpb.SSTMeta) error {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	regionID := reqCtx.regCtx.meta.Id
+	defaults := append([]string{}, im.pendingDefaults[regionID]...)
+	var writes []string
+	for _, meta := range metas {
+		path := im.sstPath(meta)
+		if _, err := os.Stat(path); err != nil {
+			return errors.Trace(err)
+		}
+		if meta.GetCfName() == cfDefault {
+			defaults = append(defaults, path)
+		} else {
+			writes = append(writes, path)
+		}
+	}
+	if len(writes) == 0 {
+		// The default CF files only have the values, they are written with the write CF files.
+		im.pendingDefaults[regionID] = defaults
+		return nil
+	}
+	values, err := readSSTDefaultValues(defaults)
+	if err != nil {
+		return err
+	}
+	store := im.svr.mvccStore
+	var batch sstIngestBatch
+	for _, path := range writes {
+		if err = batch.readWriteCF(store, reqCtx.regCtx, path, values); err != nil {
+			return err
+		}
+	}
+	if err = store.ingest(reqCtx, &batch); err != nil {
+		return err
+	}
+	delete(im.pendingDefaults, regionID)
+	for _, path := range append(defaults, writes...) {
+		if err = os.Remove(path); err != nil {
+			log.Warn("remove ingested sst failed", zap.String("path", path), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+// readSSTDefaultValues reads the values of the default CF files, they are keyed by the SST keys with the start ts.
+func readSSTDefaultValues(paths []string) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	for _, path := range paths {
+		err := iterateSST(path, func(key, value []byte) error {
+			values[string(key)] = y.SafeCopy(nil, value)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func iterateSST(path string, f func(key, value []byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer file.Close()
+	it, err := rocksdb.NewSstFileIterator(file)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if err = f(it.Key().UserKey, it.Value()); err != nil {
+			return err
+		}
+	}
+	return errors.Trace(it.Err())
+}
+
+// sstIngestBatch is the versions translated from the SST files of a region, rows are the changes published
+// to the change observers.
+type sstIngestBatch struct {
+	keys     [][]byte
+	entries  []*badger.Entry
+	rows     []*cdcpb.Event_Row
+	size     int
+	latestTS uint64
+}
+
+func (b *sstIngestBatch) readWriteCF(store *MVCCStore, regCtx *regionCtx, path string, values map[string][]byte) error {
+	return iterateSST(path, func(sstKey, sstValue []byte) error {
+		key, commitTS, err := decodeSSTKey(sstKey)
+		if err != nil {
+			return err
+		}
+		if err = checkKeysInRegion(regCtx, key); err != nil {
+			return err
+		}
+		writeType, startTS, shortValue, err := decodeSSTWriteValue(sstValue)
+		if err != nil {
+			return err
+		}
+		userMeta := mvcc.NewDBUserMeta(startTS, commitTS)
+		var entry *badger.Entry
+		var opType cdcpb.Event_Row_OpType
+		switch writeType {
+		case sstWriteTypePut:
+			val := shortValue
+			if val == nil {
+				var ok bool
+				if val, ok = values[string(encodeSSTKey(key, startTS))]; !ok {
+					return errors.Errorf("value of key %q start ts %d is not found in the default cf", key, startTS)
+				}
+			}
+			entry = &badger.Entry{Key: y.KeyWithTs(key, commitTS), Value: store.encodeValue(y.SafeCopy(nil, val)), UserMeta: userMeta}
+			opType = cdcpb.Event_Row_PUT
+		case sstWriteTypeDelete:
+			entry = &badger.Entry{Key: y.KeyWithTs(key, commitTS), UserMeta: userMeta}
+			opType = cdcpb.Event_Row_DELETE
+		case sstWriteTypeRollback:
+			rollbackKey := mvcc.EncodeExtraTxnStatusKey(key, startTS)
+			entry = &badger.Entry{Key: y.KeyWithTs(rollbackKey, startTS), UserMeta: mvcc.NewDBUserMeta(startTS, 0)}
+		case sstWriteTypeLock:
+			// The Op_Lock records are only kept for the primary keys, which are unknown here.
+			return nil
+		default:
+			return errors.Errorf("unknown write type %c of key %q", writeType, key)
+		}
+		b.keys = append(b.keys, key)
+		b.entries = append(b.entries, entry)
+		if writeType != sstWriteTypeRollback {
+			b.rows = append(b.rows, &cdcpb.Event_Row{
+				StartTs:  startTS,
+				CommitTs: commitTS,
+				Type:     cdcpb.Event_COMMITTED,
+				OpType:   opType,
+				Key:      key,
+				Value:    entry.Value,
+			})
+		}
+		b.size += len(key) + len(entry.Value)
+		if commitTS > b.latestTS {
+			b.latestTS = commitTS
+		}
+		return nil
+	})
+}
+
+// ingest writes the versions in one transaction, so they are visible atomically. The keys must not be locked.
+func (store *MVCCStore) ingest(reqCtx *requestCtx, batch *sstIngestBatch) error {
+	regCtx := reqCtx.regCtx
+	hashVals := keysToHashVals(batch.keys...)
+	regCtx.AcquireLatches(hashVals)
+	defer regCtx.ReleaseLatches(hashVals)
+	reqCtx.trace("acquire latches")
+	var buf []byte
+	for _, key := range batch.keys {
+		buf = store.lockStore.Get(key, buf)
+		if len(buf) > 0 {
+			lock := mvcc.DecodeLock(buf)
+			return BuildLockErr(safeCopy(key), &lock)
+		}
+	}
+	store.updateLatestTS(batch.latestTS)
+	// The ingest bypasses the DBWriter, so its changes are published by the observer here.
+	err := store.cdcObserver.observe(regCtx.meta.GetId(), batch.rows, nil, func() error {
+		return store.db.Update(func(txn *badger.Txn) error {
+			for _, entry := range batch.entries {
+				if err := txn.SetEntry(entry); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	regCtx.bumpDataVersion()
+	atomic.AddInt64(&regCtx.diff, int64(batch.size))
+	atomic.AddInt64(&regCtx.keysDiff, int64(len(batch.keys)))
+	return nil
+}
+
+// Compact does nothing, badger compacts the ingested data by itself.
+func (im *SSTImporter) Compact(ctx context.Context, req *import_sstpb.CompactRequest) (*import_sstpb.CompactResponse, error) {
+	return &import_sstpb.CompactResponse{}, nil
+}
+
+// SetDownloadSpeedLimit sets the max bytes per second read by Download, 0 disables the limit.
+func (im *SSTImporter) SetDownloadSpeedLimit(ctx context.Context, req *import_sstpb.SetDownloadSpeedLimitRequest) (*import_sstpb.SetDownloadSpeedLimitResponse, error) {
+	im.mu.Lock()
+	defer im.mu.Unlock()
+	im.downloadLimiter = nil
+	if limit := int(req.GetSpeedLimit()); limit > 0 {
+		im.downloadLimiter = rate.NewLimiter(rate.Limit(limit), limit)
+	}
+	return &import_sstpb.SetDownloadSpeedLimitResponse{}, nil
+}
+
+// Download copies an SST file from the storage to the importer, so it can be ingested. The keys are rewritten
+// by the rewrite rule and the keys out of the range of the meta are dropped, the rule and the range are applied
+// to the decoded keys. Only the local storage is supported.
+func (im *SSTImporter) Download(ctx context.Context, req *import_sstpb.DownloadRequest) (*import_sstpb.DownloadResponse, error) {
+	resp, err := im.download(ctx, req)
+	if err != nil {
+		log.Warn("download sst failed", zap.String("name", req.GetName()), zap.Error(err))
+		return &import_sstpb.DownloadResponse{Error: &import_sstpb.Error{Message: err.Error()}}, nil
+	}
+	return resp, nil
+}
+
+func (im *SSTImporter) download(ctx context.Context, req *import_sstpb.DownloadRequest) (*import_sstpb.DownloadResponse, error) {
+	meta := req.GetSst()
+	if err := checkSSTMeta(meta); err != nil {
+		return nil, err
+	}
+	local := req.GetStorageBackend().GetLocal()
+	if local == nil {
+		return nil, errors.New("only the local storage is supported")
+	}
+	im.mu.Lock()
+	limiter := im.downloadLimiter
+	im.mu.Unlock()
+
+	path := im.sstPath(meta)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer os.Remove(tmpPath)
+	writer := rocksdb.NewSstFileWriter(f, rocksdb.NewDefaultBlockBasedTableOptions(bytes.Compare))
+	rule := req.GetRewriteRule()
+	sstRange := meta.GetRange()
+	var first, last []byte
+	err = iterateSST(filepath.Join(local.GetPath(), req.GetName()), func(sstKey, value []byte) error {
+		if err := waitLimiter(ctx, limiter, len(sstKey)+len(value)); err != nil {
+			return err
+		}
+		key, ts, err := decodeSSTKey(sstKey)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(key, rule.GetOldKeyPrefix()) {
+			return nil
+		}
+		key = append(append([]byte{}, rule.GetNewKeyPrefix()...), key[len(rule.GetOldKeyPrefix()):]...)
+		if bytes.Compare(key, sstRange.GetStart()) < 0 || (len(sstRange.GetEnd()) > 0 && bytes.Compare(key, sstRange.GetEnd()) >= 0) {
+			return nil
+		}
+		if first == nil {
+			first = key
+		}
+		last = key
+		return writer.Put(encodeSSTKey(key, ts), value)
+	})
+	if err == nil && first != nil {
+		err = writer.Finish()
+	}
+	if err1 := writer.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if first == nil {
+		return &import_sstpb.DownloadResponse{IsEmpty: true}, nil
+	}
+	data, err := ioutil.ReadFile(tmpPath)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = os.Rename(tmpPath, path); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &import_sstpb.DownloadResponse{
+		Range:  &import_sstpb.Range{Start: first, End: last},
+		Crc32:  crc32.ChecksumIEEE(data),
+		Length: uint64(len(data)),
+	}, nil
+}
+
+// Write is not supported, the SST files should be uploaded or downloaded.
+func (im *SSTImporter) Write(stream import_sstpb.ImportSST_WriteServer) error {
+	return errors.New("write is not supported, upload the sst files instead")
+}
+
+func encodeSSTKey(key []byte, ts uint64) []byte {
+	buf := make([]byte, 0, 1+codec.EncodedBytesLength(len(key))+8)
+	buf = append(buf, sstDataKeyPrefix)
+	buf = codec.EncodeBytes(buf, key)
+	return codec.EncodeUintDesc(buf, ts)
+}
+
+func decodeSSTKey(sstKey []byte) (key []byte, ts uint64, err error) {
+	if len(sstKey) <= 9 || sstKey[0] != sstDataKeyPrefix {
+		return nil, 0, errors.Errorf("invalid sst key %q", sstKey)
+	}
+	_, ts, err = codec.DecodeUintDesc(sstKey[len(sstKey)-8:])
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	_, key, err = codec.DecodeBytes(sstKey[1:len(sstKey)-8], nil)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+	return key, ts, nil
+}
+
+// encodeSSTWriteValue encodes a write CF value, the value is in the default CF if shortValue is nil.
+func encodeSSTWriteValue(writeType byte, startTS uint64, shortValue []byte) []byte {
+	b := codec.EncodeUvarint([]byte{writeType}, startTS)
+	if shortValue != nil {
+		b = append(b, sstShortValuePrefix, byte(len(shortValue)))
+		b = append(b, shortValue...)
+	}
+	return b
+}
+
+// decodeSSTWriteValue decodes a write CF value, shortValue is nil if the value is in the default CF. The fields
+// after the short value are not used.
+func decodeSSTWriteValue(b []byte) (writeType byte, startTS uint64, shortValue []byte, err error) {
+	if len(b) == 0 {
+		return 0, 0, nil, errors.New("empty write value")
+	}
+	writeType = b[0]
+	b, startTS, err = codec.DecodeUvarint(b[1:])
+	if err != nil {
+		return 0, 0, nil, errors.Trace(err)
+	}
+	if len(b) >= 2 && b[0] == sstShortValuePrefix {
+		l := int(b[1])
+		if len(b) < 2+l {
+			return 0, 0, nil, errors.New("invalid short value")
+		}
+		shortValue = b[2 : 2+l]
+	}
+	return writeType, startTS, shortValue, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pingcap/log"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// RegionInfo is the state of a region on this store reported by the status server.
+type RegionInfo struct {
+	ID uint64 `json:"id"`
+	// StartKey and EndKey are the raw keys in hex, the end key of the last region is empty.
+	StartKey        string `json:"start_key"`
+	EndKey          string `json:"end_key"`
+	ConfVer         uint64 `json:"conf_ver"`
+	Version         uint64 `json:"version"`
+	ApproximateSize int64  `json:"approximate_size"`
+	ApproximateKeys int64  `json:"approximate_keys"`
+	ReadOnly        bool   `json:"read_only"`
+	ResolvedTS      uint64 `json:"resolved_ts"`
+}
+
+// Regions returns the regions on this store ordered by the start key.
+func (svr *Server) Regions() []RegionInfo {
+	var regCtxs []*regionCtx
+	svr.regionManager.forEachRegion(func(regCtx *regionCtx) {
+		regCtxs = append(regCtxs, regCtx)
+	})
+	sort.Slice(regCtxs, func(i, j int) bool {
+		return bytes.Compare(regCtxs[i].startKey, regCtxs[j].startKey) < 0
+	})
+	regions := make([]RegionInfo, 0, len(regCtxs))
+	for _, regCtx := range regCtxs {
+		info := RegionInfo{
+			ID:              regCtx.meta.Id,
+			StartKey:        hex.EncodeToString(regCtx.startKey),
+			ApproximateSize: regCtx.approximateSize + atomic.LoadInt64(&regCtx.diff),
+			ApproximateKeys: atomic.LoadInt64(&regCtx.approximateKeys) + atomic.LoadInt64(&regCtx.keysDiff),
+			ReadOnly:        regCtx.isReadOnly(),
+			ResolvedTS:      regCtx.getResolvedTS(),
+		}
+		if !bytes.Equal(regCtx.endKey, InternalKeyPrefix) {
+			info.EndKey = hex.EncodeToString(regCtx.endKey)
+		}
+		if epoch := regCtx.getRegionEpoch(); epoch != nil {
+			info.ConfVer, info.Version = epoch.ConfVer, epoch.Version
+		}
+		regions = append(regions, info)
+	}
+	return regions
+}
+
+// StatusHandler returns the handler of the status server, reload is called by /config/reload. It serves:
+//
+//	/status               200 if the server is up
+//	/metrics              the prometheus metrics
+//	/debug/pprof/         the pprof profiles
+//	/config               the effective config in TOML
+//	/config/reload        reloads the online config items, POST only
+//	/stats                the ServerStats in JSON
+//	/regions              the regions in JSON, or the region of ?id=
+func (svr *Server) StatusHandler(reload func() error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if err := toml.NewEncoder(w).Encode(svr.Config()); err != nil {
+			log.Warn("write config failed", zap.Error(err))
+		}
+	})
+	mux.HandleFunc("/config/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "use POST to reload the config", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, svr.Stats())
+	})
+	mux.HandleFunc("/regions", func(w http.ResponseWriter, r *http.Request) {
+		regions := svr.Regions()
+		idStr := r.URL.Query().Get("id")
+		if idStr == "" {
+			writeJSON(w, regions)
+			return
+		}
+		id, err := strconv.ParseUint(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid region id "+idStr, http.StatusBadRequest)
+			return
+		}
+		for _, region := range regions {
+			if region.ID == id {
+				writeJSON(w, region)
+				return
+			}
+		}
+		http.Error(w, "region "+idStr+" not found", http.StatusNotFound)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn("write status failed", zap.Error(err))
+	}
+}
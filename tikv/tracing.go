@@ -0,0 +1,99 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"time"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	"github.com/uber/jaeger-client-go"
+	jaegercfg "github.com/uber/jaeger-client-go/config"
+	"google.golang.org/grpc/metadata"
+)
+
+// A request is reported as a span named by its method. A trace event ends the phase started by the previous
+// event, so every event is reported as a child span lasting from the previous event to it.
+
+// newTracer creates the tracer that reports the spans to the Jaeger agent.
+func newTracer(agentAddr string, sampleRate float64) (opentracing.Tracer, io.Closer, error) {
+	cfg := jaegercfg.Configuration{
+		ServiceName: "unistore",
+		Sampler: &jaegercfg.SamplerConfig{
+			Type:  jaeger.SamplerTypeProbabilistic,
+			Param: sampleRate,
+		},
+		Reporter: &jaegercfg.ReporterConfig{
+			LocalAgentHostPort: agentAddr,
+		},
+	}
+	return cfg.NewTracer()
+}
+
+// metadataCarrier reads the span context sent by the client in the gRPC metadata.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) ForeachKey(handler func(key, val string) error) error {
+	for k, vals := range c {
+		for _, v := range vals {
+			if err := handler(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startSpan starts the span of a request, it's a child of the span of the client if the client sends one.
+func (svr *Server) startSpan(ctx context.Context, method string, startTime time.Time) opentracing.Span {
+	opts := []opentracing.StartSpanOption{opentracing.StartTime(startTime)}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if parent, err := svr.tracer.Extract(opentracing.HTTPHeaders, metadataCarrier(md)); err == nil {
+			opts = append(opts, opentracing.ChildOf(parent))
+		}
+	}
+	return svr.tracer.StartSpan(method, opts...)
+}
+
+// finishSpan tags the span of the request with its region, reports the trace events as the child spans and
+// finishes the span.
+func (req *requestCtx) finishSpan() {
+	span := req.span
+	span.SetTag("trace.id", req.traceID)
+	if req.rpcCtx != nil {
+		span.SetTag("region.id", req.rpcCtx.RegionId)
+	}
+	if req.regCtx != nil {
+		span.SetTag("region.start_key", hex.EncodeToString(req.regCtx.startKey))
+		span.SetTag("region.end_key", hex.EncodeToString(req.regCtx.endKey))
+	}
+	if req.regErr != nil {
+		ext.Error.Set(span, true)
+		span.SetTag("region.error", req.regErr.String())
+	}
+	if req.droppedTraces > 0 {
+		span.SetTag("trace.dropped_events", req.droppedTraces)
+	}
+	prev := req.startTime
+	for _, ev := range req.traces {
+		end := req.startTime.Add(ev.elapsed)
+		child := req.svr.tracer.StartSpan(ev.event, opentracing.ChildOf(span.Context()), opentracing.StartTime(prev))
+		child.FinishWithOptions(opentracing.FinishOptions{FinishTime: end})
+		prev = end
+	}
+	span.Finish()
+}
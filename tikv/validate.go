@@ -0,0 +1,268 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/ngaut/unistore/tikv/dbreader"
+	"github.com/ngaut/unistore/tikv/mvcc"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+)
+
+// The reasons of MVCCViolation.
+const (
+	violationInvalidUserMeta   = "invalid user meta"
+	violationCommitBeforeStart = "commit ts is not greater than start ts"
+	violationVersionMismatch   = "version doesn't match commit ts"
+	violationDuplicatedCommit  = "transaction is committed more than once"
+	violationCommittedLock     = "lock of a committed transaction"
+	violationRollbackCommitted = "rollback of a committed transaction"
+	violationRolledBackLock    = "lock of a rolled back transaction"
+)
+
+const (
+	validateWorkers = 4
+	// maxValidateViolations bounds the violations returned by Validate, the validation stops when it's reached.
+	maxValidateViolations = 1024
+)
+
+// MVCCViolation is a broken MVCC invariant found by Validate.
+type MVCCViolation struct {
+	RegionID uint64
+	Key      []byte
+	StartTS  uint64
+	CommitTS uint64
+	Reason   string
+}
+
+func (v *MVCCViolation) String() string {
+	return fmt.Sprintf("region %d key %q start ts %d commit ts %d: %s", v.RegionID, v.Key, v.StartTS, v.CommitTS, v.Reason)
+}
+
+type validateRange struct {
+	regionID uint64
+	startKey []byte
+	endKey   []byte
+}
+
+// violationCollector collects the violations found by the validate workers.
+type violationCollector struct {
+	mu         sync.Mutex
+	violations []*MVCCViolation
+}
+
+// report adds a violation, it returns false if the limit is reached and the validation should stop.
+func (c *violationCollector) report(v *MVCCViolation) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.violations) >= maxValidateViolations {
+		return false
+	}
+	c.violations = append(c.violations, v)
+	return len(c.violations) < maxValidateViolations
+}
+
+// Validate walks the data of every region of rm and checks the MVCC invariants: a committed version has a valid
+// user meta whose commit ts is greater than the start ts and equals the version, a transaction is committed at
+// most once on a key, a rollback record doesn't belong to a committed transaction, and a lock doesn't belong to
+// a transaction that is already committed or rolled back on the key. The values are stored inline with the
+// commit records, so there is no separate value to check.
+// It's expensive and meant for tests. The regions are validated in parallel and only the versions of the current
+// key are held in memory, at most maxValidateViolations violations are returned.
+func (store *MVCCStore) Validate(rm RegionManager) ([]*MVCCViolation, error) {
+	var ranges []validateRange
+	rm.forEachRegion(func(regCtx *regionCtx) {
+		ranges = append(ranges, validateRange{regionID: regCtx.meta.Id, startKey: regCtx.startKey, endKey: regCtx.endKey})
+	})
+	rangeCh := make(chan validateRange, len(ranges))
+	for _, r := range ranges {
+		rangeCh <- r
+	}
+	close(rangeCh)
+
+	collector := &violationCollector{}
+	errCh := make(chan error, validateWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < validateWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rangeCh {
+				if err := store.validateRange(r, collector.report); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	if err := <-errCh; err != nil {
+		return nil, errors.Trace(err)
+	}
+	return collector.violations, nil
+}
+
+// errStopValidate stops the validation of a range when the violation limit is reached.
+var errStopValidate = errors.New("too many violations")
+
+func (store *MVCCStore) validateRange(r validateRange, report func(*MVCCViolation) bool) error {
+	txn := store.db.NewTransaction(false)
+	// Close discards the txn.
+	reader := dbreader.NewDBReader(r.startKey, r.endKey, txn)
+	defer reader.Close()
+	var lockBuf []byte
+	lockStartTS := func(key []byte) uint64 {
+		lockBuf = store.lockStore.Get(key, lockBuf)
+		if len(lockBuf) == 0 {
+			return 0
+		}
+		return mvcc.DecodeLock(lockBuf).StartTS
+	}
+	violate := func(key []byte, startTS, commitTS uint64, reason string) error {
+		v := &MVCCViolation{RegionID: r.regionID, Key: safeCopy(key), StartTS: startTS, CommitTS: commitTS, Reason: reason}
+		if !report(v) {
+			return errStopValidate
+		}
+		return nil
+	}
+	err := store.validateCommits(r, txn, lockStartTS, violate)
+	if err == nil {
+		err = store.validateTxnStatus(r, txn, reader, lockStartTS, violate)
+	}
+	if err == errStopValidate {
+		return nil
+	}
+	return err
+}
+
+type violateFunc func(key []byte, startTS, commitTS uint64, reason string) error
+
+// validateCommits checks the committed versions of the keys in the range.
+func (store *MVCCStore) validateCommits(r validateRange, txn *badger.Txn, lockStartTS func([]byte) uint64, violate violateFunc) error {
+	iter := dbreader.NewIterator(txn, false, r.startKey, r.endKey)
+	defer iter.Close()
+	iter.SetAllVersions(true)
+	var curKey []byte
+	// commits maps the start ts to the commit ts of the versions of curKey.
+	commits := make(map[uint64]uint64)
+	checkLock := func() error {
+		if curKey == nil {
+			return nil
+		}
+		if startTS := lockStartTS(curKey); startTS != 0 {
+			if commitTS, ok := commits[startTS]; ok {
+				return violate(curKey, startTS, commitTS, violationCommittedLock)
+			}
+		}
+		return nil
+	}
+	for iter.Seek(r.startKey); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if isExtraTxnStatusItem(item) {
+			continue
+		}
+		if !bytes.Equal(item.Key(), curKey) {
+			if err := checkLock(); err != nil {
+				return err
+			}
+			curKey = safeCopy(item.Key())
+			for startTS := range commits {
+				delete(commits, startTS)
+			}
+		}
+		if len(item.UserMeta()) != 16 {
+			if err := violate(curKey, 0, item.Version(), violationInvalidUserMeta); err != nil {
+				return err
+			}
+			continue
+		}
+		userMeta := mvcc.DBUserMeta(item.UserMeta())
+		startTS, commitTS := userMeta.StartTS(), userMeta.CommitTS()
+		var err error
+		if commitTS <= startTS {
+			err = violate(curKey, startTS, commitTS, violationCommitBeforeStart)
+		} else if item.Version() != commitTS {
+			err = violate(curKey, startTS, commitTS, violationVersionMismatch)
+		} else if _, ok := commits[startTS]; ok {
+			err = violate(curKey, startTS, commitTS, violationDuplicatedCommit)
+		}
+		if err != nil {
+			return err
+		}
+		commits[startTS] = commitTS
+	}
+	return checkLock()
+}
+
+// validateTxnStatus checks the rollback and Op_Lock records of the keys in the range.
+func (store *MVCCStore) validateTxnStatus(r validateRange, txn *badger.Txn, reader *dbreader.DBReader,
+	lockStartTS func([]byte) uint64, violate violateFunc) error {
+	// The extra txn status keys have the first byte of the key increased.
+	startKey := append([]byte{}, r.startKey...)
+	if len(startKey) > 0 {
+		startKey[0]++
+	}
+	var endKey []byte
+	if len(r.endKey) > 0 && r.endKey[0] != 0xff {
+		endKey = append([]byte{}, r.endKey...)
+		endKey[0]++
+	}
+	iter := dbreader.NewIterator(txn, false, startKey, endKey)
+	defer iter.Close()
+	iter.SetAllVersions(true)
+	for iter.Seek(startKey); iter.Valid(); iter.Next() {
+		item := iter.Item()
+		if !isExtraTxnStatusItem(item) {
+			continue
+		}
+		key := mvcc.DecodeExtraTxnStatusKey(item.Key())
+		if bytes.Compare(key, r.startKey) < 0 || (len(r.endKey) > 0 && bytes.Compare(key, r.endKey) >= 0) {
+			continue
+		}
+		userMeta := mvcc.DBUserMeta(item.UserMeta())
+		startTS, commitTS := userMeta.StartTS(), userMeta.CommitTS()
+		var err error
+		if commitTS != 0 {
+			// Op_Lock record.
+			if commitTS <= startTS {
+				err = violate(key, startTS, commitTS, violationCommitBeforeStart)
+			}
+		} else if committed, err1 := store.checkCommitted(reader, key, startTS); err1 != nil {
+			return errors.Trace(err1)
+		} else if committed > 0 {
+			err = violate(key, startTS, committed, violationRollbackCommitted)
+		} else if lockStartTS(key) == startTS {
+			err = violate(key, startTS, 0, violationRolledBackLock)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isExtraTxnStatusItem checks if the item is a rollback or Op_Lock record, which is keyed by the key with the
+// first byte increased and the start ts appended, and has the start ts in its user meta.
+func isExtraTxnStatusItem(item *badger.Item) bool {
+	key := item.Key()
+	if len(key) <= 9 || len(item.UserMeta()) != 16 {
+		return false
+	}
+	return mvcc.DBUserMeta(item.UserMeta()).StartTS() == mvcc.DecodeKeyTS(key)
+}
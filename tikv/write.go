@@ -18,14 +18,19 @@ import (
 	"math"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cznic/mathutil"
+	"github.com/ngaut/unistore/config"
 	"github.com/ngaut/unistore/lockstore"
+	"github.com/ngaut/unistore/metrics"
 	"github.com/ngaut/unistore/tikv/dbreader"
 	"github.com/ngaut/unistore/tikv/mvcc"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
 )
 
 const (
@@ -62,6 +67,8 @@ type writeLockBatch struct {
 	entries []*badger.Entry
 	err     error
 	wg      sync.WaitGroup
+	// delta is the number of the locks inserted minus the number of the locks deleted by the batch.
+	delta int64
 }
 
 func (batch *writeLockBatch) set(key, val []byte) {
@@ -98,14 +105,42 @@ func (w writeDBWorker) run() {
 		case batch := <-w.batchCh:
 			batches = append(batches, batch)
 		}
-		chLen := len(w.batchCh)
-		for i := 0; i < chLen; i++ {
-			batches = append(batches, <-w.batchCh)
-		}
-		if len(batches) > 0 {
-			w.updateBatchGroup(batches)
+		batches = w.collectBatches(batches)
+		metrics.GroupCommitSize.Observe(float64(len(batches)))
+		w.updateBatchGroup(batches)
+	}
+}
+
+// collectBatches adds the queued batches to the group, and waits up to the batch wait for more batches until the
+// group has the max number of keys.
+func (w writeDBWorker) collectBatches(batches []*writeDBBatch) []*writeDBBatch {
+	keys := len(batches[0].entries)
+	var timeout <-chan time.Time
+	if w.writer.batchWait > 0 {
+		timer := time.NewTimer(w.writer.batchWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for w.writer.batchMaxKeys <= 0 || keys < w.writer.batchMaxKeys {
+		var batch *writeDBBatch
+		select {
+		case batch = <-w.batchCh:
+		default:
+			if timeout == nil {
+				return batches
+			}
+			select {
+			case batch = <-w.batchCh:
+			case <-timeout:
+				return batches
+			case <-w.writer.closeCh:
+				return batches
+			}
 		}
+		batches = append(batches, batch)
+		keys += len(batch.entries)
 	}
+	return batches
 }
 
 func (w writeDBWorker) updateBatchGroup(batchGroup []*writeDBBatch) {
@@ -154,22 +189,40 @@ func (w writeLockWorker) run() {
 		for i := 0; i < chLen; i++ {
 			batches = append(batches, <-w.batchCh)
 		}
+		wal := w.writer.lockWAL
+		var err error
+		if wal != nil {
+			// The mutations are logged before they are applied, so a lock seen by a read survives a restart.
+			err = wal.log(batches)
+		}
 		hint := new(lockstore.Hint)
 		var delCnt, insertCnt int
 		for _, batch := range batches {
-			for _, entry := range batch.entries {
-				switch entry.UserMeta[0] {
-				case mvcc.LockUserMetaDeleteByte:
-					delCnt++
-					// Ignore if the key doesn't exist
-					ls.DeleteWithHint(entry.Key.UserKey, hint)
-				default:
-					insertCnt++
-					ls.PutWithHint(entry.Key.UserKey, entry.Value, hint)
+			if err == nil {
+				for _, entry := range batch.entries {
+					switch entry.UserMeta[0] {
+					case mvcc.LockUserMetaDeleteByte:
+						delCnt++
+						// Ignore if the key doesn't exist
+						if ls.DeleteWithHint(entry.Key.UserKey, hint) {
+							batch.delta--
+						}
+					default:
+						insertCnt++
+						if ls.PutWithHint(entry.Key.UserKey, entry.Value, hint) {
+							batch.delta++
+						}
+					}
 				}
 			}
+			batch.err = err
 			batch.wg.Done()
 		}
+		if wal != nil && wal.size >= lockWALCheckpointSize {
+			if err = wal.checkpoint(ls); err != nil {
+				log.Error("checkpoint locks failed", zap.Error(err))
+			}
+		}
 	}
 }
 
@@ -180,12 +233,25 @@ type dbWriter struct {
 	wg       sync.WaitGroup
 	closeCh  chan struct{}
 	latestTS uint64
+
+	// The writes are committed to the DB in groups, a group waits up to batchWait for the concurrent writes
+	// until it has batchMaxKeys keys.
+	batchWait    time.Duration
+	batchMaxKeys int
+
+	// lockWAL logs the lock mutations, it's nil if the locks are not persisted.
+	lockWAL *LockWAL
+	// lockCounter is called with the region of a write batch and the change of its number of locks.
+	lockCounter func(regionID uint64, delta int64)
 }
 
-func NewDBWriter(bundle *mvcc.DBBundle) mvcc.DBWriter {
+func NewDBWriter(conf *config.Config, bundle *mvcc.DBBundle, lockWAL *LockWAL) mvcc.DBWriter {
 	return &dbWriter{
-		bundle:  bundle,
-		closeCh: make(chan struct{}, 0),
+		bundle:       bundle,
+		closeCh:      make(chan struct{}, 0),
+		batchWait:    config.ParseDuration(conf.Server.WriteBatchWait),
+		batchMaxKeys: conf.Server.WriteBatchMaxKeys,
+		lockWAL:      lockWAL,
 	}
 }
 
@@ -210,6 +276,9 @@ func (writer *dbWriter) Open() {
 func (writer *dbWriter) Close() {
 	close(writer.closeCh)
 	writer.wg.Wait()
+	if writer.lockWAL != nil {
+		writer.lockWAL.close(writer.bundle.LockStore)
+	}
 }
 
 func (writer *dbWriter) Write(batch mvcc.WriteBatch) error {
@@ -228,6 +297,9 @@ func (writer *dbWriter) Write(batch mvcc.WriteBatch) error {
 		wb.lockBatch.wg.Add(1)
 		writer.lockCh <- &wb.lockBatch
 		wb.lockBatch.wg.Wait()
+		if writer.lockCounter != nil && wb.lockBatch.delta != 0 {
+			writer.lockCounter(wb.regionID, wb.lockBatch.delta)
+		}
 		return wb.lockBatch.err
 	}
 	return nil
@@ -236,6 +308,7 @@ func (writer *dbWriter) Write(batch mvcc.WriteBatch) error {
 type writeBatch struct {
 	startTS   uint64
 	commitTS  uint64
+	regionID  uint64
 	dbBatch   writeDBBatch
 	lockBatch writeLockBatch
 }
@@ -282,6 +355,7 @@ func (writer *dbWriter) NewWriteBatch(startTS, commitTS uint64, ctx *kvrpcpb.Con
 	return &writeBatch{
 		startTS:  startTS,
 		commitTS: commitTS,
+		regionID: ctx.GetRegionId(),
 	}
 }
 
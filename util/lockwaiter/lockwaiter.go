@@ -14,6 +14,7 @@
 package lockwaiter
 
 import (
+	"context"
 	"sort"
 	"sync"
 	"time"
@@ -101,9 +102,19 @@ const WaitTimeout WakeupWaitTime = -1
 const WakeUpThisWaiter WakeupWaitTime = 0
 const WakeupDelayTimeout WakeupWaitTime = 1
 
+// WaitCanceled means the context of the waiter is done before the wait finishes.
+const WaitCanceled WakeupWaitTime = -2
+
 func (w *Waiter) Wait() WaitResult {
+	return w.WaitContext(context.Background())
+}
+
+// WaitContext waits like Wait, but returns WaitCanceled once ctx is done.
+func (w *Waiter) WaitContext(ctx context.Context) WaitResult {
 	for {
 		select {
+		case <-ctx.Done():
+			return WaitResult{WakeupSleepTime: WaitCanceled}
 		case <-w.timer.C:
 			if w.wakeupDelayed {
 				return WaitResult{WakeupSleepTime: WakeupDelayTimeout, CommitTS: w.CommitTs}
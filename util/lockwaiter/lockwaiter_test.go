@@ -14,6 +14,7 @@
 package lockwaiter
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -138,3 +139,22 @@ func (t *testLockwaiter) TestLockwaiterConcurrent(c *C) {
 	}
 	endWg.Wait()
 }
+
+func (t *testLockwaiter) TestWaitContext(c *C) {
+	mgr := NewManager(&config.DefaultConf)
+	waiter := mgr.NewWaiter(1, 2, 100, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	res := waiter.WaitContext(ctx)
+	c.Assert(res.WakeupSleepTime, Equals, WaitCanceled)
+	mgr.CleanUp(waiter)
+
+	// The waiter woken up before the context is done gets the lock.
+	waiter = mgr.NewWaiter(3, 2, 100, time.Minute)
+	mgr.WakeUp(2, 0, []uint64{100})
+	res = waiter.WaitContext(context.Background())
+	c.Assert(res.WakeupSleepTime, Equals, WakeUpThisWaiter)
+}